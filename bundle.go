@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+	"github.com/bfrengley/relay/internal/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Bundles group files which were uploaded together under one ID, so they can be shared with one
+// link. Their members are still files in their own right, which can be got individually, and a
+// bundle lasts as long as any of its members do.
+const (
+	// MaxBundleSize is the most files a bundle can hold.
+	MaxBundleSize = 256
+	// maxNewBundleSize is the largest request to create a bundle accepted, in bytes.
+	maxNewBundleSize = 64 << 10
+)
+
+// BundleMember names a file to put in a new bundle, with the owner token which shows it can be.
+type BundleMember struct {
+	ID         files.FileID `json:"id"`
+	OwnerToken string       `json:"owner_token"`
+}
+
+// NewBundle is the request to create a bundle from files which have finished uploading.
+type NewBundle struct {
+	Members []BundleMember `json:"members"`
+}
+
+// Bundle describes a bundle and those of its members which can be got, in the order they were
+// given when it was created.
+type Bundle struct {
+	ID      files.FileID         `json:"id"`
+	Members []files.FileMetadata `json:"members"`
+}
+
+// bundleSet holds the IDs of the members of each bundle.
+type bundleSet = store.Store[files.FileID, []files.FileID]
+
+var errInvalidBundle = errors.New("invalid bundle")
+
+// Validate checks the bundle has at least one member and no more than MaxBundleSize, each named
+// once.
+func (nb *NewBundle) Validate() error {
+	if len(nb.Members) == 0 || len(nb.Members) > MaxBundleSize {
+		return fmt.Errorf("%w: bundles must have 1 to %d members", errInvalidBundle, MaxBundleSize)
+	}
+	seen := make(map[files.FileID]bool, len(nb.Members))
+	for _, m := range nb.Members {
+		if m.ID.IsZero() {
+			return fmt.Errorf("%w: member with no ID", errInvalidBundle)
+		}
+		if seen[m.ID] {
+			return fmt.Errorf("%w: duplicate member %s", errInvalidBundle, m.ID)
+		}
+		seen[m.ID] = true
+	}
+	return nil
+}
+
+// CreateBundle bundles files which have finished uploading, as long as the request carries each
+// of their owner tokens.
+func (rs *RelayServer) CreateBundle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxNewBundleSize))
+	decoder.DisallowUnknownFields()
+
+	var nb NewBundle
+	if err := decoder.Decode(&nb); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := nb.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := files.NewFileID()
+	bundle := Bundle{ID: id, Members: make([]files.FileMetadata, 0, len(nb.Members))}
+	members := make([]files.FileID, 0, len(nb.Members))
+	for _, m := range nb.Members {
+		f, ok := rs.readyFile(m.ID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("File %s not found", m.ID), http.StatusNotFound)
+			return
+		}
+		if !f.CheckOwnerToken(m.OwnerToken) {
+			http.Error(w, fmt.Sprintf("Invalid or missing owner token for file %s", m.ID), http.StatusForbidden)
+			return
+		}
+		bundle.Members = append(bundle.Members, f.FileMetadata)
+		members = append(members, m.ID)
+	}
+	rs.bundles.Set(id, members)
+	logging.Infoln("created bundle", id, "of", len(members), "files")
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		logging.Errorln(err)
+	}
+}
+
+// GetBundle lists the members of a bundle which can be downloaded: those which are ready, and
+// don't need an access password other than the one in the request.
+func (rs *RelayServer) GetBundle(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := files.ParseFileID(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	members, ok := rs.bundles.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	bundle := Bundle{ID: id, Members: make([]files.FileMetadata, 0, len(members))}
+	for _, member := range members {
+		if f, ok := rs.readyFile(member); ok && f.CheckAccess(r.Header.Get(AccessPasswordHeader)) {
+			bundle.Members = append(bundle.Members, f.FileMetadata)
+		}
+	}
+	if len(bundle.Members) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		logging.Errorln(err)
+	}
+}
+
+// removeEmptyBundles removes the bundles whose members are all gone, including from the trash.
+func (rs *RelayServer) removeEmptyBundles() {
+	var empty []files.FileID
+	rs.bundles.Range(func(id files.FileID, members []files.FileID) bool {
+		for _, member := range members {
+			if _, ok := rs.files.Get(member); ok {
+				return true
+			}
+		}
+		empty = append(empty, id)
+		return true
+	})
+	for _, id := range empty {
+		rs.bundles.Remove(id)
+		logging.Infoln("removed bundle", id, "since its files are gone")
+	}
+}
@@ -2,260 +2,1362 @@ package relay
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/schollz/progressbar/v3"
-
-	"github.com/bfrengley/relay/internal/crypto"
+	"github.com/bfrengley/relay/crypto"
 	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
 )
 
+// ChunkSize is the size of each encrypted chunk of a file, except the last, unless it's uploaded
+// with another. RawChunkSize is how much plaintext that holds with the default cipher; see layout
+// for the others.
 const (
-	ChunkSize    = 32 * 1024
+	ChunkSize    = files.DefaultChunkSize
 	RawChunkSize = ChunkSize - crypto.Overhead
 )
 
 type RelayClient struct {
 	Server string
-	c      http.Client
+	// Token is sent as a bearer token to servers which require authorisation.
+	Token string
+	// AccessPassword is sent to get files which need one, as well as their password or key, and
+	// files uploaded need it unless their UploadOptions say otherwise.
+	AccessPassword string
+	// Progress creates the progress reporter for each transfer; nil disables progress output.
+	Progress ProgressFunc
+	// Parallel is how many ranges of a file DownloadToFile fetches at once, each with a request
+	// of its own, which can be faster from distant servers. Below 2, it's fetched in one.
+	Parallel int
+	// Context, if set, cancels the client's requests, and so whatever transfers they're part of,
+	// once it's done.
+	Context context.Context
+	c       http.Client
+}
+
+// Progress reports how a transfer is going. Update is called with the number of bytes
+// transferred so far every progressInterval while they change, from a goroutine of its own, so a
+// slow Progress can't hold the transfer up; updates are skipped until it catches up. Finish is
+// called once the transfer completes, after the last Update.
+type Progress interface {
+	Update(bytes int64)
+	Finish() error
+}
+
+// progressInterval is how often a transfer's Progress is updated.
+const progressInterval = 100 * time.Millisecond
+
+// ProgressFunc creates a Progress for a transfer of total bytes, described by e.g. "Uploading".
+type ProgressFunc func(description string, total int64) Progress
+
+// progressCounter counts the bytes written to it for a transfer's Progress, which is updated
+// from the count by a goroutine of its own until it's finished, or stopped if the transfer fails.
+// It can be written to from any number of goroutines.
+type progressCounter struct {
+	bytes atomic.Int64
+	p     Progress
+	// halt is closed to stop the updates, and stopped once the last one's done.
+	halt, stopped chan struct{}
+	once          sync.Once
+}
+
+func (rc *RelayClient) progress(description string, total int64) *progressCounter {
+	pc := &progressCounter{}
+	if rc.Progress != nil {
+		pc.p = rc.Progress(description, total)
+		pc.halt = make(chan struct{})
+		pc.stopped = make(chan struct{})
+		go pc.run()
+	}
+	return pc
+}
+
+func (pc *progressCounter) Write(p []byte) (int, error) {
+	pc.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (pc *progressCounter) run() {
+	defer close(pc.stopped)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	last := int64(-1)
+	for {
+		select {
+		case <-ticker.C:
+			if n := pc.bytes.Load(); n != last {
+				pc.p.Update(n)
+				last = n
+			}
+		case <-pc.halt:
+			pc.p.Update(pc.bytes.Load())
+			return
+		}
+	}
+}
+
+// stop gives the Progress its last update, without finishing it. It can be called any number of
+// times.
+func (pc *progressCounter) stop() {
+	if pc.p == nil {
+		return
+	}
+	pc.once.Do(func() { close(pc.halt) })
+	<-pc.stopped
+}
+
+// Finish gives the Progress its last update and finishes it.
+func (pc *progressCounter) Finish() error {
+	if pc.p == nil {
+		return nil
+	}
+	pc.stop()
+	return pc.p.Finish()
+}
+
+type UploadResult struct {
+	files.FileMetadata
+	// OwnerToken authorises deleting the file; the server only provides it once.
+	OwnerToken string
+	Stats      TransferStats
+}
+
+type DownloadResult struct {
+	files.FileMetadata
+	Stats TransferStats
 }
 
 func NewClient(server string) RelayClient {
-	return RelayClient{server, http.Client{}}
+	return RelayClient{Server: server}
+}
+
+// context returns the client's Context, or the background context if it hasn't one.
+func (rc *RelayClient) context() context.Context {
+	if rc.Context == nil {
+		return context.Background()
+	}
+	return rc.Context
+}
+
+func (rc *RelayClient) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(rc.context(), method, rc.Server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if rc.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rc.Token)
+	}
+	return req, nil
+}
+
+// newFileRequest makes a request to get a file or its metadata, with the access password if
+// there is one.
+func (rc *RelayClient) newFileRequest(path string) (*http.Request, error) {
+	req, err := rc.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rc.AccessPassword != "" {
+		req.Header.Set(AccessPasswordHeader, rc.AccessPassword)
+	}
+	return req, nil
+}
+
+// ShareLink returns a link to the file with the given ID on this client's server.
+func (rc *RelayClient) ShareLink(id files.FileID) string {
+	return strings.TrimRight(rc.Server, "/") + "/files/" + id.String()
+}
+
+// ShareLinkWithSecret returns a share link with the password embedded in its fragment, which
+// isn't sent to the server when the link is opened.
+func (rc *RelayClient) ShareLinkWithSecret(id files.FileID, secret string) string {
+	return rc.ShareLink(id) + "#" + url.PathEscape(secret)
+}
+
+// BundleLink returns the share link for a bundle, which works like a file's.
+func (rc *RelayClient) BundleLink(id files.FileID) string {
+	return strings.TrimRight(rc.Server, "/") + "/bundles/" + id.String()
+}
+
+func (rc *RelayClient) BundleLinkWithSecret(id files.FileID, secret string) string {
+	return rc.BundleLink(id) + "#" + url.PathEscape(secret)
+}
+
+// ParseShareLink splits a share link into the server URL, the file ID, and the secret embedded
+// in its fragment, which is empty if the link doesn't carry one.
+func ParseShareLink(link string) (server string, id files.FileID, secret string, err error) {
+	return parseLink(link, "file")
+}
+
+// ParseBundleLink splits a bundle's share link like ParseShareLink.
+func ParseBundleLink(link string) (server string, id files.FileID, secret string, err error) {
+	return parseLink(link, "bundle")
 }
 
-func (rc *RelayClient) UploadFile(filepath, pass string) error {
+// IsBundleLink reports whether link looks like a bundle's share link rather than a file's.
+func IsBundleLink(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && strings.Contains(u.Path, "/bundles/")
+}
+
+// parseLink parses a share link to a file or bundle, whose path ends in /files/<id> or
+// /bundles/<id>.
+func parseLink(link, kind string) (server string, id files.FileID, secret string, err error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", id, "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", id, "", fmt.Errorf("invalid share link %q: missing server", link)
+	}
+
+	prefix := "/" + kind + "s/"
+	i := strings.LastIndex(u.Path, prefix)
+	if i < 0 {
+		return "", id, "", fmt.Errorf("invalid share link %q: missing %s ID", link, kind)
+	}
+	idStr := u.Path[i+len(prefix):]
+	if idStr == "" || strings.Contains(idStr, "/") {
+		return "", id, "", fmt.Errorf("invalid share link %q: missing %s ID", link, kind)
+	}
+	if id, err = files.ParseFileID(idStr); err != nil {
+		return "", id, "", fmt.Errorf("invalid share link %q: %w", link, err)
+	}
+
+	server = u.Scheme + "://" + u.Host + u.Path[:i]
+	return server, id, u.Fragment, nil
+}
+
+func (rc *RelayClient) get(path string) (*http.Response, error) {
+	req, err := rc.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rc.c.Do(req)
+}
+
+// uploadStatusRetries is how many times to wait for the server to notice that an interrupted
+// upload's connection has gone before giving up on resuming it.
+const uploadStatusRetries = 10
+
+// Upload is a file which has been created on the server but whose contents may not have been
+// sent yet. If sending is interrupted, the upload can be resumed from its State.
+type Upload struct {
+	State UploadState
+
+	// the contents are read from src if it's set, or else the file at path
+	path    string
+	src     io.ReaderAt
+	key     *[crypto.KeySize]byte
+	kdf     time.Duration
+	resumed bool
+	direct  bool
+}
+
+// UploadOptions control how the server keeps an uploaded file.
+type UploadOptions struct {
+	// Name is the file name stored on the server, instead of the name of the local file.
+	Name string
+	// Scrypt sets the cost of deriving the key from a Password, if it isn't the zero value.
+	Scrypt ScryptParams
+	// Cipher names the cipher to encrypt the file with, or secretbox if empty.
+	Cipher string
+	// ChunkSize is the size of the encrypted chunks the file is uploaded in, within the bounds in
+	// the server's ServerInfo, or ChunkSize if zero. Larger chunks have less overhead on fast
+	// links; smaller ones lose less when an upload over a slow one is interrupted.
+	ChunkSize uint32
+	// Expires is how long the server keeps the file for, if non-zero.
+	Expires time.Duration
+	// MaxDownloads is how many times the file can be downloaded before it's deleted, if non-zero.
+	MaxDownloads uint
+	// Live streams the file through the server to whoever downloads it, without the server
+	// storing it. SendUpload waits for the download to start, and only succeeds once it's been
+	// sent everything. Live uploads can't be resumed.
+	Live bool
+	// Direct, with Live, also offers to send the file straight to the downloader over a
+	// connection of its own, which it takes if it can reach this client, saving the server
+	// relaying it. The server relays it otherwise.
+	Direct bool
+	// Replace is the ID of a file this one replaces once it's uploaded, keeping the file's ID and
+	// owner token, if set. OwnerToken must be that file's owner token.
+	Replace    files.FileID
+	OwnerToken string
+	// ContentType is the file's MIME type, or if empty, the one for its name's extension, if any.
+	ContentType string
+	// Description and Tags are stored with the file to help identify it.
+	Description string
+	Tags        []string
+	// AccessPassword, if set, has to be given to get the file from the server, on top of what it's
+	// encrypted with. If empty, the client's AccessPassword is used.
+	AccessPassword string
+}
+
+// UploadState is everything needed to resume an upload, other than the password.
+type UploadState struct {
+	files.FileMetadata
+	OwnerToken string `json:"owner_token"`
+}
+
+func (rc *RelayClient) UploadFile(filepath string, secret Secret, opts UploadOptions) (UploadResult, error) {
+	u, err := rc.StartUpload(filepath, secret, opts)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	return rc.SendUpload(u)
+}
+
+// StartUpload encrypts the metadata of the file and creates it on the server, ready for its
+// contents to be sent with SendUpload.
+func (rc *RelayClient) StartUpload(filepath string, secret Secret, opts UploadOptions) (*Upload, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if info.IsDir() {
-		return errors.New("cannot upload a directory")
+		return nil, errors.New("cannot upload a directory")
 	}
 
-	log.Println("INFO: hashing the file")
-	hash, err := crypto.HashData(f)
+	u, err := rc.startUpload(f, info.Size(), info.Name(), secret, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Println("INFO: file hash", hex.EncodeToString(hash))
+	u.path = filepath
+	return u, nil
+}
 
-	log.Println("INFO: generating a key")
-	key, salt, err := crypto.GenerateKey([]byte(pass), nil)
-	log.Println("INFO: generated a key with salt", hex.EncodeToString(salt[:]))
+// StartUploadFrom is StartUpload for the size bytes of src, named name, rather than a local file.
+// src is read again by SendUpload, so it mustn't change in between.
+func (rc *RelayClient) StartUploadFrom(src io.ReaderAt, size int64, name string, secret Secret, opts UploadOptions) (*Upload, error) {
+	u, err := rc.startUpload(io.NewSectionReader(src, 0, size), size, name, secret, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	u.src = src
+	return u, nil
+}
 
-	log.Println("INFO: creating decryption challenge")
-	challenge, err := crypto.EncryptChunk(*key, hash)
+// startUpload creates the file whose contents are read from r, leaving where they're read from
+// again to be filled in.
+func (rc *RelayClient) startUpload(r io.Reader, size int64, name string, secret Secret, opts UploadOptions) (_ *Upload, err error) {
+	cipher, err := crypto.CipherByName(opts.Cipher)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if opts.ChunkSize == ChunkSize {
+		opts.ChunkSize = 0 // which older servers understand too
+	}
+	if opts.ChunkSize != 0 {
+		if err = rc.checkChunkSize(opts.ChunkSize); err != nil {
+			return nil, err
+		}
+	}
+
+	logging.Infoln("generating a key")
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix, err := crypto.NewNoncePrefix()
+	if err != nil {
+		return nil, err
 	}
 
 	fileData := files.FileMetadata{
-		Name:      info.Name(),
-		Size:      uint64(info.Size()),
-		Salt:      salt[:],
-		Hash:      hash,
-		Challenge: challenge,
+		Name:        name,
+		Size:        uint64(size),
+		Salt:        salt[:],
+		KDF:         secret.KDF(),
+		Cipher:      cipher.Name(),
+		Format:      crypto.FormatVersion,
+		NoncePrefix: noncePrefix,
+		ChunkSize:   opts.ChunkSize,
+
+		MaxDownloads: opts.MaxDownloads,
+		Live:         opts.Live,
 	}
+	if fileData.KDF == crypto.KDFScrypt {
+		// record the parameters even when they're the defaults, so the defaults can change
+		params := opts.Scrypt
+		if params == (ScryptParams{}) {
+			params = crypto.DefaultScryptParams
+		}
+		fileData.Scrypt = &params
+	}
+
+	kdfStart := time.Now()
+	key, err := deriveKey(&fileData, secret)
+	if err != nil {
+		return nil, err
+	}
+	kdf := time.Since(kdfStart)
+	defer func() {
+		if err != nil {
+			crypto.Wipe(key)
+		}
+	}()
+	logging.Debugln("generated a key with salt", hex.EncodeToString(salt[:]))
 
-	log.Println("INFO: validating challenge...", fileData.CheckChallenge(*key))
+	logging.Infoln("hashing the file")
+	hasher := contentHash(fileData, key)
+	if _, err = io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+	fileData.Hash = hasher.Sum(nil)
+	logging.Debugln("file hash", hex.EncodeToString(fileData.Hash))
 
-	resBody, err := json.Marshal(fileData)
+	logging.Infoln("creating decryption challenge")
+	challengeKey := crypto.Subkey(key, crypto.PurposeChallenge)
+	defer crypto.Zero(challengeKey[:])
+	fileData.Challenge = crypto.Challenge(challengeKey)
+	if opts.Name != "" {
+		fileData.Name = opts.Name
+	}
+	fileData.ContentType = opts.ContentType
+	if fileData.ContentType == "" {
+		fileData.ContentType = mime.TypeByExtension(path.Ext(fileData.Name))
+	}
+	fileData.Description, fileData.Tags = opts.Description, opts.Tags
+	if opts.Expires > 0 {
+		fileData.Expires = time.Now().Add(opts.Expires).UTC()
+	}
+
+	logging.Debugln("validating challenge...", fileData.CheckChallenge(*challengeKey))
+	if err = fileData.ValidateNew(); err != nil {
+		return nil, err
+	}
+
+	path, ownerToken := "/files", ""
+	if !opts.Replace.IsZero() {
+		logging.Infoln("creating replacement for remote file", opts.Replace)
+		path += "/" + opts.Replace.String() + "/replace"
+		ownerToken = opts.OwnerToken
+	} else {
+		logging.Infoln("creating remote file")
+	}
+	if opts.AccessPassword == "" {
+		opts.AccessPassword = rc.AccessPassword
+	}
+	created, err := rc.createFile(path, fileData, ownerToken, opts.AccessPassword)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	logging.Infoln("created remote file with id", created.ID)
+	fileData.ID = created.ID
+	fileData.Schema = files.SchemaVersion
+
+	return &Upload{
+		State:  UploadState{fileData, created.OwnerToken},
+		key:    key,
+		kdf:    kdf,
+		direct: opts.Live && opts.Direct,
+	}, nil
+}
+
+// createFile creates a file from its metadata with a POST to path, which is /files, or a file's
+// /replace with its owner token, protected by accessPassword if it's set.
+func (rc *RelayClient) createFile(path string, meta files.FileMetadata, ownerToken, accessPassword string) (files.CreatedFile, error) {
+	var created files.CreatedFile
+	reqBody, err := json.Marshal(meta)
+	if err != nil {
+		return created, err
+	}
+	post, err := rc.newRequest(http.MethodPost, path, bytes.NewReader(reqBody))
+	if err != nil {
+		return created, err
+	}
+	post.Header.Set("Content-Type", "application/json")
+	if ownerToken != "" {
+		post.Header.Set(OwnerTokenHeader, ownerToken)
+	}
+	if accessPassword != "" {
+		post.Header.Set(AccessPasswordHeader, accessPassword)
+	}
+
+	res, err := rc.c.Do(post)
+	if err != nil {
+		return created, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return created, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return created, newStatusError("upload", res.StatusCode, body)
+	}
+	err = json.Unmarshal(body, &created)
+	return created, err
+}
+
+// ResumeUpload prepares to continue an interrupted upload of the file with SendUpload.
+func (rc *RelayClient) ResumeUpload(filepath string, secret Secret, state UploadState) (*Upload, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := rc.resumeUpload(f, info.Size(), secret, state)
+	if err != nil {
+		return nil, err
+	}
+	u.path = filepath
+	return u, nil
+}
 
-	log.Println("INFO: creating remote file")
-	res, err := rc.c.Post(rc.Server+"/files", "application/json", bytes.NewReader(resBody))
-	defer func(r *http.Response) {
-		if r != nil {
-			r.Body.Close()
+// ResumeUploadFrom is ResumeUpload for an upload started with StartUploadFrom, whose contents
+// are the size bytes of src.
+func (rc *RelayClient) ResumeUploadFrom(src io.ReaderAt, size int64, secret Secret, state UploadState) (*Upload, error) {
+	u, err := rc.resumeUpload(io.NewSectionReader(src, 0, size), size, secret, state)
+	if err != nil {
+		return nil, err
+	}
+	u.src = src
+	return u, nil
+}
+
+// resumeUpload checks the contents read from r are the ones the upload was started with, leaving
+// where they're read from again to be filled in.
+func (rc *RelayClient) resumeUpload(r io.Reader, size int64, secret Secret, state UploadState) (_ *Upload, err error) {
+	// the state may have been saved by an older version
+	if err = state.Migrate(); err != nil {
+		return nil, err
+	}
+	if err = state.Validate(); err != nil {
+		return nil, err
+	}
+	kdfStart := time.Now()
+	key, err := fileKey(state.FileMetadata, secret)
+	if err != nil {
+		return nil, err
+	}
+	kdf := time.Since(kdfStart)
+	defer func() {
+		if err != nil {
+			crypto.Wipe(key)
 		}
-	}(res)
+	}()
+
+	if uint64(size) != state.Size {
+		return nil, ErrFileChanged
+	}
+
+	logging.Infoln("checking the file hasn't changed")
+	hasher := contentHash(state.FileMetadata, key)
+	if _, err = io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(hasher.Sum(nil), state.Hash) {
+		return nil, ErrFileChanged
+	}
+
+	return &Upload{State: state, key: key, kdf: kdf, resumed: true}, nil
+}
+
+func (rc *RelayClient) uploadStatus(id files.FileID, ownerToken string) (files.UploadStatus, error) {
+	var status files.UploadStatus
+
+	req, err := rc.newRequest(http.MethodGet, "/files/"+id.String()+"/upload", nil)
 	if err != nil {
-		return err
+		return status, err
 	}
+	req.Header.Set(OwnerTokenHeader, ownerToken)
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return status, err
 	}
 
-	var id files.FileID
-	if err = json.Unmarshal(body, &id); err != nil {
-		return err
+	if res.StatusCode == http.StatusNotFound {
+		return status, ErrUploadNotFound
+	} else if res.StatusCode == http.StatusConflict {
+		return status, errUploadInProgress
+	} else if res.StatusCode != http.StatusOK {
+		return status, newStatusError("upload status request", res.StatusCode, body)
+	}
+
+	err = json.Unmarshal(body, &status)
+	return status, err
+}
+
+// SendUpload encrypts and sends the contents of the file. A resumed upload continues from
+// wherever the server's copy ends. Once it succeeds, the upload's key is wiped from memory.
+func (rc *RelayClient) SendUpload(u *Upload) (UploadResult, error) {
+	send := rc.sendUpload
+	if u.direct {
+		send = rc.sendDirect
+	}
+	res, err := send(u)
+	if err == nil {
+		crypto.Wipe(u.key)
+	}
+	return res, err
+}
+
+func (rc *RelayClient) sendUpload(u *Upload) (UploadResult, error) {
+	fileData := u.State.FileMetadata
+	result := UploadResult{FileMetadata: fileData, OwnerToken: u.State.OwnerToken}
+	result.Stats.KDF = u.kdf
+
+	var offset uint64
+	if u.resumed {
+		status, err := rc.uploadStatus(fileData.ID, u.State.OwnerToken)
+		for i := 0; i < uploadStatusRetries && err == errUploadInProgress; i++ {
+			logging.Infoln("waiting for the server to finish with the interrupted upload")
+			time.Sleep(time.Second)
+			status, err = rc.uploadStatus(fileData.ID, u.State.OwnerToken)
+		}
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if status.Complete {
+			logging.Infoln("upload for file", fileData.ID, "already completed")
+			return result, nil
+		}
+		offset = status.Offset
 	}
-	log.Println("INFO: created remote file with id", id.ID)
 
-	_, err = f.Seek(0, 0)
+	f, err := u.open()
 	if err != nil {
-		return err
+		return UploadResult{}, err
 	}
+	defer f.Close()
 
-	encryptedBytes, chunks := encryptedSize(fileData.Size)
-	log.Println("INFO: uploading", encryptedBytes, "bytes in", chunks, "chunks")
+	l, err := fileLayout(fileData)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	rawSize := l.rawChunkSize()
 
-	pb := progressbar.NewOptions64(
-		int64(encryptedBytes),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionSetDescription("Uploading"),
-		progressbar.OptionSetRenderBlankState(true),
-	)
+	// the server only keeps whole chunks, so the offset always falls on a chunk boundary
+	first := l.chunkIndex(offset)
+	_, err = f.Seek(int64(first*rawSize), io.SeekStart)
+	if err != nil {
+		return UploadResult{}, err
+	}
 
-	enc := crypto.NewEncryptingReader(f, RawChunkSize, *key)
+	encryptedBytes, chunks := l.encryptedSize(fileData.Size)
+	if offset > 0 {
+		logging.Infoln("resuming upload of", encryptedBytes-offset, "remaining bytes of", encryptedBytes)
+	} else {
+		logging.Infoln("uploading", encryptedBytes, "bytes in", chunks, "chunks")
+	}
 
-	put, err := http.NewRequest(
-		http.MethodPut,
-		rc.Server+"/files/"+id.ID,
-		io.TeeReader(enc, pb),
-	)
+	pb := rc.progress("Uploading", int64(encryptedBytes-offset))
+	defer pb.stop()
+
+	// servers which read frames get the chunks framed, so they arrive whole whatever's between
+	framed := false
+	if info, err := rc.ServerInfo(); err == nil {
+		framed = info.Framing
+	}
+
+	var encrypting stopwatch
+	pipe := u.encrypt(f, l, first, &encrypting)
+	defer pipe.Close()
+	// progress is of the contents, without the frames around them
+	body := io.TeeReader(pipe, pb)
+	if framed {
+		body = newFramingReader(body, l, l.chunkSize, offset)
+	}
+	// the time spent waiting on the pipeline is waiting for encryption, not the network
+	start := time.Now()
+	sent := newMeter(body, start)
+
+	put, err := rc.newRequest(http.MethodPut, "/files/"+fileData.ID.String(), sent)
 	if err != nil {
-		return err
+		return UploadResult{}, err
+	}
+	if framed {
+		put.Header.Set("Content-Type", FramedContentType)
 	}
 	put.Header.Add("X-Content-Type-Options", "nosniff")
+	put.Header.Set(OwnerTokenHeader, u.State.OwnerToken)
+	if offset > 0 {
+		put.Header.Set(UploadOffsetHeader, strconv.FormatUint(offset, 10))
+	}
 
-	res, err = rc.c.Do(put)
-	defer func(r *http.Response) {
-		if r != nil {
-			r.Body.Close()
-		}
-	}(res)
+	res, err := rc.c.Do(put)
 	if err != nil {
-		return err
+		return UploadResult{}, err
 	}
+	defer res.Body.Close()
 
-	// progressbar doesn't print a newline when it finishes; do it ourselves
-	println()
+	pb.Finish()
 
 	if res.StatusCode == http.StatusOK {
-		log.Println("INFO: successfully uploaded", encryptedBytes, "bytes in", chunks, "chunks")
+		logging.Infoln("successfully uploaded", encryptedBytes, "bytes in", chunks, "chunks")
 	} else {
-		body, _ = ioutil.ReadAll(res.Body)
-		return fmt.Errorf(
-			"upload failed with status code %d and body \"%s\"",
-			res.StatusCode,
-			strings.TrimSpace(string(body)),
-		)
+		body, _ := ioutil.ReadAll(res.Body)
+		return UploadResult{}, newStatusError("upload", res.StatusCode, body)
+	}
+
+	result.Stats.Elapsed = time.Since(start)
+	result.Stats.addMeter(sent)
+	result.Stats.Crypto = encrypting.total()
+	result.Stats.Network = result.Stats.Elapsed - sent.wait.total()
+	logging.Infoln("uploaded", result.Stats)
+	return result, nil
+}
+
+// open opens the upload's contents, from src if it's set, or else the file at path.
+func (u *Upload) open() (io.ReadSeekCloser, error) {
+	if u.src != nil {
+		return nopSeekCloser{io.NewSectionReader(u.src, 0, int64(u.State.Size))}, nil
 	}
+	return os.Open(u.path)
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
 
+func (nopSeekCloser) Close() error {
 	return nil
 }
 
-func (rc *RelayClient) DownloadFile(id, pass string) ([]byte, error) {
-	log.Println("INFO: getting metadata for file", id)
-	res, err := rc.c.Get(rc.Server + "/files/" + id + "/metadata")
+// encrypt encrypts the upload's contents, read from f from the start of chunk first, timing it
+// with encrypting. The next chunks are encrypted while the last ones are being sent.
+func (u *Upload) encrypt(f io.Reader, l layout, first uint64, encrypting *stopwatch) *pipeline {
+	enc := crypto.NewEncryptingReader(f, int(l.rawChunkSize()), *u.key, crypto.Stream{
+		Version:     u.State.Format,
+		Cipher:      l.cipher,
+		FileID:      []byte(u.State.ID.String()),
+		NoncePrefix: u.State.NoncePrefix,
+		FirstChunk:  first,
+	})
+	return newPipeline(timedReader{enc, encrypting}, int(l.chunkSize), pipelineDepth)
+}
+
+// ServerInfo gets what the server accepts.
+func (rc *RelayClient) ServerInfo() (ServerInfo, error) {
+	var info ServerInfo
+	res, err := rc.get("/info")
 	if err != nil {
-		return nil, err
+		return info, err
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return info, err
 	}
-
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"download failed with status code %d and body \"%s\"",
-			res.StatusCode,
-			strings.TrimSpace(string(body)),
-		)
+		return info, newStatusError("info request", res.StatusCode, body)
 	}
+	err = json.Unmarshal(body, &info)
+	return info, err
+}
 
+// checkChunkSize checks the server accepts files uploaded in chunks of size bytes.
+func (rc *RelayClient) checkChunkSize(size uint32) error {
+	info, err := rc.ServerInfo()
+	if errors.Is(err, ErrNotFound) {
+		return errors.New("the server doesn't support chunk sizes other than the default")
+	} else if err != nil {
+		return err
+	}
+	if size < info.MinChunkSize || size > info.MaxChunkSize {
+		return fmt.Errorf("chunk size must be %d to %d bytes for this server", info.MinChunkSize, info.MaxChunkSize)
+	}
+	return nil
+}
+
+func (rc *RelayClient) GetMetadata(id files.FileID) (files.FileMetadata, error) {
 	var meta files.FileMetadata
+
+	req, err := rc.newFileRequest("/files/" + id.String() + "/metadata")
+	if err != nil {
+		return meta, err
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return meta, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return meta, ErrAccessDenied
+	} else if res.StatusCode != http.StatusOK {
+		return meta, newStatusError("metadata request", res.StatusCode, body)
+	}
+
 	err = json.Unmarshal(body, &meta)
+	return meta, err
+}
+
+// DownloadFile downloads and decrypts the whole file into memory. Use DownloadTo for files which
+// might not fit.
+func (rc *RelayClient) DownloadFile(id files.FileID, secret Secret) (files.FileMetadata, []byte, error) {
+	var buf bytes.Buffer
+	res, err := rc.DownloadTo(id, secret, &buf)
 	if err != nil {
-		return nil, err
+		return res.FileMetadata, nil, err
+	}
+	return res.FileMetadata, buf.Bytes(), nil
+}
+
+// DownloadTo downloads and decrypts the file, writing it to w as it arrives, so it takes no more
+// memory however large the file is. Each chunk is authenticated before it's written, but what's
+// written is only known to be the whole file once DownloadTo returns without error.
+func (rc *RelayClient) DownloadTo(id files.FileID, secret Secret, w io.Writer) (DownloadResult, error) {
+	var res DownloadResult
+	meta, err := rc.downloadMetadata(id)
+	res.FileMetadata = meta
+	if err != nil {
+		return res, err
 	}
 
-	log.Println("INFO: got file metadata", prettyPrint(meta))
+	key, err := timeKey(meta, secret, &res.Stats)
+	if err != nil {
+		return res, err
+	}
+	defer crypto.Wipe(key)
 
-	log.Println("INFO: deriving key")
-	key, _, err := crypto.GenerateKey([]byte(pass), (*[16]byte)(meta.Salt))
+	return res, rc.download(id, meta, key, w, 0, contentHash(meta, key), &res.Stats)
+}
+
+// Decrypt decrypts a file's encrypted contents got some other way than from its server, such as
+// over WebDAV, writing them from r to w and checking them like DownloadTo. The contents are bound
+// to the ID in the metadata, so they're only known to be the file's if the metadata is.
+func (rc *RelayClient) Decrypt(meta files.FileMetadata, secret Secret, r io.Reader, w io.Writer) (DownloadResult, error) {
+	res := DownloadResult{FileMetadata: meta}
+	if err := meta.Validate(); err != nil {
+		return res, err
+	}
+	if meta.ID.IsZero() {
+		return res, errors.New("the file's metadata has no ID")
+	}
+	l, err := fileLayout(meta)
 	if err != nil {
-		return nil, err
+		return res, err
 	}
 
-	log.Println("INFO: validating challenge...")
-	if meta.CheckChallenge(*key) {
-		log.Println("INFO: successfully validated challenge")
-	} else {
-		return nil, errors.New("failed to validate challenge; incorrect password for decryption")
+	key, err := timeKey(meta, secret, &res.Stats)
+	if err != nil {
+		return res, err
+	}
+	defer crypto.Wipe(key)
+
+	hasher := contentHash(meta, key)
+	err = decrypt(rc.progress("Decrypting", int64(meta.Size)), meta.ID, meta, l, key, r, w, 0, hasher, time.Now(), &res.Stats)
+	if err != nil {
+		return res, err
+	}
+	return res, checkHash(meta, hasher)
+}
+
+// checkpointInterval is how often ResumeDownload saves the state of the file's hash, in bytes.
+const checkpointInterval = 64 << 20
+
+// HashCheckpoint is the state of a download's hash once its first Offset bytes have been written,
+// which saves hashing them again when it's resumed. The state can't be used without the file's
+// key.
+type HashCheckpoint struct {
+	Offset uint64 `json:"offset"`
+	State  []byte `json:"state"`
+}
+
+// Checkpoints keeps the latest HashCheckpoint of a resumable download.
+type Checkpoints interface {
+	Load() (HashCheckpoint, bool)
+	Save(HashCheckpoint) error
+}
+
+// WritableFile is a file downloads can be written to and resumed in, such as an *os.File.
+type WritableFile interface {
+	io.ReadWriteSeeker
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// ResumeDownload downloads the file to out, keeping any whole chunks of it already there from
+// an earlier, interrupted download. If cps is set, the hash of what's downloaded is saved to it
+// as it goes, and resumed from it rather than hashing what's already in out again.
+func (rc *RelayClient) ResumeDownload(id files.FileID, secret Secret, out WritableFile, cps Checkpoints) (DownloadResult, error) {
+	var res DownloadResult
+	meta, err := rc.downloadMetadata(id)
+	res.FileMetadata = meta
+	if err != nil {
+		return res, err
+	}
+	key, err := timeKey(meta, secret, &res.Stats)
+	if err != nil {
+		return res, err
+	}
+	defer crypto.Wipe(key)
+	l, err := fileLayout(meta)
+	if err != nil {
+		return res, err
+	}
+
+	size, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return res, err
+	}
+
+	have := uint64(size)
+	have -= have % l.rawChunkSize()
+	if err = out.Truncate(int64(have)); err != nil {
+		return res, err
+	}
+
+	// the hash covers the whole file, including the part we already have
+	hashStart := time.Now()
+	hasher := contentHash(meta, key)
+	var hashed uint64
+	if cps != nil {
+		if cp, ok := cps.Load(); ok && cp.Offset <= have {
+			if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.State); err != nil {
+				logging.Infoln("ignoring the saved state of the hash:", err)
+				hasher = contentHash(meta, key)
+			} else {
+				hashed = cp.Offset
+			}
+		}
+	}
+	if _, err = out.Seek(int64(hashed), io.SeekStart); err != nil {
+		return res, err
+	}
+	if _, err = io.CopyN(hasher, out, int64(have-hashed)); err != nil {
+		return res, err
+	}
+	res.Stats.Crypto += time.Since(hashStart)
+
+	if have > 0 {
+		logging.Infoln("resuming download after", have, "bytes, of which", have-hashed, "had to be hashed again")
+	}
+	if cps != nil {
+		hasher = &checkpointingHash{Hash: hasher, offset: have, saved: have, rawSize: l.rawChunkSize(), cps: cps}
+	}
+	return res, rc.download(id, meta, key, out, have, hasher, &res.Stats)
+}
+
+// checkpointingHash saves its state every checkpointInterval bytes it's written, at the end of a
+// chunk, since only whole chunks are kept when a download is resumed. It's written after the
+// file, so the file always has everything a checkpoint covers.
+type checkpointingHash struct {
+	hash.Hash
+	offset, saved, rawSize uint64
+	cps                    Checkpoints
+}
+
+func (h *checkpointingHash) Write(p []byte) (int, error) {
+	n, err := h.Hash.Write(p)
+	h.offset += uint64(n)
+	if h.offset-h.saved >= checkpointInterval && h.offset%h.rawSize == 0 {
+		h.saved = h.offset
+		state, err := h.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err == nil {
+			err = h.cps.Save(HashCheckpoint{h.offset, state})
+		}
+		if err != nil {
+			logging.Errorln("failed to save the state of the hash:", err)
+		}
+	}
+	return n, err
+}
+
+// OpenFile gives random access to the decrypted contents of a file, fetching only the chunks
+// that are read with HTTP range requests. Each chunk is authenticated as it's read, but the hash
+// of the whole file isn't checked, since it may never all be read.
+func (rc *RelayClient) OpenFile(id files.FileID, secret Secret) (*crypto.ReaderAt, files.FileMetadata, error) {
+	meta, err := rc.downloadMetadata(id)
+	if err != nil {
+		return nil, meta, err
+	}
+	key, err := fileKey(meta, secret)
+	if err != nil {
+		return nil, meta, err
+	}
+	defer crypto.Wipe(key)
+	l, err := fileLayout(meta)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	size, _ := l.encryptedSize(meta.Size)
+	ra, err := crypto.NewReaderAt(&httpReaderAt{rc, id}, int64(size), int(l.chunkSize), *key, crypto.Stream{
+		Version:     meta.Format,
+		Cipher:      l.cipher,
+		FileID:      []byte(uploadedID(id, meta).String()),
+		NoncePrefix: meta.NoncePrefix,
+	})
+	return ra, meta, err
+}
+
+// httpReaderAt reads a file's encrypted contents with range requests.
+type httpReaderAt struct {
+	rc *RelayClient
+	id files.FileID
+}
+
+func (h *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := h.rc.newFileRequest("/files/" + h.id.String())
+	if err != nil {
+		return 0, err
 	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
 
-	log.Println("INFO: downloading and decrypting file")
+	res, err := h.rc.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, io.EOF
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return 0, newStatusError("download", res.StatusCode, body)
+	}
+	n, err := io.ReadFull(res.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
 
-	res, err = rc.c.Get(rc.Server + "/files/" + id)
+func (rc *RelayClient) downloadMetadata(id files.FileID) (files.FileMetadata, error) {
+	logging.Infoln("getting metadata for file", id)
+	meta, err := rc.GetMetadata(id)
+	if err != nil {
+		return meta, err
+	}
+	logging.Debugln("got file metadata", prettyPrint(meta))
+	// the rest of the download trusts the metadata, so don't take the server's word for it
+	if err = meta.Validate(); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// download writes the file's contents to w, starting from offset bytes into the decrypted file,
+// which must be a multiple of the file's raw chunk size. hasher must already hold the data
+// before offset. What it takes is added to stats.
+func (rc *RelayClient) download(id files.FileID, meta files.FileMetadata, key *[crypto.KeySize]byte, w io.Writer, offset uint64, hasher hash.Hash, stats *TransferStats) error {
+	l, err := fileLayout(meta)
+	if err != nil {
+		return err
+	}
+	rawSize := l.rawChunkSize()
+
+	// a live file's uploader may have offered to send it directly
+	if offset == 0 && meta.Live && meta.Size > 0 {
+		if conn := rc.dialDirect(id, key); conn != nil {
+			return rc.downloadDirect(conn, id, meta, key, w, hasher, stats)
+		}
+	}
+
+	if offset < meta.Size {
+		logging.Infoln("downloading and decrypting file")
+
+		req, err := rc.newFileRequest("/files/" + id.String())
+		if err != nil {
+			return err
+		}
+		// servers which frame the chunks keep them whole whatever's between, and older ones ignore
+		// the ask
+		req.Header.Set("Accept", FramedContentType)
+		status := http.StatusOK
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", l.chunkOffset(offset/rawSize)))
+			status = http.StatusPartialContent
+		}
+
+		start := time.Now()
+		res, err := rc.c.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		stats.Network += time.Since(start)
+
+		if res.StatusCode != status {
+			body, _ := ioutil.ReadAll(res.Body)
+			return newStatusError("download", res.StatusCode, body)
+		}
+		var body io.Reader = res.Body
+		if res.Header.Get("Content-Type") == FramedContentType {
+			body = newFrameReader(res.Body)
+		}
+		if err = decrypt(rc.progress("Downloading", int64(meta.Size-offset)), id, meta, l, key, body, w, offset, hasher, start, stats); err != nil {
+			return err
+		}
+	}
+	return checkHash(meta, hasher)
+}
+
+// decrypt decrypts the file's encrypted contents from body, which start at the chunk offset bytes
+// of them, writing them to w and hasher. The download started at start.
+func decrypt(pb *progressCounter, id files.FileID, meta files.FileMetadata, l layout, key *[crypto.KeySize]byte, body io.Reader, w io.Writer, offset uint64, hasher hash.Hash, start time.Time, stats *TransferStats) error {
+	defer pb.stop()
+
+	// bind the chunks to the ID that was asked for, so the server can't substitute another file,
+	// unless the file was forwarded from another server
+	dec := crypto.NewDecryptingWriter(io.MultiWriter(w, hasher, pb), int(l.chunkSize), *key, crypto.Stream{
+		Version:     meta.Format,
+		Cipher:      l.cipher,
+		FileID:      []byte(uploadedID(id, meta).String()),
+		NoncePrefix: meta.NoncePrefix,
+		FirstChunk:  offset / l.rawChunkSize(),
+	})
+	received := newMeter(body, start)
+	copyStart := time.Now()
+	if _, err := io.Copy(dec, received); err != nil {
+		return err
+	}
+	if err := dec.Close(); err != nil {
+		return err
+	}
+
+	pb.Finish()
+	logging.Infoln("file downloaded and decrypted")
+	stats.Elapsed += time.Since(start)
+	stats.addMeter(received)
+	stats.Network += received.wait.total()
+	stats.Crypto += time.Since(copyStart) - received.wait.total()
+	logging.Infoln("downloaded", *stats)
+	return nil
+}
+
+// checkHash checks the hash of the whole decrypted file is the one it was uploaded with.
+func checkHash(meta files.FileMetadata, hasher hash.Hash) error {
+	logging.Infoln("checking decrypted file hash")
+	logging.Debugln("expecting:", hex.EncodeToString(meta.Hash))
+
+	sum := hasher.Sum(nil)
+
+	logging.Debugln("  hash is:", hex.EncodeToString(sum))
+	if !hmac.Equal(sum, meta.Hash) {
+		return ErrHashMismatch
+	}
+
+	logging.Infoln("hashes match; file download and decryption successful")
+	return nil
+}
+
+// ListFilter narrows down the files listed by ListFiles and SearchFiles. Its zero value lists every file.
+type ListFilter struct {
+	// Tags are tags the files must all have.
+	Tags []string
+	// ContentType is the content type the files must have, which can be like "image/*".
+	ContentType string
+}
+
+func (filter ListFilter) query() url.Values {
+	query := url.Values{"tag": filter.Tags}
+	if filter.ContentType != "" {
+		query.Set("type", filter.ContentType)
+	}
+	return query
+}
+
+func (rc *RelayClient) ListFiles(filter ListFilter) ([]files.FileMetadata, error) {
+	return rc.fileList("/files", filter.query(), "list request")
+}
+
+// SearchFiles lists the files with a word in their name or tags starting with each word of query.
+func (rc *RelayClient) SearchFiles(query string, filter ListFilter) ([]files.FileMetadata, error) {
+	values := filter.query()
+	values.Set("q", query)
+	return rc.fileList("/files/search", values, "search request")
+}
+
+func (rc *RelayClient) fileList(endpoint string, query url.Values, what string) ([]files.FileMetadata, error) {
+	if encoded := query.Encode(); encoded != "" {
+		endpoint += "?" + encoded
+	}
+	res, err := rc.get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		body, _ = ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf(
-			"download failed with status code %d and body \"%s\"",
-			res.StatusCode,
-			strings.TrimSpace(string(body)),
-		)
+		return nil, newStatusError(what, res.StatusCode, body)
 	}
 
-	pb := progressbar.NewOptions64(
-		int64(meta.Size),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionSetDescription("Downloading"),
-		progressbar.OptionSetRenderBlankState(true),
-	)
+	var list []files.FileMetadata
+	err = json.Unmarshal(body, &list)
+	return list, err
+}
 
-	dec := crypto.NewDecryptingReader(res.Body, ChunkSize, *key)
-	file, err := io.ReadAll(io.TeeReader(dec, pb))
+// CreateBundle bundles files which have finished uploading, so they can be shared with one
+// link.
+func (rc *RelayClient) CreateBundle(members []BundleMember) (Bundle, error) {
+	var bundle Bundle
+	body, err := json.Marshal(NewBundle{members})
 	if err != nil {
-		return nil, err
+		return bundle, err
+	}
+	req, err := rc.newRequest(http.MethodPost, "/bundles", bytes.NewReader(body))
+	if err != nil {
+		return bundle, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	// progressbar doesn't print a newline when it finishes; do it ourselves
-	println()
-	log.Println("INFO: file downloaded and decrypted")
-	log.Println("INFO: checking decrypted file hash")
-	log.Println("INFO: expecting:", hex.EncodeToString(meta.Hash))
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return bundle, err
+	}
+	defer res.Body.Close()
 
-	hash, err := crypto.HashData(bytes.NewReader(file))
+	if res.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bundle, newStatusError("bundle request", res.StatusCode, body)
+	}
+	err = json.NewDecoder(res.Body).Decode(&bundle)
+	return bundle, err
+}
+
+// GetBundle gets the metadata of the members of a bundle which can be downloaded, each of which
+// can then be downloaded like any other file.
+func (rc *RelayClient) GetBundle(id files.FileID) (Bundle, error) {
+	var bundle Bundle
+	req, err := rc.newFileRequest("/bundles/" + id.String())
 	if err != nil {
-		return nil, err
+		return bundle, err
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return bundle, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return bundle, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return bundle, newStatusError("bundle request", res.StatusCode, body)
+	}
+
+	if err = json.Unmarshal(body, &bundle); err != nil {
+		return bundle, err
+	}
+	// the members' metadata is used to decrypt them, so it's checked like any other
+	for i := range bundle.Members {
+		if err = bundle.Members[i].Validate(); err != nil {
+			return bundle, err
+		}
+	}
+	return bundle, nil
+}
+
+// DeleteFile deletes a file, or moves it to the trash if the server keeps one, in which case it
+// returns when the file will be purged. Otherwise the TrashedFile is zero.
+func (rc *RelayClient) DeleteFile(id files.FileID, ownerToken string) (files.TrashedFile, error) {
+	return rc.deleteFile(id, ownerToken, false)
+}
+
+// PurgeFile deletes a file for good, whether or not it's in the trash.
+func (rc *RelayClient) PurgeFile(id files.FileID, ownerToken string) error {
+	_, err := rc.deleteFile(id, ownerToken, true)
+	return err
+}
+
+func (rc *RelayClient) deleteFile(id files.FileID, ownerToken string, purge bool) (files.TrashedFile, error) {
+	var trashed files.TrashedFile
+	endpoint := "/files/" + id.String()
+	if purge {
+		endpoint += "?purge=true"
+	}
+	req, err := rc.newRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return trashed, err
 	}
+	req.Header.Set(OwnerTokenHeader, ownerToken)
 
-	log.Println("INFO:   hash is:", hex.EncodeToString(hash))
-	if !bytes.Equal(hash, meta.Hash) {
-		return nil, errors.New("hashes do not match")
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return trashed, err
 	}
+	defer res.Body.Close()
 
-	log.Println("INFO: hashes match; file download and decryption successful")
-	return file, nil
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return trashed, nil
+	case http.StatusOK:
+		err = json.NewDecoder(res.Body).Decode(&trashed)
+		return trashed, err
+	default:
+		body, _ := ioutil.ReadAll(res.Body)
+		return trashed, newStatusError("delete", res.StatusCode, body)
+	}
 }
 
-func encryptedSize(size uint64) (bytes uint64, chunks uint64) {
-	chunks, extra := size/RawChunkSize, size%RawChunkSize > 0
-	if extra {
-		chunks += 1
+// RestoreFile takes a file back out of the trash. Without its owner token, the client's auth
+// token has to be the server's.
+func (rc *RelayClient) RestoreFile(id files.FileID, ownerToken string) error {
+	req, err := rc.newRequest(http.MethodPost, "/files/"+id.String()+"/restore", nil)
+	if err != nil {
+		return err
+	}
+	if ownerToken != "" {
+		req.Header.Set(OwnerTokenHeader, ownerToken)
 	}
-	bytes = size + chunks*crypto.Overhead
-	return bytes, chunks
+
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return newStatusError("restore", res.StatusCode, body)
+	}
+	return nil
 }
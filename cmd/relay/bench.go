@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type benchResult struct {
+	Size     uint64        `json:"size"`
+	KDF      time.Duration `json:"kdf_ns"`
+	Encrypt  time.Duration `json:"encrypt_ns"`
+	Overhead uint64        `json:"encryption_overhead_bytes"`
+	Upload   time.Duration `json:"upload_ns"`
+	Download time.Duration `json:"download_ns"`
+}
+
+func runBench(args []string) error {
+	fs := newFlagSet("bench", "")
+	cf := addClientFlags(fs)
+	size := byteSize(16 << 20)
+	fs.Var(&size, "size", "Size of the test file, e.g. 100MB")
+	var params relay.ScryptParams
+	addScryptFlag(fs, &params)
+	var cipherName string
+	addCipherFlag(fs, &cipherName)
+	var chunkSize uint32
+	addChunkSizeFlag(fs, &chunkSize)
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if size == 0 {
+		return errors.New("-size must be positive")
+	}
+
+	tmp, err := os.MkdirTemp("", "relay-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	logging.Infoln("generating", humanSize(uint64(size)), "of random data")
+	path := filepath.Join(tmp, "bench.bin")
+	if err = writeRandomFile(path, int64(size)); err != nil {
+		return err
+	}
+
+	// the file is only readable by this run, so a random password is as good as any
+	passBytes := make([]byte, 16)
+	if _, err = rand.Read(passBytes); err != nil {
+		return err
+	}
+	secret := relay.Password(hex.EncodeToString(passBytes))
+
+	res := benchResult{Size: uint64(size)}
+
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return err
+	}
+	if params == (relay.ScryptParams{}) {
+		params = crypto.DefaultScryptParams
+	}
+	start := time.Now()
+	key, err := secret.DeriveKey(&files.FileMetadata{Salt: salt[:], Scrypt: &params})
+	if err != nil {
+		return err
+	}
+	res.KDF = time.Since(start)
+
+	cipher, err := crypto.CipherByName(cipherName)
+	if err != nil {
+		return err
+	}
+	if chunkSize == 0 {
+		chunkSize = relay.ChunkSize
+	}
+	if res.Encrypt, res.Overhead, err = benchEncrypt(path, key, cipher, int(chunkSize)); err != nil {
+		return err
+	}
+
+	// each transfer derives its key again, so leave that out of the transfer times
+	rc := cf.client()
+	start = time.Now()
+	up, err := rc.UploadFile(path, secret, relay.UploadOptions{Scrypt: params, Cipher: cipherName, ChunkSize: chunkSize})
+	if err != nil {
+		return err
+	}
+	res.Upload = time.Since(start) - res.KDF
+	defer func() {
+		if err := rc.PurgeFile(up.ID, up.OwnerToken); err != nil {
+			logging.Errorln("failed to delete the test file:", err)
+		}
+	}()
+
+	start = time.Now()
+	if _, err = rc.DownloadTo(up.ID, secret, io.Discard); err != nil {
+		return err
+	}
+	res.Download = time.Since(start) - res.KDF
+
+	if jsonOutput {
+		return printJSON(res)
+	}
+	fmt.Printf("Size:       %s\n", humanSize(res.Size))
+	fmt.Printf("KDF:        %s\n", res.KDF.Round(time.Millisecond))
+	fmt.Printf("Encryption: %s (%s, +%s)\n",
+		res.Encrypt.Round(time.Millisecond), throughput(res.Size, res.Encrypt), humanSize(res.Overhead))
+	fmt.Printf("Upload:     %s (%s)\n", res.Upload.Round(time.Millisecond), throughput(res.Size, res.Upload))
+	fmt.Printf("Download:   %s (%s)\n", res.Download.Round(time.Millisecond), throughput(res.Size, res.Download))
+	return nil
+}
+
+func writeRandomFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, rand.Reader, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// benchEncrypt times encrypting the file locally, and returns how many bytes encryption added.
+func benchEncrypt(path string, key *[crypto.KeySize]byte, cipher crypto.Cipher, chunkSize int) (time.Duration, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, crypto.NewEncryptingReader(f, chunkSize-cipher.Overhead(), *key, crypto.Stream{Cipher: cipher}))
+	if err != nil {
+		return 0, 0, err
+	}
+	return time.Since(start), uint64(n - info.Size()), nil
+}
+
+func throughput(n uint64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return humanSize(uint64(float64(n)/d.Seconds())) + "/s"
+}
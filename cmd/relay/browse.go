@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+func runBrowse(args []string) error {
+	fs := newFlagSet("browse", "")
+	cf := addClientFlags(fs)
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("browse must be run in a terminal")
+	}
+
+	tokensPath, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(tokensPath)
+	if err != nil {
+		return err
+	}
+
+	rc := cf.client()
+	b := &browser{rc: &rc, cf: cf, tokens: tokens, tokensPath: tokensPath}
+	return b.run()
+}
+
+type browser struct {
+	rc *relay.RelayClient
+	cf *clientFlags
+
+	tokens     config.OwnerTokens
+	tokensPath string
+
+	files    []files.FileMetadata
+	selected int
+	offset   int
+	showInfo bool
+	status   string
+
+	state *term.State
+}
+
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l"
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+)
+
+func (b *browser) run() error {
+	b.refresh()
+
+	if err := b.enterRaw(); err != nil {
+		return err
+	}
+	defer b.leaveRaw()
+
+	for {
+		b.render()
+
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+
+		if b.showInfo {
+			b.showInfo = false
+			continue
+		}
+
+		switch key {
+		case "q", "\x03", "\x1b":
+			return nil
+		case "k", "\x1b[A":
+			b.move(-1)
+		case "j", "\x1b[B":
+			b.move(1)
+		case "g", "\x1b[H":
+			b.move(-len(b.files))
+		case "G", "\x1b[F":
+			b.move(len(b.files))
+		case "r":
+			b.refresh()
+		case "i":
+			b.showInfo = len(b.files) > 0
+		case "\r", "\n":
+			if len(b.files) > 0 {
+				b.suspend(b.download)
+			}
+		case "d", "x", "\x1b[3~":
+			if len(b.files) > 0 {
+				b.delete()
+			}
+		}
+	}
+}
+
+func (b *browser) enterRaw() error {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	b.state = state
+	fmt.Print(enterScreen)
+	return nil
+}
+
+func (b *browser) leaveRaw() {
+	fmt.Print(leaveScreen)
+	term.Restore(int(os.Stdin.Fd()), b.state)
+}
+
+// suspend hands the terminal back for actions which print logs or prompt for input.
+func (b *browser) suspend(fn func() error) {
+	b.leaveRaw()
+
+	if err := fn(); err != nil {
+		fmt.Fprintln(os.Stderr, "ERR:", err)
+		b.status = "Error: " + err.Error()
+	}
+	fmt.Fprint(os.Stderr, "\nPress Enter to return to the file list...")
+	var discard string
+	fmt.Scanln(&discard)
+
+	if err := b.enterRaw(); err != nil {
+		b.status = "Error: " + err.Error()
+	}
+}
+
+func readKey() (string, error) {
+	buf := make([]byte, 8)
+	n, err := os.Stdin.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func (b *browser) refresh() {
+	list, err := b.rc.ListFiles(relay.ListFilter{})
+	if err != nil {
+		b.status = "Error: " + err.Error()
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Uploaded.After(list[j].Uploaded) })
+	b.files = list
+	b.move(0)
+	b.status = fmt.Sprintf("Loaded %d files", len(list))
+}
+
+func (b *browser) move(delta int) {
+	b.selected += delta
+	if b.selected >= len(b.files) {
+		b.selected = len(b.files) - 1
+	}
+	if b.selected < 0 {
+		b.selected = 0
+	}
+}
+
+func (b *browser) current() files.FileMetadata {
+	return b.files[b.selected]
+}
+
+func (b *browser) download() error {
+	meta := b.current()
+	path, err := safeFileName(meta.Name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Downloading %s (%s) to %s\n", meta.Name, meta.ID, path)
+	secret, err := b.cf.secret(false)
+	if err != nil {
+		return err
+	}
+
+	if _, err = downloadToFile(b.rc, meta.ID, secret, path); err != nil {
+		return err
+	}
+
+	b.status = fmt.Sprintf("Downloaded %s to %s", meta.Name, path)
+	fmt.Fprintln(os.Stderr, b.status)
+	return nil
+}
+
+func (b *browser) delete() {
+	meta := b.current()
+	token, ok := b.tokens.Get(b.cf.server, meta.ID)
+	if !ok {
+		b.status = "No owner token for " + meta.Name + "; only files uploaded from here can be deleted"
+		return
+	}
+
+	b.status = fmt.Sprintf("Delete %s? (y/n)", meta.Name)
+	b.render()
+	if key, err := readKey(); err != nil || (key != "y" && key != "Y") {
+		b.status = "Cancelled"
+		return
+	}
+
+	trashed, err := b.rc.DeleteFile(meta.ID, token)
+	if err != nil {
+		b.status = "Error: " + err.Error()
+		return
+	}
+	if !trashed.Purge.IsZero() {
+		// the owner token is kept, so the file can be restored
+		b.refresh()
+		b.status = "Moved " + meta.Name + " to the trash"
+		return
+	}
+
+	b.tokens.Remove(b.cf.server, meta.ID)
+	if err := b.tokens.Save(b.tokensPath); err != nil {
+		b.status = "Error: " + err.Error()
+		return
+	}
+	b.refresh()
+	b.status = "Deleted " + meta.Name
+}
+
+func (b *browser) render() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	var sb strings.Builder
+	line := func(format string, args ...interface{}) {
+		s := fmt.Sprintf(format, args...)
+		// lines with escape codes are laid out to fit by their callers
+		if !strings.Contains(s, "\x1b") && len([]rune(s)) > width {
+			s = string([]rune(s)[:width])
+		}
+		sb.WriteString(s + "\x1b[K\r\n")
+	}
+
+	sb.WriteString("\x1b[H")
+	line("relay: %s (%d files)", b.cf.server, len(b.files))
+	line("")
+
+	if b.showInfo {
+		b.renderInfo(line)
+	} else {
+		b.renderList(line, width, height-6)
+	}
+
+	sb.WriteString("\x1b[J")
+	sb.WriteString(fmt.Sprintf("\x1b[%d;1H", height-1))
+	line("%s", b.status)
+	sb.WriteString("\x1b[7m")
+	hint := "↑/↓ move  enter download  i info  d delete  r refresh  q quit"
+	if b.showInfo {
+		hint = "press any key to return"
+	}
+	sb.WriteString(fmt.Sprintf("%-*s", width, hint))
+	sb.WriteString("\x1b[0m")
+
+	fmt.Print(sb.String())
+}
+
+func (b *browser) renderList(line func(string, ...interface{}), width, rows int) {
+	if rows < 1 {
+		rows = 1
+	}
+	if b.selected < b.offset {
+		b.offset = b.selected
+	} else if b.selected >= b.offset+rows {
+		b.offset = b.selected - rows + 1
+	}
+
+	nameWidth := width - 40
+	if nameWidth < 10 {
+		nameWidth = 10
+	}
+
+	line("  %-*s  %10s  %10s  %9s", nameWidth, "NAME", "SIZE", "UPLOADED", "DOWNLOADS")
+	now := time.Now()
+	for i := b.offset; i < len(b.files) && i < b.offset+rows; i++ {
+		f := b.files[i]
+		name := f.Name
+		if len([]rune(name)) > nameWidth {
+			name = string([]rune(name)[:nameWidth-1]) + "…"
+		}
+
+		row := fmt.Sprintf(
+			"%-*s  %10s  %10s  %9d",
+			nameWidth, name, humanSize(f.Size), relativeTime(f.Uploaded, now), f.Downloads,
+		)
+		if i == b.selected {
+			line("\x1b[7m> %s\x1b[0m", row)
+		} else {
+			line("  %s", row)
+		}
+	}
+}
+
+func (b *browser) renderInfo(line func(string, ...interface{})) {
+	f := b.current()
+	_, owned := b.tokens.Get(b.cf.server, f.ID)
+
+	for _, l := range infoLines(f, b.rc.ShareLink(f.ID), owned) {
+		line("%s", l)
+	}
+}
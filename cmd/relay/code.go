@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/archive"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type codeResult struct {
+	ID   files.FileID `json:"id"`
+	Code string       `json:"code"`
+}
+
+// uploadWithCode uploads the file with a random key, then gives the key to whoever enters the
+// code printed for it. The file is deleted again if the exchange fails, since nobody else can
+// ever decrypt it.
+func uploadWithCode(rc *relay.RelayClient, path string, opts relay.UploadOptions, recursive bool, filter archive.Filter) error {
+	key := make(relay.Keyfile, relay.MinKeyfileSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	defer crypto.Zero(key)
+
+	res, err := uploadPath(rc, path, key, opts, recursive, filter, nil)
+	if err != nil {
+		return err
+	}
+
+	offer, err := rc.OfferCode()
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Code: %s\nOn the other side, run: %s download -code %s\n", offer.Code, os.Args[0], offer.Code)
+		err = offer.Send(res.ID, key)
+	}
+	if err != nil {
+		if delErr := rc.PurgeFile(res.ID, res.OwnerToken); delErr != nil {
+			logging.Errorln("failed to delete the uploaded file:", delErr)
+		}
+		return err
+	}
+
+	if err = saveOwnerToken(rc.Server, res.ID, res.OwnerToken); err != nil {
+		logging.Errorln("failed to save owner token for", res.ID.String()+":", err)
+	}
+	return printResult(codeResult{res.ID, offer.Code}, "Sent %s as %s\n", path, res.ID)
+}
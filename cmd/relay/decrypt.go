@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+func runDecrypt(args []string) error {
+	fs := newFlagSet("decrypt", "<file.relay>")
+	cf := addClientFlags(fs)
+	metaFlag := fs.String("metadata", "", "File holding the file's metadata (default <file.relay>.json, as served over WebDAV)")
+	outFlag := fs.String("output", "", "File to write to, or - for stdout (default the uploaded file name)")
+	fs.StringVar(outFlag, "o", "", "Shorthand for -output")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	in := fs.Arg(0)
+	metaPath := *metaFlag
+	if metaPath == "" {
+		metaPath = in + ".json"
+	}
+
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return err
+	}
+	var meta files.FileMetadata
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	secret, err := cf.secret(false)
+	if err != nil {
+		return err
+	}
+	rc := cf.client()
+
+	if *outFlag == "-" {
+		if jsonOutput {
+			return errors.New("cannot write JSON output and file contents to stdout")
+		}
+		_, err = rc.Decrypt(meta, secret, src, os.Stdout)
+		return err
+	}
+
+	path := *outFlag
+	if path == "" {
+		if path, err = safeFileName(meta.Name); err != nil {
+			return err
+		}
+	}
+	if sameFile(path, in) {
+		return errors.New("the decrypted file would replace the encrypted one; specify where to write it with -output")
+	}
+
+	res, err := writeFileVia(path, func(tmp *os.File) (relay.DownloadResult, error) {
+		return rc.Decrypt(meta, secret, src, tmp)
+	})
+	if err != nil {
+		return err
+	}
+	return printResult(
+		newDownloadResult(path, res),
+		"Decrypted %s to %s\n", in, path,
+	)
+}
+
+// sameFile reports whether the paths a and b name the same file which exists.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
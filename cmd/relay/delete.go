@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type deleteResult struct {
+	ID      files.FileID `json:"id"`
+	Deleted bool         `json:"deleted"`
+	// Purge is when the file will be deleted for good, if it was moved to the trash.
+	Purge time.Time `json:"purge,omitempty"`
+}
+
+func runDelete(args []string) error {
+	fs := newFlagSet("delete", "<id|link>")
+	cf := addClientFlags(fs)
+	forceFlag := fs.Bool("force", false, "Delete without asking for confirmation")
+	fs.BoolVar(forceFlag, "f", false, "Shorthand for -force")
+	purgeFlag := fs.Bool("purge", false, "Delete the file for good, instead of moving it to the trash if the server keeps one")
+	ownerFlag := fs.String("owner-token", "", "Owner token for the file (default the one saved when it was uploaded)")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	id, _, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	tokensPath, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(tokensPath)
+	if err != nil {
+		return err
+	}
+
+	token := *ownerFlag
+	if token == "" {
+		var ok bool
+		if token, ok = tokens.Get(cf.server, id); !ok {
+			return fmt.Errorf("no owner token saved for %s; only files uploaded from here can be deleted", id)
+		}
+	}
+
+	rc := cf.client()
+	if !*forceFlag {
+		// files which haven't finished uploading have no metadata yet
+		name := id.String()
+		if meta, err := rc.GetMetadata(id); err == nil {
+			name = fmt.Sprintf("%s (%s)", meta.Name, id)
+		}
+
+		ok, err := confirm("Delete " + name + "?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("cancelled")
+		}
+	}
+
+	var trashed files.TrashedFile
+	if *purgeFlag {
+		err = rc.PurgeFile(id, token)
+	} else {
+		trashed, err = rc.DeleteFile(id, token)
+	}
+	if err != nil {
+		return err
+	}
+	if !trashed.Purge.IsZero() {
+		// the owner token is kept, so the file can be restored
+		logging.Infoln("moved file", id, "to the trash")
+		return printResult(deleteResult{id, true, trashed.Purge},
+			"Moved %s to the trash; restore it before %s to keep it\n", id, trashed.Purge.Local().Format(time.RFC1123))
+	}
+	logging.Infoln("deleted file", id)
+
+	tokens.Remove(cf.server, id)
+	if err = tokens.Save(tokensPath); err != nil {
+		logging.Errorln("failed to remove saved owner token:", err)
+	}
+
+	return printResult(deleteResult{ID: id, Deleted: true}, "Deleted %s\n", id)
+}
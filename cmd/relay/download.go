@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+func runDownload(args []string) error {
+	fs := newFlagSet("download", "<id|link> | -code <code>")
+	cf := addClientFlags(fs)
+	outFlag := fs.String("output", "", "File to write to, or - for stdout (default the uploaded file name)")
+	fs.StringVar(outFlag, "o", "", "Shorthand for -output")
+	resumeFlag := fs.Bool("resume", false, "Download to a partial file, resuming an earlier interrupted download of it")
+	codeFlag := fs.String("code", "", "Download the file being sent with this code from upload -code")
+	parallelFlag := fs.Int("parallel", 1, "Download each file in up to `N` ranges at once, which can be faster from distant servers")
+	bundleFlag := fs.Bool("bundle", false, "Download every file in a bundle, named by its ID or share link, into the -output directory (default the current one); bundle links imply it")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if (fs.NArg() != 1) == (*codeFlag == "") || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *parallelFlag < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+	if *parallelFlag > 1 && *resumeFlag {
+		// the ranges arrive out of order, so an interrupted download would leave gaps
+		return errors.New("-parallel downloads can't be resumed, so can't be used with -resume")
+	}
+
+	var (
+		id     files.FileID
+		secret relay.Secret
+		err    error
+	)
+	bundle := *bundleFlag || (fs.NArg() == 1 && relay.IsBundleLink(fs.Arg(0)))
+	if bundle && (*codeFlag != "" || *resumeFlag) {
+		return errors.New("bundles can't be downloaded with -code or -resume; download their files individually")
+	}
+	if *codeFlag != "" {
+		rc := cf.client()
+		var key relay.Keyfile
+		if id, key, err = rc.AcceptCode(*codeFlag); err != nil {
+			return err
+		}
+		defer crypto.Zero(key)
+		secret = key
+	} else {
+		// a share link names its server, and may carry the password too
+		var linkSecret string
+		if bundle {
+			id, linkSecret, err = cf.resolveBundleID(fs.Arg(0))
+		} else {
+			id, linkSecret, err = cf.resolveID(fs.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+
+		secret = relay.Password(linkSecret)
+		if linkSecret == "" {
+			if secret, err = cf.secret(false); err != nil {
+				return err
+			}
+		}
+	}
+
+	rc := cf.client()
+	rc.Parallel = *parallelFlag
+	if bundle {
+		return downloadBundle(&rc, id, secret, *outFlag)
+	}
+	if *resumeFlag {
+		if *outFlag == "-" {
+			return errors.New("cannot resume a download to stdout")
+		}
+		return resumeDownload(&rc, id, secret, *outFlag)
+	}
+
+	if *outFlag == "-" {
+		if jsonOutput {
+			return errors.New("cannot write JSON output and file contents to stdout")
+		}
+		_, err = rc.DownloadTo(id, secret, os.Stdout)
+		return err
+	}
+
+	path := *outFlag
+	if path == "" {
+		meta, err := rc.GetMetadata(id)
+		if err != nil {
+			return err
+		}
+		if path, err = safeFileName(meta.Name); err != nil {
+			return err
+		}
+	}
+
+	res, err := downloadToFile(&rc, id, secret, path)
+	if err != nil {
+		return err
+	}
+	return printResult(
+		newDownloadResult(path, res),
+		"Downloaded %s to %s\n", res.ID, path,
+	)
+}
+
+// resumeDownload downloads the file to path via a partial file, which is kept if the download
+// is interrupted so that it can be continued later.
+func resumeDownload(rc *relay.RelayClient, id files.FileID, secret relay.Secret, path string) error {
+	if path == "" {
+		meta, err := rc.GetMetadata(id)
+		if err != nil {
+			return err
+		}
+		if path, err = safeFileName(meta.Name); err != nil {
+			return err
+		}
+	}
+
+	partPath := path + ".part"
+	key, err := filepath.Abs(partPath)
+	if err != nil {
+		return err
+	}
+	state, err := loadTransferState()
+	if err != nil {
+		return err
+	}
+
+	want := downloadState{Server: strings.TrimRight(rc.Server, "/"), ID: id}
+	flags := os.O_RDWR | os.O_CREATE
+	if saved, ok := state.Downloads[key]; !ok {
+		// don't overwrite a file we didn't create
+		if _, err := os.Stat(partPath); err == nil {
+			return fmt.Errorf("%s already exists and isn't a partial download; move it out of the way first", partPath)
+		}
+	} else if saved.Server != want.Server || saved.ID != want.ID {
+		flags |= os.O_TRUNC
+	} else {
+		want = saved
+	}
+
+	state.Downloads[key] = want
+	if err = state.save(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	res, err := rc.ResumeDownload(id, secret, f, downloadCheckpoints{state, key})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var chunkErr *crypto.ChunkError
+	if errors.As(err, &chunkErr) {
+		// trying again would fail at the same place
+		return fmt.Errorf("%w (the server's copy is corrupt; the %d chunks before it were kept)", err, chunkErr.Index)
+	} else if err != nil {
+		return fmt.Errorf("%w (run again with -resume to continue)", err)
+	}
+
+	if err = os.Rename(partPath, path); err != nil {
+		return err
+	}
+	delete(state.Downloads, key)
+	if err = state.save(); err != nil {
+		logging.Errorln("failed to save transfer state:", err)
+	}
+
+	logging.Infoln("wrote", res.Size, "bytes to", path)
+	return printResult(
+		newDownloadResult(path, res),
+		"Downloaded %s to %s\n", res.ID, path,
+	)
+}
+
+// downloadToFile downloads the file to a temporary file beside path, which takes its place once
+// the whole file has been checked, so a failed download leaves nothing at path.
+func downloadToFile(rc *relay.RelayClient, id files.FileID, secret relay.Secret, path string) (relay.DownloadResult, error) {
+	return writeFileVia(path, func(tmp *os.File) (relay.DownloadResult, error) {
+		return rc.DownloadToFile(id, secret, tmp)
+	})
+}
+
+// writeFileVia has write write a decrypted file to a temporary file beside path, which takes its
+// place if write succeeds.
+func writeFileVia(path string, write func(*os.File) (relay.DownloadResult, error)) (relay.DownloadResult, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return relay.DownloadResult{}, err
+	}
+	defer os.Remove(tmp.Name()) // which fails harmlessly once it's been renamed
+
+	res, err := write(tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return res, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return res, err
+	}
+	logging.Infoln("wrote", res.Size, "bytes to", path)
+	return res, nil
+}
+
+// downloadBundle downloads every file in a bundle into dir, under their own names.
+func downloadBundle(rc *relay.RelayClient, id files.FileID, secret relay.Secret, dir string) error {
+	if dir == "-" {
+		return errors.New("cannot download a bundle to stdout")
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	bundle, err := rc.GetBundle(id)
+	if err != nil {
+		return err
+	}
+	// work out every path first, so nothing is downloaded if any of them won't do
+	paths := make([]string, len(bundle.Members))
+	seen := make(map[string]bool, len(bundle.Members))
+	for i, member := range bundle.Members {
+		name, err := safeFileName(member.Name)
+		if err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("bundle has more than one file named %q; download them individually", name)
+		}
+		seen[name] = true
+		paths[i] = filepath.Join(dir, name)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	results := make([]downloadResult, 0, len(bundle.Members))
+	for i, member := range bundle.Members {
+		res, err := downloadToFile(rc, member.ID, secret, paths[i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", member.Name, err)
+		}
+		results = append(results, newDownloadResult(paths[i], res))
+	}
+
+	if jsonOutput {
+		return printJSON(results)
+	}
+	_, err = fmt.Printf("Downloaded %d files from bundle %s to %s\n", len(results), id, dir)
+	return err
+}
+
+// safeFileName reduces a server-provided file name to a plain name in the current directory.
+func safeFileName(name string) (string, error) {
+	base := filepath.Base(filepath.FromSlash(name))
+	if base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("cannot use file name %q; specify one with -output", name)
+	}
+	return base, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+)
+
+// Exit codes, so scripts can tell classes of failure apart.
+const (
+	exitError         = 1
+	exitUsage         = 2
+	exitNotFound      = 3
+	exitWrongPassword = 4
+	exitCorrupt       = 5
+	exitNetwork       = 6
+	exitRejected      = 7
+)
+
+const exitCodeHelp = `Exit status:
+  0  success
+  1  other errors
+  2  invalid command line
+  3  file not found on the server
+  4  incorrect password, access password or code
+  5  downloaded data failed to decrypt or didn't match its hash
+  6  couldn't reach the server
+  7  the server rejected the request
+`
+
+func exitCode(err error) int {
+	var statusErr *relay.StatusError
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, relay.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, relay.ErrWrongPassword), errors.Is(err, relay.ErrWrongCode), errors.Is(err, relay.ErrAccessDenied):
+		return exitWrongPassword
+	case errors.Is(err, relay.ErrHashMismatch),
+		errors.Is(err, crypto.ErrDecryptFailed),
+		errors.Is(err, crypto.ErrTruncated),
+		errors.Is(err, crypto.ErrInvalidHeader),
+		errors.Is(err, crypto.ErrCiphertextTooShort):
+		return exitCorrupt
+	case errors.As(err, &statusErr):
+		return exitRejected
+	case errors.As(err, &urlErr):
+		return exitNetwork
+	}
+	return exitError
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bfrengley/relay/internal/files"
+)
+
+func humanSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// relativeTime describes t relative to now, e.g. "5m ago" or "in 2h".
+func relativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var s string
+	switch {
+	case d < time.Minute && future:
+		return "in <1m"
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		s = fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 48*time.Hour:
+		s = fmt.Sprintf("%dh", int(d/time.Hour))
+	default:
+		s = fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+
+	if future {
+		return "in " + s
+	}
+	return s + " ago"
+}
+
+// infoLines describes a file's metadata for the info command and browser.
+func infoLines(f files.FileMetadata, link string, owned bool) []string {
+	now := time.Now()
+	downloads := fmt.Sprint(f.Downloads)
+	if f.MaxDownloads > 0 {
+		downloads += fmt.Sprintf(" of %d", f.MaxDownloads)
+	}
+	expires := "never"
+	if !f.Expires.IsZero() {
+		expires = fmt.Sprintf("%s (%s)", f.Expires.Local().Format(time.RFC1123), relativeTime(f.Expires, now))
+	}
+
+	lines := []string{
+		"Name:       " + f.Name,
+		"ID:         " + f.ID.String(),
+		"Link:       " + link,
+		fmt.Sprintf("Size:       %s (%d bytes)", humanSize(f.Size), f.Size),
+	}
+	if f.ContentType != "" {
+		lines = append(lines, "Type:       "+f.ContentType)
+	}
+	if f.Description != "" {
+		lines = append(lines, "About:      "+f.Description)
+	}
+	if len(f.Tags) > 0 {
+		lines = append(lines, "Tags:       "+strings.Join(f.Tags, ", "))
+	}
+	return append(lines,
+		fmt.Sprintf("Uploaded:   %s (%s)", f.Uploaded.Local().Format(time.RFC1123), relativeTime(f.Uploaded, now)),
+		"Expires:    "+expires,
+		"Downloads:  "+downloads,
+		fmt.Sprintf("Owned:      %t", owned),
+	)
+}
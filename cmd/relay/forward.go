@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type forwardResult struct {
+	ID     files.FileID `json:"id"`
+	Server string       `json:"server"`
+	Link   string       `json:"link"`
+	// Deleted is set if the file was deleted from the server it was forwarded from.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func runForward(args []string) error {
+	fs := newFlagSet("forward", "<id|link>")
+	cf := addClientFlags(fs)
+	toFlag := fs.String("to", "", "URL of the server to send the file to, or name: of a saved remote")
+	toTokenFlag := fs.String("to-token", "", "Token the other server needs to upload files, if any (or set $RELAY_FORWARD_TOKEN)")
+	toAccessFlag := fs.String("to-access-password", "", "Password needed to get the file from the other server, on top of what it's encrypted with")
+	deleteFlag := fs.Bool("delete", false, "Delete the file from this server once it's been forwarded")
+	ownerFlag := fs.String("owner-token", "", "Owner token for the file (default the one saved when it was uploaded)")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" || *toFlag == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	id, secret, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	tokensPath, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(tokensPath)
+	if err != nil {
+		return err
+	}
+	token := *ownerFlag
+	if token == "" {
+		var ok bool
+		if token, ok = tokens.Get(cf.server, id); !ok {
+			return fmt.Errorf("no owner token saved for %s; only files uploaded from here can be forwarded", id)
+		}
+	}
+
+	to := strings.TrimRight(*toFlag, "/")
+	toToken := *toTokenFlag
+	if toToken == "" {
+		toToken = os.Getenv("RELAY_FORWARD_TOKEN")
+	}
+	if p, ok := cf.lookupRemote(*toFlag); ok {
+		to = strings.TrimRight(p.URL, "/")
+		if toToken == "" {
+			toToken = p.Token
+		}
+	}
+
+	rc := cf.client()
+	created, err := rc.ForwardFile(id, token, relay.ForwardRequest{
+		Server:         to,
+		Token:          toToken,
+		AccessPassword: *toAccessFlag,
+	})
+	if err != nil {
+		return err
+	}
+	logging.Infoln("forwarded file", id, "to", to, "as", created.ID)
+	tokens.Set(to, created.ID, created.OwnerToken)
+
+	dest := relay.NewClient(to)
+	link := dest.ShareLink(created.ID)
+	if secret != "" {
+		// the file's still encrypted with the password the link carried
+		link = dest.ShareLinkWithSecret(created.ID, secret)
+	}
+	res := forwardResult{ID: created.ID, Server: to, Link: link}
+
+	if *deleteFlag {
+		if err = rc.PurgeFile(id, token); err != nil {
+			err = fmt.Errorf("forwarded the file, but couldn't delete it here: %w", err)
+		} else {
+			logging.Infoln("deleted file", id)
+			tokens.Remove(cf.server, id)
+			res.Deleted = true
+		}
+	}
+	if saveErr := tokens.Save(tokensPath); saveErr != nil {
+		logging.Errorln("failed to save owner tokens:", saveErr)
+	}
+	if err != nil {
+		return errors.Join(err, printResult(res, "Share link: %s\n", link))
+	}
+	return printResult(res, "Share link: %s\n", link)
+}
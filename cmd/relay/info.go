@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+type infoResult struct {
+	files.FileMetadata
+	Link  string `json:"link"`
+	Owned bool   `json:"owned"`
+}
+
+func runInfo(args []string) error {
+	fs := newFlagSet("info", "<id|link>")
+	cf := addClientFlags(fs)
+	bundleFlag := fs.Bool("bundle", false, "List the files in a bundle, named by its ID or share link; bundle links imply it")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *bundleFlag || relay.IsBundleLink(fs.Arg(0)) {
+		return bundleInfo(cf, fs.Arg(0))
+	}
+	id, _, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	rc := cf.client()
+	meta, err := rc.GetMetadata(id)
+	if err != nil {
+		return err
+	}
+
+	tokensPath, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(tokensPath)
+	if err != nil {
+		return err
+	}
+	_, owned := tokens.Get(cf.server, id)
+
+	link := rc.ShareLink(id)
+	return printResult(
+		infoResult{meta, link, owned},
+		"%s\n", strings.Join(infoLines(meta, link, owned), "\n"),
+	)
+}
+
+// bundleInfo lists the files in a bundle, each of which can be downloaded by its ID.
+func bundleInfo(cf *clientFlags, arg string) error {
+	id, _, err := cf.resolveBundleID(arg)
+	if err != nil {
+		return err
+	}
+	rc := cf.client()
+	bundle, err := rc.GetBundle(id)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(bundle)
+	}
+
+	fmt.Printf("Bundle %s\nShare link: %s\n\n", id, rc.BundleLink(id))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSIZE")
+	for _, f := range bundle.Members {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.ID, f.Name, humanSize(f.Size))
+	}
+	return tw.Flush()
+}
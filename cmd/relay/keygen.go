@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type keygenResult struct {
+	Recipient string `json:"recipient"`
+	Path      string `json:"path,omitempty"`
+}
+
+func runKeygen(args []string) error {
+	fs := newFlagSet("keygen", "")
+	addJSONFlag(fs)
+	outFlag := fs.String("o", "", "Write the identity to this file instead of stdout")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *outFlag == "" && jsonOutput {
+		return errors.New("cannot write JSON output and the identity to stdout")
+	}
+
+	id, err := relay.NewIdentity()
+	if err != nil {
+		return err
+	}
+	recipient, err := id.Recipient()
+	if err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), recipient, id)
+
+	if *outFlag == "" {
+		fmt.Fprintln(os.Stderr, "Public key:", recipient)
+		_, err = fmt.Print(contents)
+		return err
+	}
+
+	// never overwrite an identity, since files sent to it would be lost
+	f, err := os.OpenFile(*outFlag, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	logging.Infoln("wrote identity to", *outFlag)
+
+	return printResult(keygenResult{recipient.String(), *outFlag}, "Public key: %s\n", recipient)
+}
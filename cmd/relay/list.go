@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// listSorts orders files for each -sort key, in the order the key is most useful: names A-Z,
+// and the biggest, newest, or most downloaded files first.
+var listSorts = map[string]func(a, b *files.FileMetadata) bool{
+	"name":      func(a, b *files.FileMetadata) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) },
+	"size":      func(a, b *files.FileMetadata) bool { return a.Size > b.Size },
+	"uploaded":  func(a, b *files.FileMetadata) bool { return a.Uploaded.After(b.Uploaded) },
+	"downloads": func(a, b *files.FileMetadata) bool { return a.Downloads > b.Downloads },
+}
+
+func runList(args []string) error {
+	fs := newFlagSet("list", "")
+	cf := addClientFlags(fs)
+	sortFlag := fs.String("sort", "uploaded", "Sort files by `key`: name, size, uploaded or downloads")
+	reverseFlag := fs.Bool("reverse", false, "Reverse the sort order")
+	searchFlag := fs.String("search", "", "Only list files with words in their names or tags starting with each word of this text, searched for by the server")
+	filterFlag := fs.String("filter", "", "Only list files whose names contain this text, or match it if it's a glob pattern")
+	var filter relay.ListFilter
+	fs.Var((*stringList)(&filter.Tags), "tag", "Only list files with this tag (repeatable)")
+	fs.StringVar(&filter.ContentType, "type", "", "Only list files with this content type, e.g. application/pdf or image/*")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	less, ok := listSorts[*sortFlag]
+	if !ok {
+		return fmt.Errorf("unknown sort key %q", *sortFlag)
+	}
+	match, err := nameMatcher(*filterFlag)
+	if err != nil {
+		return err
+	}
+
+	rc := cf.client()
+	var list []files.FileMetadata
+	if *searchFlag != "" {
+		list, err = rc.SearchFiles(*searchFlag, filter)
+	} else {
+		list, err = rc.ListFiles(filter)
+	}
+	if err != nil {
+		return err
+	}
+
+	filtered := list[:0]
+	for _, f := range list {
+		if match(f.Name) {
+			filtered = append(filtered, f)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if *reverseFlag {
+			return less(&filtered[j], &filtered[i])
+		}
+		return less(&filtered[i], &filtered[j])
+	})
+
+	if jsonOutput {
+		return printJSON(filtered)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSIZE\tUPLOADED\tDOWNLOADS\tEXPIRES")
+	for _, f := range filtered {
+		expires := "-"
+		if !f.Expires.IsZero() {
+			expires = relativeTime(f.Expires, now)
+		}
+		downloads := fmt.Sprint(f.Downloads)
+		if f.MaxDownloads > 0 {
+			downloads += fmt.Sprintf("/%d", f.MaxDownloads)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			f.ID, f.Name, humanSize(f.Size), relativeTime(f.Uploaded, now), downloads, expires)
+	}
+	return tw.Flush()
+}
+
+// nameMatcher returns a case-insensitive match on file names for a -filter value.
+func nameMatcher(filter string) (func(name string) bool, error) {
+	filter = strings.ToLower(filter)
+	if !strings.ContainsAny(filter, "*?[") {
+		return func(name string) bool { return strings.Contains(strings.ToLower(name), filter) }, nil
+	}
+	if _, err := path.Match(filter, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", filter, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(filter, strings.ToLower(name))
+		return ok
+	}, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"upload", "encrypt and upload a file", runUpload},
+		{"download", "download and decrypt a file", runDownload},
+		{"send", "encrypt and send a snippet of text", runSend},
+		{"receive", "download a snippet of text and print it", runReceive},
+		{"decrypt", "decrypt a file fetched some other way, such as over WebDAV", runDecrypt},
+		{"list", "list the files on a server", runList},
+		{"info", "show the details of a file without downloading it", runInfo},
+		{"delete", "delete a file uploaded from here", runDelete},
+		{"restore", "restore a deleted or expired file from the trash", runRestore},
+		{"forward", "send a file uploaded from here to another server", runForward},
+		{"rotate", "re-encrypt a file with a new password or key", runRotate},
+		{"browse", "interactively browse the files on a server", runBrowse},
+		{"mount", "mount the files on a server as a read-only directory", runMount},
+		{"remote", "save servers and their tokens to use like work:<id>", runRemote},
+		{"watch", "upload new and changed files in a directory", runWatch},
+		{"keygen", "generate a key pair for receiving files without a password", runKeygen},
+		{"bench", "measure transfer and encryption speed against a server", runBench},
+		{"serve", "run a relay server", runServe},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for help with a command.\n\n", os.Args[0])
+	fmt.Fprint(os.Stderr, exitCodeHelp)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(os.Args[2:]); err != nil {
+				if jsonOutput {
+					printJSON(errorResult{err.Error()})
+				}
+				logging.Errorln(err)
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
+
+const (
+	defaultServer = "http://localhost:8080"
+
+	serverEnv   = "RELAY_SERVER"
+	passwordEnv = "RELAY_PASSWORD"
+	tokenEnv    = "RELAY_TOKEN"
+)
+
+// clientFlags holds the flags shared by every command which talks to a relay server.
+type clientFlags struct {
+	fs *flag.FlagSet
+
+	server   string
+	pass     string
+	keyfile  string
+	identity string
+	yubikey  int
+	token    string
+	profile  string
+	access   string
+	// remote is set to the profile named by arguments like name:<id>, or by -server name:.
+	remote string
+	cfg    *config.Config
+
+	progress   progressMode
+	noProgress bool
+	http3      bool
+}
+
+func addClientFlags(fs *flag.FlagSet) *clientFlags {
+	cf := &clientFlags{fs: fs}
+	fs.StringVar(&cf.server, "server", defaultServer, "URL of the remote server, or name: of a saved remote (or set $"+serverEnv+")")
+	fs.StringVar(&cf.pass, "password", "",
+		"Password for file encryption (or set $"+passwordEnv+"; prompted for if neither is set)")
+	fs.StringVar(&cf.keyfile, "keyfile", "", "File whose contents to use as the key instead of a password")
+	fs.StringVar(&cf.identity, "identity", "", "Identity file from keygen, or SSH private key, to decrypt files sent to its public key")
+	fs.Func("yubikey", "Derive the key with the challenge-response `slot` (1 or 2) of a YubiKey instead of a password", func(s string) error {
+		slot, err := strconv.Atoi(s)
+		if err != nil || (slot != 1 && slot != 2) {
+			return errors.New("must be 1 or 2")
+		}
+		cf.yubikey = slot
+		return nil
+	})
+	fs.StringVar(&cf.token, "token", "", "Authorization token for the server (or set $"+tokenEnv+")")
+	fs.StringVar(&cf.profile, "profile", "", "Named server profile from the config file, or saved remote")
+	fs.StringVar(&cf.access, "access-password", "",
+		"Password the server requires to get the file, on top of its encryption; files uploaded with it set require it")
+	cf.progress = "bar"
+	fs.Var(&cf.progress, "progress", "Show transfer progress as `mode`: bar, json (records on stderr) or none")
+	fs.BoolVar(&cf.noProgress, "no-progress", false, "Don't show transfer progress; same as -progress=none")
+	fs.BoolFunc("http3", "Connect to the server over HTTP/3, which copes better with lossy networks (only in builds with -tags http3)", func(s string) error {
+		if !relay.HTTP3Built {
+			return errors.New("HTTP/3 isn't built in; rebuild with -tags http3")
+		}
+		cf.http3, _ = strconv.ParseBool(s)
+		return nil
+	})
+	addJSONFlag(fs)
+	return cf
+}
+
+// parse parses the command line, then fills in anything not given explicitly from the
+// environment and the config file. An explicitly selected profile takes precedence over the
+// environment; the default profile does not. Naming a remote in a target like work:<id> selects
+// it like -profile work.
+func (cf *clientFlags) parse(args []string) error {
+	cf.fs.Parse(args)
+
+	set := make(map[string]bool)
+	cf.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	envServer, envToken := os.Getenv(serverEnv), os.Getenv(tokenEnv)
+	if !set["server"] && envServer != "" {
+		cf.server = envServer
+	}
+	if !set["token"] && envToken != "" {
+		cf.token = envToken
+	}
+
+	path, err := config.DefaultPath()
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	cf.cfg = cfg
+
+	if cf.remote, err = cf.targetRemote(set); err != nil {
+		return err
+	}
+	if cf.remote != "" {
+		if cf.profile != "" && cf.profile != cf.remote {
+			return fmt.Errorf("cannot use -profile %s with %s:", cf.profile, cf.remote)
+		}
+		cf.profile = cf.remote
+		set["server"] = false
+	}
+
+	explicit := cf.profile != ""
+	if !explicit {
+		cf.profile = cfg.DefaultProfile
+	}
+	if cf.profile == "" {
+		return nil
+	}
+
+	p, err := cfg.Profile(cf.profile)
+	if err != nil {
+		return err
+	}
+	if !set["server"] && p.URL != "" && (explicit || envServer == "") {
+		cf.server = p.URL
+	}
+	if !set["token"] && p.Token != "" && (explicit || envToken == "") {
+		cf.token = p.Token
+	}
+	for name, value := range p.Options {
+		if cf.fs.Lookup(name) == nil || set[name] {
+			continue
+		}
+		if err := cf.fs.Set(name, value); err != nil {
+			return fmt.Errorf("profile %q: invalid value for %s: %w", p.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// targetRemote returns the remote, or profile, named by -server name: or by arguments like
+// name:<id>, which all have to name the same one. Arguments which only name it, like name:, are
+// dropped, so relay list work: and relay upload notes.txt work: work.
+func (cf *clientFlags) targetRemote(set map[string]bool) (string, error) {
+	var remote string
+	use := func(name string) error {
+		if remote != "" && name != remote {
+			return fmt.Errorf("cannot use both %s: and %s:", remote, name)
+		}
+		remote = name
+		return nil
+	}
+
+	if set["server"] {
+		if p, ok := cf.lookupRemote(cf.server); ok {
+			remote = p.Name
+		} else if name, ok := strings.CutSuffix(cf.server, ":"); ok {
+			return "", fmt.Errorf("no remote named %q", name)
+		}
+	}
+
+	args := make([]string, 0, cf.fs.NArg())
+	for _, arg := range cf.fs.Args() {
+		name, rest, ok := cutRemote(cf.cfg, arg)
+		if !ok {
+			args = append(args, arg)
+			continue
+		}
+		if err := use(name); err != nil {
+			return "", err
+		}
+		if rest != "" {
+			args = append(args, arg)
+		}
+	}
+	if remote != "" && set["server"] && cf.server != remote+":" {
+		return "", fmt.Errorf("cannot use -server with %s:", remote)
+	}
+	if len(args) != cf.fs.NArg() {
+		cf.fs.Parse(append([]string{"--"}, args...))
+	}
+	return remote, nil
+}
+
+// cutRemote splits an argument like name:<id> into the name of the remote, or profile, and the
+// rest of it.
+func cutRemote(cfg *config.Config, arg string) (name, rest string, ok bool) {
+	name, rest, ok = strings.Cut(arg, ":")
+	if !ok || strings.HasPrefix(rest, "//") {
+		return "", arg, false
+	}
+	_, ok = cfg.Profiles[name]
+	return name, rest, ok
+}
+
+// lookupRemote returns the remote, or profile, named by a server given like name:.
+func (cf *clientFlags) lookupRemote(server string) (*config.Profile, bool) {
+	name, rest, ok := cutRemote(cf.cfg, server)
+	if !ok || rest != "" {
+		return nil, false
+	}
+	return cf.cfg.Profiles[name], true
+}
+
+func (cf *clientFlags) client() relay.RelayClient {
+	rc := relay.NewClient(cf.server)
+	rc.Token = cf.token
+	rc.AccessPassword = cf.access
+	if cf.http3 {
+		// -http3 is refused unless HTTP/3 is built in, which is all UseHTTP3 can fail for
+		rc.UseHTTP3()
+	}
+	switch {
+	case cf.noProgress || cf.progress == "none":
+	case cf.progress == "json":
+		rc.Progress = newJSONProgress
+	default:
+		rc.Progress = newTerminalProgress
+	}
+	return rc
+}
+
+// secret returns the keyfile, identity or YubiKey if one was given, or otherwise the password from the
+// command line or environment, prompting for it if neither is set.
+func (cf *clientFlags) secret(confirm bool) (relay.Secret, error) {
+	keys := 0
+	for _, set := range []bool{cf.keyfile != "", cf.identity != "", cf.yubikey != 0} {
+		if set {
+			keys++
+		}
+	}
+	if keys > 1 {
+		return nil, errors.New("only one of -keyfile, -identity and -yubikey can be used")
+	}
+	if keys == 1 {
+		if cf.pass != "" {
+			return nil, errors.New("cannot use a password with -keyfile, -identity or -yubikey")
+		}
+		switch {
+		case cf.identity != "":
+			return readIdentity(cf.identity)
+		case cf.yubikey != 0:
+			return relay.YubiKey(cf.yubikey), nil
+		}
+		return relay.ReadKeyfile(cf.keyfile)
+	}
+	if cf.pass != "" {
+		return relay.Password(cf.pass), nil
+	}
+	if env := os.Getenv(passwordEnv); env != "" {
+		return relay.Password(env), nil
+	}
+	pass, err := promptPassword(confirm)
+	return relay.Password(pass), err
+}
+
+// readIdentity reads an identity file from keygen, or an SSH private key, asking for its
+// passphrase if it has one.
+func readIdentity(path string) (relay.Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !relay.IsSSHPrivateKey(data) {
+		return relay.ReadIdentity(path)
+	}
+	return relay.ReadSSHIdentity(path, func() ([]byte, error) {
+		pass, err := readPassword("Passphrase for " + path + ": ")
+		return []byte(pass), err
+	})
+}
+
+// resolveID accepts either a file ID, optionally after the name of a remote like work:<id>, or a
+// share link. A link's server replaces the configured one, and any secret embedded in it is
+// returned.
+func (cf *clientFlags) resolveID(arg string) (id files.FileID, secret string, err error) {
+	return cf.resolveLink(arg, "file", relay.ParseShareLink)
+}
+
+// resolveBundleID is like resolveID, for a bundle ID or a bundle's share link.
+func (cf *clientFlags) resolveBundleID(arg string) (id files.FileID, secret string, err error) {
+	return cf.resolveLink(arg, "bundle", relay.ParseBundleLink)
+}
+
+func (cf *clientFlags) resolveLink(
+	arg, kind string, parse func(string) (string, files.FileID, string, error),
+) (id files.FileID, secret string, err error) {
+	if !strings.Contains(arg, "://") {
+		if cf.remote != "" {
+			arg = strings.TrimPrefix(arg, cf.remote+":")
+		}
+		if id, err = files.ParseFileID(arg); err != nil {
+			return id, "", fmt.Errorf("%q is not a %s ID or share link", arg, kind)
+		}
+		return id, "", nil
+	}
+
+	server, id, secret, err := parse(arg)
+	if err != nil {
+		return id, "", err
+	}
+	// don't send this profile's token to some other server
+	if server != strings.TrimRight(cf.server, "/") {
+		cf.token = ""
+	}
+	cf.server = server
+	return id, secret, nil
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\nFlags:\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	fs.Var(logLevelFlag(logging.LevelError), "q", "Only log errors")
+	fs.Var(logLevelFlag(logging.LevelError), "quiet", "Only log errors")
+	fs.Var(logLevelFlag(logging.LevelDebug), "v", "Log extra detail for debugging")
+	fs.Var(logLevelFlag(logging.LevelDebug), "verbose", "Log extra detail for debugging")
+	return fs
+}
+
+// progressMode is a flag value selecting how transfer progress is shown.
+type progressMode string
+
+func (m *progressMode) Set(s string) error {
+	switch s {
+	case "bar", "json", "none":
+		*m = progressMode(s)
+		return nil
+	}
+	return errors.New("must be bar, json or none")
+}
+
+func (m *progressMode) String() string {
+	return string(*m)
+}
+
+// logLevelFlag is a boolean flag which sets the log level when it's given.
+type logLevelFlag logging.Level
+
+func (l logLevelFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		logging.SetLevel(logging.Level(l))
+	}
+	return nil
+}
+
+func (l logLevelFlag) String() string {
+	return "false"
+}
+
+func (l logLevelFlag) IsBoolFlag() bool {
+	return true
+}
+
+// stringList is a flag value which collects every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
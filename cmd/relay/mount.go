@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/fuse"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+func runMount(args []string) error {
+	fs := newFlagSet("mount", "<dir>")
+	cf := addClientFlags(fs)
+	var filter relay.ListFilter
+	fs.Var((*stringList)(&filter.Tags), "tag", "Only include files with this tag (repeatable)")
+	fs.StringVar(&filter.ContentType, "type", "", "Only include files with this content type, e.g. application/pdf or image/*")
+	refreshFlag := fs.Duration("refresh", 30*time.Second, "How long to cache the list of files for before asking the server again")
+	allowOtherFlag := fs.Bool("allow-other", false, "Let other users read the mounted files (needs user_allow_other in /etc/fuse.conf unless run as root)")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	dir := fs.Arg(0)
+
+	secret, err := cf.secret(false)
+	if err != nil {
+		return err
+	}
+	// the files are only fetched as they're read, and nobody's watching a progress bar for that
+	cf.noProgress = true
+	m := &mountedFiles{rc: cf.client(), secret: secret, filter: filter, opened: make(map[string]*openedFile)}
+
+	conn, err := fuse.Mount(dir, m.list, fuse.Options{Name: "relay", AllowOther: *allowOtherFlag, Refresh: *refreshFlag})
+	if err != nil {
+		return err
+	}
+	logging.Infoln("mounted", cf.server, "at", dir)
+	if !jsonOutput {
+		fmt.Fprintf(os.Stderr, "Mounted %s at %s; unmount it or press Ctrl-C to stop\n", cf.server, dir)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range sigs {
+			if err := conn.Unmount(); err != nil {
+				logging.Errorln("failed to unmount:", err)
+			}
+		}
+	}()
+	return conn.Serve()
+}
+
+// mountedFiles lists and opens the files on a server for relay mount.
+type mountedFiles struct {
+	rc     relay.RelayClient
+	secret relay.Secret
+	filter relay.ListFilter
+
+	mu sync.Mutex
+	// opened holds the files which have been opened by their fuse.File keys, since deriving their
+	// keys is slow.
+	opened map[string]*openedFile
+}
+
+type openedFile struct {
+	once sync.Once
+	ra   *crypto.ReaderAt
+	err  error
+}
+
+// list lists the files on the server under their names, which are followed by their IDs when
+// more than one has the same name.
+func (m *mountedFiles) list() ([]fuse.File, error) {
+	list, err := m.rc.ListFiles(m.filter)
+	if err != nil {
+		return nil, err
+	}
+	count := make(map[string]int, len(list))
+	for i := range list {
+		list[i].Name = mountName(list[i].Name)
+		count[list[i].Name]++
+	}
+
+	out := make([]fuse.File, 0, len(list))
+	for _, meta := range list {
+		name := meta.Name
+		if count[name] > 1 {
+			name += " (" + meta.ID.String() + ")"
+		}
+		// a replaced file is a new one, with new contents
+		key := meta.ID.String() + "@" + strconv.FormatInt(meta.Uploaded.UnixNano(), 36)
+		id := meta.ID
+		out = append(out, fuse.File{
+			Key:     key,
+			Name:    name,
+			Size:    int64(meta.Size),
+			ModTime: meta.Uploaded,
+			Open:    func() (io.ReaderAt, error) { return m.open(key, id) },
+		})
+	}
+	return out, nil
+}
+
+// mountName is a file's name from its metadata as it can be in a directory.
+func mountName(name string) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "." || name == ".." {
+		name = strings.Repeat("_", len(name))
+	}
+	return name
+}
+
+// open gives random access to the decrypted contents of the file, fetching and decrypting the
+// chunks which are read, and keeps it for the next time the file's opened.
+func (m *mountedFiles) open(key string, id files.FileID) (io.ReaderAt, error) {
+	m.mu.Lock()
+	o, ok := m.opened[key]
+	if !ok {
+		o = &openedFile{}
+		m.opened[key] = o
+	}
+	m.mu.Unlock()
+
+	o.once.Do(func() {
+		logging.Infoln("opening file", id)
+		o.ra, _, o.err = m.rc.OpenFile(id, m.secret)
+	})
+	if o.err != nil {
+		// so it's tried again next time, in case it was the network
+		m.mu.Lock()
+		if m.opened[key] == o {
+			delete(m.opened, key)
+		}
+		m.mu.Unlock()
+		if errors.Is(o.err, relay.ErrWrongPassword) || errors.Is(o.err, relay.ErrAccessDenied) {
+			return nil, fmt.Errorf("%w: %w", os.ErrPermission, o.err)
+		} else if errors.Is(o.err, relay.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %w", os.ErrNotExist, o.err)
+		}
+		return nil, o.err
+	}
+	return o.ra, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/qr"
+)
+
+// jsonOutput makes commands write their results to stdout as JSON. Logs and progress output
+// always go to stderr.
+var jsonOutput bool
+
+func addJSONFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&jsonOutput, "json", false, "Write results to stdout as JSON")
+}
+
+type errorResult struct {
+	Error string `json:"error"`
+}
+
+type uploadResult struct {
+	Path     string               `json:"path"`
+	ID       files.FileID         `json:"id,omitempty"`
+	Link     string               `json:"link,omitempty"`
+	Metadata *files.FileMetadata  `json:"metadata,omitempty"`
+	Stats    *relay.TransferStats `json:"stats,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+type bundleResult struct {
+	ID    files.FileID   `json:"id"`
+	Link  string         `json:"link"`
+	Files []uploadResult `json:"files"`
+}
+
+type downloadResult struct {
+	ID       files.FileID        `json:"id"`
+	Path     string              `json:"path,omitempty"`
+	Metadata files.FileMetadata  `json:"metadata"`
+	Stats    relay.TransferStats `json:"stats"`
+}
+
+func newDownloadResult(path string, res relay.DownloadResult) downloadResult {
+	return downloadResult{res.ID, path, res.FileMetadata, res.Stats}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printResult writes v as JSON in JSON mode, or the human-readable text otherwise.
+func printResult(v interface{}, human string, args ...interface{}) error {
+	if jsonOutput {
+		return printJSON(v)
+	}
+	_, err := fmt.Printf(human, args...)
+	return err
+}
+
+// printQR renders a QR code of text to stdout, or to stderr if stdout is reserved for JSON.
+func printQR(text string) error {
+	code, err := qr.Encode([]byte(text), qr.Medium)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if jsonOutput {
+		out = os.Stderr
+	}
+	_, err = fmt.Fprint(out, code)
+	return err
+}
+
+// newTerminalProgress draws a progress bar on stderr.
+func newTerminalProgress(description string, total int64) relay.Progress {
+	return terminalProgress{progressbar.NewOptions64(
+		total,
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetRenderBlankState(true),
+	)}
+}
+
+type terminalProgress struct {
+	*progressbar.ProgressBar
+}
+
+func (p terminalProgress) Update(bytes int64) {
+	p.ProgressBar.Set64(bytes)
+}
+
+func (p terminalProgress) Finish() error {
+	err := p.ProgressBar.Finish()
+	// progressbar doesn't print a newline when it finishes; do it ourselves
+	fmt.Fprintln(os.Stderr)
+	return err
+}
+
+// progressInterval is how often JSON progress records are written during a transfer.
+const progressInterval = 250 * time.Millisecond
+
+type progressRecord struct {
+	Progress string `json:"progress"`
+	Bytes    int64  `json:"bytes"`
+	Total    int64  `json:"total"`
+	Done     bool   `json:"done,omitempty"`
+}
+
+// jsonProgress writes transfer progress to stderr as one JSON object per line.
+type jsonProgress struct {
+	record progressRecord
+	last   time.Time
+}
+
+func newJSONProgress(description string, total int64) relay.Progress {
+	p := &jsonProgress{record: progressRecord{Progress: strings.ToLower(description), Total: total}}
+	p.emit()
+	return p
+}
+
+func (p *jsonProgress) emit() {
+	p.last = time.Now()
+	json.NewEncoder(os.Stderr).Encode(p.record)
+}
+
+func (p *jsonProgress) Update(bytes int64) {
+	p.record.Bytes = bytes
+	if time.Since(p.last) >= progressInterval {
+		p.emit()
+	}
+}
+
+func (p *jsonProgress) Finish() error {
+	p.record.Done = true
+	p.emit()
+	return nil
+}
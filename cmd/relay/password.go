@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/bfrengley/relay"
+)
+
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		// allow piping a password in when there's no terminal to prompt on
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// promptPassword asks for a password interactively, optionally requiring it to be entered twice.
+func promptPassword(confirm bool) (string, error) {
+	return promptNamedPassword("Password", confirm)
+}
+
+// promptNamedPassword is promptPassword with the prompt naming which password it wants.
+func promptNamedPassword(name string, confirm bool) (string, error) {
+	pass, err := readPassword(name + ": ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("password cannot be empty")
+	}
+
+	if confirm && term.IsTerminal(int(os.Stdin.Fd())) {
+		again, err := readPassword("Confirm " + strings.ToLower(name) + ": ")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", errors.New("passwords do not match")
+		}
+	}
+	return pass, nil
+}
+
+// weakPasswordMode is what to do with a password weaker than relay.MinPasswordEntropy.
+type weakPasswordMode string
+
+func (m *weakPasswordMode) Set(s string) error {
+	switch s {
+	case "warn", "refuse", "allow":
+		*m = weakPasswordMode(s)
+		return nil
+	}
+	return errors.New("must be warn, refuse or allow")
+}
+
+func (m *weakPasswordMode) String() string {
+	return string(*m)
+}
+
+func addWeakPasswordFlag(fs *flag.FlagSet) *weakPasswordMode {
+	mode := weakPasswordMode("warn")
+	fs.Var(&mode, "weak-password", "What to do when encrypting with a weak password: warn, refuse or allow")
+	return &mode
+}
+
+// checkPassword warns about or refuses a password that's too weak to survive being guessed
+// offline by anyone who gets the encrypted file.
+func checkPassword(pass relay.Password, mode weakPasswordMode) error {
+	bits := pass.Entropy()
+	if mode == "allow" || bits >= relay.MinPasswordEntropy {
+		return nil
+	}
+
+	msg := fmt.Sprintf("the password is weak (about %.0f bits of entropy, where %d are recommended), "+
+		"so anyone who gets the file could guess it", bits, relay.MinPasswordEntropy)
+	if mode == "refuse" {
+		return errors.New(msg + "; use a longer, more random password, or -weak-password=warn")
+	}
+	fmt.Fprintln(os.Stderr, "Warning:", msg)
+	return nil
+}
+
+// confirm asks a yes/no question on the terminal, defaulting to no.
+func confirm(prompt string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("cannot ask for confirmation without a terminal (use -force)")
+	}
+
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return false, err
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type remoteResult struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Token is whether the remote has a token, which isn't shown.
+	Token   bool     `json:"token"`
+	Options []string `json:"options,omitempty"`
+}
+
+func runRemote(args []string) error {
+	if len(args) == 0 {
+		remoteUsage()
+		os.Exit(exitUsage)
+	}
+	switch args[0] {
+	case "add":
+		return runRemoteAdd(args[1:])
+	case "list", "ls":
+		return runRemoteList(args[1:])
+	case "remove", "rm":
+		return runRemoteRemove(args[1:])
+	case "-h", "-help", "--help", "help":
+		remoteUsage()
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "unknown remote command %q\n\n", args[0])
+	remoteUsage()
+	os.Exit(exitUsage)
+	return nil
+}
+
+func remoteUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: %[1]s remote <command> [flags] [args]
+
+Saved remotes are servers along with their tokens and default flags, which any command can use
+by naming them before a file ID, like work:<id>, or with -server work:.
+
+Commands:
+  add        save a remote: %[1]s remote add <name> <url> [-token token]
+  list       list the saved remotes
+  remove     forget a saved remote
+`, os.Args[0])
+}
+
+func runRemoteAdd(args []string) error {
+	fs := newFlagSet("remote add", "<name> <url>")
+	addJSONFlag(fs)
+	tokenFlag := fs.String("token", "", "Authorization token for the server (or set $"+tokenEnv+")")
+	var options stringList
+	fs.Var(&options, "option", "Default for a flag when using the remote, like access-password=secret (repeatable)")
+	forceFlag := fs.Bool("force", false, "Replace the remote if there's already one with the same name")
+	args = parseInterspersed(fs, args)
+
+	if len(args) != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	name, server := args[0], strings.TrimRight(args[1], "/")
+	if err := config.ValidateRemoteName(name); err != nil {
+		return err
+	}
+	if u, err := url.Parse(server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", args[1])
+	}
+
+	r := config.Remote{URL: server, Token: *tokenFlag}
+	if r.Token == "" {
+		r.Token = os.Getenv(tokenEnv)
+	}
+	for _, opt := range options {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("-option %q should be like name=value", opt)
+		}
+		if k == "server" || k == "token" || k == "profile" {
+			return fmt.Errorf("-option cannot set %s", k)
+		}
+		if r.Options == nil {
+			r.Options = make(map[string]string)
+		}
+		r.Options[strings.TrimLeft(k, "-")] = v
+	}
+
+	configPath, err := config.DefaultPath()
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	path, err := config.RemotesPath()
+	if err != nil {
+		return err
+	}
+	remotes, err := config.LoadRemotes(path)
+	if err != nil {
+		return err
+	}
+	// the config file's profiles would take precedence over the remote
+	if p, ok := cfg.Profiles[name]; ok && !p.Remote {
+		return fmt.Errorf("%s already has a profile named %q", configPath, name)
+	}
+	if _, ok := remotes[name]; ok && !*forceFlag {
+		return fmt.Errorf("there's already a remote named %q; use -force to replace it", name)
+	}
+
+	remotes[name] = r
+	if err = remotes.Save(path); err != nil {
+		return err
+	}
+	logging.Infoln("saved remote", name, "for", server)
+
+	if jsonOutput {
+		return printJSON(newRemoteResult(name, r))
+	}
+	fmt.Printf("Saved %s for %s; use it like %s:<id> or -server %s:\n", name, server, name, name)
+	return nil
+}
+
+func runRemoteList(args []string) error {
+	fs := newFlagSet("remote list", "")
+	addJSONFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	path, err := config.RemotesPath()
+	if err != nil {
+		return err
+	}
+	remotes, err := config.LoadRemotes(path)
+	if err != nil {
+		return err
+	}
+
+	results := make([]remoteResult, 0, len(remotes))
+	for _, name := range remotes.Names() {
+		results = append(results, newRemoteResult(name, remotes[name]))
+	}
+	if jsonOutput {
+		return printJSON(results)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tURL\tTOKEN\tOPTIONS")
+	for _, r := range results {
+		token, options := "-", "-"
+		if r.Token {
+			token = "yes"
+		}
+		if len(r.Options) > 0 {
+			options = strings.Join(r.Options, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, r.URL, token, options)
+	}
+	return tw.Flush()
+}
+
+func runRemoteRemove(args []string) error {
+	fs := newFlagSet("remote remove", "<name>")
+	addJSONFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	name := fs.Arg(0)
+
+	path, err := config.RemotesPath()
+	if err != nil {
+		return err
+	}
+	remotes, err := config.LoadRemotes(path)
+	if err != nil {
+		return err
+	}
+	r, ok := remotes[name]
+	if !ok {
+		return fmt.Errorf("no remote named %q", name)
+	}
+
+	delete(remotes, name)
+	if err = remotes.Save(path); err != nil {
+		return err
+	}
+	logging.Infoln("removed remote", name)
+
+	if jsonOutput {
+		return printJSON(newRemoteResult(name, r))
+	}
+	fmt.Printf("Removed %s (%s)\n", name, r.URL)
+	return nil
+}
+
+// newRemoteResult describes a remote without giving away its token, or the values of its
+// options, which can be passwords.
+func newRemoteResult(name string, r config.Remote) remoteResult {
+	res := remoteResult{Name: name, URL: r.URL, Token: r.Token != ""}
+	for k := range r.Options {
+		res.Options = append(res.Options, k)
+	}
+	sort.Strings(res.Options)
+	return res
+}
+
+// parseInterspersed parses flags given before, between or after the positional arguments, as in
+// relay remote add work https://relay.example -token ..., and returns the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		// everything after -- is positional
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
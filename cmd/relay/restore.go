@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type restoreResult struct {
+	ID       files.FileID `json:"id"`
+	Restored bool         `json:"restored"`
+}
+
+func runRestore(args []string) error {
+	fs := newFlagSet("restore", "<id|link>")
+	cf := addClientFlags(fs)
+	ownerFlag := fs.String("owner-token", "", "Owner token for the file (default the one saved when it was uploaded)")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	id, _, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	token := *ownerFlag
+	if token == "" {
+		tokensPath, err := config.OwnerTokensPath()
+		if err != nil {
+			return err
+		}
+		tokens, err := config.LoadOwnerTokens(tokensPath)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		// the server's auth token can restore any file, so carry on without one
+		if token, ok = tokens.Get(cf.server, id); !ok && cf.token == "" {
+			return fmt.Errorf("no owner token saved for %s; only files uploaded from here can be restored", id)
+		}
+	}
+
+	rc := cf.client()
+	if err = rc.RestoreFile(id, token); err != nil {
+		return err
+	}
+	logging.Infoln("restored file", id)
+	return printResult(restoreResult{id, true}, "Restored %s\n", id)
+}
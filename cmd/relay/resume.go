@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// transferState records uploads and downloads in progress, so they can be continued with -resume
+// if they're interrupted.
+type transferState struct {
+	// Uploads are keyed by transferKey.
+	Uploads map[string]relay.UploadState `json:"uploads,omitempty"`
+	// Downloads are keyed by the absolute path of the partially downloaded file.
+	Downloads map[string]downloadState `json:"downloads,omitempty"`
+
+	path string
+	// mu guards Uploads and saving while files are uploaded in parallel.
+	mu sync.Mutex
+}
+
+type downloadState struct {
+	Server string       `json:"server"`
+	ID     files.FileID `json:"id"`
+	// Hash saves hashing what's already been downloaded again when it's resumed.
+	Hash *relay.HashCheckpoint `json:"hash,omitempty"`
+}
+
+func transferKey(server, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(server, "/") + " " + abs, nil
+}
+
+func loadTransferState() (*transferState, error) {
+	path, err := config.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	state := &transferState{
+		Uploads:   make(map[string]relay.UploadState),
+		Downloads: make(map[string]downloadState),
+		path:      filepath.Join(filepath.Dir(path), "transfers.json"),
+	}
+
+	data, err := os.ReadFile(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes the state back to disk, readable only by the current user since uploads include
+// their owner tokens.
+func (s *transferState) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *transferState) upload(key string) (relay.UploadState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Uploads[key]
+	return u, ok
+}
+
+// setUpload records an upload, or forgets it if u is nil, and saves the state.
+func (s *transferState) setUpload(key string, u *relay.UploadState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u == nil {
+		delete(s.Uploads, key)
+	} else {
+		s.Uploads[key] = *u
+	}
+	return s.save()
+}
+
+// downloadCheckpoints keeps the hash checkpoints of the download to the partial file key.
+type downloadCheckpoints struct {
+	state *transferState
+	key   string
+}
+
+func (c downloadCheckpoints) Load() (relay.HashCheckpoint, bool) {
+	d := c.state.Downloads[c.key]
+	if d.Hash == nil {
+		return relay.HashCheckpoint{}, false
+	}
+	return *d.Hash, true
+}
+
+func (c downloadCheckpoints) Save(cp relay.HashCheckpoint) error {
+	d := c.state.Downloads[c.key]
+	d.Hash = &cp
+	c.state.Downloads[c.key] = d
+	return c.state.save()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+type rotateResult struct {
+	ID       files.FileID        `json:"id"`
+	Link     string              `json:"link"`
+	Replaced bool                `json:"replaced"`
+	Metadata *files.FileMetadata `json:"metadata"`
+}
+
+func runRotate(args []string) error {
+	fs := newFlagSet("rotate", "<id|link>")
+	cf := addClientFlags(fs)
+	newPassFlag := fs.String("new-password", "", "Password to re-encrypt the file with (prompted for if no new key is given)")
+	newKeyfileFlag := fs.String("new-keyfile", "", "File whose contents to re-encrypt the file with instead of a password")
+	recipientFlag := fs.String("recipient", "",
+		"Re-encrypt to this public key from keygen instead of a password, or to an SSH public key given inline, in a file, or at a URL")
+	replaceFlag := fs.Bool("replace", false,
+		"Replace the file, keeping its ID so existing links still work, instead of uploading a new copy")
+	ownerFlag := fs.String("owner-token", "", "With -replace, owner token for the file (default the one saved when it was uploaded)")
+	var opts relay.UploadOptions
+	fs.DurationVar(&opts.Expires, "expires", 0, "Delete the file from the server after this long (default what's left of the old file's expiry)")
+	fs.UintVar(&opts.MaxDownloads, "max-downloads", 0,
+		"Delete the file from the server after this many downloads (default what's left of the old file's limit)")
+	addScryptFlag(fs, &opts.Scrypt)
+	addCipherFlag(fs, &opts.Cipher)
+	weakFlag := addWeakPasswordFlag(fs)
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.Expires < 0 {
+		return errors.New("-expires must be positive")
+	}
+
+	id, embedded, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	tokensPath, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(tokensPath)
+	if err != nil {
+		return err
+	}
+	if *replaceFlag {
+		opts.Replace, opts.OwnerToken = id, *ownerFlag
+		if opts.OwnerToken == "" {
+			var ok bool
+			if opts.OwnerToken, ok = tokens.Get(cf.server, id); !ok {
+				return fmt.Errorf("no owner token saved for %s; only files uploaded from here can be replaced", id)
+			}
+		}
+	} else if *ownerFlag != "" {
+		return errors.New("-owner-token can only be used with -replace")
+	}
+
+	var oldSecret relay.Secret = relay.Password(embedded)
+	if embedded == "" {
+		if oldSecret, err = cf.secret(false); err != nil {
+			return err
+		}
+	}
+
+	newSecret, err := rotateSecret(*newPassFlag, *newKeyfileFlag, *recipientFlag)
+	if err != nil {
+		return err
+	}
+	if pass, ok := newSecret.(relay.Password); ok {
+		if old, ok := oldSecret.(relay.Password); ok && old == pass {
+			return errors.New("the new password is the same as the old one")
+		}
+		if err = checkPassword(pass, *weakFlag); err != nil {
+			return err
+		}
+	}
+
+	rc := cf.client()
+	res, err := rc.RotateKey(id, oldSecret, newSecret, opts)
+	if err != nil {
+		return err
+	}
+	if !*replaceFlag {
+		if err = saveOwnerToken(cf.server, res.ID, res.OwnerToken); err != nil {
+			return fmt.Errorf("failed to save owner token for %s: %w", res.ID, err)
+		}
+	}
+
+	link := rc.ShareLink(res.ID)
+	result := rotateResult{res.ID, link, *replaceFlag, &res.FileMetadata}
+	if *replaceFlag {
+		return printResult(result, "Re-encrypted %s in place\nShare link: %s\n", res.ID, link)
+	}
+	return printResult(result,
+		"Re-encrypted %s as %s\nShare link: %s\nThe old file is still on the server; delete it with '%s delete %s'\n",
+		id, res.ID, link, os.Args[0], id)
+}
+
+// rotateSecret returns the secret to re-encrypt a file with, asking for a new password if no
+// other key was given.
+func rotateSecret(pass, keyfile, recipient string) (relay.Secret, error) {
+	given := 0
+	for _, s := range []string{pass, keyfile, recipient} {
+		if s != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, errors.New("only one of -new-password, -new-keyfile and -recipient can be used")
+	}
+
+	switch {
+	case recipient != "":
+		return parseRecipient(recipient)
+	case keyfile != "":
+		return relay.ReadKeyfile(keyfile)
+	case pass != "":
+		return relay.Password(pass), nil
+	}
+	p, err := promptNamedPassword("New password", true)
+	return relay.Password(p), err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/web"
+)
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "")
+	portFlag := fs.String("port", "8080", "Port to listen on")
+	hostFlag := fs.String("host", "", "Address to bind to (default all interfaces)")
+	storageFlag := fs.String("storage", "", "Directory to store file contents in (default in memory, which limits files to the memory available)")
+	ipfsFlag := fs.String("ipfs-api", "", "URL of an IPFS node's RPC API, e.g. http://127.0.0.1:5001, to store file contents in instead of -storage")
+	mmapFlag := fs.Bool("mmap", false, "Serve files from -storage by mapping them into memory, which saves copying them for TLS and HTTP/2 downloads")
+	maxFilesFlag := fs.Int("max-files", 0, "Maximum number of files to hold at once (0 for no limit)")
+	certFlag := fs.String("tls-cert", "", "TLS certificate file; enables HTTPS with -tls-key")
+	keyFlag := fs.String("tls-key", "", "TLS private key file")
+	h2cFlag := fs.Bool("h2c", false, "Serve HTTP/2 without TLS too (with prior knowledge), for a trusted proxy which terminates TLS in front of the server")
+	http3Flag := fs.Bool("http3", false, "Serve HTTP/3 over QUIC as well, on the same port over UDP, which needs -tls-cert (only in builds with -tags http3)")
+	davFlag := fs.Bool("webdav", false, "Serve the files which are listed read-only over WebDAV at /dav/, still encrypted, for relay decrypt to decrypt")
+	webFlag := fs.Bool("web", false, "Serve a web UI at / which encrypts and decrypts files in the browser")
+	tokenFlag := fs.String("auth-token", "", "Token clients must present to upload files (or set $RELAY_AUTH_TOKEN)")
+	trashFlag := fs.Duration("trash-period", 24*time.Hour, "How long deleted and expired files can be restored for before they're purged (0 to purge them straight away)")
+	var maxSize byteSize
+	fs.Var(&maxSize, "max-size", "Maximum size of an uploaded file, e.g. 500MB (0 for no limit)")
+	var maxChunkSize byteSize
+	fs.Var(&maxChunkSize, "max-chunk-size", "Largest chunk size files can be uploaded in, e.g. 4MiB, which bounds each upload's buffer (default 16MiB)")
+	var memoryBudget byteSize
+	fs.Var(&memoryBudget, "memory-budget", "Most memory to commit to file contents and upload buffers, e.g. 2GiB; new files are refused with 503 beyond it (0 for no limit)")
+	var downloadRate, egressRate byteSize
+	fs.Var(&downloadRate, "download-rate", "Most bytes a second to send each download, e.g. 10MB (0 for no limit)")
+	fs.Var(&egressRate, "egress-rate", "Most bytes a second to send all downloads together, shared evenly between them, e.g. 100MB (0 for no limit)")
+	var forwardTo stringList
+	fs.Var(&forwardTo, "forward-to", "URL of a server the owners of files can forward them to, or * for any (repeatable)")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *mmapFlag && *storageFlag == "" {
+		return errors.New("-mmap needs -storage, since files in memory are already served from memory")
+	}
+	if maxChunkSize > files.MaxChunkSize {
+		return fmt.Errorf("-max-chunk-size must be at most %s", humanSize(files.MaxChunkSize))
+	}
+
+	var ui http.Handler
+	if *webFlag {
+		if !web.Built() {
+			return errors.New("the web UI's WebAssembly client isn't built in; run go generate ./internal/web and rebuild")
+		}
+		ui = web.Handler("/web")
+	}
+
+	token := *tokenFlag
+	if token == "" {
+		token = os.Getenv("RELAY_AUTH_TOKEN")
+	}
+
+	rs, err := relay.NewServer(relay.ServerConfig{
+		Addr:         *hostFlag + ":" + *portFlag,
+		StorageDir:   *storageFlag,
+		MapFiles:     *mmapFlag,
+		IPFSAPI:      *ipfsFlag,
+		MaxFileSize:  uint64(maxSize),
+		MaxFiles:     *maxFilesFlag,
+		MaxChunkSize: uint32(maxChunkSize),
+		MemoryBudget: uint64(memoryBudget),
+		DownloadRate: uint64(downloadRate),
+		EgressRate:   uint64(egressRate),
+		AuthToken:    token,
+		TrashPeriod:  *trashFlag,
+		TLSCertFile:  *certFlag,
+		TLSKeyFile:   *keyFlag,
+		H2C:          *h2cFlag,
+		HTTP3:        *http3Flag,
+		ForwardTo:    forwardTo,
+		WebDAV:       *davFlag,
+		WebUI:        ui,
+	})
+	if err != nil {
+		return err
+	}
+	return rs.ListenAndServe()
+}
+
+// byteSize is a flag value accepting sizes like "512", "64KB", or "1.5GiB".
+type byteSize uint64
+
+var sizeUnits = []struct {
+	suffix string
+	mult   float64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *byteSize) Set(s string) error {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	mult := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str, mult = strings.TrimSpace(strings.TrimSuffix(str, u.suffix)), u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/clipboard"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// snippetName is the file name text snippets are uploaded under.
+const snippetName = "snippet.txt"
+
+func runSend(args []string) error {
+	fs := newFlagSet("send", "")
+	cf := addClientFlags(fs)
+	textFlag := fs.String("text", "", "Text to send (default read from stdin)")
+	clipboardFlag := fs.Bool("clipboard", false, "Send the contents of the clipboard")
+	copyFlag := fs.Bool("copy", false, "Copy the share link to the clipboard")
+	embedFlag := fs.Bool("embed-password", false,
+		"Embed the password in the share link, so anyone with the link can read the text without it")
+	var opts relay.UploadOptions
+	fs.DurationVar(&opts.Expires, "expires", 0, "Delete the text from the server after this long, e.g. 24h")
+	fs.UintVar(&opts.MaxDownloads, "max-downloads", 0, "Delete the text from the server after this many downloads")
+	addScryptFlag(fs, &opts.Scrypt)
+	addCipherFlag(fs, &opts.Cipher)
+	weakFlag := addWeakPasswordFlag(fs)
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 || cf.server == "" || (*textFlag != "" && *clipboardFlag) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.Expires < 0 {
+		return errors.New("-expires must be positive")
+	}
+
+	// the password prompt would compete with the text for stdin
+	if *textFlag == "" && !*clipboardFlag && cf.pass == "" && cf.keyfile == "" && cf.yubikey == 0 && os.Getenv(passwordEnv) == "" {
+		return errors.New("a password must be given with -password or $" + passwordEnv + " when sending from stdin")
+	}
+
+	text := *textFlag
+	if *clipboardFlag {
+		var err error
+		if text, err = clipboard.Paste(); err != nil {
+			return err
+		}
+	} else if text == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return errors.New("nothing to send")
+	}
+
+	secret, err := cf.secret(true)
+	if err != nil {
+		return err
+	}
+	pass, isPassword := secret.(relay.Password)
+	if *embedFlag && !isPassword {
+		return errors.New("-embed-password can't be used with -keyfile")
+	}
+	if isPassword {
+		if err = checkPassword(pass, *weakFlag); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.MkdirTemp("", "relay-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, snippetName)
+	if err = os.WriteFile(path, []byte(text), 0600); err != nil {
+		return err
+	}
+
+	rc := cf.client()
+	res, err := rc.UploadFile(path, secret, opts)
+	if err != nil {
+		return err
+	}
+	if err = saveOwnerToken(cf.server, res.ID, res.OwnerToken); err != nil {
+		logging.Errorln("failed to save owner token for", res.ID.String()+":", err)
+	}
+
+	link := rc.ShareLink(res.ID)
+	if *embedFlag {
+		link = rc.ShareLinkWithSecret(res.ID, string(pass))
+	}
+	if *copyFlag {
+		if err = clipboard.Copy(link); err != nil {
+			return err
+		}
+		logging.Infoln("copied the share link to the clipboard")
+	}
+	return printResult(
+		uploadResult{Path: snippetName, ID: res.ID, Link: link, Metadata: &res.FileMetadata, Stats: &res.Stats},
+		"Sent %d bytes as %s\nShare link: %s\n", len(text), res.ID, link,
+	)
+}
+
+type receiveResult struct {
+	ID   files.FileID `json:"id"`
+	Text string       `json:"text"`
+}
+
+func runReceive(args []string) error {
+	fs := newFlagSet("receive", "<id|link>")
+	cf := addClientFlags(fs)
+	copyFlag := fs.Bool("copy", false, "Copy the text to the clipboard instead of printing it")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	id, linkSecret, err := cf.resolveID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var secret relay.Secret = relay.Password(linkSecret)
+	if linkSecret == "" {
+		if secret, err = cf.secret(false); err != nil {
+			return err
+		}
+	}
+
+	rc := cf.client()
+	_, data, err := rc.DownloadFile(id, secret)
+	if err != nil {
+		return err
+	}
+
+	if *copyFlag {
+		if err = clipboard.Copy(string(data)); err != nil {
+			return err
+		}
+		logging.Infoln("copied", len(data), "bytes to the clipboard")
+		return nil
+	}
+	if jsonOutput {
+		return printJSON(receiveResult{id, string(data)})
+	}
+	_, err = fmt.Print(string(data))
+	return err
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/archive"
+	"github.com/bfrengley/relay/internal/clipboard"
+	"github.com/bfrengley/relay/internal/config"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+func runUpload(args []string) error {
+	fs := newFlagSet("upload", "<path|glob>...")
+	cf := addClientFlags(fs)
+	qrFlag := fs.Bool("qr", false, "Show a QR code of each share link")
+	copyFlag := fs.Bool("copy", false, "Copy the share links to the clipboard")
+	embedFlag := fs.Bool("embed-password", false,
+		"Embed the password in share links, so anyone with a link can download the file without it")
+	recursiveFlag := fs.Bool("recursive", false, "Upload directories as gzipped tar archives")
+	fs.BoolVar(recursiveFlag, "r", false, "Shorthand for -recursive")
+	var opts relay.UploadOptions
+	fs.StringVar(&opts.Name, "name", "", "Store the file under this name instead of its local one")
+	fs.DurationVar(&opts.Expires, "expires", 0, "Delete the file from the server after this long, e.g. 24h")
+	fs.UintVar(&opts.MaxDownloads, "max-downloads", 0, "Delete the file from the server after this many downloads")
+	fs.StringVar(&opts.ContentType, "type", "", "Content type to store with the file (default based on its extension)")
+	fs.StringVar(&opts.Description, "description", "", "Description to store with the file")
+	fs.Var((*stringList)(&opts.Tags), "tag", "Tag to store with the file, for filtering lists (repeatable)")
+	addScryptFlag(fs, &opts.Scrypt)
+	addCipherFlag(fs, &opts.Cipher)
+	addChunkSizeFlag(fs, &opts.ChunkSize)
+	weakFlag := addWeakPasswordFlag(fs)
+	parallelFlag := fs.Int("parallel", 1, "Upload up to `N` files at once")
+	fs.IntVar(parallelFlag, "j", 1, "Shorthand for -parallel")
+	resumeFlag := fs.Bool("resume", false, "Resume interrupted uploads of the same files, and keep track of these uploads until they finish")
+	recipientFlag := fs.String("recipient", "",
+		"Encrypt to this public key from keygen instead of a password, or to an SSH public key given inline, in a file, or at a URL like https://github.com/<user>.keys")
+	bundleFlag := fs.Bool("bundle", false, "Put the uploaded files in a bundle, shared with one link")
+	codeFlag := fs.Bool("code", false, "Print a short code to send the file with instead of a password, and wait for it to be entered")
+	liveFlag := fs.Bool("live", false, "Print the share link, then stream the file through the server to whoever downloads it, without the server storing it")
+	fs.BoolVar(&opts.Direct, "direct", false, "With -live, send the file straight to the downloader if they can connect to this machine, saving the server relaying it")
+	var filter archive.Filter
+	fs.Var((*stringList)(&filter.Include), "include", "With -recursive, only include files matching this pattern (repeatable)")
+	fs.Var((*stringList)(&filter.Exclude), "exclude", "With -recursive, skip paths matching this pattern (repeatable)")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 || cf.server == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if opts.Expires < 0 {
+		return errors.New("-expires must be positive")
+	}
+	if *parallelFlag < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+
+	paths, err := expandPaths(fs.Args())
+	if err != nil {
+		return err
+	}
+	if opts.Name != "" && len(paths) > 1 {
+		return errors.New("-name can only be used when uploading a single file")
+	}
+
+	if opts.Direct && !*liveFlag {
+		return errors.New("-direct can only be used with -live")
+	}
+	if *liveFlag && (len(paths) != 1 || *resumeFlag || *bundleFlag || *recursiveFlag) {
+		return errors.New("-live can only send a single file, and can't be used with -resume, -bundle or -recursive")
+	}
+	if *codeFlag {
+		if len(paths) != 1 {
+			return errors.New("-code can only be used when uploading a single file")
+		}
+		if cf.pass != "" || cf.keyfile != "" || cf.identity != "" || cf.yubikey != 0 || *recipientFlag != "" || *embedFlag || *resumeFlag || cf.access != "" || *bundleFlag || *liveFlag {
+			return errors.New("-code can't be used with a password, -keyfile, -identity, -yubikey, -recipient, -embed-password, -resume, -access-password, -bundle or -live")
+		}
+		rc := cf.client()
+		return uploadWithCode(&rc, paths[0], opts, *recursiveFlag, filter)
+	}
+
+	var secret relay.Secret
+	if *recipientFlag != "" {
+		if cf.pass != "" || cf.keyfile != "" || cf.identity != "" || cf.yubikey != 0 {
+			return errors.New("-recipient can't be used with a password, -keyfile, -identity or -yubikey")
+		}
+		if *resumeFlag {
+			// only the recipient can derive the key again
+			return errors.New("uploads to a -recipient can't be resumed")
+		}
+		if secret, err = parseRecipient(*recipientFlag); err != nil {
+			return err
+		}
+	} else if secret, err = cf.secret(true); err != nil {
+		return err
+	}
+	pass, isPassword := secret.(relay.Password)
+	if *embedFlag && !isPassword {
+		return errors.New("-embed-password can only be used with a password")
+	}
+	if isPassword {
+		if err = checkPassword(pass, *weakFlag); err != nil {
+			return err
+		}
+	}
+
+	if *liveFlag {
+		rc := cf.client()
+		var embed string
+		if *embedFlag {
+			embed = string(pass)
+		}
+		return uploadLive(&rc, paths[0], secret, opts, embed, *qrFlag)
+	}
+
+	var state *transferState
+	if *resumeFlag {
+		if state, err = loadTransferState(); err != nil {
+			return err
+		}
+	}
+
+	rc := cf.client()
+	if *parallelFlag > 1 && len(paths) > 1 && cf.progress == "bar" {
+		// progress bars for concurrent uploads would overwrite each other
+		rc.Progress = nil
+	}
+
+	uploaded := uploadPaths(*parallelFlag, paths, func(path string) (relay.UploadResult, error) {
+		return uploadPath(&rc, path, secret, opts, *recursiveFlag, filter, state)
+	})
+
+	results := make([]uploadResult, 0, len(paths))
+	var links []string
+	var firstErr error
+	for i, path := range paths {
+		res, err := uploaded[i].res, uploaded[i].err
+		if err != nil {
+			logging.Errorln("failed to upload", path+":", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			results = append(results, uploadResult{Path: path, Error: err.Error()})
+			continue
+		}
+
+		if err = saveOwnerToken(cf.server, res.ID, res.OwnerToken); err != nil {
+			logging.Errorln("failed to save owner token for", res.ID.String()+":", err)
+		}
+
+		link := rc.ShareLink(res.ID)
+		if *embedFlag {
+			link = rc.ShareLinkWithSecret(res.ID, string(pass))
+		}
+		links = append(links, link)
+		results = append(results, uploadResult{Path: path, ID: res.ID, Link: link, Metadata: &res.FileMetadata, Stats: &res.Stats})
+	}
+
+	if *bundleFlag && len(links) == len(results) {
+		members := make([]relay.BundleMember, len(uploaded))
+		for i, up := range uploaded {
+			members[i] = relay.BundleMember{ID: up.res.ID, OwnerToken: up.res.OwnerToken}
+		}
+		bundle, err := rc.CreateBundle(members)
+		if err != nil {
+			return fmt.Errorf("the files were uploaded, but bundling them failed: %w", err)
+		}
+		link := rc.BundleLink(bundle.ID)
+		if *embedFlag {
+			link = rc.BundleLinkWithSecret(bundle.ID, string(pass))
+		}
+		if err = printBundleResult(bundleResult{bundle.ID, link, results}); err != nil {
+			return err
+		}
+		// the bundle's link is the one to share
+		links = []string{link}
+		results = []uploadResult{{Path: "bundle", ID: bundle.ID, Link: link}}
+	} else if err = printUploadResults(results); err != nil {
+		return err
+	}
+
+	if *qrFlag {
+		for _, res := range results {
+			if res.Error == "" {
+				if len(results) > 1 {
+					fmt.Fprintln(os.Stderr, res.Path+":")
+				}
+				if err = printQR(res.Link); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if *copyFlag && len(links) > 0 {
+		if err = clipboard.Copy(strings.Join(links, "\n")); err != nil {
+			return err
+		}
+		logging.Infoln("copied", len(links), "share link(s) to the clipboard")
+	}
+
+	if failed := len(results) - len(links); failed > 0 {
+		// keep the first error, so it decides the exit code
+		return fmt.Errorf("%d of %d uploads failed: %w", failed, len(results), firstErr)
+	}
+	return nil
+}
+
+type pathUpload struct {
+	res relay.UploadResult
+	err error
+}
+
+// uploadPaths runs upload for each path, with up to parallel uploads at once, and returns the
+// outcomes in the same order as paths.
+func uploadPaths(parallel int, paths []string, upload func(string) (relay.UploadResult, error)) []pathUpload {
+	out := make([]pathUpload, len(paths))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			out[i].res, out[i].err = upload(path)
+		}(i, path)
+	}
+	wg.Wait()
+	return out
+}
+
+// addScryptFlag adds -scrypt-cost, which sets the scrypt N parameter for new files as a power
+// of two.
+func addScryptFlag(fs *flag.FlagSet, params *relay.ScryptParams) {
+	usage := fmt.Sprintf("Derive keys from passwords with scrypt N=2^`cost` (default %d); higher is slower to derive and to guess",
+		bits.Len(uint(crypto.ScryptIters))-1)
+	fs.Func("scrypt-cost", usage, func(s string) error {
+		cost, err := strconv.Atoi(s)
+		if err != nil || cost < 1 || cost >= bits.UintSize-1 {
+			return errors.New("must be a positive number of bits")
+		}
+		p := crypto.DefaultScryptParams
+		p.N = 1 << cost
+		if err = p.Validate(); err != nil {
+			return err
+		}
+		*params = p
+		return nil
+	})
+}
+
+// parseRecipient parses a public key from keygen, or finds an SSH public key.
+func parseRecipient(s string) (relay.Secret, error) {
+	if strings.HasPrefix(s, "relay-pk-") {
+		return relay.ParseRecipient(s)
+	}
+
+	var r *relay.SSHRecipient
+	var err error
+	if relay.IsSSHPublicKey(s) {
+		r, err = relay.ParseSSHRecipient(s)
+	} else {
+		r, err = relay.ReadSSHRecipient(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logging.Infoln("encrypting to SSH key", r.Fingerprint())
+	return r, nil
+}
+
+func addCipherFlag(fs *flag.FlagSet, name *string) {
+	usage := fmt.Sprintf("Encrypt with `cipher`: %s (default), %s, or %s",
+		crypto.CipherSecretbox, crypto.CipherXChaCha20Poly1305, crypto.CipherAES256GCM)
+	fs.Func("cipher", usage, func(s string) error {
+		c, err := crypto.CipherByName(s)
+		if err != nil {
+			return err
+		}
+		*name = c.Name()
+		return nil
+	})
+}
+
+func addChunkSizeFlag(fs *flag.FlagSet, size *uint32) {
+	usage := fmt.Sprintf("Encrypt and upload in chunks of `size`, e.g. 1MiB for fast links (default %s)", humanSize(relay.ChunkSize))
+	fs.Func("chunk-size", usage, func(s string) error {
+		var b byteSize
+		if err := b.Set(s); err != nil {
+			return err
+		}
+		if b < files.MinChunkSize || b > files.MaxChunkSize {
+			return fmt.Errorf("must be %s to %s", humanSize(files.MinChunkSize), humanSize(files.MaxChunkSize))
+		}
+		*size = uint32(b)
+		return nil
+	})
+}
+
+func saveOwnerToken(server string, id files.FileID, token string) error {
+	path, err := config.OwnerTokensPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := config.LoadOwnerTokens(path)
+	if err != nil {
+		return err
+	}
+	tokens.Set(server, id, token)
+	return tokens.Save(path)
+}
+
+func uploadPath(
+	rc *relay.RelayClient, path string, secret relay.Secret, opts relay.UploadOptions,
+	recursive bool, filter archive.Filter, state *transferState,
+) (relay.UploadResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return relay.UploadResult{}, err
+	}
+	if !info.IsDir() {
+		return uploadFile(rc, path, secret, opts, state)
+	}
+	if !recursive {
+		return relay.UploadResult{}, fmt.Errorf("%s is a directory (use -recursive to upload it)", path)
+	}
+
+	// name the archive after the directory, since that becomes the uploaded file name
+	tmp, err := os.MkdirTemp("", "relay-")
+	if err != nil {
+		return relay.UploadResult{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	archivePath := filepath.Join(tmp, filepath.Base(filepath.Clean(path))+".tar.gz")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return relay.UploadResult{}, err
+	}
+
+	logging.Infoln("archiving directory", path)
+	n, err := archive.WriteTarGz(f, path, filter)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return relay.UploadResult{}, err
+	}
+	if n == 0 {
+		return relay.UploadResult{}, fmt.Errorf("no files to upload in %s", path)
+	}
+	logging.Infoln("archived", n, "files")
+
+	// the archive is rebuilt every time, so there's nothing to resume
+	return rc.UploadFile(archivePath, secret, opts)
+}
+
+// uploadFile uploads a single file. With state, an interrupted upload of the same file is
+// resumed, and this one is recorded until it finishes.
+func uploadFile(
+	rc *relay.RelayClient, path string, secret relay.Secret, opts relay.UploadOptions, state *transferState,
+) (relay.UploadResult, error) {
+	if state == nil {
+		return rc.UploadFile(path, secret, opts)
+	}
+
+	key, err := transferKey(rc.Server, path)
+	if err != nil {
+		return relay.UploadResult{}, err
+	}
+
+	var u *relay.Upload
+	saved, resuming := state.upload(key)
+	if resuming {
+		logging.Infoln("resuming upload of", path, "as", saved.ID)
+		u, err = rc.ResumeUpload(path, secret, saved)
+		if errors.Is(err, relay.ErrFileChanged) {
+			logging.Infoln(path, "has changed since it was last uploaded; starting again")
+			if err = rc.PurgeFile(saved.ID, saved.OwnerToken); err != nil {
+				logging.Errorln("failed to delete the old upload:", err)
+			}
+			u = nil
+		} else if err != nil {
+			return relay.UploadResult{}, err
+		}
+	}
+
+	if u == nil {
+		if u, err = rc.StartUpload(path, secret, opts); err != nil {
+			return relay.UploadResult{}, err
+		}
+		if err = state.setUpload(key, &u.State); err != nil {
+			return relay.UploadResult{}, err
+		}
+	}
+
+	res, err := rc.SendUpload(u)
+	if errors.Is(err, relay.ErrUploadNotFound) && resuming {
+		logging.Infoln("the server no longer has upload", saved.ID.String()+"; starting again")
+		if err = state.setUpload(key, nil); err != nil {
+			return relay.UploadResult{}, err
+		}
+		return uploadFile(rc, path, secret, opts, state)
+	} else if err != nil {
+		return relay.UploadResult{}, err
+	}
+
+	if err = state.setUpload(key, nil); err != nil {
+		logging.Errorln("failed to save transfer state:", err)
+	}
+	return res, nil
+}
+
+// uploadLive streams the file to whoever downloads it, printing its share link first, with the
+// password embedded if embed is set, so it can be passed on while the upload waits for them.
+func uploadLive(rc *relay.RelayClient, path string, secret relay.Secret, opts relay.UploadOptions, embed string, qr bool) error {
+	opts.Live = true
+	u, err := rc.StartUpload(path, secret, opts)
+	if err != nil {
+		return err
+	}
+	link := rc.ShareLink(u.State.ID)
+	if embed != "" {
+		link = rc.ShareLinkWithSecret(u.State.ID, embed)
+	}
+	fmt.Fprintf(os.Stderr, "Share link: %s\n", link)
+	if qr {
+		if err = printQR(link); err != nil {
+			return err
+		}
+	}
+	logging.Infoln("waiting for the file to be downloaded")
+
+	// the server forgets the file once it's been sent, so there's no owner token to keep
+	res, err := rc.SendUpload(u)
+	if err != nil {
+		return err
+	}
+	return printResult(
+		uploadResult{Path: path, ID: res.ID, Link: link, Metadata: &res.FileMetadata, Stats: &res.Stats},
+		"Sent %s to its downloader\n", path,
+	)
+}
+
+// expandPaths expands any glob patterns the shell didn't, keeping other arguments as-is.
+func expandPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+func printBundleResult(res bundleResult) error {
+	if jsonOutput {
+		return printJSON(res)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tID")
+	for _, f := range res.Files {
+		fmt.Fprintf(tw, "%s\t%s\n", f.Path, f.ID)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Printf("Uploaded %d files as bundle %s\nShare link: %s\n", len(res.Files), res.ID, res.Link)
+	return err
+}
+
+func printUploadResults(results []uploadResult) error {
+	if jsonOutput {
+		if len(results) == 1 {
+			return printJSON(results[0])
+		}
+		return printJSON(results)
+	}
+
+	if len(results) == 1 {
+		if res := results[0]; res.Error == "" {
+			_, err := fmt.Printf("Uploaded %s as %s\nShare link: %s\n", res.Metadata.Name, res.ID, res.Link)
+			return err
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tID\tSHARE LINK")
+	for _, res := range results {
+		if res.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\tfailed: %s\n", res.Path, res.Error)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", res.Path, res.ID, res.Link)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/archive"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+func runWatch(args []string) error {
+	fs := newFlagSet("watch", "<dir>")
+	cf := addClientFlags(fs)
+	intervalFlag := fs.Duration("interval", 2*time.Second, "How often to scan the directory for changes")
+	existingFlag := fs.Bool("existing", false, "Also upload files already in the directory when starting")
+	recursiveFlag := fs.Bool("recursive", false, "Watch subdirectories too")
+	fs.BoolVar(recursiveFlag, "r", false, "Shorthand for -recursive")
+	execFlag := fs.String("exec", "",
+		"Shell command to run after each upload, with $RELAY_PATH, $RELAY_ID and $RELAY_LINK set")
+	var filter archive.Filter
+	fs.Var((*stringList)(&filter.Include), "include", "Only upload files matching this pattern (repeatable)")
+	fs.Var((*stringList)(&filter.Exclude), "exclude", "Ignore paths matching this pattern (repeatable)")
+	weakFlag := addWeakPasswordFlag(fs)
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || cf.server == "" || *intervalFlag <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	dir := fs.Arg(0)
+
+	// skip dotfiles and editor backups, which are usually temporary
+	filter.Exclude = append(filter.Exclude, ".*", "*~")
+
+	secret, err := cf.secret(true)
+	if err != nil {
+		return err
+	}
+	if pass, ok := secret.(relay.Password); ok {
+		if err = checkPassword(pass, *weakFlag); err != nil {
+			return err
+		}
+	}
+
+	seen, err := scanDir(dir, *recursiveFlag, filter)
+	if err != nil {
+		return err
+	}
+	if *existingFlag {
+		seen = make(map[string]watchedFile)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*intervalFlag)
+	defer ticker.Stop()
+
+	rc := cf.client()
+	// files are only uploaded once they've stopped changing between two scans
+	pending := make(map[string]watchedFile)
+	logging.Infoln("watching", dir, "for changes")
+	for {
+		select {
+		case <-interrupt:
+			logging.Infoln("stopped watching", dir)
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := scanDir(dir, *recursiveFlag, filter)
+		if err != nil {
+			return err
+		}
+
+		for path, state := range current {
+			if prev, ok := seen[path]; ok && prev == state {
+				continue
+			}
+			if prev, ok := pending[path]; !ok || prev != state {
+				pending[path] = state
+				continue
+			}
+
+			delete(pending, path)
+			seen[path] = state
+			watchUpload(&rc, cf.server, path, secret, *execFlag)
+		}
+
+		for path := range seen {
+			if _, ok := current[path]; !ok {
+				delete(seen, path)
+			}
+		}
+		for path := range pending {
+			if _, ok := current[path]; !ok {
+				delete(pending, path)
+			}
+		}
+	}
+}
+
+func scanDir(dir string, recursive bool, filter archive.Filter) (map[string]watchedFile, error) {
+	found := make(map[string]watchedFile)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the file may have been removed since the directory was listed
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if filter.Excluded(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		found[path] = watchedFile{info.Size(), info.ModTime()}
+		return nil
+	})
+	return found, err
+}
+
+func watchUpload(rc *relay.RelayClient, server, path string, secret relay.Secret, command string) {
+	res, err := rc.UploadFile(path, secret, relay.UploadOptions{})
+	if err != nil {
+		logging.Errorln("failed to upload", path+":", err)
+		if jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(uploadResult{Path: path, Error: err.Error()})
+		}
+		return
+	}
+
+	if err = saveOwnerToken(server, res.ID, res.OwnerToken); err != nil {
+		logging.Errorln("failed to save owner token for", res.ID.String()+":", err)
+	}
+
+	link := rc.ShareLink(res.ID)
+	if jsonOutput {
+		// one object per line, so the output can be consumed as a stream
+		json.NewEncoder(os.Stdout).Encode(uploadResult{Path: path, ID: res.ID, Link: link, Metadata: &res.FileMetadata, Stats: &res.Stats})
+	} else {
+		fmt.Printf("%s\t%s\t%s\n", path, res.ID, link)
+	}
+
+	if command != "" {
+		if err = runHook(command, path, res.ID.String(), link); err != nil {
+			logging.Errorln("-exec command failed for", path+":", err)
+		}
+	}
+}
+
+func runHook(command, path, id, link string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "RELAY_PATH="+path, "RELAY_ID="+id, "RELAY_LINK="+link)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
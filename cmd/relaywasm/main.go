@@ -0,0 +1,252 @@
+//go:build js && wasm
+
+// Command relaywasm is the relay client compiled to WebAssembly for the server's web UI, which
+// calls it to encrypt files before they're uploaded and decrypt them after they're downloaded, so
+// the server never sees their contents. It's built into the UI with go generate ./internal/web.
+//
+// It sets a global relay object with functions which return promises:
+//
+//	relay.upload(file, password, options) -> {id, link, ownerToken}
+//	relay.download(idOrLink, password, options) -> {name, type, data}
+//	relay.list(options) -> [metadata]
+//
+// where file is a File or Blob, data is a Uint8Array, and options may hold token, accessPassword,
+// expires (in seconds) and onProgress(description, bytes, total).
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+func main() {
+	js.Global().Set("relay", js.ValueOf(map[string]any{
+		"upload":   asyncFunc(upload),
+		"download": asyncFunc(download),
+		"list":     asyncFunc(list),
+	}))
+	select {}
+}
+
+// asyncFunc wraps f as a JavaScript function which returns a promise of its result. f runs in a
+// goroutine of its own, since it waits on fetches and reads which need the event loop it's
+// called from.
+func asyncFunc(f func(args []js.Value) (any, error)) js.Func {
+	return js.FuncOf(func(_ js.Value, args []js.Value) any {
+		var executor js.Func
+		executor = js.FuncOf(func(_ js.Value, p []js.Value) any {
+			resolve, reject := p[0], p[1]
+			go func() {
+				defer executor.Release()
+				v, err := f(args)
+				if err != nil {
+					reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				} else {
+					resolve.Invoke(v)
+				}
+			}()
+			return nil
+		})
+		return js.Global().Get("Promise").New(executor)
+	})
+}
+
+// await waits for a promise to settle, returning what it resolves to.
+func await(promise js.Value) (js.Value, error) {
+	var v js.Value
+	var err error
+	done := make(chan struct{})
+	then := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		v = args[0]
+		close(done)
+		return nil
+	})
+	defer then.Release()
+	catch := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		err = errors.New(args[0].Call("toString").String())
+		close(done)
+		return nil
+	})
+	defer catch.Release()
+	promise.Call("then", then, catch)
+	<-done
+	return v, err
+}
+
+// blobReader reads a Blob, such as a File picked for upload, a slice at a time.
+type blobReader struct {
+	blob js.Value
+	size int64
+}
+
+func (b blobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	buf, err := await(b.blob.Call("slice", off, end).Call("arrayBuffer"))
+	if err != nil {
+		return 0, err
+	}
+	n := js.CopyBytesToGo(p, js.Global().Get("Uint8Array").New(buf))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// jsProgress passes a transfer's progress to a JavaScript callback.
+type jsProgress struct {
+	callback    js.Value
+	description string
+	total       int64
+}
+
+func (p jsProgress) Update(bytes int64) {
+	p.callback.Invoke(p.description, bytes, p.total)
+}
+
+func (p jsProgress) Finish() error {
+	return nil
+}
+
+// client returns a client for server, or the UI's own server if it's empty, set up from the
+// options passed from JavaScript.
+func client(server string, opts js.Value) relay.RelayClient {
+	if server == "" {
+		server = js.Global().Get("location").Get("origin").String()
+	}
+	rc := relay.NewClient(server)
+	if opts.Type() != js.TypeObject {
+		return rc
+	}
+	if cb := opts.Get("onProgress"); cb.Type() == js.TypeFunction {
+		rc.Progress = func(description string, total int64) relay.Progress {
+			return jsProgress{cb, description, total}
+		}
+	}
+	if token := opts.Get("token"); token.Truthy() {
+		rc.Token = token.String()
+	}
+	if access := opts.Get("accessPassword"); access.Truthy() {
+		rc.AccessPassword = access.String()
+	}
+	return rc
+}
+
+func upload(args []js.Value) (any, error) {
+	if len(args) < 2 {
+		return nil, errors.New("upload needs a file and a password")
+	}
+	file, password := args[0], args[1].String()
+	if password == "" {
+		return nil, errors.New("a password is needed to encrypt the file")
+	}
+	var opts js.Value
+	if len(args) > 2 {
+		opts = args[2]
+	}
+	rc := client("", opts)
+
+	var uo relay.UploadOptions
+	if t := file.Get("type"); t.Truthy() {
+		uo.ContentType = t.String()
+	}
+	if opts.Type() == js.TypeObject {
+		if expires := opts.Get("expires"); expires.Truthy() {
+			uo.Expires = time.Duration(expires.Float() * float64(time.Second))
+		}
+	}
+	name := "upload"
+	if n := file.Get("name"); n.Truthy() {
+		name = n.String()
+	}
+	size := int64(file.Get("size").Float())
+
+	u, err := rc.StartUploadFrom(blobReader{file, size}, size, name, relay.Password(password), uo)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rc.SendUpload(u)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"id":         res.ID.String(),
+		"link":       rc.ShareLink(res.ID),
+		"ownerToken": res.OwnerToken,
+	}, nil
+}
+
+func download(args []js.Value) (any, error) {
+	if len(args) < 1 {
+		return nil, errors.New("download needs a file ID or share link")
+	}
+	target := strings.TrimSpace(args[0].String())
+	var password string
+	if len(args) > 1 && args[1].Truthy() {
+		password = args[1].String()
+	}
+	var opts js.Value
+	if len(args) > 2 {
+		opts = args[2]
+	}
+
+	var server string
+	var id files.FileID
+	var err error
+	if strings.Contains(target, "/") {
+		var secret string
+		if server, id, secret, err = relay.ParseShareLink(target); err != nil {
+			return nil, err
+		}
+		if password == "" {
+			password = secret
+		}
+	} else if id, err = files.ParseFileID(target); err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, errors.New("a password is needed to decrypt the file")
+	}
+
+	rc := client(server, opts)
+	var buf bytes.Buffer
+	res, err := rc.DownloadTo(id, relay.Password(password), &buf)
+	if err != nil {
+		return nil, err
+	}
+	data := js.Global().Get("Uint8Array").New(buf.Len())
+	js.CopyBytesToJS(data, buf.Bytes())
+	return map[string]any{
+		"name": res.Name,
+		"type": res.ContentType,
+		"data": data,
+	}, nil
+}
+
+func list(args []js.Value) (any, error) {
+	var opts js.Value
+	if len(args) > 0 {
+		opts = args[0]
+	}
+	rc := client("", opts)
+	metas, err := rc.ListFiles(relay.ListFilter{})
+	if err != nil {
+		return nil, err
+	}
+	// the UI gets the metadata as it's sent over the API
+	b, err := json.Marshal(metas)
+	if err != nil {
+		return nil, err
+	}
+	return js.Global().Get("JSON").Call("parse", string(b)), nil
+}
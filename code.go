@@ -0,0 +1,286 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// ErrWrongCode is returned when the sender and receiver of a file used different codes.
+var ErrWrongCode = errors.New("incorrect code")
+
+const codePollInterval = 500 * time.Millisecond
+
+// Mailbox slots, written in this order during an exchange.
+const (
+	slotSender   = "sender"
+	slotReceiver = "receiver"
+	slotPayload  = "payload"
+	slotAck      = "ack"
+)
+
+// codeWords are the words codes are made of. Each code has two, so guessing one has a 1 in 65536
+// chance, and each wrong guess uses up the code.
+var codeWords = [256]string{
+	"acorn", "actor", "adobe", "agent", "alarm", "album", "alley", "amber", "angle", "ankle",
+	"apple", "apron", "arena", "arrow", "aspen", "atlas", "audio", "autumn", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "basil", "basin", "beach", "beard", "beetle",
+	"berry", "bison", "blade", "blanket", "bloom", "board", "boat", "bonus", "book", "boot",
+	"bottle", "brain", "brass", "bread", "brick", "brook", "broom", "bucket", "bugle", "button",
+	"cabin", "cable", "cactus", "camel", "candle", "canoe", "canyon", "carbon", "carpet",
+	"carrot", "cedar", "chalk", "cherry", "chess", "chimney", "cider", "cinema", "circle", "clay",
+	"cliff", "clock", "cloud", "clover", "cobra", "cocoa", "coral", "cotton", "cougar", "crane",
+	"crayon", "creek", "crown", "cubic", "curtain", "cycle", "daisy", "dancer", "delta", "desert",
+	"diesel", "dollar", "dolphin", "donkey", "dragon", "drum", "eagle", "echo", "elbow", "ember",
+	"engine", "fabric", "falcon", "feather", "fence", "ferry", "finch", "flame", "flute",
+	"forest", "fossil", "fox", "frost", "galaxy", "garden", "garlic", "gecko", "giant", "ginger",
+	"glacier", "glove", "gravel", "guitar", "hammer", "harbor", "harp", "hazel", "helmet",
+	"heron", "hockey", "honey", "hornet", "igloo", "iris", "island", "ivory", "jaguar", "jelly",
+	"jewel", "jungle", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "laser",
+	"lemon", "lily", "lizard", "locket", "magnet", "mango", "maple", "marble", "meadow", "melon",
+	"mirror", "mitten", "monkey", "moose", "mosaic", "motor", "mountain", "muffin", "nectar",
+	"needle", "nickel", "noodle", "oasis", "ocean", "olive", "onion", "opal", "orange", "orbit",
+	"otter", "oyster", "paddle", "panda", "parrot", "pasta", "peach", "pearl", "pebble", "pencil",
+	"pepper", "piano", "pigeon", "pillow", "pirate", "planet", "plum", "pocket", "pony", "potato",
+	"pretzel", "pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar", "radish", "raven",
+	"ribbon", "river", "robin", "rocket", "rose", "saddle", "salmon", "sandal", "saturn", "scarf",
+	"shadow", "shell", "silver", "sketch", "sled", "sofa", "spider", "sponge", "spruce", "squid",
+	"statue", "stone", "sugar", "summit", "sunset", "swan", "table", "tango", "temple", "tiger",
+	"timber", "toast", "tomato", "torch", "tractor", "tulip", "turtle", "umbrella", "valley",
+	"velvet", "violin", "volcano", "wagon", "walnut", "walrus", "whale", "willow", "window",
+	"wizard", "yacht", "zebra",
+}
+
+// codePayload is what the sender of a file sends the receiver once they've agreed on a key.
+type codePayload struct {
+	ID  files.FileID `json:"id"`
+	Key []byte       `json:"key"`
+}
+
+// CodeOffer is the sender's side of an exchange, offering a file to whoever enters its Code.
+// Files sent this way are encrypted with a random Keyfile, which is sent to the receiver once
+// they've run a PAKE with the sender from the code through the server's mailbox.
+type CodeOffer struct {
+	Code string
+
+	rc         *RelayClient
+	nameplate  string
+	ownerToken string
+	pake       *crypto.SPAKE2
+}
+
+// OfferCode creates a mailbox on the server and a code for it, which the receiver needs to
+// enter before Send can finish.
+func (rc *RelayClient) OfferCode() (*CodeOffer, error) {
+	res, err := rc.post("/mailboxes", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return nil, newStatusError("mailbox creation", res.StatusCode, body)
+	}
+	var created MailboxCreated
+	if err = json.Unmarshal(body, &created); err != nil {
+		return nil, err
+	}
+
+	var b [2]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	o := &CodeOffer{
+		Code:       fmt.Sprintf("%d-%s-%s", created.Nameplate, codeWords[b[0]], codeWords[b[1]]),
+		rc:         rc,
+		nameplate:  strconv.FormatUint(uint64(created.Nameplate), 10),
+		ownerToken: created.OwnerToken,
+	}
+	if o.pake, err = crypto.NewSPAKE2([]byte(o.Code), true); err != nil {
+		return nil, err
+	}
+	if err = rc.putMessage(o.nameplate, slotSender, o.pake.Message()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Send waits for the receiver to enter the code, then sends them the file's ID and key. It
+// fails if they entered the wrong code, or nobody entered it before the mailbox expired.
+func (o *CodeOffer) Send(id files.FileID, key Keyfile) error {
+	defer o.rc.deleteMailbox(o.nameplate, o.ownerToken)
+
+	logging.Infoln("waiting for the receiver to enter the code")
+	peer, err := o.rc.waitMessage(o.nameplate, slotReceiver)
+	if errors.Is(err, ErrNotFound) {
+		return errors.New("the code expired before anyone entered it")
+	} else if err != nil {
+		return err
+	}
+
+	shared, err := o.pake.Finish(peer)
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(shared)
+	payload, err := json.Marshal(codePayload{id, key})
+	if err != nil {
+		return err
+	}
+	defer crypto.Zero(payload)
+	sealed, err := crypto.EncryptChunk(*crypto.Subkey(shared, crypto.PurposeCodeSender), payload)
+	if err != nil {
+		return err
+	}
+	if err = o.rc.putMessage(o.nameplate, slotPayload, sealed); err != nil {
+		return err
+	}
+
+	// the receiver's ack doesn't decrypt if their key didn't match
+	ack, err := o.rc.waitMessage(o.nameplate, slotAck)
+	if errors.Is(err, ErrNotFound) {
+		return ErrWrongCode
+	} else if err != nil {
+		return err
+	}
+	if _, err = crypto.DecryptChunk(*crypto.Subkey(shared, crypto.PurposeCodeReceiver), ack, nil); err != nil {
+		return ErrWrongCode
+	}
+	logging.Infoln("the receiver has the key")
+	return nil
+}
+
+// AcceptCode runs the receiver's side of an exchange, returning the ID and key of the file
+// offered with the code.
+func (rc *RelayClient) AcceptCode(code string) (files.FileID, Keyfile, error) {
+	nameplate := strings.SplitN(code, "-", 2)[0]
+	if _, err := strconv.ParseUint(nameplate, 10, 32); err != nil || !strings.Contains(code, "-") {
+		return files.FileID{}, nil, fmt.Errorf("invalid code %q", code)
+	}
+
+	peer, err := rc.waitMessage(nameplate, slotSender)
+	if errors.Is(err, ErrNotFound) {
+		return files.FileID{}, nil, fmt.Errorf("nothing is being sent with code %q: %w", code, err)
+	} else if err != nil {
+		return files.FileID{}, nil, err
+	}
+	pake, err := crypto.NewSPAKE2([]byte(code), false)
+	if err != nil {
+		return files.FileID{}, nil, err
+	}
+	if err = rc.putMessage(nameplate, slotReceiver, pake.Message()); err != nil {
+		return files.FileID{}, nil, err
+	}
+	shared, err := pake.Finish(peer)
+	if err != nil {
+		return files.FileID{}, nil, err
+	}
+	defer crypto.Wipe(shared)
+
+	logging.Infoln("waiting for the sender")
+	sealed, err := rc.waitMessage(nameplate, slotPayload)
+	if err != nil {
+		return files.FileID{}, nil, err
+	}
+	plain, err := crypto.DecryptChunk(*crypto.Subkey(shared, crypto.PurposeCodeSender), sealed, nil)
+	if err != nil {
+		// an ack that doesn't decrypt tells the sender, and nobody else can guess the code,
+		// since the receiver's slot is already written
+		rc.putMessage(nameplate, slotAck, []byte("wrong code"))
+		return files.FileID{}, nil, ErrWrongCode
+	}
+	defer crypto.Zero(plain)
+	var payload codePayload
+	if err = json.Unmarshal(plain, &payload); err != nil {
+		return files.FileID{}, nil, err
+	}
+
+	ack, err := crypto.EncryptChunk(*crypto.Subkey(shared, crypto.PurposeCodeReceiver), nil)
+	if err != nil {
+		return files.FileID{}, nil, err
+	}
+	if err = rc.putMessage(nameplate, slotAck, ack); err != nil {
+		return files.FileID{}, nil, err
+	}
+	return payload.ID, Keyfile(payload.Key), nil
+}
+
+func (rc *RelayClient) post(path string, body []byte) (*http.Response, error) {
+	req, err := rc.newRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return rc.c.Do(req)
+}
+
+func (rc *RelayClient) putMessage(nameplate, slot string, msg []byte) error {
+	req, err := rc.newRequest(http.MethodPut, "/mailboxes/"+nameplate+"/"+slot, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return errors.New("the code has already been used")
+	}
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return newStatusError("mailbox write", res.StatusCode, body)
+	}
+	return nil
+}
+
+// waitMessage polls a slot until something is written to it. It returns an error matching
+// ErrNotFound if the mailbox is closed or expires first.
+func (rc *RelayClient) waitMessage(nameplate, slot string) ([]byte, error) {
+	for {
+		res, err := rc.get("/mailboxes/" + nameplate + "/" + slot)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch res.StatusCode {
+		case http.StatusOK:
+			return body, nil
+		case http.StatusNoContent:
+			time.Sleep(codePollInterval)
+		default:
+			return nil, newStatusError("mailbox read", res.StatusCode, body)
+		}
+	}
+}
+
+func (rc *RelayClient) deleteMailbox(nameplate, ownerToken string) {
+	req, err := rc.newRequest(http.MethodDelete, "/mailboxes/"+nameplate, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(OwnerTokenHeader, ownerToken)
+	if res, err := rc.c.Do(req); err == nil {
+		res.Body.Close()
+	}
+}
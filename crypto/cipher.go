@@ -0,0 +1,194 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Cipher names, as recorded in file metadata. Files without one use CipherSecretbox.
+const (
+	CipherSecretbox         = "secretbox"
+	CipherXChaCha20Poly1305 = "xchacha20poly1305"
+	CipherAES256GCM         = "aes256gcm"
+)
+
+// Cipher is an authenticated encryption scheme for file chunks. Ciphertexts start with their
+// nonce, which must never be used twice with the same key.
+type Cipher interface {
+	Name() string
+	NonceSize() int
+	// Overhead is how much longer a ciphertext is than its plaintext, including the nonce.
+	Overhead() int
+	// Seal appends the nonce and ciphertext to out, which must not overlap the plaintext.
+	Seal(key *[KeySize]byte, nonce, plaintext, ad, out []byte) ([]byte, error)
+	// Open appends the plaintext to out, which must not overlap the ciphertext.
+	Open(key *[KeySize]byte, ciphertext, ad, out []byte) ([]byte, error)
+}
+
+// RandomNonce returns a random nonce for c.
+func RandomNonce(c Cipher) ([]byte, error) {
+	nonce := make([]byte, c.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func checkNonce(c Cipher, nonce []byte) error {
+	if len(nonce) != c.NonceSize() {
+		return fmt.Errorf("%s nonces must be %d bytes, not %d", c.Name(), c.NonceSize(), len(nonce))
+	}
+	return nil
+}
+
+var (
+	Secretbox         Cipher = secretboxCipher{}
+	XChaCha20Poly1305 Cipher = xchachaCipher{}
+	// AES256GCM is for environments that require FIPS-approved algorithms, and is usually
+	// hardware accelerated. Its nonces are only 96 bits, so they shouldn't be random.
+	AES256GCM Cipher = aesGCMCipher{}
+)
+
+// CipherByName returns the named cipher, treating an empty name as CipherSecretbox.
+func CipherByName(name string) (Cipher, error) {
+	switch name {
+	case "", CipherSecretbox:
+		return Secretbox, nil
+	case CipherXChaCha20Poly1305:
+		return XChaCha20Poly1305, nil
+	case CipherAES256GCM:
+		return AES256GCM, nil
+	}
+	return nil, fmt.Errorf("unknown cipher %q", name)
+}
+
+type secretboxCipher struct{}
+
+func (secretboxCipher) Name() string   { return CipherSecretbox }
+func (secretboxCipher) NonceSize() int { return NonceSize }
+func (secretboxCipher) Overhead() int  { return Overhead }
+
+// adKey mixes associated data into the key, since secretbox has no associated data of its own.
+func (secretboxCipher) adKey(key *[KeySize]byte, ad []byte) *[KeySize]byte {
+	if len(ad) == 0 {
+		return key
+	}
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("relay chunk"))
+	mac.Write(ad)
+
+	subkey := new([KeySize]byte)
+	copy(subkey[:], mac.Sum(nil))
+	return subkey
+}
+
+func (c secretboxCipher) Seal(key *[KeySize]byte, nonce, plaintext, ad, out []byte) ([]byte, error) {
+	if err := checkNonce(c, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return secretbox.Seal(out, plaintext, (*[NonceSize]byte)(nonce), c.adKey(key, ad)), nil
+}
+
+func (c secretboxCipher) Open(key *[KeySize]byte, ciphertext, ad, out []byte) ([]byte, error) {
+	return DecryptChunk(*c.adKey(key, ad), ciphertext, out)
+}
+
+type xchachaCipher struct{}
+
+func (xchachaCipher) Name() string   { return CipherXChaCha20Poly1305 }
+func (xchachaCipher) NonceSize() int { return chacha20poly1305.NonceSizeX }
+
+func (xchachaCipher) Overhead() int {
+	return chacha20poly1305.NonceSizeX + xchachaTagSize
+}
+
+const xchachaTagSize = 16
+
+func (c xchachaCipher) Seal(key *[KeySize]byte, nonce, plaintext, ad, out []byte) ([]byte, error) {
+	if err := checkNonce(c, nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+func (xchachaCipher) Open(key *[KeySize]byte, ciphertext, ad, out []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCiphertextTooShort
+	}
+
+	nonce, box := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	out, err = aead.Open(out, nonce, box, ad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return out, nil
+}
+
+type aesGCMCipher struct{}
+
+func (aesGCMCipher) Name() string   { return CipherAES256GCM }
+func (aesGCMCipher) NonceSize() int { return aesGCMNonceSize }
+
+func (aesGCMCipher) Overhead() int {
+	return aesGCMNonceSize + aesGCMTagSize
+}
+
+const (
+	aesGCMNonceSize = 12
+	aesGCMTagSize   = 16
+)
+
+func newGCM(key *[KeySize]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c aesGCMCipher) Seal(key *[KeySize]byte, nonce, plaintext, ad, out []byte) ([]byte, error) {
+	if err := checkNonce(c, nonce); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+func (aesGCMCipher) Open(key *[KeySize]byte, ciphertext, ad, out []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aesGCMNonceSize+aesGCMTagSize {
+		return nil, ErrCiphertextTooShort
+	}
+
+	out, err = aead.Open(out, ciphertext[:aesGCMNonceSize], ciphertext[aesGCMNonceSize:], ad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return out, nil
+}
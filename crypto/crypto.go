@@ -0,0 +1,634 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KeySize   = 32
+	SaltSize  = 16
+	NonceSize = 24
+
+	// Overhead is how much longer EncryptChunk makes a chunk.
+	Overhead = NonceSize + secretbox.Overhead
+)
+
+// Key derivation functions, as recorded in file metadata. Files without one use KDFScrypt.
+const (
+	KDFScrypt  = "scrypt"
+	KDFKeyfile = "keyfile"
+	// KDFX25519 files are encrypted to a recipient's public key; see X25519SenderKey.
+	KDFX25519 = "x25519"
+	// KDFSSHEd25519 and KDFSSHRSA files are encrypted to an SSH public key; see
+	// SSHEd25519SenderKey and SSHRSASenderKey.
+	KDFSSHEd25519 = "ssh-ed25519"
+	KDFSSHRSA     = "ssh-rsa"
+	// KDFYubiKey files' keys are derived with KeyfileKey from a YubiKey's HMAC-SHA1 response to
+	// a challenge made from the salt; see YubiKeyChallenge.
+	KDFYubiKey = "yubikey"
+)
+
+const (
+	ScryptIters   = 1 << 20
+	ScryptMemCost = 8
+	ScryptCPUCost = 1
+
+	// MaxScryptMemory bounds the memory scrypt parameters from metadata may ask for (128*N*r
+	// bytes), so a file can't make its downloaders exhaust their memory.
+	MaxScryptMemory uint64 = 4 << 30
+)
+
+// ScryptParams are the cost parameters for deriving a key with scrypt.
+type ScryptParams struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// DefaultScryptParams are used for new files, and for files that don't record their parameters.
+var DefaultScryptParams = ScryptParams{N: ScryptIters, R: ScryptMemCost, P: ScryptCPUCost}
+
+var ErrInvalidScryptParams = errors.New("relay: invalid scrypt parameters")
+
+// Validate checks the parameters are usable, and won't use more than MaxScryptMemory.
+func (p ScryptParams) Validate() error {
+	switch {
+	case p.N <= 1 || p.N&(p.N-1) != 0:
+		return fmt.Errorf("%w: N must be a power of two greater than 1", ErrInvalidScryptParams)
+	case p.R < 1 || p.P < 1 || uint64(p.R)*uint64(p.P) >= 1<<30:
+		return fmt.Errorf("%w: r and p must be positive and r*p < 2^30", ErrInvalidScryptParams)
+	case uint64(p.N)*uint64(p.R)*128 > MaxScryptMemory:
+		return fmt.Errorf("%w: N and r need more than %d bytes of memory", ErrInvalidScryptParams, MaxScryptMemory)
+	}
+	return nil
+}
+
+// Errors from decrypting chunks and streams.
+var (
+	ErrCiphertextTooShort = errors.New("relay: ciphertext too short")
+	ErrDecryptFailed      = errors.New("relay: decryption failed")
+	ErrTruncated          = errors.New("relay: encrypted stream ended early")
+)
+
+// ChunkError is the error for a chunk of a stream which failed to encrypt or decrypt, saying
+// where the chunk is, so corruption can be located without reading the rest of the stream.
+type ChunkError struct {
+	// Index is the chunk's index in the stream.
+	Index uint64
+	// Offset is where the chunk's ciphertext starts in the encrypted stream, header included.
+	Offset int64
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d at byte %d of the encrypted stream: %v", e.Index, e.Offset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// chunkError locates err at the chunk with the index, whose ciphertext is chunkSize bytes.
+func (s Stream) chunkError(index uint64, chunkSize int, err error) error {
+	offset := int64(index) * int64(chunkSize)
+	if s.Version >= 1 {
+		offset += int64(HeaderSize)
+	}
+	return &ChunkError{index, offset, err}
+}
+
+// Stream identifies the chunks of an encrypted file, so each chunk is only valid in its own
+// position of its own file.
+type Stream struct {
+	// Version is the stream format version; streams of version 1 or later start with a Header.
+	Version uint8
+	// Cipher encrypts the chunks; nil means Secretbox.
+	Cipher Cipher
+	// FileID is the ID of the file on the server.
+	FileID []byte
+	// NoncePrefix is a random NoncePrefixSize bytes for the file, which chunk nonces are
+	// made from. Without one, each chunk has a random nonce.
+	NoncePrefix []byte
+	// FirstChunk is the index of the first chunk read, for streams that start partway through.
+	// Streams that don't start at the first chunk have no header.
+	FirstChunk uint64
+}
+
+func (s Stream) cipher() Cipher {
+	if s.Cipher == nil {
+		return Secretbox
+	}
+	return s.Cipher
+}
+
+// chunkReader reuses its buffers from chunk to chunk, so a stream of any length only needs a few
+// chunks' worth of memory.
+type chunkReader struct {
+	r io.Reader
+	// chunkFn encrypts or decrypts data, appending the result to out.
+	chunkFn func(key [KeySize]byte, data []byte, final bool, out []byte) ([]byte, error)
+	// startFn is called before the first chunk, and returns anything to be read before it.
+	startFn func() ([]byte, error)
+
+	key       [KeySize]byte
+	chunkSize int
+	// sealedSize is the size of each chunk's ciphertext.
+	sealedSize int
+	stream     Stream
+	// sealing is whether the reader encrypts rather than decrypts.
+	sealing bool
+
+	chunk []byte
+	idx   int
+	// seq is the index of the next chunk in the stream.
+	seq uint64
+	// next is the input for the chunk after the current one, read ahead to find the last chunk.
+	next []byte
+	// spare is an input buffer which is free to reuse.
+	spare   []byte
+	started bool
+	// err is sticky, so a failed stream can't carry on from a later chunk.
+	err error
+}
+
+// NewEncryptingReader encrypts r in chunks of chunkSize bytes of plaintext, with subkeys of the
+// file key.
+func NewEncryptingReader(r io.Reader, chunkSize int, key [KeySize]byte, s Stream) io.Reader {
+	cr := &chunkReader{
+		r:          r,
+		key:        *Subkey(&key, PurposeChunks),
+		chunkSize:  chunkSize,
+		sealedSize: chunkSize + s.cipher().Overhead(),
+		stream:     s,
+		sealing:    true,
+		seq:        s.FirstChunk,
+	}
+	cr.chunkFn = func(key [KeySize]byte, data []byte, final bool, out []byte) ([]byte, error) {
+		return SealChunk(key, s, cr.seq, final, data, out)
+	}
+	if s.hasHeader() {
+		cr.startFn = func() ([]byte, error) {
+			defer Zero(key[:])
+			return s.header(&key, chunkSize), nil
+		}
+	}
+	return cr
+}
+
+// NewDecryptingReader decrypts a stream from NewEncryptingReader, in chunks of chunkSize bytes of
+// ciphertext.
+func NewDecryptingReader(r io.Reader, chunkSize int, key [KeySize]byte, s Stream) io.Reader {
+	cr := &chunkReader{
+		r:          r,
+		key:        *Subkey(&key, PurposeChunks),
+		chunkSize:  chunkSize,
+		sealedSize: chunkSize,
+		stream:     s,
+		seq:        s.FirstChunk,
+	}
+	if s.hasHeader() {
+		cr.startFn = func() ([]byte, error) {
+			defer Zero(key[:])
+			b := make([]byte, HeaderSize)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, fmt.Errorf("reading stream header: %w", err)
+			}
+			return nil, s.CheckHeader(b, &key, chunkSize)
+		}
+	}
+	cr.chunkFn = func(key [KeySize]byte, data []byte, final bool, out []byte) ([]byte, error) {
+		return openStreamChunk(key, s, cr.seq, final, data, out)
+	}
+	return cr
+}
+
+func (s Stream) hasHeader() bool {
+	return s.Version >= 1 && s.FirstChunk == 0
+}
+
+// emptyFinal is whether an empty stream still has a final chunk, as it does since version 3, so
+// that one cut down to its header doesn't decrypt as an empty file.
+func (s Stream) emptyFinal() bool {
+	return s.Version >= 3 && s.FirstChunk == 0
+}
+
+// header is the sealed header for the stream, with chunks of chunkSize bytes of plaintext.
+func (s Stream) header(key *[KeySize]byte, chunkSize int) []byte {
+	h := Header{s.Version, s.cipher(), uint32(chunkSize + s.cipher().Overhead())}
+	return h.Seal(key, s.FileID)
+}
+
+// CheckHeader checks the header b matches the stream, with chunks of chunkSize bytes of
+// ciphertext.
+func (s Stream) CheckHeader(b []byte, key *[KeySize]byte, chunkSize int) error {
+	h, err := OpenHeader(b, key, s.FileID)
+	if err != nil {
+		return err
+	}
+	if h.Version != s.Version || h.Cipher != s.cipher() || h.ChunkSize != uint32(chunkSize) {
+		return fmt.Errorf("%w: doesn't match the file's metadata", ErrInvalidHeader)
+	}
+	return nil
+}
+
+// openStreamChunk opens a chunk of a stream, telling a truncated stream apart from a corrupt one.
+func openStreamChunk(key [KeySize]byte, s Stream, index uint64, final bool, data, out []byte) ([]byte, error) {
+	out, err := OpenChunk(key, s, index, final, data, out)
+	if err != nil && final {
+		// a chunk that isn't the last one means the rest of the stream is missing
+		if _, err2 := OpenChunk(key, s, index, false, data, nil); err2 == nil {
+			return nil, ErrTruncated
+		}
+	}
+	return out, err
+}
+
+func (er *chunkReader) Read(b []byte) (n int, err error) {
+	for n < len(b) && er.err == nil {
+		// only move on to the next chunk once more is asked for, so the last bytes of the
+		// stream come back with a nil error and io.EOF follows on the next call
+		if er.idx >= len(er.chunk) {
+			if er.err = er.readNextChunk(); er.err != nil {
+				er.wipe()
+			}
+			continue
+		}
+		copied := copy(b[n:], er.chunk[er.idx:])
+		er.idx += copied
+		n += copied
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, er.err
+}
+
+// wipe zeroes the key and buffers once the stream has ended.
+func (er *chunkReader) wipe() {
+	Zero(er.key[:])
+	Zero(er.chunk[:cap(er.chunk)])
+	Zero(er.next[:cap(er.next)])
+	Zero(er.spare[:cap(er.spare)])
+}
+
+// readInput reads the input for one chunk, returning nil at the end of the input. Only the last
+// chunk can be short, so this reads a whole chunk however the input happens to be split up.
+func (er *chunkReader) readInput() ([]byte, error) {
+	data := er.spare
+	er.spare = nil
+	if cap(data) < er.chunkSize {
+		data = make([]byte, er.chunkSize)
+	}
+	data = data[:er.chunkSize]
+
+	n, err := io.ReadFull(er.r, data)
+	if err == io.EOF {
+		er.spare = data
+		return nil, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (er *chunkReader) readNextChunk() error {
+	if !er.started {
+		er.started = true
+		var start []byte
+		var err error
+		if er.startFn != nil {
+			if start, err = er.startFn(); err != nil {
+				return err
+			}
+		}
+		if er.next, err = er.readInput(); err != nil {
+			return err
+		}
+		if er.next == nil && er.stream.emptyFinal() {
+			if !er.sealing {
+				return er.stream.chunkError(er.seq, er.sealedSize, ErrTruncated)
+			}
+			er.next = []byte{}
+		}
+		if start != nil {
+			er.chunk = start
+			er.idx = 0
+			return nil
+		}
+	}
+
+	data := er.next
+	if data == nil {
+		return io.EOF
+	}
+	var err error
+	if er.next, err = er.readInput(); err != nil {
+		return err
+	}
+
+	// the last chunk has been read by now, so its buffer can take the next one
+	nextChunk, err := er.chunkFn(er.key, data, er.next == nil, er.chunk[:0])
+	if err != nil {
+		return er.stream.chunkError(er.seq, er.sealedSize, err)
+	}
+
+	er.spare = data
+	er.chunk = nextChunk
+	er.idx = 0
+	er.seq++
+	return nil
+}
+
+// HashFile returns the NewHash hash of the file at path.
+func HashFile(path string) ([]byte, error) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	return HashData(handle)
+}
+
+// NewHash returns the hash used to check file integrity, for hashing data incrementally.
+func NewHash() hash.Hash {
+	return sha256.New()
+}
+
+// NewKeyedHash returns the hash used to check the integrity of files encrypted with key. It's an
+// HMAC-SHA-256, so the hash doesn't let the server confirm a file's contents by hashing a guess at
+// them. Like that of NewHash, its state can be saved with MarshalBinary and restored with
+// UnmarshalBinary, which only works with a hash made with the same key, since the state doesn't
+// include it.
+func NewKeyedHash(key *[KeySize]byte) hash.Hash {
+	subkey := Subkey(key, PurposeHash)
+	defer Zero(subkey[:])
+	h := &keyedHash{inner: sha256.New()}
+	copy(h.innerPad[:], subkey[:])
+	copy(h.outerPad[:], subkey[:])
+	for i := range h.innerPad {
+		h.innerPad[i] ^= 0x36
+		h.outerPad[i] ^= 0x5c
+	}
+	h.inner.Write(h.innerPad[:])
+	return h
+}
+
+// keyedHash is HMAC with SHA-256, written out so the state of its inner hash can be saved, which
+// crypto/hmac doesn't allow.
+type keyedHash struct {
+	inner              hash.Hash
+	innerPad, outerPad [sha256.BlockSize]byte
+}
+
+func (h *keyedHash) Write(p []byte) (int, error) {
+	return h.inner.Write(p)
+}
+
+func (h *keyedHash) Sum(b []byte) []byte {
+	outer := sha256.New()
+	outer.Write(h.outerPad[:])
+	outer.Write(h.inner.Sum(nil))
+	return outer.Sum(b)
+}
+
+func (h *keyedHash) Reset() {
+	h.inner.Reset()
+	h.inner.Write(h.innerPad[:])
+}
+
+func (h *keyedHash) Size() int      { return sha256.Size }
+func (h *keyedHash) BlockSize() int { return sha256.BlockSize }
+
+func (h *keyedHash) MarshalBinary() ([]byte, error) {
+	return h.inner.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (h *keyedHash) UnmarshalBinary(b []byte) error {
+	return h.inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+}
+
+// HashData returns the NewHash hash of everything read from r.
+func HashData(r io.Reader) ([]byte, error) {
+	hasher := NewHash()
+
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// Zero overwrites b with zeroes, for wiping keys once they're no longer needed.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// NewSalt returns a random salt for a new file.
+func NewSalt() (*[SaltSize]byte, error) {
+	salt := new([SaltSize]byte)
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// GenerateKey derives a key from the password with DefaultScryptParams, generating a new salt if
+// salt is nil.
+func GenerateKey(password []byte, salt *[SaltSize]byte) (*[KeySize]byte, *[SaltSize]byte, error) {
+	// generate a new salt if necessary
+	if salt == nil {
+		var err error
+		if salt, err = NewSalt(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ScryptKey(password, salt, DefaultScryptParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, salt, nil
+}
+
+// ScryptKey derives a file key from a password.
+func ScryptKey(password []byte, salt *[SaltSize]byte, params ScryptParams) (*[KeySize]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	key := new([KeySize]byte)
+	keySlice, err := scrypt.Key(password, salt[:], params.N, params.R, params.P, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	copy(key[:], keySlice)
+	Zero(keySlice)
+
+	return key, nil
+}
+
+// KeyfileKey derives a key from the contents of a keyfile. Keyfiles are expected to be random
+// already, so this is just HKDF-Extract rather than a slow password hash.
+func KeyfileKey(keyfile []byte, salt *[SaltSize]byte) *[KeySize]byte {
+	mac := hmac.New(sha256.New, salt[:])
+	mac.Write(keyfile)
+
+	key := new([KeySize]byte)
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// YubiKeyChallenge is the challenge for a YubiKey to answer for a file with the salt.
+func YubiKeyChallenge(salt *[SaltSize]byte) []byte {
+	mac := hmac.New(sha256.New, salt[:])
+	mac.Write([]byte("relay yubikey"))
+	return mac.Sum(nil)
+}
+
+// Subkey purposes, as HKDF info strings. A file's key is only used to derive these subkeys, so
+// that each use of it has its own key.
+const (
+	PurposeChallenge = "relay challenge"
+	PurposeChunks    = "relay chunks"
+	PurposeHeader    = "relay header"
+	PurposeHash      = "relay hash"
+	// PurposeDirect keys the proofs that both ends of a direct transfer know the file's key.
+	PurposeDirect = "relay direct"
+	// PurposeCodeSender and PurposeCodeReceiver key the messages each side sends after agreeing
+	// on a key from a code with SPAKE2.
+	PurposeCodeSender   = "relay code sender"
+	PurposeCodeReceiver = "relay code receiver"
+)
+
+// Subkey derives the subkey of key for purpose with HKDF-Expand. The key must already be
+// uniformly random, as it is from scrypt or KeyfileKey.
+func Subkey(key *[KeySize]byte, purpose string) *[KeySize]byte {
+	subkey := new([KeySize]byte)
+	// reading up to 255 hash lengths from HKDF can't fail
+	io.ReadFull(hkdf.Expand(sha256.New, key[:], []byte(purpose)), subkey[:])
+	return subkey
+}
+
+// Challenge computes a file's challenge, which lets a client check a key before downloading the
+// file. It's an HMAC over a fixed context, which commits to the key: unlike a ciphertext, no
+// challenge validates under more than one key, and it reveals nothing about the file.
+func Challenge(key *[KeySize]byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("relay key check"))
+	return mac.Sum(nil)
+}
+
+// EncryptChunk seals a standalone message with secretbox and a random nonce. Unlike SealChunk,
+// it isn't bound to any position in a file.
+func EncryptChunk(key [KeySize]byte, chunk []byte) ([]byte, error) {
+	nonce, err := RandomNonce(Secretbox)
+	if err != nil {
+		return nil, err
+	}
+	return Secretbox.Seal(&key, nonce, chunk, nil, nil)
+}
+
+// NoncePrefixSize is the size of Stream.NoncePrefix.
+const NoncePrefixSize = 16
+
+// NewNoncePrefix returns a random nonce prefix for a new file.
+func NewNoncePrefix() ([]byte, error) {
+	prefix := make([]byte, NoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return prefix, nil
+}
+
+// chunkNonce is the nonce for the chunk at index: as much of the stream's nonce prefix as fits,
+// followed by the index. Every file has its own key, so these never repeat under one key, and
+// unlike random nonces they're safe however many chunks a file has.
+func chunkNonce(s Stream, index uint64) ([]byte, error) {
+	c := s.cipher()
+	if s.NoncePrefix == nil {
+		return RandomNonce(c)
+	}
+	if len(s.NoncePrefix) != NoncePrefixSize || c.NonceSize() < 8 {
+		return nil, fmt.Errorf("nonce prefix must be %d bytes", NoncePrefixSize)
+	}
+
+	nonce := make([]byte, c.NonceSize())
+	copy(nonce, s.NoncePrefix)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce, nil
+}
+
+// SealChunk encrypts the chunk at index of the stream, appending the ciphertext to out. final
+// marks the last chunk of the file.
+func SealChunk(key [KeySize]byte, s Stream, index uint64, final bool, chunk []byte, out []byte) ([]byte, error) {
+	nonce, err := chunkNonce(s, index)
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher().Seal(&key, nonce, chunk, chunkAD(s.FileID, index, final), out)
+}
+
+// OpenChunk decrypts a chunk sealed by SealChunk, which fails unless the file ID, index, and
+// final flag all match, as well as the nonce if the stream has a nonce prefix.
+func OpenChunk(key [KeySize]byte, s Stream, index uint64, final bool, ciphertext []byte, out []byte) ([]byte, error) {
+	if len(ciphertext) < s.cipher().Overhead() {
+		return nil, ErrCiphertextTooShort
+	}
+	if s.NoncePrefix != nil {
+		nonce, err := chunkNonce(s, index)
+		if err != nil {
+			return nil, err
+		}
+		if len(ciphertext) < len(nonce) || subtle.ConstantTimeCompare(ciphertext[:len(nonce)], nonce) != 1 {
+			return nil, ErrDecryptFailed
+		}
+	}
+	return s.cipher().Open(&key, ciphertext, chunkAD(s.FileID, index, final), out)
+}
+
+// chunkAD is the associated data for a chunk, binding it to the file, its position in it, and
+// whether it's the last one, so a chunk that's moved, duplicated, or taken from another file
+// fails to decrypt, as does a stream that's cut short.
+func chunkAD(fileID []byte, index uint64, final bool) []byte {
+	ad := make([]byte, 8+len(fileID)+8+1)
+	binary.BigEndian.PutUint64(ad, uint64(len(fileID)))
+	copy(ad[8:], fileID)
+	binary.BigEndian.PutUint64(ad[8+len(fileID):], index)
+	if final {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// DecryptChunk opens a message sealed by EncryptChunk, appending the plaintext to out.
+func DecryptChunk(key [KeySize]byte, ciphertext []byte, out []byte) ([]byte, error) {
+	if len(ciphertext) < Overhead {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce := new([NonceSize]byte)
+	copy(nonce[:], ciphertext)
+
+	out, ok := secretbox.Open(out, ciphertext[NonceSize:], nonce, &key)
+	if !ok {
+		return nil, ErrDecryptFailed
+	}
+	return out, nil
+}
@@ -0,0 +1,213 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// testChunkSize is small, so the streams below cover many chunks without much data.
+const testChunkSize = 64
+
+var testCiphers = []Cipher{Secretbox, XChaCha20Poly1305, AES256GCM}
+
+// testSizes cover empty streams, a short last chunk, and a last chunk that's exactly full.
+var testSizes = []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3*testChunkSize + 7}
+
+// testVersions are a stream without a header, one with a header whose empty streams have no
+// chunks, and one that always ends with a final chunk.
+var testVersions = []uint8{0, 2, FormatVersion}
+
+// testReaders wrap a reader in each of the ways iotest can misbehave without failing.
+var testReaders = map[string]func(io.Reader) io.Reader{
+	"plain":         func(r io.Reader) io.Reader { return r },
+	"OneByteReader": iotest.OneByteReader,
+	"HalfReader":    iotest.HalfReader,
+	"DataErrReader": iotest.DataErrReader,
+}
+
+type streamCase struct {
+	name      string
+	key       [KeySize]byte
+	stream    Stream
+	plaintext []byte
+}
+
+func (sc streamCase) sealedSize() int {
+	return testChunkSize + sc.stream.cipher().Overhead()
+}
+
+func (sc streamCase) encrypter(r io.Reader) io.Reader {
+	return NewEncryptingReader(r, testChunkSize, sc.key, sc.stream)
+}
+
+func (sc streamCase) decrypter(r io.Reader) io.Reader {
+	return NewDecryptingReader(r, sc.sealedSize(), sc.key, sc.stream)
+}
+
+// streamCases returns a case for every cipher, version and size. The streams have nonce prefixes,
+// so their ciphertexts are the same every time they're encrypted.
+func streamCases(t *testing.T) []streamCase {
+	t.Helper()
+	var cases []streamCase
+	for _, c := range testCiphers {
+		for _, version := range testVersions {
+			for _, size := range testSizes {
+				sc := streamCase{
+					name:      fmt.Sprintf("%s/v%d/%d", c.Name(), version, size),
+					plaintext: make([]byte, size),
+					stream: Stream{
+						Version:     version,
+						Cipher:      c,
+						FileID:      []byte("test file"),
+						NoncePrefix: bytes.Repeat([]byte{7}, NoncePrefixSize),
+					},
+				}
+				for i := range sc.plaintext {
+					sc.plaintext[i] = byte(i)
+				}
+				for i := range sc.key {
+					sc.key[i] = byte(i + 1)
+				}
+				cases = append(cases, sc)
+			}
+		}
+	}
+	return cases
+}
+
+func (sc streamCase) ciphertext(t *testing.T) []byte {
+	t.Helper()
+	ct, err := io.ReadAll(sc.encrypter(bytes.NewReader(sc.plaintext)))
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	return ct
+}
+
+func TestReaders(t *testing.T) {
+	for _, sc := range streamCases(t) {
+		t.Run(sc.name, func(t *testing.T) {
+			ct := sc.ciphertext(t)
+			if err := iotest.TestReader(sc.encrypter(bytes.NewReader(sc.plaintext)), ct); err != nil {
+				t.Errorf("encrypting: %v", err)
+			}
+			if err := iotest.TestReader(sc.decrypter(bytes.NewReader(ct)), sc.plaintext); err != nil {
+				t.Errorf("decrypting: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadersWithAwkwardInput(t *testing.T) {
+	for _, sc := range streamCases(t) {
+		ct := sc.ciphertext(t)
+		for name, wrap := range testReaders {
+			t.Run(sc.name+"/"+name, func(t *testing.T) {
+				var copied bytes.Buffer
+				if _, err := io.Copy(&copied, sc.encrypter(wrap(bytes.NewReader(sc.plaintext)))); err != nil {
+					t.Fatalf("encrypting with io.Copy: %v", err)
+				}
+				if !bytes.Equal(copied.Bytes(), ct) {
+					t.Error("encrypting with io.Copy gave a different ciphertext")
+				}
+
+				var teed bytes.Buffer
+				read, err := io.ReadAll(io.TeeReader(sc.decrypter(wrap(bytes.NewReader(ct))), &teed))
+				if err != nil {
+					t.Fatalf("decrypting through a TeeReader: %v", err)
+				}
+				if !bytes.Equal(read, sc.plaintext) || !bytes.Equal(teed.Bytes(), sc.plaintext) {
+					t.Error("decrypting through a TeeReader gave a different plaintext")
+				}
+			})
+		}
+	}
+}
+
+func TestReadersTimeout(t *testing.T) {
+	for _, sc := range streamCases(t) {
+		if len(sc.plaintext) <= testChunkSize {
+			continue // the timeout comes after the first read, so needs a longer stream
+		}
+		t.Run(sc.name, func(t *testing.T) {
+			ct := sc.ciphertext(t)
+			for name, r := range map[string]io.Reader{
+				"encrypting": sc.encrypter(iotest.TimeoutReader(bytes.NewReader(sc.plaintext))),
+				"decrypting": sc.decrypter(iotest.TimeoutReader(iotest.OneByteReader(bytes.NewReader(ct)))),
+			} {
+				if _, err := io.Copy(io.Discard, r); !errors.Is(err, iotest.ErrTimeout) {
+					t.Errorf("%s: got %v, want ErrTimeout", name, err)
+				}
+				// errors are sticky, so nothing more comes out after one
+				if n, err := r.Read(make([]byte, 1)); n != 0 || !errors.Is(err, iotest.ErrTimeout) {
+					t.Errorf("%s: read %d bytes and %v after the timeout", name, n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWritersMatchReaders(t *testing.T) {
+	for _, sc := range streamCases(t) {
+		t.Run(sc.name, func(t *testing.T) {
+			ct := sc.ciphertext(t)
+
+			var encrypted bytes.Buffer
+			ew := NewEncryptingWriter(&encrypted, testChunkSize, sc.key, sc.stream)
+			if _, err := io.Copy(ew, iotest.OneByteReader(bytes.NewReader(sc.plaintext))); err != nil {
+				t.Fatal(err)
+			}
+			if err := ew.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encrypted.Bytes(), ct) {
+				t.Error("the encrypting writer and reader gave different ciphertexts")
+			}
+
+			var decrypted bytes.Buffer
+			dw := NewDecryptingWriter(&decrypted, sc.sealedSize(), sc.key, sc.stream)
+			if _, err := io.Copy(dw, iotest.HalfReader(bytes.NewReader(ct))); err != nil {
+				t.Fatal(err)
+			}
+			if err := dw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), sc.plaintext) {
+				t.Error("the decrypting writer gave a different plaintext")
+			}
+		})
+	}
+}
+
+func TestTruncatedStreams(t *testing.T) {
+	for _, sc := range streamCases(t) {
+		ct := sc.ciphertext(t)
+		header := 0
+		if sc.stream.hasHeader() {
+			header = HeaderSize
+		}
+		// cut the stream at every chunk boundary before its end
+		for end := header; end < len(ct); end += sc.sealedSize() {
+			if end == header && !sc.stream.emptyFinal() {
+				continue // without a final chunk, an empty stream looks the same
+			}
+			t.Run(fmt.Sprintf("%s/cut at %d", sc.name, end), func(t *testing.T) {
+				if _, err := io.ReadAll(sc.decrypter(bytes.NewReader(ct[:end]))); !errors.Is(err, ErrTruncated) {
+					t.Errorf("reader: got %v, want ErrTruncated", err)
+				}
+				dw := NewDecryptingWriter(io.Discard, sc.sealedSize(), sc.key, sc.stream)
+				_, err := dw.Write(ct[:end])
+				if err == nil {
+					err = dw.Close()
+				}
+				if !errors.Is(err, ErrTruncated) {
+					t.Errorf("writer: got %v, want ErrTruncated", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Package crypto implements relay's file encryption, so other tools can produce and consume
+// files compatible with relay clients without going through them.
+//
+// A file is encrypted with a 32-byte file key, derived from a password with ScryptKey, from a
+// keyfile or a YubiKey's response to YubiKeyChallenge with KeyfileKey, or agreed with a
+// recipient's public key with X25519SenderKey, or with an SSH key with SSHEd25519SenderKey or
+// SSHRSASenderKey. The key is only used to derive subkeys with Subkey: one for the challenge
+// that lets a downloader check their key (Challenge), one for the stream header, one for the
+// chunks, and one for the hash of the contents (NewKeyedHash).
+//
+// The encrypted contents are a stream of FormatVersion, made by NewEncryptingReader or
+// NewEncryptingWriter and read by NewDecryptingReader or NewDecryptingWriter. Since version 1 it
+// starts with a HeaderSize-byte Header, followed by the plaintext in fixed size chunks, each
+// sealed on its own with SealChunk by the stream's Cipher. Every chunk is bound to the file ID,
+// its index, and whether it's the last, so chunks can't be reordered, moved between files, or
+// dropped from the end without detection. Every chunk but the last is the same size, so any
+// chunk can be found from its index and decrypted on its own, which NewReaderAt uses for random
+// access.
+//
+// The salt, KDF, cipher, format version, nonce prefix, challenge, and hash are stored in the
+// file's metadata, which the other side needs to decrypt the stream.
+//
+// Keys should be wiped with Zero or Wipe once they're no longer needed, and can be kept out of
+// swap with Lock. The readers and writers wipe their own subkeys and buffers once their stream
+// ends or fails.
+package crypto
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FormatVersion is the version of the encrypted stream format written by this package. Version 0
+// streams have no header, and start with their first chunk. Version 2 files have a keyed hash of
+// their contents (see NewKeyedHash) rather than a plain one. Version 3 streams always end with a
+// final chunk, which is empty for an empty file, so a stream cut down to its header fails too.
+const FormatVersion = 3
+
+// HeaderSize is the size of the header at the start of a stream of FormatVersion 1 or later.
+const HeaderSize = len(headerMagic) + 1 + 1 + 4 + sha256.Size
+
+var headerMagic = [4]byte{'R', 'L', 'A', 'Y'}
+
+// ErrInvalidHeader is returned for stream headers which are malformed, unauthentic, or don't
+// match what the stream was expected to be.
+var ErrInvalidHeader = errors.New("relay: invalid stream header")
+
+// cipherIDs identify ciphers in stream headers. They must never be reused.
+var cipherIDs = map[string]byte{
+	CipherSecretbox:         1,
+	CipherXChaCha20Poly1305: 2,
+	CipherAES256GCM:         3,
+}
+
+// Header describes how an encrypted stream is laid out. It's authenticated with a subkey of the
+// file key, so it can't be altered without the key.
+type Header struct {
+	Version uint8
+	Cipher  Cipher
+	// ChunkSize is the size of each chunk of ciphertext, except the last.
+	ChunkSize uint32
+}
+
+func (h Header) fields() []byte {
+	b := make([]byte, 0, HeaderSize)
+	b = append(b, headerMagic[:]...)
+	b = append(b, h.Version, cipherIDs[h.Cipher.Name()])
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], h.ChunkSize)
+	return append(b, size[:]...)
+}
+
+func headerTag(key *[KeySize]byte, fileID, fields []byte) []byte {
+	mac := hmac.New(sha256.New, Subkey(key, PurposeHeader)[:])
+	mac.Write(fields)
+	mac.Write(fileID)
+	return mac.Sum(nil)
+}
+
+// Seal encodes the header for the file with the given ID, authenticated with the file key.
+func (h Header) Seal(key *[KeySize]byte, fileID []byte) []byte {
+	fields := h.fields()
+	return append(fields, headerTag(key, fileID, fields)...)
+}
+
+// OpenHeader decodes and authenticates a header sealed by Header.Seal.
+func OpenHeader(b []byte, key *[KeySize]byte, fileID []byte) (Header, error) {
+	var h Header
+	if len(b) != HeaderSize || !bytes.Equal(b[:len(headerMagic)], headerMagic[:]) {
+		return h, ErrInvalidHeader
+	}
+
+	fields, tag := b[:HeaderSize-sha256.Size], b[HeaderSize-sha256.Size:]
+	if !hmac.Equal(tag, headerTag(key, fileID, fields)) {
+		return h, fmt.Errorf("%w: authentication failed", ErrInvalidHeader)
+	}
+
+	h.Version = fields[4]
+	if h.Version < 1 || h.Version > FormatVersion {
+		return h, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, h.Version)
+	}
+	for name, id := range cipherIDs {
+		if id == fields[5] {
+			h.Cipher, _ = CipherByName(name)
+		}
+	}
+	if h.Cipher == nil {
+		return h, fmt.Errorf("%w: unknown cipher %d", ErrInvalidHeader, fields[5])
+	}
+	h.ChunkSize = binary.BigEndian.Uint32(fields[6:])
+	return h, nil
+}
@@ -0,0 +1,25 @@
+package crypto
+
+// Lock asks the OS not to swap b out to disk, where that's supported. It's best effort: a key
+// that couldn't be locked is still fine to use, and may just end up in swap. Locking works on
+// whole pages and doesn't nest, so Unlock can also unlock other keys on the same page.
+func Lock(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return mlock(b)
+}
+
+// Unlock undoes Lock.
+func Unlock(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return munlock(b)
+}
+
+// Wipe unlocks and zeroes a key once it's no longer needed.
+func Wipe(key *[KeySize]byte) {
+	Unlock(key[:])
+	Zero(key[:])
+}
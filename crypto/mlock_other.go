@@ -0,0 +1,6 @@
+//go:build !darwin && !linux
+
+package crypto
+
+func mlock(b []byte) error   { return nil }
+func munlock(b []byte) error { return nil }
@@ -0,0 +1,8 @@
+//go:build darwin || linux
+
+package crypto
+
+import "syscall"
+
+func mlock(b []byte) error   { return syscall.Mlock(b) }
+func munlock(b []byte) error { return syscall.Munlock(b) }
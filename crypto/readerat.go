@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ReaderAt decrypts any part of a stream from random access to its ciphertext. Every chunk but
+// the last has the same size, so the offset of a chunk's ciphertext follows from its index, and
+// reads only need to decrypt the chunks they cover. Wrap it in an io.SectionReader to Seek.
+type ReaderAt struct {
+	r         io.ReaderAt
+	key       [KeySize]byte
+	stream    Stream
+	chunkSize int64
+	header    int64
+	chunks    int64
+	// size is the size of the plaintext, and end the size of the ciphertext.
+	size int64
+	end  int64
+
+	// mu guards the most recently decrypted chunk, which sequential reads smaller than a chunk
+	// can reuse.
+	mu       sync.Mutex
+	cacheIdx int64
+	cache    []byte
+}
+
+// NewReaderAt returns a ReaderAt for a whole stream from NewEncryptingReader, whose ciphertext of
+// size bytes is read from r in chunks of chunkSize bytes.
+func NewReaderAt(r io.ReaderAt, size int64, chunkSize int, key [KeySize]byte, s Stream) (*ReaderAt, error) {
+	if s.FirstChunk != 0 {
+		return nil, errors.New("relay: a ReaderAt needs the whole stream")
+	}
+	ra := &ReaderAt{
+		r:         r,
+		key:       *Subkey(&key, PurposeChunks),
+		stream:    s,
+		chunkSize: int64(chunkSize),
+		end:       size,
+		cacheIdx:  -1,
+	}
+
+	if s.hasHeader() {
+		b := make([]byte, HeaderSize)
+		if _, err := r.ReadAt(b, 0); err != nil {
+			return nil, fmt.Errorf("reading stream header: %w", err)
+		}
+		if err := s.CheckHeader(b, &key, chunkSize); err != nil {
+			return nil, err
+		}
+		ra.header = int64(HeaderSize)
+	}
+
+	body := size - ra.header
+	if body < 0 {
+		return nil, ErrTruncated
+	}
+	overhead := int64(s.cipher().Overhead())
+	ra.chunks = (body + ra.chunkSize - 1) / ra.chunkSize
+	if ra.chunks == 0 && s.emptyFinal() {
+		return nil, ErrTruncated
+	}
+	// only the final chunk of an empty stream can have no plaintext
+	last := body - (ra.chunks-1)*ra.chunkSize
+	if ra.chunks > 0 && (last < overhead || last == overhead && (ra.chunks > 1 || !s.emptyFinal())) {
+		return nil, ErrCiphertextTooShort
+	}
+	ra.size = body - ra.chunks*overhead
+	if ra.size == 0 && ra.chunks > 0 {
+		// nothing will be read, so check the empty final chunk now
+		if _, err := ra.chunk(0); err != nil {
+			return nil, s.chunkError(0, chunkSize, err)
+		}
+	}
+	return ra, nil
+}
+
+// Size is the size of the decrypted stream.
+func (ra *ReaderAt) Size() int64 {
+	return ra.size
+}
+
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("relay: negative offset %d", off)
+	}
+	raw := ra.chunkSize - int64(ra.stream.cipher().Overhead())
+
+	n := 0
+	for n < len(p) && off < ra.size {
+		idx := off / raw
+		chunk, err := ra.chunk(idx)
+		if err != nil {
+			return n, ra.stream.chunkError(uint64(idx), int(ra.chunkSize), err)
+		}
+		copied := copy(p[n:], chunk[off-idx*raw:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ra *ReaderAt) chunk(idx int64) ([]byte, error) {
+	ra.mu.Lock()
+	if idx == ra.cacheIdx {
+		defer ra.mu.Unlock()
+		return ra.cache, nil
+	}
+	ra.mu.Unlock()
+
+	start := ra.header + idx*ra.chunkSize
+	end := start + ra.chunkSize
+	final := idx == ra.chunks-1
+	if final {
+		end = ra.end
+	}
+
+	data := make([]byte, end-start)
+	if n, err := ra.r.ReadAt(data, start); n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	out, err := openStreamChunk(ra.key, ra.stream, uint64(idx), final, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ra.mu.Lock()
+	ra.cacheIdx, ra.cache = idx, out
+	ra.mu.Unlock()
+	return out, nil
+}
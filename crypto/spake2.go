@@ -0,0 +1,216 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The SPAKE2 points M and N for P-256 from RFC 9382, which nobody knows the discrete logs of.
+var (
+	spake2M = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spake2N = mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+// p256Order is the order of the P-256 group, which SPAKE2's scalars are taken modulo.
+var p256Order = mustModulus("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551")
+
+// wideModulus is 2^384-1, for reading the MHF output as a number before reducing it modulo the
+// group order.
+var wideModulus = mustModulus("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+
+// The identities of the two sides of a code exchange, bound into the transcript.
+const (
+	spake2Sender   = "relay sender"
+	spake2Receiver = "relay receiver"
+)
+
+// The scrypt parameters for the MHF that turns a password into SPAKE2's w. Codes are short, so
+// they're cheap, but an offline guess at one costs as much as the exchange does.
+const (
+	spake2ScryptN = 1 << 15
+	spake2ScryptR = 8
+	spake2ScryptP = 1
+)
+
+// spake2WideSize is the MHF output size: 128 bits more than the group order, so reducing it
+// leaves no noticeable bias.
+const spake2WideSize = 48
+
+// ErrInvalidPAKEMessage is returned by SPAKE2.Finish for messages which aren't valid points.
+var ErrInvalidPAKEMessage = errors.New("relay: invalid PAKE message")
+
+func mustPoint(s string) *nistec.P256Point {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		panic("invalid SPAKE2 point " + s)
+	}
+	return p
+}
+
+func mustModulus(s string) *bigmod.Modulus {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	m, err := bigmod.NewModulus(b)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// SPAKE2 is one side of a SPAKE2 exchange (RFC 9382) over P-256, which turns a low entropy
+// password shared by both sides into a strong shared key. Someone who doesn't know the password
+// gets a single guess at it per exchange, and a passive observer learns nothing about it.
+type SPAKE2 struct {
+	sender bool
+	// idA and idB are the identities of the sender (A) and receiver (B).
+	idA, idB []byte
+	w, x     *bigmod.Nat
+	msg      []byte
+}
+
+// NewSPAKE2 starts an exchange with the password. One side must be the sender, and the other
+// not; the identities of both are fixed.
+func NewSPAKE2(password []byte, sender bool) (*SPAKE2, error) {
+	w, err := spake2Password(password)
+	if err != nil {
+		return nil, err
+	}
+	// ECDH keys are uniformly random scalars, which is all x needs to be
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	x, err := bigmod.NewNat().SetBytes(priv.Bytes(), p256Order)
+	if err != nil {
+		return nil, err
+	}
+	return newSPAKE2([]byte(spake2Sender), []byte(spake2Receiver), w, x, sender)
+}
+
+// spake2Password derives w from the password with an MHF, as RFC 9382 asks.
+func spake2Password(password []byte) (*bigmod.Nat, error) {
+	wide, err := scrypt.Key(password, []byte("relay spake2"), spake2ScryptN, spake2ScryptR, spake2ScryptP, spake2WideSize)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(wide)
+	n, err := bigmod.NewNat().SetBytes(wide, wideModulus)
+	if err != nil {
+		return nil, err
+	}
+	return bigmod.NewNat().Mod(n, p256Order), nil
+}
+
+// newSPAKE2 starts an exchange between the identities idA and idB with the scalars w and x.
+func newSPAKE2(idA, idB []byte, w, x *bigmod.Nat, sender bool) (*SPAKE2, error) {
+	// the sender sends x*G + w*M, and the receiver x*G + w*N
+	blind := spake2N
+	if sender {
+		blind = spake2M
+	}
+	xG, err := nistec.NewP256Point().ScalarBaseMult(x.Bytes(p256Order))
+	if err != nil {
+		return nil, err
+	}
+	wB, err := nistec.NewP256Point().ScalarMult(blind, w.Bytes(p256Order))
+	if err != nil {
+		return nil, err
+	}
+	msg := nistec.NewP256Point().Add(xG, wB).Bytes()
+	return &SPAKE2{sender, idA, idB, w, x, msg}, nil
+}
+
+// Message is the message to send to the other side.
+func (s *SPAKE2) Message() []byte {
+	return s.msg
+}
+
+// Finish derives the shared key from the other side's message. Both sides get the same key only
+// if they used the same password, which the caller must check by using the key.
+func (s *SPAKE2) Finish(peer []byte) (*[KeySize]byte, error) {
+	tt, err := s.transcript(peer)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(tt)
+
+	// Ke is the first half of the hash of the transcript, which is stretched to a full key
+	sum := sha256.Sum256(tt)
+	defer Zero(sum[:])
+	key := new([KeySize]byte)
+	io.ReadFull(hkdf.Expand(sha256.New, sum[:sha256.Size/2], []byte("relay code key")), key[:])
+	return key, nil
+}
+
+// sharedPoint is K = x*(peer - w*blind), with the peer's blinding removed.
+func (s *SPAKE2) sharedPoint(peer []byte) (*nistec.P256Point, error) {
+	// only uncompressed points, as RFC 9382 sends them, and never the point at infinity
+	if len(peer) != 65 || peer[0] != 4 {
+		return nil, ErrInvalidPAKEMessage
+	}
+	p, err := nistec.NewP256Point().SetBytes(peer)
+	if err != nil {
+		return nil, ErrInvalidPAKEMessage
+	}
+
+	blind := spake2M
+	if s.sender {
+		blind = spake2N
+	}
+	negW := bigmod.NewNat().ExpandFor(p256Order).Sub(s.w, p256Order)
+	wB, err := nistec.NewP256Point().ScalarMult(blind, negW.Bytes(p256Order))
+	if err != nil {
+		return nil, err
+	}
+	k, err := nistec.NewP256Point().ScalarMult(p.Add(p, wB), s.x.Bytes(p256Order))
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Bytes()) == 1 {
+		// the point at infinity, which only a malicious peer could cause
+		return nil, ErrInvalidPAKEMessage
+	}
+	return k, nil
+}
+
+// transcript is RFC 9382's TT: the identities, M, N, both messages, K and w, each with its
+// length.
+func (s *SPAKE2) transcript(peer []byte) ([]byte, error) {
+	k, err := s.sharedPoint(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	msgA, msgB := s.msg, peer
+	if !s.sender {
+		msgA, msgB = peer, s.msg
+	}
+	var tt []byte
+	for _, b := range [][]byte{
+		s.idA, s.idB,
+		spake2M.Bytes(), spake2N.Bytes(),
+		msgA, msgB,
+		k.Bytes(),
+		s.w.Bytes(p256Order),
+	} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(b)))
+		tt = append(tt, b...)
+	}
+	return tt, nil
+}
@@ -0,0 +1,165 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"filippo.io/bigmod"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func scalar(t *testing.T, s string) *bigmod.Nat {
+	t.Helper()
+	n, err := bigmod.NewNat().SetBytes(unhex(t, s), p256Order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// spake2Vector is a SPAKE2-P256-SHA256 test vector from RFC 9382, appendix B.
+var spake2Vector = struct {
+	idA, idB   string
+	w, x, y    string
+	pA, pB, k  string
+	transcript string
+}{
+	idA: "server",
+	idB: "client",
+	w:   "2ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a5f",
+	x:   "43dd0fd7215bdcb482879fca3220c6a968e66d70b1356cac18bb26c84a78d729",
+	y:   "dcb60106f276b02606d8ef0a328c02e4b629f84f89786af5befb0bc75b6e66be",
+	pA: "04a56fa807caaa53a4d28dbb9853b9815c61a411118a6fe516a8798434751470f9" +
+		"010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb4116988ede5f912c",
+	pB: "0406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d0" +
+		"9857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b7",
+	k: "0412af7e89717850671913e6b469ace67bd90a4df8ce45c2af19010175e37eed69" +
+		"f75897996d539356e2fa6a406d528501f907e04d97515fbe83db277b715d3325",
+	transcript: "06000000000000007365727665720600000000000000636c69656e74410000000000000004886e2f97ace46e55ba9dd7" +
+		"242579f2993b64e16ef3dcab95afd497333d8fa12f5ff355163e43ce224e0b0e65ff02ac8e5c7be09419c785e0ca547d" +
+		"55a12e2d20410000000000000004d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b4907d6" +
+		"0aa6bfade45008a636337f5168c64d9bd36034808cd564490b1e656edbe7410000000000000004a56fa807caaa53a4d2" +
+		"8dbb9853b9815c61a411118a6fe516a8798434751470f9010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb41" +
+		"16988ede5f912c41000000000000000406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d0" +
+		"9857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b741000000000000000412af7e89717850" +
+		"671913e6b469ace67bd90a4df8ce45c2af19010175e37eed69f75897996d539356e2fa6a406d528501f907e04d97515f" +
+		"be83db277b715d332520000000000000002ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a" +
+		"5f",
+}
+
+func TestSPAKE2Vector(t *testing.T) {
+	v := spake2Vector
+	w := scalar(t, v.w)
+	a, err := newSPAKE2([]byte(v.idA), []byte(v.idB), w, scalar(t, v.x), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSPAKE2([]byte(v.idA), []byte(v.idB), w, scalar(t, v.y), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(a.Message()); got != v.pA {
+		t.Errorf("pA = %s, want %s", got, v.pA)
+	}
+	if got := hex.EncodeToString(b.Message()); got != v.pB {
+		t.Errorf("pB = %s, want %s", got, v.pB)
+	}
+
+	for _, side := range []struct {
+		name string
+		s    *SPAKE2
+		peer string
+	}{{"A", a, v.pB}, {"B", b, v.pA}} {
+		k, err := side.s.sharedPoint(unhex(t, side.peer))
+		if err != nil {
+			t.Fatalf("%s: %v", side.name, err)
+		}
+		if got := hex.EncodeToString(k.Bytes()); got != v.k {
+			t.Errorf("%s: K = %s, want %s", side.name, got, v.k)
+		}
+		tt, err := side.s.transcript(unhex(t, side.peer))
+		if err != nil {
+			t.Fatalf("%s: %v", side.name, err)
+		}
+		if got := hex.EncodeToString(tt); got != v.transcript {
+			t.Errorf("%s: TT = %s, want %s", side.name, got, v.transcript)
+		}
+	}
+
+	keyA, err := a.Finish(b.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := b.Finish(a.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *keyA != *keyB {
+		t.Error("the two sides derived different keys")
+	}
+}
+
+func TestSPAKE2Passwords(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		sender, recver string
+		same           bool
+	}{
+		{"same password", "7-apple-tiger", "7-apple-tiger", true},
+		{"wrong password", "7-apple-tiger", "7-apple-tigers", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewSPAKE2([]byte(tc.sender), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := NewSPAKE2([]byte(tc.recver), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyA, err := a.Finish(b.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyB, err := b.Finish(a.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (*keyA == *keyB) != tc.same {
+				t.Errorf("keys match = %v, want %v", *keyA == *keyB, tc.same)
+			}
+		})
+	}
+}
+
+func TestSPAKE2InvalidMessages(t *testing.T) {
+	s, err := NewSPAKE2([]byte("7-apple-tiger"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offCurve := bytes.Clone(s.Message())
+	offCurve[len(offCurve)-1] ^= 1
+
+	for name, msg := range map[string][]byte{
+		"empty":      nil,
+		"infinity":   {0},
+		"compressed": unhex(t, "02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f"),
+		"off curve":  offCurve,
+		"too long":   append(bytes.Clone(s.Message()), 0),
+	} {
+		if _, err := s.Finish(msg); !errors.Is(err, ErrInvalidPAKEMessage) {
+			t.Errorf("%s: got %v, want ErrInvalidPAKEMessage", name, err)
+		}
+	}
+}
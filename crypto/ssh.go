@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MinRSAKeyBits is the smallest RSA key files can be encrypted to.
+const MinRSAKeyBits = 2048
+
+// ErrInvalidSSHKey is returned for SSH public keys which can't be encrypted to.
+var ErrInvalidSSHKey = errors.New("relay: invalid SSH key")
+
+// curve25519P is the prime 2^255 - 19.
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// ed25519ToX25519 converts an Ed25519 public key to the X25519 public key of the same private
+// key, with the birational map u = (1 + y) / (1 - y).
+func ed25519ToX25519(pub ed25519.PublicKey) (*[X25519KeySize]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, ErrInvalidSSHKey
+	}
+	// y is little endian, with the top bit holding the sign of x
+	le := make([]byte, len(pub))
+	for i, b := range pub {
+		le[len(pub)-1-i] = b
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrInvalidSSHKey
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, ErrInvalidSSHKey
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := new([X25519KeySize]byte)
+	u.FillBytes(out[:])
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// SSHEd25519SenderKey derives a new file key for an Ed25519 SSH public key, like
+// X25519SenderKey with the key converted to X25519.
+func SSHEd25519SenderKey(recipient ed25519.PublicKey, salt *[SaltSize]byte) (key *[KeySize]byte, ephemeral *[X25519KeySize]byte, err error) {
+	pub, err := ed25519ToX25519(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, ephemeral, err := NewX25519Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Zero(private[:])
+
+	if key, err = x25519Key(KDFSSHEd25519, private, pub, ephemeral, pub, salt); err != nil {
+		return nil, nil, err
+	}
+	return key, ephemeral, nil
+}
+
+// SSHEd25519RecipientKey derives the file key made by SSHEd25519SenderKey from the Ed25519
+// private key.
+func SSHEd25519RecipientKey(private ed25519.PrivateKey, ephemeral *[X25519KeySize]byte, salt *[SaltSize]byte) (*[KeySize]byte, error) {
+	if len(private) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidSSHKey
+	}
+	// the X25519 scalar is the Ed25519 one, which X25519 clamps the same way
+	h := sha512.Sum512(private.Seed())
+	defer Zero(h[:])
+	scalar := new([X25519KeySize]byte)
+	copy(scalar[:], h[:X25519KeySize])
+	defer Zero(scalar[:])
+
+	pub, err := ed25519ToX25519(private.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return x25519Key(KDFSSHEd25519, scalar, ephemeral, ephemeral, pub, salt)
+}
+
+// SSHRSASenderKey derives a new file key for an RSA SSH public key from a random secret, which
+// it returns wrapped with RSA-OAEP for SSHRSARecipientKey to unwrap.
+func SSHRSASenderKey(recipient *rsa.PublicKey, salt *[SaltSize]byte) (key *[KeySize]byte, wrapped []byte, err error) {
+	if recipient.N.BitLen() < MinRSAKeyBits {
+		return nil, nil, fmt.Errorf("%w: RSA keys must be at least %d bits", ErrInvalidSSHKey, MinRSAKeyBits)
+	}
+	secret := make([]byte, KeySize)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	defer Zero(secret)
+
+	if wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, secret, salt[:]); err != nil {
+		return nil, nil, err
+	}
+	return KeyfileKey(secret, salt), wrapped, nil
+}
+
+// SSHRSARecipientKey derives the file key made by SSHRSASenderKey from the RSA private key.
+func SSHRSARecipientKey(private *rsa.PrivateKey, wrapped []byte, salt *[SaltSize]byte) (*[KeySize]byte, error) {
+	secret, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, private, wrapped, salt[:])
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	defer Zero(secret)
+	return KeyfileKey(secret, salt), nil
+}
@@ -0,0 +1,173 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errWriterClosed = errors.New("relay: write to closed writer")
+
+// chunkWriter buffers writes into chunks for chunkFn. Whether a chunk is the last isn't known
+// until something more is written or the writer is closed, so a whole chunk is held back until
+// then.
+type chunkWriter struct {
+	w io.Writer
+	// chunkFn encrypts or decrypts data, appending the result to out.
+	chunkFn func(data []byte, final bool, out []byte) ([]byte, error)
+	// startFn consumes anything before the first chunk, returning the rest of the data, and
+	// whether it has finished.
+	startFn func(b []byte) ([]byte, bool, error)
+
+	key       [KeySize]byte
+	chunkSize int
+	// sealedSize is the size of each chunk's ciphertext.
+	sealedSize int
+	stream     Stream
+	// sealing is whether the writer encrypts rather than decrypts.
+	sealing bool
+	buf     []byte
+	// out is reused for each chunk's output, since writers can't keep what they're given.
+	out     []byte
+	seq     uint64
+	started bool
+	// err is the first error, after which every call fails.
+	err error
+}
+
+// NewEncryptingWriter returns a writer which encrypts what is written to it to w in the format of
+// NewEncryptingReader, in chunks of chunkSize bytes of plaintext. It must be closed to write the
+// last chunk, but closing it doesn't close w.
+func NewEncryptingWriter(w io.Writer, chunkSize int, key [KeySize]byte, s Stream) io.WriteCloser {
+	cw := &chunkWriter{w: w, chunkSize: chunkSize, sealedSize: chunkSize + s.cipher().Overhead(), stream: s,
+		sealing: true, seq: s.FirstChunk, started: !s.hasHeader()}
+	cw.key = *Subkey(&key, PurposeChunks)
+	cw.chunkFn = func(data []byte, final bool, out []byte) ([]byte, error) {
+		return SealChunk(cw.key, s, cw.seq, final, data, out)
+	}
+	cw.startFn = func(b []byte) ([]byte, bool, error) {
+		defer Zero(key[:])
+		if _, err := w.Write(s.header(&key, chunkSize)); err != nil {
+			return nil, false, err
+		}
+		return b, true, nil
+	}
+	return cw
+}
+
+// NewDecryptingWriter returns a writer which decrypts a stream from NewEncryptingReader written
+// to it, in chunks of chunkSize bytes of ciphertext, writing the plaintext to w. Close fails if
+// the stream was incomplete, but doesn't close w.
+func NewDecryptingWriter(w io.Writer, chunkSize int, key [KeySize]byte, s Stream) io.WriteCloser {
+	cw := &chunkWriter{w: w, chunkSize: chunkSize, sealedSize: chunkSize, stream: s,
+		seq: s.FirstChunk, started: !s.hasHeader()}
+	cw.key = *Subkey(&key, PurposeChunks)
+	cw.chunkFn = func(data []byte, final bool, out []byte) ([]byte, error) {
+		return openStreamChunk(cw.key, s, cw.seq, final, data, out)
+	}
+	cw.startFn = func(b []byte) ([]byte, bool, error) {
+		need := HeaderSize - len(cw.buf)
+		if len(b) < need {
+			cw.buf = append(cw.buf, b...)
+			return nil, false, nil
+		}
+		header := append(cw.buf, b[:need]...)
+		cw.buf = nil
+		defer Zero(key[:])
+		if err := s.CheckHeader(header, &key, chunkSize); err != nil {
+			return nil, false, err
+		}
+		return b[need:], true, nil
+	}
+	return cw
+}
+
+func (cw *chunkWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n := len(b)
+
+	if !cw.started {
+		rest, done, err := cw.startFn(b)
+		if err != nil {
+			return 0, cw.fail(err)
+		}
+		if !done {
+			return n, nil
+		}
+		cw.started = true
+		b = rest
+	}
+
+	cw.buf = append(cw.buf, b...)
+	// keep the last whole chunk until it's known whether it's the final one
+	start := 0
+	for len(cw.buf)-start > cw.chunkSize {
+		if err := cw.writeChunk(cw.buf[start:start+cw.chunkSize], false); err != nil {
+			return 0, err
+		}
+		start += cw.chunkSize
+	}
+	if start > 0 {
+		cw.buf = append(cw.buf[:0], cw.buf[start:]...)
+	}
+	return n, nil
+}
+
+func (cw *chunkWriter) writeChunk(data []byte, final bool) error {
+	out, err := cw.chunkFn(data, final, cw.out[:0])
+	if err != nil {
+		return cw.fail(cw.stream.chunkError(cw.seq, cw.sealedSize, err))
+	}
+	cw.out = out
+	if _, err = cw.w.Write(out); err != nil {
+		return cw.fail(err)
+	}
+	cw.seq++
+	return nil
+}
+
+// Close writes the last chunk. An empty stream has no chunks at all before version 3, and an
+// empty final chunk since.
+func (cw *chunkWriter) Close() error {
+	if cw.err == errWriterClosed {
+		return nil
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+
+	if !cw.started {
+		rest, done, err := cw.startFn(nil)
+		if err == nil && !done {
+			err = fmt.Errorf("reading stream header: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return cw.fail(err)
+		}
+		cw.buf = rest
+	}
+	if len(cw.buf) == 0 && cw.stream.emptyFinal() && !cw.sealing {
+		// nothing held back means no chunks at all, so the final one is missing
+		return cw.fail(cw.stream.chunkError(cw.seq, cw.sealedSize, ErrTruncated))
+	}
+	if len(cw.buf) > 0 || cw.stream.emptyFinal() {
+		if err := cw.writeChunk(cw.buf, true); err != nil {
+			return err
+		}
+	}
+	cw.fail(errWriterClosed)
+	return nil
+}
+
+// fail records the writer's first error, and wipes its key and buffers since it can't be used
+// any more.
+func (cw *chunkWriter) fail(err error) error {
+	cw.err = err
+	Zero(cw.key[:])
+	Zero(cw.buf[:cap(cw.buf)])
+	Zero(cw.out[:cap(cw.out)])
+	cw.buf, cw.out = nil, nil
+	return err
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// X25519KeySize is the size of X25519 public and private keys.
+const X25519KeySize = curve25519.PointSize
+
+// NewX25519Key generates an X25519 private key and returns it with its public key.
+func NewX25519Key() (private, public *[X25519KeySize]byte, err error) {
+	private = new([X25519KeySize]byte)
+	if _, err = rand.Read(private[:]); err != nil {
+		return nil, nil, err
+	}
+	if public, err = X25519Public(private); err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+// X25519Public returns the public key for an X25519 private key.
+func X25519Public(private *[X25519KeySize]byte) (*[X25519KeySize]byte, error) {
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return (*[X25519KeySize]byte)(pub), nil
+}
+
+// X25519SenderKey derives a new file key for the recipient's public key, returning it with the
+// ephemeral public key the recipient needs to derive it with X25519RecipientKey.
+func X25519SenderKey(recipient *[X25519KeySize]byte, salt *[SaltSize]byte) (key *[KeySize]byte, ephemeral *[X25519KeySize]byte, err error) {
+	private, ephemeral, err := NewX25519Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Zero(private[:])
+
+	if key, err = x25519Key(KDFX25519, private, recipient, ephemeral, recipient, salt); err != nil {
+		return nil, nil, err
+	}
+	return key, ephemeral, nil
+}
+
+// X25519RecipientKey derives the file key made by X25519SenderKey from the recipient's private
+// key.
+func X25519RecipientKey(private, ephemeral *[X25519KeySize]byte, salt *[SaltSize]byte) (*[KeySize]byte, error) {
+	recipient, err := X25519Public(private)
+	if err != nil {
+		return nil, err
+	}
+	return x25519Key(KDFX25519, private, ephemeral, ephemeral, recipient, salt)
+}
+
+// x25519Key derives a file key from the shared secret of private and peer, bound to both public
+// keys like age's X25519 recipients, and to the KDF it's for.
+func x25519Key(kdf string, private, peer, ephemeral, recipient *[X25519KeySize]byte, salt *[SaltSize]byte) (*[KeySize]byte, error) {
+	// this fails for low order points, which would make the shared secret predictable
+	shared, err := curve25519.X25519(private[:], peer[:])
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(shared)
+
+	info := make([]byte, 0, len(kdf)+2*X25519KeySize)
+	info = append(info, kdf...)
+	info = append(info, ephemeral[:]...)
+	info = append(info, recipient[:]...)
+
+	key := new([KeySize]byte)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, salt[:], info), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
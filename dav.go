@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+const (
+	davPrefix = "/dav/"
+	// davSuffix ends the names of files over WebDAV, whose contents are still encrypted, and
+	// davMetaSuffix those of the metadata needed to decrypt them.
+	davSuffix     = ".relay"
+	davMetaSuffix = ".relay.json"
+	davMethods    = "OPTIONS, GET, HEAD, PROPFIND"
+)
+
+// davUnsafe replaces the characters in file names which can't be in a WebDAV resource's name.
+var davUnsafe = strings.NewReplacer("/", "_", "\\", "_")
+
+// davFiles returns the files listed over WebDAV, which are those GetFileList lists, by their names
+// from their metadata. Names which more than one file has are followed by their IDs.
+func (rs *RelayServer) davFiles() map[string]files.File {
+	byName := make(map[string][]files.File)
+	rs.files.Range(func(_ files.FileID, f files.File) bool {
+		if f.State != files.StateReady || f.AccessHash != nil {
+			return true
+		}
+		name := davUnsafe.Replace(f.Name)
+		if name == "." || name == ".." {
+			name = f.ID.String()
+		}
+		byName[name] = append(byName[name], f)
+		return true
+	})
+	named := make(map[string]files.File, len(byName))
+	for name, same := range byName {
+		if len(same) == 1 {
+			named[name] = same[0]
+			continue
+		}
+		for _, f := range same {
+			named[name+" ("+f.ID.String()+")"] = f
+		}
+	}
+	return named
+}
+
+// WebDAV serves the files which are listed read-only over WebDAV under /dav/, so file managers
+// and other tools can browse and fetch them. Each file's encrypted contents are <name>.relay,
+// beside the metadata needed to decrypt them in <name>.relay.json, which the client's Decrypt
+// takes.
+func (rs *RelayServer) WebDAV(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", davMethods)
+		return
+	case http.MethodGet, http.MethodHead, "PROPFIND":
+	default:
+		w.Header().Set("Allow", davMethods)
+		http.Error(w, "Files can only be read over WebDAV", http.StatusMethodNotAllowed)
+		return
+	}
+
+	named := rs.davFiles()
+	path := strings.TrimPrefix(p.ByName("path"), "/")
+	if path == "" {
+		if r.Method == "PROPFIND" {
+			davPropfind(w, r, named)
+		} else {
+			davIndex(w, named)
+		}
+		return
+	}
+
+	name, meta := strings.CutSuffix(path, davMetaSuffix)
+	if !meta {
+		var ok bool
+		if name, ok = strings.CutSuffix(path, davSuffix); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	f, ok := named[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "PROPFIND":
+		writeMultistatus(w, davEntry(path, f))
+	case meta:
+		body, err := json.Marshal(f.FileMetadata)
+		if err != nil {
+			logging.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", contentETag(f))
+		http.ServeContent(w, r, "", f.Uploaded, bytes.NewReader(body))
+	default:
+		rs.GetFileContents(w, r, httprouter.Params{{Key: "id", Value: f.ID.String()}})
+	}
+}
+
+// davIndex lists the files for a browser, which GETs the collection instead of finding them.
+func davIndex(w http.ResponseWriter, named map[string]files.File) {
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s\n%s%s\n", name, davSuffix, name, davMetaSuffix)
+	}
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	NS        string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname,omitempty"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+// davPropfind responds with the properties of the collection, and those of the files in it unless
+// only its own are asked for, whatever properties are asked for.
+func davPropfind(w http.ResponseWriter, r *http.Request, named map[string]files.File) {
+	responses := []davResponse{{
+		Href:   davPrefix,
+		Prop:   davProp{ResourceType: davResourceType{Collection: &struct{}{}}},
+		Status: "HTTP/1.1 200 OK",
+	}}
+	if r.Header.Get("Depth") != "0" {
+		names := make([]string, 0, len(named))
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			responses = append(responses, davEntry(name+davSuffix, named[name]), davEntry(name+davMetaSuffix, named[name]))
+		}
+	}
+	writeMultistatus(w, responses...)
+}
+
+func writeMultistatus(w http.ResponseWriter, responses ...davResponse) {
+	body, err := xml.Marshal(davMultistatus{NS: "DAV:", Responses: responses})
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// davEntry describes the file's encrypted contents or metadata, whichever name is of.
+func davEntry(name string, f files.File) davResponse {
+	prop := davProp{
+		DisplayName:  name,
+		LastModified: f.Uploaded.UTC().Format(http.TimeFormat),
+		ETag:         contentETag(f),
+	}
+	if strings.HasSuffix(name, davMetaSuffix) {
+		body, _ := json.Marshal(f.FileMetadata)
+		prop.ContentLength = strconv.Itoa(len(body))
+		prop.ContentType = "application/json"
+	} else {
+		prop.ContentLength = strconv.FormatInt(f.Content.Size(), 10)
+		prop.ContentType = "application/octet-stream"
+	}
+	return davResponse{Href: davPrefix + url.PathEscape(name), Prop: prop, Status: "HTTP/1.1 200 OK"}
+}
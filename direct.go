@@ -0,0 +1,426 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// A live file's uploader can offer to send it directly: it listens for a connection from the
+// downloader, and tells the server the addresses it can be reached at, which are its own, and the
+// one the server sees it at with the port it listens on. The downloader tries them all at once,
+// and downloads the file through the server as usual if it can't reach any of them in
+// directDialTimeout. There's no NAT traversal, so this only works on a shared network, or if the
+// uploader can be reached from the downloader's.
+//
+// The uploader speaks first, so the downloader doesn't send anything to addresses which aren't
+// it. Each side proves it has the file's key over both sides' nonces before the uploader sends
+// the encrypted contents, and the downloader acknowledges them once the hash matches:
+//
+//	uploader:   directMagic, nonce
+//	downloader: nonce, directProof("downloader")
+//	uploader:   directProof("uploader"), encrypted contents
+//	downloader: directAck
+const (
+	directMagic       = "relay direct 1\n"
+	directNonceSize   = 32
+	directAck         = 1
+	directDialTimeout = 3 * time.Second
+	// directHandshakeTimeout is how long each side waits for the other's half of the handshake,
+	// directIdleTimeout how long either waits for the other once the file's being sent, and
+	// directAckTimeout how long the uploader waits for the downloader to check its hash.
+	directHandshakeTimeout = 10 * time.Second
+	directIdleTimeout      = time.Minute
+	directAckTimeout       = 5 * time.Minute
+)
+
+var errDirectHandshake = errors.New("direct connection handshake failed")
+
+// directProof proves the sender of it has the file's key, as the downloader or the uploader.
+func directProof(key *[crypto.KeySize]byte, role string, id files.FileID, nonceU, nonceD []byte) []byte {
+	subkey := crypto.Subkey(key, crypto.PurposeDirect)
+	defer crypto.Zero(subkey[:])
+	mac := hmac.New(sha256.New, subkey[:])
+	mac.Write([]byte(role + "\n" + id.String() + "\n"))
+	mac.Write(nonceU)
+	mac.Write(nonceD)
+	return mac.Sum(nil)
+}
+
+// idleConn is a connection whose reads and writes fail once they've waited on the other end for
+// directIdleTimeout.
+type idleConn struct {
+	net.Conn
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(directIdleTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(directIdleTimeout))
+	return c.Conn.Write(p)
+}
+
+// sendDirect sends a live upload to the downloader directly if they connect, or through the
+// server if they download it from there instead.
+func (rc *RelayClient) sendDirect(u *Upload) (UploadResult, error) {
+	ln, err := net.Listen("tcp", ":0")
+	if err == nil {
+		err = rc.offerDirect(u, ln.Addr().(*net.TCPAddr).Port)
+	}
+	if err != nil {
+		logging.Errorln("can't send the file directly, sending it through the server:", err)
+		if ln != nil {
+			ln.Close()
+		}
+		return rc.sendUpload(u)
+	}
+	defer ln.Close()
+
+	// the server doesn't know which way the file went, so it's told if it goes directly, which
+	// ends the relayed upload
+	ctx, cancel := context.WithCancel(rc.context())
+	defer cancel()
+	relayed := *rc
+	relayed.Context = ctx
+	type sent struct {
+		res UploadResult
+		err error
+	}
+	relayDone := make(chan sent, 1)
+	go func() {
+		res, err := relayed.sendUpload(u)
+		relayDone <- sent{res, err}
+	}()
+
+	conns := make(chan net.Conn)
+	done := make(chan struct{})
+	defer close(done)
+	go acceptDirect(ln, u, conns, done)
+
+	select {
+	case s := <-relayDone:
+		return s.res, s.err
+	case conn := <-conns:
+		defer conn.Close()
+		ln.Close()
+		if err := rc.sentDirect(u); err != nil {
+			logging.Errorln("failed to tell the server the file was sent directly:", err)
+		}
+		cancel()
+		<-relayDone
+		return rc.sendOverConn(u, conn)
+	}
+}
+
+// offerDirect tells the server the addresses the upload can be sent directly from, listening on
+// port.
+func (rc *RelayClient) offerDirect(u *Upload, port int) error {
+	offer := directOffer{Port: uint16(port)}
+	ifaces, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range ifaces {
+		ipnet, ok := a.(*net.IPNet)
+		// loopback addresses would have the downloader connect to itself
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if len(offer.Addrs) < maxDirectAddrs-1 {
+			offer.Addrs = append(offer.Addrs, net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(port)))
+		}
+	}
+
+	body, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	req, err := rc.newRequest(http.MethodPut, "/files/"+u.State.ID.String()+"/direct", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(OwnerTokenHeader, u.State.OwnerToken)
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return newStatusError("direct offer", res.StatusCode, body)
+	}
+	logging.Infoln("offered to send the file directly from", offer.Addrs, "and port", port)
+	return nil
+}
+
+// sentDirect tells the server the upload's being sent directly, so it can forget the file.
+func (rc *RelayClient) sentDirect(u *Upload) error {
+	req, err := rc.newRequest(http.MethodPost, "/files/"+u.State.ID.String()+"/direct/sent", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(OwnerTokenHeader, u.State.OwnerToken)
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return newStatusError("direct transfer", res.StatusCode, body)
+	}
+	return nil
+}
+
+// acceptDirect accepts connections to ln until it's closed, passing those from the upload's
+// downloader to conns, until done is closed.
+func acceptDirect(ln net.Listener, u *Upload, conns chan<- net.Conn, done <-chan struct{}) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := handshakeUploader(conn, u); err != nil {
+				logging.Debugln("rejected direct connection from", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case conns <- conn:
+			case <-done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// handshakeUploader is the uploader's side of the handshake.
+func handshakeUploader(conn net.Conn, u *Upload) error {
+	conn.SetDeadline(time.Now().Add(directHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonceU := make([]byte, directNonceSize)
+	if _, err := rand.Read(nonceU); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte(directMagic), nonceU...)); err != nil {
+		return err
+	}
+	reply := make([]byte, directNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	nonceD, proof := reply[:directNonceSize], reply[directNonceSize:]
+	if !hmac.Equal(proof, directProof(u.key, "downloader", u.State.ID, nonceU, nonceD)) {
+		return errDirectHandshake
+	}
+	_, err := conn.Write(directProof(u.key, "uploader", u.State.ID, nonceU, nonceD))
+	return err
+}
+
+// sendOverConn sends the upload's encrypted contents to the downloader at the other end of conn,
+// and waits for them to acknowledge it.
+func (rc *RelayClient) sendOverConn(u *Upload, conn net.Conn) (UploadResult, error) {
+	fileData := u.State.FileMetadata
+	result := UploadResult{FileMetadata: fileData, OwnerToken: u.State.OwnerToken}
+	result.Stats.KDF = u.kdf
+	stop := context.AfterFunc(rc.context(), func() { conn.Close() })
+	defer stop()
+
+	f, err := u.open()
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	l, err := fileLayout(fileData)
+	if err != nil {
+		return result, err
+	}
+	encryptedBytes, chunks := l.encryptedSize(fileData.Size)
+	logging.Infoln("sending", encryptedBytes, "bytes in", chunks, "chunks directly to", conn.RemoteAddr())
+
+	pb := rc.progress("Sending directly", int64(encryptedBytes))
+	defer pb.stop()
+	var encrypting stopwatch
+	pipe := u.encrypt(f, l, 0, &encrypting)
+	defer pipe.Close()
+	start := time.Now()
+	sent := newMeter(pipe, start)
+	if _, err = io.Copy(idleConn{conn}, io.TeeReader(sent, pb)); err != nil {
+		return result, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(directAckTimeout))
+	ack := make([]byte, 1)
+	if _, err = io.ReadFull(conn, ack); err != nil || ack[0] != directAck {
+		return result, errors.New("the downloader didn't confirm it received the file")
+	}
+	pb.Finish()
+
+	result.Stats.Elapsed = time.Since(start)
+	result.Stats.addMeter(sent)
+	result.Stats.Crypto = encrypting.total()
+	result.Stats.Network = result.Stats.Elapsed - sent.wait.total()
+	logging.Infoln("sent directly", result.Stats)
+	return result, nil
+}
+
+// directAddrs gets the addresses the uploader of a live file offered to send it directly from,
+// which is none if it didn't.
+func (rc *RelayClient) directAddrs(id files.FileID) ([]string, error) {
+	req, err := rc.newFileRequest("/files/" + id.String() + "/direct")
+	if err != nil {
+		return nil, err
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, newStatusError("direct offer request", res.StatusCode, body)
+	}
+	var offer directOffer
+	err = json.NewDecoder(res.Body).Decode(&offer)
+	return offer.Addrs, err
+}
+
+// dialDirect connects to the uploader of a live file, if it offered to send it directly and can
+// be reached, returning nil otherwise.
+func (rc *RelayClient) dialDirect(id files.FileID, key *[crypto.KeySize]byte) net.Conn {
+	addrs, err := rc.directAddrs(id)
+	if err != nil {
+		logging.Infoln("couldn't get the addresses to download the file directly from:", err)
+		return nil
+	} else if len(addrs) == 0 {
+		return nil
+	}
+	logging.Infoln("trying to download the file directly from", addrs)
+
+	// connect to every address at once, taking the first to answer like the uploader
+	ctx, cancel := context.WithTimeout(rc.context(), directDialTimeout)
+	defer cancel()
+	type hello struct {
+		conn   net.Conn
+		nonceU []byte
+	}
+	hellos := make(chan hello, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				logging.Debugln("couldn't connect to", addr+":", err)
+				hellos <- hello{}
+				return
+			}
+			deadline, _ := ctx.Deadline()
+			conn.SetReadDeadline(deadline)
+			buf := make([]byte, len(directMagic)+directNonceSize)
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf[:len(directMagic)]) != directMagic {
+				logging.Debugln("no uploader at", addr)
+				conn.Close()
+				hellos <- hello{}
+				return
+			}
+			hellos <- hello{conn, buf[len(directMagic):]}
+		}()
+	}
+
+	var h hello
+	left := len(addrs)
+	for ; left > 0 && h.conn == nil; left-- {
+		h = <-hellos
+	}
+	// close the connections to any other addresses the uploader answered on
+	go func() {
+		for ; left > 0; left-- {
+			if other := <-hellos; other.conn != nil {
+				other.conn.Close()
+			}
+		}
+	}()
+	if h.conn == nil {
+		logging.Infoln("couldn't connect to the uploader directly")
+		return nil
+	}
+
+	if err := handshakeDownloader(h.conn, id, key, h.nonceU); err != nil {
+		logging.Infoln("couldn't connect to the uploader directly:", err)
+		h.conn.Close()
+		return nil
+	}
+	logging.Infoln("connected directly to the uploader at", h.conn.RemoteAddr())
+	return h.conn
+}
+
+// handshakeDownloader is the downloader's side of the handshake, once it's had the uploader's
+// nonce.
+func handshakeDownloader(conn net.Conn, id files.FileID, key *[crypto.KeySize]byte, nonceU []byte) error {
+	conn.SetDeadline(time.Now().Add(directHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonceD := make([]byte, directNonceSize)
+	if _, err := rand.Read(nonceD); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(nonceD, directProof(key, "downloader", id, nonceU, nonceD)...)); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, directProof(key, "uploader", id, nonceU, nonceD)) {
+		return errDirectHandshake
+	}
+	return nil
+}
+
+// downloadDirect downloads the file from its uploader over conn, acknowledging it once its hash
+// has been checked.
+func (rc *RelayClient) downloadDirect(conn net.Conn, id files.FileID, meta files.FileMetadata, key *[crypto.KeySize]byte, w io.Writer, hasher hash.Hash, stats *TransferStats) error {
+	defer conn.Close()
+	stop := context.AfterFunc(rc.context(), func() { conn.Close() })
+	defer stop()
+
+	l, err := fileLayout(meta)
+	if err != nil {
+		return err
+	}
+	size, _ := l.encryptedSize(meta.Size)
+	// the uploader waits for the acknowledgement rather than closing the connection, so only
+	// the file is read
+	body := io.LimitReader(idleConn{conn}, int64(size))
+	if err = decrypt(rc.progress("Downloading directly", int64(meta.Size)), id, meta, l, key, body, w, 0, hasher, time.Now(), stats); err != nil {
+		return err
+	}
+	if err = checkHash(meta, hasher); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{directAck})
+	return err
+}
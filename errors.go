@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNotFound is matched by errors for files the server doesn't have.
+	ErrNotFound = errors.New("file not found")
+	// ErrWrongPassword is returned when the password doesn't decrypt a file's challenge.
+	ErrWrongPassword = errors.New("incorrect password")
+	// ErrAccessDenied is matched by errors for files which need an access password, when it's
+	// missing or incorrect.
+	ErrAccessDenied = errors.New("the file needs an access password, which is missing or incorrect")
+	// ErrHashMismatch is returned when a downloaded file doesn't match the hash it was uploaded with.
+	ErrHashMismatch = errors.New("hashes do not match")
+
+	// ErrUploadNotFound is returned when resuming an upload which the server no longer has.
+	ErrUploadNotFound = fmt.Errorf("upload no longer exists on the server: %w", ErrNotFound)
+	// ErrFileChanged is returned when resuming an upload of a file which has changed since it started.
+	ErrFileChanged = errors.New("file has changed since the upload started")
+
+	errUploadInProgress = errors.New("upload is still in progress on the server")
+	errHTTP3NotBuilt    = errors.New("HTTP/3 isn't built in; rebuild with -tags http3")
+)
+
+// StatusError is returned when the server rejects a request.
+type StatusError struct {
+	// Op describes the request, e.g. "upload" or "metadata request".
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func newStatusError(op string, code int, body []byte) error {
+	return &StatusError{op, code, strings.TrimSpace(string(body))}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with status code %d and body \"%s\"", e.Op, e.StatusCode, e.Body)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// ForwardRequest asks a server to send one of its files to another server, which it uploads the
+// encrypted contents to as they are, so the file can be downloaded from there with the same
+// password.
+type ForwardRequest struct {
+	// Server is the URL of the server to send the file to.
+	Server string `json:"server"`
+	// Token is the bearer token the other server needs to create files, if it needs one.
+	Token string `json:"token,omitempty"`
+	// AccessPassword, if set, has to be given to get the file from the other server.
+	AccessPassword string `json:"access_password,omitempty"`
+}
+
+// canForward reports whether files can be forwarded to server.
+func (rs *RelayServer) canForward(server string) bool {
+	server = strings.TrimRight(server, "/")
+	for _, allowed := range rs.config.ForwardTo {
+		if allowed == "*" || strings.TrimRight(allowed, "/") == server {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardFile sends a file which has finished uploading to another server, responding with the
+// ID and owner token it has there. It needs the file's owner token, and the other server must be
+// one of the ServerConfig's ForwardTo. The file stays on this server until it's deleted.
+func (rs *RelayServer) ForwardFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _, ok := rs.ownedFile(w, r, p)
+	if !ok {
+		return
+	}
+	f, ok := rs.readyFile(id)
+	if !ok {
+		http.Error(w, "Only files which have finished uploading can be forwarded", http.StatusConflict)
+		return
+	}
+
+	var req ForwardRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.Server, "http://") && !strings.HasPrefix(req.Server, "https://") {
+		http.Error(w, "The server to forward to must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if !rs.canForward(req.Server) {
+		http.Error(w, "This server doesn't forward files to "+req.Server, http.StatusForbidden)
+		return
+	}
+
+	// the copy keeps its chunks bound to the ID they were uploaded with
+	meta := f.FileMetadata
+	meta.Origin = uploadedID(id, f.FileMetadata)
+	meta.Schema, meta.ID, meta.Uploaded, meta.Downloads = 0, files.FileID{}, time.Time{}, 0
+	if meta.MaxDownloads > 0 {
+		meta.MaxDownloads -= f.Downloads
+	}
+
+	data, err := f.Content.Open()
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer data.Close()
+
+	logging.Infoln("forwarding file", id, "to", req.Server)
+	rc := NewClient(strings.TrimRight(req.Server, "/"))
+	rc.Token = req.Token
+	rc.Context = r.Context()
+	created, err := rc.copyFile(meta, req.AccessPassword, &egressReader{data, r.Context(), rs.egress}, uint64(f.Content.Size()))
+	if err != nil {
+		logging.Infoln("forwarding file", id, "to", req.Server, "failed:", err)
+		http.Error(w, "Forwarding failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	logging.Infoln("forwarded file", id, "to", req.Server, "as", created.ID)
+	writeCreated(w, created.ID, created.OwnerToken)
+}
+
+// egressReader holds reads back until the server's egress limit lets them through.
+type egressReader struct {
+	r     io.Reader
+	ctx   context.Context
+	limit *rateLimit
+}
+
+func (e *egressReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if wait := e.limit.reserve(n); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-e.ctx.Done():
+			return n, e.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// copyFile creates a file from the metadata of one on another server, and uploads its encrypted
+// contents, size bytes read from r. If the upload fails, the new file is deleted.
+func (rc *RelayClient) copyFile(meta files.FileMetadata, accessPassword string, r io.Reader, size uint64) (files.CreatedFile, error) {
+	created, err := rc.createFile("/files", meta, "", accessPassword)
+	if err != nil {
+		return created, err
+	}
+	put, err := rc.newRequest(http.MethodPut, "/files/"+created.ID.String(), r)
+	if err == nil {
+		put.ContentLength = int64(size)
+		put.Header.Set(OwnerTokenHeader, created.OwnerToken)
+		var res *http.Response
+		if res, err = rc.c.Do(put); err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = newStatusError("upload", res.StatusCode, body)
+			}
+		}
+	}
+	if err != nil {
+		// the request's context may be why it failed
+		cleanup := *rc
+		cleanup.Context = nil
+		if delErr := cleanup.PurgeFile(created.ID, created.OwnerToken); delErr != nil {
+			logging.Errorln("failed to delete the incomplete copy:", delErr)
+		}
+		return files.CreatedFile{}, err
+	}
+	return created, nil
+}
+
+// ForwardFile has the server send one of its files, which it knows the owner token of, to
+// another server, returning its ID and owner token there. The file can be downloaded from the
+// other server with the same password, and stays on this one until it's deleted.
+func (rc *RelayClient) ForwardFile(id files.FileID, ownerToken string, req ForwardRequest) (files.CreatedFile, error) {
+	var created files.CreatedFile
+	body, err := json.Marshal(req)
+	if err != nil {
+		return created, err
+	}
+	post, err := rc.newRequest(http.MethodPost, "/files/"+id.String()+"/forward", bytes.NewReader(body))
+	if err != nil {
+		return created, err
+	}
+	post.Header.Set("Content-Type", "application/json")
+	post.Header.Set(OwnerTokenHeader, ownerToken)
+	res, err := rc.c.Do(post)
+	if err != nil {
+		return created, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return created, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return created, newStatusError("forward", res.StatusCode, resBody)
+	}
+	err = json.Unmarshal(resBody, &created)
+	return created, err
+}
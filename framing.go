@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// FramedContentType is the content type of encrypted contents sent in frames: the stream header
+// and each chunk prefixed with its length, as a 4 byte big-endian number, and then an empty frame
+// to end them. Frames keep the chunks whole however the contents are buffered on their way, and
+// the empty frame tells complete contents from ones cut short at a chunk boundary. Uploads are
+// framed if the server's ServerInfo says it reads them, and downloads if they're asked for with
+// Accept.
+const FramedContentType = "application/x-relay-chunks"
+
+// framePrefixSize is the size of the length before each frame.
+const framePrefixSize = 4
+
+// errBadFrame is matched by errors for framed contents which don't fit the file's layout.
+var errBadFrame = errors.New("invalid chunk frame")
+
+// frameSizer gives the size of the frame starting offset bytes into the encrypted contents, or 0
+// if they end there.
+type frameSizer interface {
+	frameSize(offset uint64) (uint64, error)
+}
+
+// frameSize is the size of the stream header if it's still to come, and otherwise of a chunk.
+func (l layout) frameSize(offset uint64) (uint64, error) {
+	if offset < l.header {
+		return l.header - offset, nil
+	}
+	return l.chunkSize, nil
+}
+
+// indexFrames gives the sizes of the frames from the contents' index, from the chunk at next on.
+type indexFrames struct {
+	ci   *files.ChunkIndex
+	next int64
+}
+
+func (f *indexFrames) frameSize(offset uint64) (uint64, error) {
+	if f.next == f.ci.Len() {
+		return 0, nil
+	}
+	c, err := f.ci.Chunk(f.next)
+	if err != nil {
+		return 0, err
+	}
+	if c.Offset != int64(offset) {
+		return 0, fmt.Errorf("chunk %d is indexed at %d, not %d", f.next, c.Offset, offset)
+	}
+	f.next++
+	return uint64(c.Length), nil
+}
+
+// framingReader frames the encrypted contents read from r, which start offset bytes into them, a
+// chunk at a time, with chunks the sizes sizes gives.
+type framingReader struct {
+	r      io.Reader
+	sizes  frameSizer
+	offset uint64
+	// frame holds the rest of the frame being read.
+	frame []byte
+	buf   []byte
+	ended bool
+	err   error
+}
+
+// newFramingReader returns a framingReader for contents with chunks up to maxChunk bytes.
+func newFramingReader(r io.Reader, sizes frameSizer, maxChunk, offset uint64) *framingReader {
+	// room for a whole chunk, and the empty frame after it if it's the last
+	return &framingReader{r: r, sizes: sizes, offset: offset, buf: make([]byte, 2*framePrefixSize+maxChunk)}
+}
+
+func (fr *framingReader) Read(p []byte) (int, error) {
+	for len(fr.frame) == 0 {
+		if fr.err != nil {
+			return 0, fr.err
+		}
+		if fr.ended {
+			return 0, io.EOF
+		}
+		fr.err = fr.next()
+	}
+	n := copy(p, fr.frame)
+	fr.frame = fr.frame[n:]
+	return n, nil
+}
+
+// next reads the next frame.
+func (fr *framingReader) next() error {
+	size, err := fr.sizes.frameSize(fr.offset)
+	if err != nil {
+		return err
+	}
+	if size > uint64(len(fr.buf)-2*framePrefixSize) {
+		return fmt.Errorf("%w: a chunk of %d bytes is too large to frame", errBadFrame, size)
+	}
+	n, err := io.ReadFull(fr.r, fr.buf[framePrefixSize:framePrefixSize+size])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	binary.BigEndian.PutUint32(fr.buf, uint32(n))
+	fr.frame = fr.buf[:framePrefixSize+n]
+	fr.offset += uint64(n)
+	if n < int(size) || size == 0 {
+		// only the last frame can be short, so the contents end here
+		if n > 0 {
+			fr.frame = binary.BigEndian.AppendUint32(fr.frame, 0)
+		}
+		fr.ended = true
+	}
+	return nil
+}
+
+// frameReader reads framed contents from r.
+type frameReader struct {
+	r io.Reader
+	// remaining is how much of the current frame Read has still to return.
+	remaining uint32
+	ended     bool
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+// readPrefix reads the length of the next frame, marking the contents ended if it's empty.
+func (fr *frameReader) readPrefix() (uint32, error) {
+	var prefix [framePrefixSize]byte
+	if _, err := io.ReadFull(fr.r, prefix[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("%w: the contents ended before their empty frame", errBadFrame)
+	} else if err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	fr.ended = size == 0
+	return size, nil
+}
+
+// ReadFrame reads the next frame into chunk, which must be able to hold it, returning errors
+// like io.ReadFull does: io.EOF once the contents have ended, and io.ErrUnexpectedEOF with a
+// frame shorter than chunk, which must be the last.
+func (fr *frameReader) ReadFrame(chunk []byte) (int, error) {
+	if fr.ended {
+		return 0, io.EOF
+	}
+	size, err := fr.readPrefix()
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, io.EOF
+	}
+	if size > uint32(len(chunk)) {
+		return 0, fmt.Errorf("%w: a frame of %d bytes is larger than the %d byte chunk", errBadFrame, size, len(chunk))
+	}
+	n, err := io.ReadFull(fr.r, chunk[:size])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, fmt.Errorf("%w: the contents ended in the middle of a frame", errBadFrame)
+	} else if err != nil {
+		return n, err
+	}
+	if n == len(chunk) {
+		return n, nil
+	}
+	if last, err := fr.readPrefix(); err != nil {
+		return n, err
+	} else if last != 0 {
+		return n, fmt.Errorf("%w: a short frame isn't the last", errBadFrame)
+	}
+	return n, io.ErrUnexpectedEOF
+}
+
+// Read reads the contents from the frames, without their prefixes, until the empty frame.
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for fr.remaining == 0 {
+		if fr.ended {
+			return 0, io.EOF
+		}
+		size, err := fr.readPrefix()
+		if err != nil {
+			return 0, err
+		}
+		fr.remaining = size
+	}
+	if uint32(len(p)) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	n, err := fr.r.Read(p)
+	fr.remaining -= uint32(n)
+	if err == io.EOF {
+		// which is only a problem once the reader gets to it
+		if fr.remaining > 0 {
+			err = fmt.Errorf("%w: the contents ended in the middle of a frame", errBadFrame)
+		} else {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// chunkSource returns how to read whole chunks of the upload r into a buffer: as frames if it's
+// framed, or else as much of the body as fills it.
+func chunkSource(r *http.Request) (read func(chunk []byte) (int, error), framed bool) {
+	if r.Header.Get("Content-Type") == FramedContentType {
+		return newFrameReader(r.Body).ReadFrame, true
+	}
+	return func(chunk []byte) (int, error) { return io.ReadFull(r.Body, chunk) }, false
+}
+
+// wantsFrames reports whether the download r asks for framed contents.
+func wantsFrames(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), FramedContentType)
+}
+
+// framedOffset returns where the framed contents of size bytes asked for by the download r
+// should start, reporting whether they can be framed. Frames start on chunk boundaries, which
+// boundary reports, so ranges are only framed if they run from one to the end of the contents, as
+// a resumed download's do; other requests get the contents unframed.
+func framedOffset(r *http.Request, size uint64, boundary func(offset uint64) bool) (uint64, bool) {
+	spec := r.Header.Get("Range")
+	if spec == "" {
+		return 0, true
+	}
+	start, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok {
+		return 0, false
+	}
+	start, ok = strings.CutSuffix(start, "-")
+	if !ok {
+		return 0, false
+	}
+	offset, err := strconv.ParseUint(start, 10, 64)
+	if err != nil || offset >= size || !boundary(offset) {
+		return 0, false
+	}
+	return offset, true
+}
@@ -0,0 +1,46 @@
+//go:build http3
+
+package relay
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Built reports whether HTTP/3 is built in, which needs the http3 build tag, so the default
+// build doesn't pull in a QUIC implementation.
+const HTTP3Built = true
+
+// withHTTP3 has srv's handler served over HTTP/3 as well, on the same port over UDP, and
+// advertises it to srv's clients with Alt-Svc headers. The returned function serves it until it
+// fails.
+func withHTTP3(srv *http.Server, certFile, keyFile string) func() error {
+	h3 := &http3.Server{Addr: srv.Addr, Handler: srv.Handler}
+	handler := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+	return func() error { return h3.ListenAndServeTLS(certFile, keyFile) }
+}
+
+// http3Transport sends requests to https:// URLs over HTTP/3, and any others over TCP as usual.
+type http3Transport struct {
+	h3 *http3.Transport
+}
+
+func (t http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.h3.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// UseHTTP3 has the client make its requests to the server over HTTP/3, which, running over UDP,
+// doesn't stall every transfer on a connection when a packet is lost, as TCP does on lossy mobile
+// and wifi networks. The server must serve HTTP/3, and be given with https://.
+func (rc *RelayClient) UseHTTP3() error {
+	rc.c.Transport = http3Transport{&http3.Transport{}}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !http3
+
+package relay
+
+import "net/http"
+
+// HTTP3Built reports whether HTTP/3 is built in, which needs the http3 build tag, so the default
+// build doesn't pull in a QUIC implementation.
+const HTTP3Built = false
+
+func withHTTP3(srv *http.Server, certFile, keyFile string) func() error {
+	return func() error { return errHTTP3NotBuilt }
+}
+
+func (rc *RelayClient) UseHTTP3() error {
+	return errHTTP3NotBuilt
+}
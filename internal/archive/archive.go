@@ -0,0 +1,110 @@
+// Package archive bundles directory trees into gzipped tar archives for upload.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Filter selects which paths under the archived directory are included. Patterns use
+// path.Match syntax and are matched against both the slash-separated path relative to the
+// root and the base name.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded reports whether rel should be skipped. Directories are only checked against the
+// exclude patterns, so that include patterns like "*.go" still descend into subdirectories.
+func (f Filter) Excluded(rel string, isDir bool) bool {
+	if matchAny(f.Exclude, rel) {
+		return true
+	}
+	return !isDir && len(f.Include) > 0 && !matchAny(f.Include, rel)
+}
+
+// WriteTarGz writes the regular files and directories under root to w as a gzipped tar
+// archive, with paths prefixed by the root's base name. It returns the number of files written.
+func WriteTarGz(w io.Writer, root string, filter Filter) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	prefix := filepath.Base(filepath.Clean(root))
+
+	count := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && filter.Excluded(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil // skip symlinks, devices, etc.
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err = io.Copy(tw, f); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return count, err
+	}
+	return count, gz.Close()
+}
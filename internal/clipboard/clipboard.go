@@ -0,0 +1,91 @@
+// Package clipboard accesses the system clipboard through the platform's command line tools.
+package clipboard
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var ErrUnavailable = errors.New("no clipboard tool found (install wl-clipboard, xclip, or xsel)")
+
+func copyCommand() (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("pbcopy"), nil
+	case "windows":
+		return exec.Command("clip"), nil
+	}
+
+	candidates := [][]string{
+		{"xclip", "-selection", "clipboard", "-in"},
+		{"xsel", "--clipboard", "--input"},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		candidates = append([][]string{{"wl-copy"}}, candidates...)
+	}
+	return findCommand(candidates)
+}
+
+func findCommand(candidates [][]string) (*exec.Cmd, error) {
+	for _, c := range candidates {
+		if path, err := exec.LookPath(c[0]); err == nil {
+			return exec.Command(path, c[1:]...), nil
+		}
+	}
+	return nil, ErrUnavailable
+}
+
+func Copy(text string) error {
+	cmd, err := copyCommand()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(cmd.Path + ": " + msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func pasteCommand() (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("pbpaste"), nil
+	case "windows":
+		return exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"), nil
+	}
+
+	candidates := [][]string{
+		{"xclip", "-selection", "clipboard", "-out"},
+		{"xsel", "--clipboard", "--output"},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		candidates = append([][]string{{"wl-paste", "--no-newline"}}, candidates...)
+	}
+	return findCommand(candidates)
+}
+
+func Paste() (string, error) {
+	cmd, err := pasteCommand()
+	if err != nil {
+		return "", err
+	}
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.New(cmd.Path + ": " + msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Profile struct {
+	Name  string
+	URL   string
+	Token string
+	// Options are default values for command line flags, keyed by flag name.
+	Options map[string]string
+	// Remote is set if the profile is a remote saved with relay remote add, rather than one from
+	// the config file.
+	Remote bool
+}
+
+type Config struct {
+	DefaultProfile string
+	Profiles       map[string]*Profile
+}
+
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "relay", "config.toml"), nil
+}
+
+// Load reads the config file at path. A missing file is treated as an empty config. The remotes
+// saved beside it are loaded as profiles too, unless the file has a profile with the same name.
+func Load(path string) (*Config, error) {
+	cfg := &Config{Profiles: make(map[string]*Profile)}
+	if err := cfg.load(path); err != nil {
+		return nil, err
+	}
+
+	remotes, err := LoadRemotes(remotesPath(path))
+	if err != nil {
+		return nil, err
+	}
+	for name, r := range remotes {
+		if _, ok := cfg.Profiles[name]; !ok {
+			cfg.Profiles[name] = &Profile{Name: name, URL: r.URL, Token: r.Token, Options: r.Options, Remote: true}
+		}
+	}
+	return cfg, nil
+}
+
+func (c *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tables, err := parse(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for table, values := range tables {
+		switch {
+		case table == "":
+			for k, v := range values {
+				if k != "default_profile" {
+					return fmt.Errorf("%s: unknown key %q", path, k)
+				}
+				c.DefaultProfile = v
+			}
+		case strings.HasPrefix(table, "profiles."):
+			p := &Profile{Name: strings.TrimPrefix(table, "profiles."), Options: make(map[string]string)}
+			for k, v := range values {
+				switch k {
+				case "url":
+					p.URL = v
+				case "token":
+					p.Token = v
+				default:
+					p.Options[k] = v
+				}
+			}
+			c.Profiles[p.Name] = p
+		case table == "profiles":
+			// an empty parent table is fine
+		default:
+			return fmt.Errorf("%s: unknown table [%s]", path, table)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) Profile(name string) (*Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile named %q", name)
+	}
+	return p, nil
+}
+
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
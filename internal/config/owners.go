@@ -0,0 +1,82 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// OwnerTokens holds the owner tokens of files uploaded from this machine, keyed by server URL
+// and then file ID.
+type OwnerTokens map[string]map[string]string
+
+func OwnerTokensPath() (string, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "owners.json"), nil
+}
+
+func LoadOwnerTokens(path string) (OwnerTokens, error) {
+	tokens := make(OwnerTokens)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func serverKey(server string) string {
+	return strings.TrimRight(server, "/")
+}
+
+func (t OwnerTokens) Get(server string, id files.FileID) (string, bool) {
+	token, ok := t[serverKey(server)][id.String()]
+	return token, ok
+}
+
+func (t OwnerTokens) Set(server string, id files.FileID, token string) {
+	key := serverKey(server)
+	if t[key] == nil {
+		t[key] = make(map[string]string)
+	}
+	t[key][id.String()] = token
+}
+
+func (t OwnerTokens) Remove(server string, id files.FileID) {
+	key := serverKey(server)
+	delete(t[key], id.String())
+	if len(t[key]) == 0 {
+		delete(t, key)
+	}
+}
+
+// Save writes the tokens to path, readable only by the current user.
+func (t OwnerTokens) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
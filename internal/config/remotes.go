@@ -0,0 +1,93 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Remote is a server saved with relay remote add, along with the token for it. Remotes are used
+// like the profiles in the config file, which take precedence over them.
+type Remote struct {
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+	// Options are default values for command line flags, keyed by flag name.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// Remotes holds the saved remotes by name.
+type Remotes map[string]Remote
+
+func RemotesPath() (string, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return remotesPath(path), nil
+}
+
+// remotesPath is where remotes are saved beside the config file at configPath.
+func remotesPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "remotes.json")
+}
+
+func LoadRemotes(path string) (Remotes, error) {
+	remotes := make(Remotes)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return remotes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &remotes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return remotes, nil
+}
+
+// Save writes the remotes to path, readable only by the current user, since they hold tokens.
+func (r Remotes) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (r Remotes) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateRemoteName checks name can name a remote, written before a file ID like name:<id>, and
+// a profile in the config file.
+func ValidateRemoteName(name string) error {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("remote names can only have letters, digits, - and _, not %q", name)
+		}
+	}
+	if len(name) < 2 {
+		// which would look like a Windows drive
+		return errors.New("remote names must be at least two characters long")
+	}
+	return nil
+}
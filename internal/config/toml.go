@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parse reads the subset of TOML used by the config file: tables, bare or quoted keys, and
+// string, integer, float, and boolean values. Values are returned in their string form.
+func parse(src string) (map[string]map[string]string, error) {
+	tables := map[string]map[string]string{"": {}}
+	current := ""
+
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", n+1)
+			}
+			name, err := parseTableName(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			if _, ok := tables[name]; ok {
+				return nil, fmt.Errorf("line %d: duplicate table [%s]", n+1, name)
+			}
+			tables[name] = map[string]string{}
+			current = name
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		key, err := parseKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		value, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if _, ok := tables[current][key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n+1, key)
+		}
+		tables[current][key] = value
+	}
+
+	return tables, nil
+}
+
+// stripComment removes a trailing comment, ignoring any '#' inside a quoted string.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTableName(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	for i, part := range parts {
+		key, err := parseKey(strings.TrimSpace(part))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = key
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func parseKey(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		return parseValue(s)
+	}
+	if s == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("invalid key %q", s)
+		}
+	}
+	return s, nil
+}
+
+func parseValue(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+
+	if _, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, 64); err == nil {
+		return strings.ReplaceAll(s, "_", ""), nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported value %q", s)
+}
@@ -0,0 +1,573 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Content is where a file's encrypted contents are kept, so the handlers serving them don't need
+// to know whether they're in memory, on disk, or somewhere else.
+type Content interface {
+	io.ReaderAt
+	// Open opens the contents for a series of reads, which carry on reading the same contents
+	// even if they're replaced while they're open.
+	Open() (io.ReadSeekCloser, error)
+	// Size is the length of the contents in bytes.
+	Size() int64
+	// Chunks opens the index of the contents' chunks, which keeps describing the contents it was
+	// opened with even if they're replaced, and must be closed. It's nil if the contents weren't
+	// indexed whole as they were written, as they weren't before indexes were kept.
+	Chunks() (*ChunkIndex, error)
+	// Remove deletes the contents. They can't be read afterwards.
+	Remove() error
+}
+
+// ContentWriter stores a file's contents as they're uploaded, straight into wherever they're
+// kept. An interrupted upload is resumed with a new ContentWriter, from where the last one left
+// off. Each Write is a whole chunk, or the stream header before them, which is recorded in the
+// contents' ChunkIndex.
+type ContentWriter interface {
+	io.Writer
+	// Truncate discards everything after the first n bytes of the contents, and carries on
+	// writing from there.
+	Truncate(n int64) error
+	// Finish stores what's been written as the file's contents, and returns them.
+	Finish() (Content, error)
+	// Close stops writing, keeping what's been written so the upload can be resumed.
+	Close() error
+}
+
+// Chunk is where a chunk of a file's contents falls in them.
+type Chunk struct {
+	Offset int64
+	Length int64
+}
+
+// End is the offset just after the chunk.
+func (c Chunk) End() int64 {
+	return c.Offset + c.Length
+}
+
+// chunkRecordSize is the size of each chunk's record in an index: its offset in 8 bytes, and its
+// length in 4, both big-endian.
+const chunkRecordSize = 12
+
+func appendChunk(records []byte, c Chunk) []byte {
+	records = binary.BigEndian.AppendUint64(records, uint64(c.Offset))
+	return binary.BigEndian.AppendUint32(records, uint32(c.Length))
+}
+
+// ChunkIndex records where each chunk of a file's contents falls in them, as they're uploaded, and
+// is stored alongside them. Downloads are served from it a whole chunk at a time, and seek
+// straight to the chunk they start from, however the contents have been buffered by whatever
+// they're stored in. The stream header, for contents with one, is recorded as a chunk of its own,
+// since it's sent whole as well.
+type ChunkIndex struct {
+	records io.ReaderAt
+	len     int64
+	closer  io.Closer
+}
+
+// openChunkIndex returns the index of the n records read from records, if they describe the
+// whole of contents of size bytes, or nil if not.
+func openChunkIndex(records io.ReaderAt, n int64, closer io.Closer, size int64) (*ChunkIndex, error) {
+	ci := &ChunkIndex{records, n, closer}
+	end := int64(0)
+	if n > 0 {
+		last, err := ci.Chunk(n - 1)
+		if err != nil {
+			ci.Close()
+			return nil, err
+		}
+		end = last.End()
+	}
+	if end != size {
+		ci.Close()
+		return nil, nil
+	}
+	return ci, nil
+}
+
+// memoryChunkIndex returns the index of the records in memory, for contents of size bytes.
+func memoryChunkIndex(records []byte, size int64) (*ChunkIndex, error) {
+	if records == nil && size > 0 {
+		return nil, nil
+	}
+	return openChunkIndex(bytes.NewReader(records), int64(len(records)/chunkRecordSize), nil, size)
+}
+
+// Len is the number of chunks in the index.
+func (ci *ChunkIndex) Len() int64 {
+	return ci.len
+}
+
+// Chunk returns the chunk at index i.
+func (ci *ChunkIndex) Chunk(i int64) (Chunk, error) {
+	if i < 0 || i >= ci.len {
+		return Chunk{}, os.ErrInvalid
+	}
+	var record [chunkRecordSize]byte
+	if _, err := ci.records.ReadAt(record[:], i*chunkRecordSize); err != nil {
+		return Chunk{}, err
+	}
+	return Chunk{
+		Offset: int64(binary.BigEndian.Uint64(record[:8])),
+		Length: int64(binary.BigEndian.Uint32(record[8:])),
+	}, nil
+}
+
+// Find returns the index of the chunk starting at offset, reporting whether there is one.
+func (ci *ChunkIndex) Find(offset int64) (int64, bool, error) {
+	i, err := ci.search(func(c Chunk) bool { return c.Offset >= offset })
+	if err != nil || i == ci.len {
+		return i, false, err
+	}
+	c, err := ci.Chunk(i)
+	return i, err == nil && c.Offset == offset, err
+}
+
+// search returns the index of the first chunk for which f is true, like sort.Search.
+func (ci *ChunkIndex) search(f func(Chunk) bool) (int64, error) {
+	var err error
+	i := sort.Search(int(ci.len), func(i int) bool {
+		c, e := ci.Chunk(int64(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return f(c)
+	})
+	return int64(i), err
+}
+
+// Close closes the index, if it's held open.
+func (ci *ChunkIndex) Close() error {
+	if ci.closer == nil {
+		return nil
+	}
+	return ci.closer.Close()
+}
+
+// keptChunks returns how many of the n records in records are of chunks which end within the
+// first size bytes of the contents, and so are kept when they're truncated to them.
+func keptChunks(records io.ReaderAt, n, size int64) (int64, error) {
+	ci := &ChunkIndex{records: records, len: n}
+	return ci.search(func(c Chunk) bool { return c.End() > size })
+}
+
+// memoryRecordSize is the most MemoryContent keeps in one piece of memory.
+const memoryRecordSize = 1 << 20
+
+// MemoryContent holds contents in memory, packed into records of up to memoryRecordSize bytes.
+type MemoryContent struct {
+	records [][]byte
+	size    int64
+	// chunks are the records of the contents' ChunkIndex.
+	chunks []byte
+}
+
+func NewMemoryContent() *MemoryContent {
+	return &MemoryContent{}
+}
+
+// Write appends a copy of p to the contents, so the caller can reuse p.
+func (m *MemoryContent) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		last := len(m.records) - 1
+		if last < 0 || len(m.records[last]) == cap(m.records[last]) {
+			// records grow with the contents, so small ones don't waste much
+			size := min(max(m.size, int64(len(p))), memoryRecordSize)
+			m.records = append(m.records, make([]byte, 0, size))
+			last++
+		}
+		record := m.records[last]
+		k := min(len(p), cap(record)-len(record))
+		m.records[last] = append(record, p[:k]...)
+		p = p[k:]
+		m.size += int64(k)
+	}
+	return n, nil
+}
+
+// Truncate shortens the contents to their first n bytes, and their index to the chunks within
+// them.
+func (m *MemoryContent) Truncate(n int64) {
+	if n >= m.size {
+		return
+	}
+	kept, _ := keptChunks(bytes.NewReader(m.chunks), int64(len(m.chunks)/chunkRecordSize), n)
+	m.chunks = m.chunks[:kept*chunkRecordSize]
+	m.size = n
+	for i, record := range m.records {
+		if n <= int64(len(record)) {
+			if n == 0 {
+				m.records = m.records[:i]
+			} else {
+				m.records[i] = record[:n]
+				m.records = m.records[:i+1]
+			}
+			return
+		}
+		n -= int64(len(record))
+	}
+}
+
+// Writer returns a ContentWriter which appends to the contents after their first offset bytes,
+// discarding the rest.
+func (m *MemoryContent) Writer(offset int64) ContentWriter {
+	m.Truncate(offset)
+	return memoryWriter{m}
+}
+
+type memoryWriter struct {
+	m *MemoryContent
+}
+
+func (w memoryWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.m.chunks = appendChunk(w.m.chunks, Chunk{w.m.size, int64(len(p))})
+	}
+	return w.m.Write(p)
+}
+
+func (w memoryWriter) Truncate(n int64) error {
+	w.m.Truncate(n)
+	return nil
+}
+
+func (w memoryWriter) Finish() (Content, error) {
+	return w.m, nil
+}
+
+func (w memoryWriter) Close() error {
+	return nil
+}
+
+func (m *MemoryContent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	var pos int64
+	for _, record := range m.records {
+		if n == len(p) {
+			break
+		}
+		end := pos + int64(len(record))
+		if off+int64(n) < end {
+			n += copy(p[n:], record[off+int64(n)-pos:])
+		}
+		pos = end
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemoryContent) Open() (io.ReadSeekCloser, error) {
+	return memoryReader{io.NewSectionReader(m, 0, m.size)}, nil
+}
+
+// memoryReader reads contents in memory, which have nothing to close.
+type memoryReader struct {
+	*io.SectionReader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (m *MemoryContent) Size() int64 {
+	return m.size
+}
+
+func (m *MemoryContent) Chunks() (*ChunkIndex, error) {
+	return memoryChunkIndex(m.chunks, m.size)
+}
+
+// Remove does nothing, since the memory is freed once nothing refers to the contents, which can
+// still be being read.
+func (m *MemoryContent) Remove() error {
+	return nil
+}
+
+// DiskContent is contents in a file on disk, named by its path.
+type DiskContent string
+
+func (d DiskContent) Open() (io.ReadSeekCloser, error) {
+	return os.Open(string(d))
+}
+
+// Map opens the contents mapped into memory, so they're read straight from the page cache rather
+// than copied into a buffer for each read. Where files can't be mapped, it's the same as Open.
+func (d DiskContent) Map() (io.ReadSeekCloser, error) {
+	if !canMap {
+		return d.Open()
+	}
+	f, err := os.Open(string(d))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // the mapping doesn't need it
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return &MappedReader{}, nil // which can't be mapped
+	}
+	if size != int64(int(size)) {
+		return d.Open()
+	}
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &MappedReader{data: data}, nil
+}
+
+// ReadAt opens the file for each read, so stored files don't hold a file descriptor each while
+// nothing is reading them.
+func (d DiskContent) ReadAt(p []byte, off int64) (int, error) {
+	f, err := os.Open(string(d))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+func (d DiskContent) Size() int64 {
+	info, err := os.Stat(string(d))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// IndexPath is where the ChunkIndex of contents stored on disk at path is kept.
+func IndexPath(path string) string {
+	return path + ".chunks"
+}
+
+func (d DiskContent) Chunks() (*ChunkIndex, error) {
+	f, err := os.Open(IndexPath(string(d)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return openChunkIndex(f, info.Size()/chunkRecordSize, f, d.Size())
+}
+
+// Remove removes the contents and their index.
+func (d DiskContent) Remove() error {
+	if err := os.Remove(IndexPath(string(d))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(string(d))
+}
+
+// MappedReader reads contents mapped into memory by DiskContent.Map. It's safe to close while it's
+// being read, which then fails rather than reading memory that's been unmapped.
+type MappedReader struct {
+	mu     sync.Mutex
+	data   []byte
+	off    int64
+	closed bool
+}
+
+func (m *MappedReader) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.off:])
+	m.off += int64(n)
+	return n, nil
+}
+
+// Next returns up to the next n bytes of the contents and reads past them, without copying them.
+// They can only be used until m is closed.
+func (m *MappedReader) Next(n int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return nil, io.EOF
+	}
+	b := m.data[m.off:]
+	if len(b) > n {
+		b = b[:n]
+	}
+	m.off += int64(len(b))
+	return b, nil
+}
+
+func (m *MappedReader) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MappedReader) Seek(offset int64, whence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	m.off = offset
+	return offset, nil
+}
+
+func (m *MappedReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.data == nil {
+		return nil
+	}
+	return munmap(m.data)
+}
+
+// PartPath is where the contents to be stored at path are kept until they've all been uploaded.
+func PartPath(path string) string {
+	return path + ".part"
+}
+
+// RemovePart removes the partly uploaded contents to be stored at path, and their index.
+func RemovePart(path string) error {
+	if err := os.Remove(PartPath(IndexPath(path))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(PartPath(path))
+}
+
+type diskWriter struct {
+	f    *os.File
+	path string
+	// index holds the records of the contents' ChunkIndex, written beside them, and off is where
+	// the next chunk starts.
+	index *os.File
+	off   int64
+}
+
+// NewDiskWriter returns a ContentWriter for contents to be stored on disk at path. They're
+// written to PartPath(path) after its first offset bytes, which are kept from an earlier upload,
+// and moved to path when they're finished, with their index going to IndexPath(path) the same
+// way.
+func NewDiskWriter(path string, offset int64) (ContentWriter, error) {
+	f, err := os.OpenFile(PartPath(path), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(PartPath(IndexPath(path)), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &diskWriter{f: f, path: path, index: index}
+	if err = w.Truncate(offset); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *diskWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := w.index.Write(appendChunk(nil, Chunk{w.off, int64(len(p))})); err != nil {
+		return 0, err
+	}
+	n, err := w.f.Write(p)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *diskWriter) Truncate(n int64) error {
+	if err := w.f.Truncate(n); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(n, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := w.index.Stat()
+	if err != nil {
+		return err
+	}
+	kept, err := keptChunks(w.index, info.Size()/chunkRecordSize, n)
+	if err != nil {
+		return err
+	}
+	if err := w.index.Truncate(kept * chunkRecordSize); err != nil {
+		return err
+	}
+	_, err = w.index.Seek(kept*chunkRecordSize, io.SeekStart)
+	w.off = n
+	return err
+}
+
+func (w *diskWriter) Finish() (Content, error) {
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	// if this is interrupted between the two, an index which doesn't end where the contents do
+	// is ignored
+	if err := os.Rename(w.index.Name(), IndexPath(w.path)); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return nil, err
+	}
+	return DiskContent(w.path), nil
+}
+
+func (w *diskWriter) Close() error {
+	return errors.Join(w.index.Close(), w.f.Close())
+}
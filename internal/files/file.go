@@ -1,41 +1,180 @@
 package files
 
 import (
-	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"mime"
+	"strings"
 	"time"
 
-	"github.com/bfrengley/relay/internal/crypto"
-	"github.com/google/uuid"
+	"github.com/bfrengley/relay/crypto"
 )
 
 type FileMetadata struct {
-	FileID
-	Name      string    `json:"name"`
-	Size      uint64    `json:"size"`
-	Salt      []byte    `json:"salt"`
+	// Schema is the version of these fields the metadata was stored with; see SchemaVersion.
+	Schema uint   `json:"schema,omitempty"`
+	ID     FileID `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	Salt   []byte `json:"salt"`
+	// KDF is how the key is derived from the salt; empty means scrypt.
+	KDF string `json:"kdf,omitempty"`
+	// Ephemeral is the uploader's X25519 public key for files encrypted to a recipient, or the
+	// RSA wrapped secret for files encrypted to an RSA SSH key.
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	// Scrypt holds the scrypt cost parameters; files without them use crypto.DefaultScryptParams.
+	Scrypt *crypto.ScryptParams `json:"scrypt,omitempty"`
+	// Format is the version of the encrypted stream format the contents are in.
+	Format uint8 `json:"format,omitempty"`
+	// Cipher is how the contents are encrypted; empty means secretbox.
+	Cipher string `json:"cipher,omitempty"`
+	// NoncePrefix is what the chunk nonces are made from; without one they're random.
+	NoncePrefix []byte `json:"nonce_prefix,omitempty"`
+	// ChunkSize is the size of each encrypted chunk of the contents, except the last; zero means
+	// DefaultChunkSize.
+	ChunkSize uint32    `json:"chunk_size,omitempty"`
 	Hash      []byte    `json:"hash"`
 	Challenge []byte    `json:"challenge"`
 	Uploaded  time.Time `json:"uploaded,omitempty"`
 	Downloads uint      `json:"downloads,omitempty"`
+	// Expires is when the server deletes the file, if set.
+	Expires time.Time `json:"expires,omitempty"`
+	// MaxDownloads is how many times the file can be downloaded before the server deletes it,
+	// if non-zero.
+	MaxDownloads uint `json:"max_downloads,omitempty"`
+	// Live files are streamed from their uploader to a single downloader through the server,
+	// which only buffers a few chunks of them and never stores them.
+	Live bool `json:"live,omitempty"`
+	// ContentType, Description and Tags help identify the file. Like its name, they're stored
+	// unencrypted.
+	ContentType string   `json:"content_type,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Origin is the ID the file was uploaded with, if it was forwarded from another server where
+	// it had that ID. Its chunks stay bound to that ID, so unlike other files, the server could
+	// give out another file encrypted with the same password in its place.
+	Origin FileID `json:"origin,omitzero"`
 }
 
-type FileID struct {
-	ID string `json:"id,omitempty"`
+// CreatedFile is the server's response to creating a file. The owner token authorises
+// later changes to the file, such as deleting it, and is only ever sent once.
+type CreatedFile struct {
+	ID         FileID `json:"id"`
+	OwnerToken string `json:"owner_token"`
+}
+
+// TrashedFile is the server's response to deleting a file which goes to the trash rather than
+// being deleted straight away. It can be restored until Purge.
+type TrashedFile struct {
+	Purge time.Time `json:"purge"`
+}
+
+// UploadStatus reports how much of a file's encrypted contents the server has received, so an
+// interrupted upload can be resumed from Offset.
+type UploadStatus struct {
+	Offset   uint64 `json:"offset"`
+	Complete bool   `json:"complete,omitempty"`
 }
 
 type File struct {
 	FileMetadata
-	Data [][]byte
+	State State
+	// Replacement is new contents and metadata being uploaded to take the file's place, keeping
+	// its ID; see RelayServer.ReplaceFile.
+	Replacement *File
+	// Content holds the file's encrypted contents. While it's being uploaded, it's only set if the
+	// contents are kept in memory.
+	Content Content
+	// Received is the number of bytes of encrypted contents held for the file.
+	Received uint64
+	// OwnerTokenHash is the SHA-256 hash of the file's owner token.
+	OwnerTokenHash []byte
+	// AccessHash is the salt followed by the salted SHA-256 hash of the password needed to get the
+	// file, or nil if it doesn't need one. It's checked by the server, on top of the encryption.
+	AccessHash []byte
+	// Purge is when a trashed file is deleted for good.
+	Purge time.Time
 }
 
-func NewFile(id uuid.UUID) File {
-	return File{}
+func (f *File) CheckOwnerToken(token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	return len(f.OwnerTokenHash) == sha256.Size && subtle.ConstantTimeCompare(hash[:], f.OwnerTokenHash) == 1
 }
 
-func (file *FileMetadata) CheckChallenge(key [crypto.KeySize]byte) bool {
-	b, err := crypto.DecryptChunk(key, file.Challenge, nil)
+// accessSaltSize is the size of the salt hashed with a file's access password.
+const accessSaltSize = 16
+
+// SetAccessPassword makes the file need password to get it, or no password if it's empty.
+func (f *File) SetAccessPassword(password string) error {
+	if password == "" {
+		f.AccessHash = nil
+		return nil
+	}
+	salt := make([]byte, accessSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	f.AccessHash = append(salt, accessHash(salt, password)...)
+	return nil
+}
+
+// CheckAccess reports whether password is enough to get the file.
+func (f *File) CheckAccess(password string) bool {
+	if f.AccessHash == nil {
+		return true
+	}
+	if len(f.AccessHash) != accessSaltSize+sha256.Size {
+		return false
+	}
+	salt := f.AccessHash[:accessSaltSize]
+	return subtle.ConstantTimeCompare(accessHash(salt, password), f.AccessHash[accessSaltSize:]) == 1
+}
+
+func accessHash(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (file *FileMetadata) Expired(now time.Time) bool {
+	return !file.Expires.IsZero() && !now.Before(file.Expires)
+}
+
+// HasTags reports whether the file has every one of tags.
+func (file *FileMetadata) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range file.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesType reports whether the file's content type, without its parameters, is pattern, or
+// has its major type if pattern is like "image/*".
+func (file *FileMetadata) MatchesType(pattern string) bool {
+	mediaType, _, err := mime.ParseMediaType(file.ContentType)
 	if err != nil {
 		return false
 	}
-	return bytes.Equal(b, file.Hash)
+	if major := strings.TrimSuffix(pattern, "/*"); major != pattern {
+		return strings.HasPrefix(mediaType, strings.ToLower(major)+"/")
+	}
+	return mediaType == strings.ToLower(pattern)
+}
+
+// CheckChallenge reports whether key is the file's key. It runs in constant time, so it gives
+// away nothing about how close a wrong key was.
+func (file *FileMetadata) CheckChallenge(key [crypto.KeySize]byte) bool {
+	return hmac.Equal(crypto.Challenge(&key), file.Challenge)
 }
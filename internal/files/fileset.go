@@ -1,40 +1,18 @@
 package files
 
-import (
-	"sync"
-
-	"github.com/google/uuid"
-)
+import "github.com/bfrengley/relay/internal/store"
 
+// FileSet is a set of files safe for concurrent use, each of which can expire.
 type FileSet struct {
-	sync.Mutex
-	Files map[uuid.UUID]File
-}
-
-func (fs *FileSet) Set(id uuid.UUID, f File) {
-	fs.Lock()
-	fs.Files[id] = f
-	fs.Unlock()
-}
-
-func (fs *FileSet) Remove(id uuid.UUID) (File, bool) {
-	fs.Lock()
-	defer fs.Unlock()
-
-	f, ok := fs.Files[id]
-	if ok {
-		delete(fs.Files, id)
-	}
-	return f, ok
+	*store.Store[FileID, File]
 }
 
-func (fs *FileSet) Get(id uuid.UUID) (File, bool) {
-	fs.Lock()
-	f, ok := fs.Files[id]
-	fs.Unlock()
-	return f, ok
+// Bytes is the total size of the contents of the files in the set, as far as they've been
+// received, including expired ones which haven't been removed yet.
+func (fs FileSet) Bytes() uint64 {
+	return fs.Size()
 }
 
 func NewSet() FileSet {
-	return FileSet{sync.Mutex{}, make(map[uuid.UUID]File)}
+	return FileSet{store.New[FileID](func(f File) uint64 { return f.Received })}
 }
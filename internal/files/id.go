@@ -0,0 +1,55 @@
+package files
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidFileID is returned for text which isn't a file ID.
+var ErrInvalidFileID = errors.New("invalid file ID")
+
+// FileID identifies a file on a server. The zero FileID is no ID at all, and is written as an
+// empty string.
+type FileID uuid.UUID
+
+func NewFileID() FileID {
+	return FileID(uuid.New())
+}
+
+// ParseFileID parses an ID in the usual UUID form.
+func ParseFileID(s string) (FileID, error) {
+	id, err := uuid.Parse(s)
+	if err != nil || id == uuid.Nil {
+		return FileID{}, ErrInvalidFileID
+	}
+	return FileID(id), nil
+}
+
+func (id FileID) IsZero() bool {
+	return id == FileID{}
+}
+
+func (id FileID) String() string {
+	if id.IsZero() {
+		return ""
+	}
+	return uuid.UUID(id).String()
+}
+
+func (id FileID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *FileID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*id = FileID{}
+		return nil
+	}
+	parsed, err := ParseFileID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
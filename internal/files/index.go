@@ -0,0 +1,100 @@
+package files
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Index finds files by the words in their names and tags. It's safe for concurrent use.
+type Index struct {
+	mu sync.RWMutex
+	// words maps each word to the files it's in.
+	words map[string]map[FileID]bool
+	// files maps each file to its words, so they can be removed.
+	files map[FileID][]string
+}
+
+func NewIndex() *Index {
+	return &Index{words: make(map[string]map[FileID]bool), files: make(map[FileID][]string)}
+}
+
+// searchWords splits text into lower case words at anything that isn't a letter or digit.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// Add indexes a file under the words of its name and tags, and each whole tag, replacing
+// whatever it was indexed under before.
+func (ix *Index) Add(meta FileMetadata) {
+	words := searchWords(meta.Name)
+	for _, tag := range meta.Tags {
+		words = append(words, strings.ToLower(tag))
+		words = append(words, searchWords(tag)...)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(meta.ID)
+	for _, word := range words {
+		if ix.words[word] == nil {
+			ix.words[word] = make(map[FileID]bool)
+		}
+		ix.words[word][meta.ID] = true
+	}
+	ix.files[meta.ID] = words
+}
+
+func (ix *Index) Remove(id FileID) {
+	ix.mu.Lock()
+	ix.remove(id)
+	ix.mu.Unlock()
+}
+
+// remove removes a file from the index. The index must be write locked.
+func (ix *Index) remove(id FileID) {
+	for _, word := range ix.files[id] {
+		delete(ix.words[word], id)
+		if len(ix.words[word]) == 0 {
+			delete(ix.words, word)
+		}
+	}
+	delete(ix.files, id)
+}
+
+// Search returns the files which have a word starting with each word of query, in no particular
+// order. An empty query finds nothing.
+func (ix *Index) Search(query string) []FileID {
+	terms := searchWords(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var found map[FileID]bool
+	for _, term := range terms {
+		matches := make(map[FileID]bool)
+		for word, ids := range ix.words {
+			if !strings.HasPrefix(word, term) {
+				continue
+			}
+			for id := range ids {
+				if found == nil || found[id] {
+					matches[id] = true
+				}
+			}
+		}
+		if found = matches; len(found) == 0 {
+			return nil
+		}
+	}
+
+	ids := make([]FileID, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	return ids
+}
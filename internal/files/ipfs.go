@@ -0,0 +1,401 @@
+package files
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IPFSContent is contents stored in IPFS through a node's HTTP RPC API, like Kubo's. They're
+// split into pieces of PieceSize bytes, each added and pinned as an object of its own, except that
+// the first also holds the Header bytes before the rest. So if PieceSize is a whole number of
+// chunks, each piece holds whole chunks. Until the upload finishes, the last piece is kept in
+// memory.
+type IPFSContent struct {
+	// API is the URL of the node's RPC API, such as http://127.0.0.1:5001.
+	API       string
+	Header    int64
+	PieceSize int64
+
+	mu   sync.Mutex
+	cids []string
+	size int64
+	// tail is the piece being uploaded, after the pieces in cids.
+	tail []byte
+	// chunks are the records of the contents' ChunkIndex, which is kept in memory, like the
+	// CIDs.
+	chunks []byte
+}
+
+// NewIPFSContent returns empty contents to be stored in pieces of pieceSize bytes, after a header
+// of header bytes, by the node with the RPC API at api.
+func NewIPFSContent(api string, header, pieceSize int64) *IPFSContent {
+	return &IPFSContent{API: strings.TrimRight(api, "/"), Header: header, PieceSize: pieceSize}
+}
+
+// piece returns the index of the piece holding the byte at pos, and where the piece starts.
+func (c *IPFSContent) piece(pos int64) (i, start int64) {
+	if i = (pos - c.Header) / c.PieceSize; i <= 0 {
+		return 0, 0
+	}
+	return i, c.Header + i*c.PieceSize
+}
+
+// pieceLen is the size of piece i if it's whole.
+func (c *IPFSContent) pieceLen(i int64) int64 {
+	if i == 0 {
+		return c.Header + c.PieceSize
+	}
+	return c.PieceSize
+}
+
+// CIDs returns the CIDs of the pieces the contents are stored in, in order.
+func (c *IPFSContent) CIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.cids...)
+}
+
+// ipfsError is the body of an error response from the RPC API.
+type ipfsError struct {
+	Message string
+}
+
+// call makes a request to the RPC API's command, like "cat", with the query args and body, if
+// it's not nil, as the file in a multipart form.
+func (c *IPFSContent) call(command string, args url.Values, body []byte) (*http.Response, error) {
+	endpoint := c.API + "/api/v0/" + command + "?" + args.Encode()
+	var req *http.Request
+	var err error
+	if body == nil {
+		req, err = http.NewRequest(http.MethodPost, endpoint, nil)
+	} else {
+		var form bytes.Buffer
+		mw := multipart.NewWriter(&form)
+		part, _ := mw.CreateFormFile("file", "piece")
+		part.Write(body)
+		mw.Close()
+		if req, err = http.NewRequest(http.MethodPost, endpoint, &form); err == nil {
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		var e ipfsError
+		if json.Unmarshal(msg, &e) == nil && e.Message != "" {
+			msg = []byte(e.Message)
+		}
+		return nil, fmt.Errorf("ipfs %s failed with status code %d: %s", command, res.StatusCode, msg)
+	}
+	return res, nil
+}
+
+// add adds and pins a piece, returning its CID.
+func (c *IPFSContent) add(piece []byte) (string, error) {
+	res, err := c.call("add", url.Values{
+		"pin":         {"true"},
+		"cid-version": {"1"},
+		"raw-leaves":  {"true"},
+		"quieter":     {"true"},
+	}, piece)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var added struct {
+		Hash string
+	}
+	if err = json.NewDecoder(res.Body).Decode(&added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", errors.New("ipfs add didn't return a CID")
+	}
+	return added.Hash, nil
+}
+
+// cat reads the piece with cid from offset onwards, up to length bytes if it's positive.
+func (c *IPFSContent) cat(cid string, offset, length int64) (io.ReadCloser, error) {
+	args := url.Values{"arg": {cid}}
+	if offset > 0 {
+		args.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	if length > 0 {
+		args.Set("length", strconv.FormatInt(length, 10))
+	}
+	res, err := c.call("cat", args, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// unpin unpins the pieces with cids, so the node can collect them as garbage.
+func (c *IPFSContent) unpin(cids []string) error {
+	var errs []error
+	for _, cid := range cids {
+		res, err := c.call("pin/rm", url.Values{"arg": {cid}}, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res.Body.Close()
+	}
+	return errors.Join(errs...)
+}
+
+func (c *IPFSContent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	c.mu.Lock()
+	cids, size := c.cids, c.size
+	c.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off+int64(n) < size {
+		pos := off + int64(n)
+		i, start := c.piece(pos)
+		if i >= int64(len(cids)) {
+			break // the tail isn't readable until it's stored
+		}
+		within := pos - start
+		length := min(int64(len(p)-n), c.pieceLen(i)-within)
+		body, err := c.cat(cids[i], within, length)
+		if err != nil {
+			return n, err
+		}
+		k, err := io.ReadFull(body, p[n:n+int(length)])
+		body.Close()
+		n += k
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Open reads the contents a piece at a time, streaming each from the node.
+func (c *IPFSContent) Open() (io.ReadSeekCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &ipfsReader{c: c, cids: c.cids, size: c.size}, nil
+}
+
+func (c *IPFSContent) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *IPFSContent) Chunks() (*ChunkIndex, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return memoryChunkIndex(c.chunks, c.size)
+}
+
+// Remove unpins the pieces, which the node deletes once it next collects garbage.
+func (c *IPFSContent) Remove() error {
+	c.mu.Lock()
+	cids := c.cids
+	c.cids, c.size, c.tail, c.chunks = nil, 0, nil, nil
+	c.mu.Unlock()
+	return c.unpin(cids)
+}
+
+// Truncate shortens the contents to their first n bytes, reading back the piece n falls in, if
+// it's been stored, to carry on from.
+func (c *IPFSContent) Truncate(n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n >= c.size {
+		return nil
+	}
+	kept, _ := keptChunks(bytes.NewReader(c.chunks), int64(len(c.chunks)/chunkRecordSize), n)
+	c.chunks = c.chunks[:kept*chunkRecordSize]
+	i, start := c.piece(n)
+	if i < int64(len(c.cids)) {
+		within := n - start
+		tail := make([]byte, within, c.pieceLen(i))
+		if within > 0 {
+			body, err := c.cat(c.cids[i], 0, within)
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadFull(body, tail)
+			body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if err := c.unpin(c.cids[i:]); err != nil {
+			return err
+		}
+		c.cids, c.tail = c.cids[:i], tail
+	} else {
+		c.tail = c.tail[:n-start]
+	}
+	c.size = n
+	return nil
+}
+
+// Writer returns a ContentWriter which appends to the contents after their first offset bytes,
+// discarding the rest.
+func (c *IPFSContent) Writer(offset int64) (ContentWriter, error) {
+	if err := c.Truncate(offset); err != nil {
+		return nil, err
+	}
+	return ipfsWriter{c}, nil
+}
+
+type ipfsWriter struct {
+	c *IPFSContent
+}
+
+// Write adds each piece to IPFS once it's whole and there's more to write, or the upload's
+// finished.
+func (w ipfsWriter) Write(p []byte) (int, error) {
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(p) > 0 {
+		c.chunks = appendChunk(c.chunks, Chunk{c.size, int64(len(p))})
+	}
+	n := 0
+	for len(p) > 0 {
+		if int64(len(c.tail)) == c.pieceLen(int64(len(c.cids))) {
+			if err := c.storeTail(); err != nil {
+				return n, err
+			}
+		}
+		if c.tail == nil {
+			c.tail = make([]byte, 0, c.pieceLen(int64(len(c.cids))))
+		}
+		k := min(len(p), int(c.pieceLen(int64(len(c.cids))))-len(c.tail))
+		c.tail = append(c.tail, p[:k]...)
+		c.size += int64(k)
+		p, n = p[k:], n+k
+	}
+	return n, nil
+}
+
+// storeTail adds the tail to IPFS as the next piece, or keeps it if that fails. It needs c.mu
+// held.
+func (c *IPFSContent) storeTail() error {
+	cid, err := c.add(c.tail)
+	if err != nil {
+		return err
+	}
+	c.cids, c.tail = append(c.cids, cid), nil
+	return nil
+}
+
+func (w ipfsWriter) Truncate(n int64) error {
+	return w.c.Truncate(n)
+}
+
+// Finish stores the last piece.
+func (w ipfsWriter) Finish() (Content, error) {
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tail) > 0 {
+		if err := c.storeTail(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close keeps the pieces stored so far and the tail, to resume the upload from.
+func (w ipfsWriter) Close() error {
+	return nil
+}
+
+// ipfsReader reads contents in IPFS, with a request for each piece it reads from.
+type ipfsReader struct {
+	c    *IPFSContent
+	cids []string
+	size int64
+	off  int64
+	// body is the rest of the piece being read.
+	body io.ReadCloser
+}
+
+func (r *ipfsReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		i, start := r.c.piece(r.off)
+		if i >= int64(len(r.cids)) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		body, err := r.c.cat(r.cids[i], r.off-start, 0)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	if err == io.EOF {
+		// the next read goes on to the next piece, unless this one was cut short
+		r.body.Close()
+		r.body = nil
+		if _, start := r.c.piece(r.off); r.off < r.size && start != r.off {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (r *ipfsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *ipfsReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package files
+
+import (
+	"errors"
+	"os"
+)
+
+const canMap = false
+
+func mmap(f *os.File, size int) ([]byte, error) { return nil, errors.ErrUnsupported }
+func munmap(b []byte) error                     { return nil }
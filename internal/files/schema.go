@@ -0,0 +1,40 @@
+package files
+
+import "fmt"
+
+// SchemaVersion is the version of FileMetadata this build writes. Stored metadata carries the
+// version it was written with, so it can be brought up to date by Migrate when it's read back.
+//
+// Any change to the fields which would make older stored metadata mean something else, such as a
+// new default, needs a new version, with a migration added to migrations to bring older
+// metadata into line.
+const SchemaVersion = 1
+
+// migrations[v] brings metadata from schema version v to v+1. Version 0 is metadata stored
+// before versions were recorded, which is the same as version 1.
+var migrations = []func(meta *FileMetadata) error{
+	0: func(meta *FileMetadata) error { return nil },
+}
+
+// SchemaError is returned by Migrate for metadata written by a newer version of relay, which
+// this one can't be sure to understand.
+type SchemaError struct {
+	Version uint
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("file metadata schema version %d is newer than the latest supported version %d", e.Version, SchemaVersion)
+}
+
+// Migrate brings stored metadata up to SchemaVersion.
+func (meta *FileMetadata) Migrate() error {
+	if meta.Schema > SchemaVersion {
+		return &SchemaError{meta.Schema}
+	}
+	for ; meta.Schema < SchemaVersion; meta.Schema++ {
+		if err := migrations[meta.Schema](meta); err != nil {
+			return fmt.Errorf("migrating file metadata from schema version %d: %w", meta.Schema, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int            `json:"version"`
+	Files   []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	FileMetadata
+	State          State            `json:"state"`
+	Received       uint64           `json:"received"`
+	OwnerTokenHash []byte           `json:"owner_token_hash"`
+	AccessHash     []byte           `json:"access_hash,omitempty"`
+	Purge          time.Time        `json:"purge,omitempty"`
+	Content        *snapshotContent `json:"content,omitempty"`
+	Replacement    *snapshotFile    `json:"replacement,omitempty"`
+}
+
+// snapshotContent refers to contents on disk by their path, and holds contents in memory as they
+// are. Contents in IPFS are referred to by the CIDs of their pieces, with Data holding the piece
+// still being uploaded. Chunks holds the records of the ChunkIndex of contents in memory or IPFS;
+// those on disk have theirs beside them.
+type snapshotContent struct {
+	Path   string `json:"path,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	Chunks []byte `json:"chunks,omitempty"`
+
+	IPFS      string   `json:"ipfs,omitempty"`
+	Header    int64    `json:"header,omitempty"`
+	PieceSize int64    `json:"piece_size,omitempty"`
+	CIDs      []string `json:"cids,omitempty"`
+	Size      int64    `json:"size,omitempty"`
+}
+
+// Snapshot writes out the files in the set, leaving out expired ones, so they can be put back
+// with Restore. Their metadata is written with the current SchemaVersion. Contents on disk are written as their paths, contents in IPFS as the CIDs of their pieces, and contents in memory in full.
+// Uploads in progress are written as if they'd been interrupted, and live files are left out.
+func (fs FileSet) Snapshot(w io.Writer) error {
+	s := snapshot{Version: snapshotVersion, Files: make([]snapshotFile, 0)}
+	var err error
+	fs.Range(func(_ FileID, f File) bool {
+		if f.Live {
+			return true // which can't outlive the connections streaming them
+		}
+		var sf snapshotFile
+		if sf, err = snapshotOf(f); err != nil {
+			return false
+		}
+		s.Files = append(s.Files, sf)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// in a stable order, so the same files always make the same snapshot
+	sort.Slice(s.Files, func(i, j int) bool { return s.Files[i].ID.String() < s.Files[j].ID.String() })
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func snapshotOf(f File) (snapshotFile, error) {
+	f.Schema = SchemaVersion
+	sf := snapshotFile{
+		FileMetadata:   f.FileMetadata,
+		State:          f.State,
+		Received:       f.Received,
+		OwnerTokenHash: f.OwnerTokenHash,
+		AccessHash:     f.AccessHash,
+		Purge:          f.Purge,
+	}
+	if sf.State == StateUploading {
+		sf.State = StateCreated
+	}
+
+	switch c := f.Content.(type) {
+	case nil:
+	case DiskContent:
+		sf.Content = &snapshotContent{Path: string(c)}
+	case *MemoryContent:
+		data := make([]byte, c.Size())
+		if _, err := c.ReadAt(data, 0); err != nil && err != io.EOF {
+			return sf, err
+		}
+		sf.Content = &snapshotContent{Data: data, Chunks: c.chunks}
+	case *IPFSContent:
+		c.mu.Lock()
+		sf.Content = &snapshotContent{
+			IPFS:      c.API,
+			Header:    c.Header,
+			PieceSize: c.PieceSize,
+			CIDs:      append([]string(nil), c.cids...),
+			Size:      c.size,
+			Data:      append([]byte(nil), c.tail...),
+			Chunks:    append([]byte(nil), c.chunks...),
+		}
+		c.mu.Unlock()
+	default:
+		return sf, fmt.Errorf("file %s: can't snapshot contents of type %T", f.ID, f.Content)
+	}
+
+	if f.Replacement != nil {
+		r, err := snapshotOf(*f.Replacement)
+		if err != nil {
+			return sf, err
+		}
+		sf.Replacement = &r
+	}
+	return sf, nil
+}
+
+// Restore adds the files in a snapshot written by Snapshot to the set, replacing any with the
+// same IDs, migrating their metadata to the current SchemaVersion. Nothing is added if the
+// snapshot can't be read, or has metadata which can't be migrated.
+func (fs FileSet) Restore(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	restored := make(map[FileID]File, len(s.Files))
+	for _, sf := range s.Files {
+		if sf.ID.IsZero() {
+			return errors.New("file with no ID in snapshot")
+		}
+		f, err := sf.file()
+		if err != nil {
+			return fmt.Errorf("file %s: %w", sf.ID, err)
+		}
+		restored[sf.ID] = f
+	}
+	for id, f := range restored {
+		switch f.State {
+		case StateReady:
+			fs.SetExpiring(id, f, f.Expires)
+		case StateTrashed:
+			fs.SetExpiring(id, f, f.Purge)
+		default:
+			fs.Set(id, f)
+		}
+	}
+	return nil
+}
+
+func (sf *snapshotFile) file() (File, error) {
+	if err := sf.Migrate(); err != nil {
+		return File{}, err
+	}
+	f := File{
+		FileMetadata:   sf.FileMetadata,
+		State:          sf.State,
+		Received:       sf.Received,
+		OwnerTokenHash: sf.OwnerTokenHash,
+		AccessHash:     sf.AccessHash,
+		Purge:          sf.Purge,
+	}
+	if c := sf.Content; c != nil {
+		switch {
+		case c.Path != "":
+			f.Content = DiskContent(c.Path)
+		case c.IPFS != "":
+			if c.PieceSize <= 0 {
+				return f, errors.New("contents in IPFS with no piece size")
+			}
+			ipfs := NewIPFSContent(c.IPFS, c.Header, c.PieceSize)
+			ipfs.cids, ipfs.size, ipfs.chunks = c.CIDs, c.Size, c.Chunks
+			if len(c.Data) > 0 {
+				ipfs.tail = c.Data
+			}
+			f.Content = ipfs
+		default:
+			mem := NewMemoryContent()
+			mem.Write(c.Data)
+			mem.chunks = c.Chunks
+			f.Content = mem
+		}
+	}
+	if sf.Replacement != nil {
+		r, err := sf.Replacement.file()
+		if err != nil {
+			return f, err
+		}
+		f.Replacement = &r
+	}
+	return f, nil
+}
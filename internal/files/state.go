@@ -0,0 +1,89 @@
+package files
+
+import "fmt"
+
+// State is where a file is in its life on the server.
+type State uint8
+
+const (
+	// StateCreated files have their metadata, and are waiting for (the rest of) their contents.
+	StateCreated State = iota
+	// StateUploading files have their contents being received.
+	StateUploading
+	// StateReady files have all their contents, and can be downloaded.
+	StateReady
+	// StateTrashed files have been deleted, or have expired, but can still be restored until
+	// they're purged.
+	StateTrashed
+	// StateExpired files have passed their expiry, and are being removed.
+	StateExpired
+	// StateDeleted files have been deleted or purged, or reached their download limit, and are
+	// being removed.
+	StateDeleted
+)
+
+var stateNames = [...]string{"created", "uploading", "ready", "trashed", "expired", "deleted"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", s)
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	if int(s) >= len(stateNames) {
+		return nil, fmt.Errorf("invalid file state %d", s)
+	}
+	return []byte(stateNames[s]), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if string(text) == name {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid file state %q", text)
+}
+
+// Done reports whether a file in state s is on its way out, and can't change any more.
+func (s State) Done() bool {
+	return s == StateExpired || s == StateDeleted
+}
+
+// transitions lists the states each state can move to. An interrupted upload goes back to
+// created, keeping what it received so it can be resumed, and a restored file goes back to ready.
+var transitions = map[State][]State{
+	StateCreated:   {StateUploading, StateDeleted},
+	StateUploading: {StateCreated, StateReady},
+	StateReady:     {StateTrashed, StateExpired, StateDeleted},
+	StateTrashed:   {StateReady, StateDeleted},
+}
+
+// TransitionError is returned for a change of state a file can't make.
+type TransitionError struct {
+	From, To State
+}
+
+func (e *TransitionError) Error() string {
+	if e.From == StateUploading {
+		if e.To == StateUploading {
+			return "file is already being uploaded"
+		}
+		return fmt.Sprintf("file can't be %s while it's being uploaded", e.To)
+	}
+	return fmt.Sprintf("file can't become %s once it's %s", e.To, e.From)
+}
+
+// Transition moves the file to state to, if it can get there from the state it's in.
+func (f *File) Transition(to State) error {
+	for _, s := range transitions[f.State] {
+		if s == to {
+			f.State = to
+			return nil
+		}
+	}
+	return &TransitionError{f.State, to}
+}
@@ -0,0 +1,196 @@
+package files
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bfrengley/relay/crypto"
+)
+
+const (
+	// MaxNameSize is the longest file name accepted, in bytes.
+	MaxNameSize = 1024
+	// MaxDescriptionSize is the longest description accepted, in bytes.
+	MaxDescriptionSize = 4096
+	// MaxTags is the most tags a file can have, and MaxTagSize the longest tag, in bytes.
+	MaxTags    = 16
+	MaxTagSize = 64
+	// maxContentTypeSize is the longest content type accepted, in bytes.
+	maxContentTypeSize = 256
+	// maxSize is the largest file size accepted, far beyond anything that can be stored but small
+	// enough that working out where its chunks are can't overflow.
+	maxSize = 1 << 56
+	// maxWrappedKeySize is the longest RSA wrapped file key accepted, from a 16384-bit key.
+	maxWrappedKeySize = 16384 / 8
+
+	// DefaultChunkSize is the size of each encrypted chunk of a file, except the last, unless its
+	// metadata gives another between MinChunkSize and MaxChunkSize.
+	DefaultChunkSize = 32 * 1024
+	MinChunkSize     = 4 * 1024
+	MaxChunkSize     = 16 * 1024 * 1024
+)
+
+// ErrInvalidMetadata is matched by errors for metadata that's malformed or inconsistent.
+var ErrInvalidMetadata = errors.New("invalid file metadata")
+
+func invalidMetadata(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidMetadata, fmt.Sprintf(format, a...))
+}
+
+// Validate checks that everything needed to decrypt a file is present, well formed, and
+// consistent, so it's safe to act on. The client checks it before trusting what the server sends
+// back. It doesn't check the fields the server sets; see ValidateNew.
+func (meta *FileMetadata) Validate() error {
+	switch {
+	case meta.Name == "":
+		return invalidMetadata("name cannot be empty")
+	case len(meta.Name) > MaxNameSize:
+		return invalidMetadata("name is longer than %d bytes", MaxNameSize)
+	case !utf8.ValidString(meta.Name):
+		return invalidMetadata("name is not valid UTF-8")
+	}
+	for _, c := range meta.Name {
+		if unicode.IsControl(c) {
+			return invalidMetadata("name contains control characters")
+		}
+	}
+
+	if meta.Size == 0 {
+		return invalidMetadata("file must be >0 bytes")
+	}
+	if meta.Size > maxSize {
+		return invalidMetadata("file size %d is too large", meta.Size)
+	}
+	if len(meta.Hash) != sha256.Size {
+		return invalidMetadata("hash must be a valid SHA-256 hash")
+	}
+	if len(meta.Salt) != crypto.SaltSize {
+		return invalidMetadata("salt must be %d bytes", crypto.SaltSize)
+	}
+	if len(meta.Challenge) != sha256.Size {
+		return invalidMetadata("invalid challenge size")
+	}
+
+	switch meta.KDF {
+	case "", crypto.KDFScrypt:
+		if meta.Scrypt != nil {
+			if err := meta.Scrypt.Validate(); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+			}
+		}
+	case crypto.KDFKeyfile, crypto.KDFYubiKey, crypto.KDFX25519, crypto.KDFSSHEd25519, crypto.KDFSSHRSA:
+		if meta.Scrypt != nil {
+			return invalidMetadata(`unexpected field "scrypt" for the %s key derivation function`, meta.KDF)
+		}
+	default:
+		return invalidMetadata("unknown key derivation function %q", meta.KDF)
+	}
+	switch meta.KDF {
+	case crypto.KDFX25519, crypto.KDFSSHEd25519:
+		if len(meta.Ephemeral) != crypto.X25519KeySize {
+			return invalidMetadata("invalid ephemeral key size")
+		}
+	case crypto.KDFSSHRSA:
+		// the file key wrapped with RSA, which is as long as the key
+		if len(meta.Ephemeral) < crypto.MinRSAKeyBits/8 || len(meta.Ephemeral) > maxWrappedKeySize {
+			return invalidMetadata("invalid wrapped key size")
+		}
+	default:
+		if meta.Ephemeral != nil {
+			return invalidMetadata(`unexpected field "ephemeral"`)
+		}
+	}
+
+	if _, err := crypto.CipherByName(meta.Cipher); err != nil {
+		return invalidMetadata("unknown cipher %q", meta.Cipher)
+	}
+	if meta.ChunkSize != 0 && (meta.ChunkSize < MinChunkSize || meta.ChunkSize > MaxChunkSize) {
+		return invalidMetadata("chunk size must be %d to %d bytes", MinChunkSize, MaxChunkSize)
+	}
+	if meta.Format > crypto.FormatVersion {
+		return invalidMetadata("unsupported format version %d", meta.Format)
+	}
+	if meta.NoncePrefix != nil && len(meta.NoncePrefix) != crypto.NoncePrefixSize {
+		return invalidMetadata("invalid nonce prefix size")
+	}
+	return meta.validateDetails()
+}
+
+// validateDetails checks the optional fields describing the file.
+func (meta *FileMetadata) validateDetails() error {
+	if meta.ContentType != "" {
+		if len(meta.ContentType) > maxContentTypeSize {
+			return invalidMetadata("content type is longer than %d bytes", maxContentTypeSize)
+		}
+		if _, _, err := mime.ParseMediaType(meta.ContentType); err != nil {
+			return invalidMetadata("invalid content type %q", meta.ContentType)
+		}
+	}
+
+	switch {
+	case len(meta.Description) > MaxDescriptionSize:
+		return invalidMetadata("description is longer than %d bytes", MaxDescriptionSize)
+	case !utf8.ValidString(meta.Description):
+		return invalidMetadata("description is not valid UTF-8")
+	}
+	for _, c := range meta.Description {
+		if unicode.IsControl(c) && c != '\n' && c != '\t' {
+			return invalidMetadata("description contains control characters")
+		}
+	}
+
+	if len(meta.Tags) > MaxTags {
+		return invalidMetadata("file has more than %d tags", MaxTags)
+	}
+	seen := make(map[string]bool, len(meta.Tags))
+	for _, tag := range meta.Tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+		if seen[tag] {
+			return invalidMetadata("duplicate tag %q", tag)
+		}
+		seen[tag] = true
+	}
+	return nil
+}
+
+// ValidateTag checks that tag can be used as a tag: it isn't empty or too long, and is made of
+// letters, digits, and the punctuation "-", "_", "." and ":", so tags can be listed with commas
+// or spaces between them.
+func ValidateTag(tag string) error {
+	if tag == "" || len(tag) > MaxTagSize {
+		return invalidMetadata("tags must be 1 to %d bytes", MaxTagSize)
+	}
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_.:", c) {
+			return invalidMetadata("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// ValidateNew checks the metadata of a file which is about to be created, like Validate, and
+// that it leaves the fields the server sets empty. The client checks it before creating a file,
+// and the server before accepting one.
+func (meta *FileMetadata) ValidateNew() error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case meta.Schema != 0:
+		return invalidMetadata(`unexpected field "schema"`)
+	case !meta.ID.IsZero():
+		return invalidMetadata(`unexpected field "id"`)
+	case !meta.Uploaded.IsZero():
+		return invalidMetadata(`unexpected field "uploaded"`)
+	case meta.Downloads != 0:
+		return invalidMetadata(`unexpected field "downloads"`)
+	}
+	return nil
+}
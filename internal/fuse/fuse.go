@@ -0,0 +1,36 @@
+// Package fuse serves a read-only directory of files through the Linux kernel's FUSE protocol. It
+// only does what relay mount needs, which saves depending on cgo or a general FUSE library.
+package fuse
+
+import (
+	"io"
+	"time"
+)
+
+// File is a file in the directory.
+type File struct {
+	// Key identifies the file across listings, so it keeps its inode number while its key stays
+	// the same, whatever it's named.
+	Key     string
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Open returns what the file's contents are read through. Errors matching fs.ErrPermission
+	// and fs.ErrNotExist fail opening it with EACCES and ENOENT, and others with EIO.
+	Open func() (io.ReaderAt, error)
+}
+
+// Lister lists the files in the directory. It's called again when the last listing is older
+// than Options.Refresh, so the directory can change.
+type Lister func() ([]File, error)
+
+type Options struct {
+	// Name is the name of the mounted filesystem, as mount lists it.
+	Name string
+	// AllowOther lets users other than the one mounting the filesystem use it, which needs
+	// user_allow_other in /etc/fuse.conf unless it's mounted by root.
+	AllowOther bool
+	// Refresh is how long a listing of the directory, and the attributes of its files, are
+	// cached for.
+	Refresh time.Duration
+}
@@ -0,0 +1,550 @@
+//go:build linux
+
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// The opcodes of the requests which are handled; the rest fail with ENOSYS.
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opOpen        = 14
+	opRead        = 15
+	opStatfs      = 17
+	opRelease     = 18
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+const (
+	rootID = 1
+	// maxWrite is the largest write the kernel's told it can send, which it sizes the buffer
+	// requests are read into by, though nothing's written.
+	maxWrite    = 128 << 10
+	inHeaderLen = 40
+
+	initAsyncRead = 1 << 0
+	openKeepCache = 1 << 1
+	direntDir     = 4
+	direntReg     = 8
+)
+
+var order = binary.NativeEndian
+
+// Conn is a mounted filesystem.
+type Conn struct {
+	fd         int
+	mountpoint string
+	list       Lister
+	opts       Options
+	uid, gid   uint32
+	mounted    time.Time
+
+	// refreshing is held while the directory's listed, so only one listing happens at once.
+	refreshing sync.Mutex
+
+	mu     sync.Mutex
+	listed time.Time
+	byName map[string]*node
+	// nodes holds every file ever listed by inode number, and ids their inode numbers by key.
+	nodes   map[uint64]*node
+	ids     map[string]uint64
+	handles map[uint64]io.ReaderAt
+	dirs    map[uint64][]*node
+	nextFH  uint64
+}
+
+type node struct {
+	id uint64
+	File
+}
+
+// Mount mounts a filesystem at mountpoint, an existing directory, with the files list lists in
+// it. It has to be served with Serve. Mounting needs root, or the fusermount3 or fusermount
+// command, which is setuid, to do it on the user's behalf.
+func Mount(mountpoint string, list Lister, opts Options) (*Conn, error) {
+	if fi, err := os.Stat(mountpoint); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", mountpoint)
+	}
+	if opts.Name == "" {
+		opts.Name = "fuse"
+	}
+	if opts.Refresh < time.Second {
+		opts.Refresh = time.Second
+	}
+	c := &Conn{
+		mountpoint: mountpoint,
+		list:       list,
+		opts:       opts,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+		mounted:    time.Now(),
+		byName:     make(map[string]*node),
+		nodes:      make(map[uint64]*node),
+		ids:        make(map[string]uint64),
+		handles:    make(map[uint64]io.ReaderAt),
+		dirs:       make(map[uint64][]*node),
+	}
+
+	// which only root can do, or fusermount can do instead
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err == nil {
+		data := fmt.Sprintf("fd=%d,rootmode=%o,user_id=%d,group_id=%d,default_permissions", fd, syscall.S_IFDIR, c.uid, c.gid)
+		if opts.AllowOther {
+			data += ",allow_other"
+		}
+		err = syscall.Mount(opts.Name, mountpoint, "fuse."+opts.Name, syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, data)
+		if err == nil {
+			c.fd = fd
+			return c, nil
+		}
+		syscall.Close(fd)
+	}
+	if err != syscall.EPERM && err != syscall.EACCES {
+		return nil, err
+	}
+
+	options := "ro,nosuid,nodev,default_permissions,fsname=" + opts.Name + ",subtype=" + opts.Name
+	if opts.AllowOther {
+		options += ",allow_other"
+	}
+	if c.fd, err = fusermount(mountpoint, options); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fusermount has the fusermount command mount the filesystem, returning the /dev/fuse descriptor
+// it passes back over a socket.
+func fusermount(mountpoint, options string) (int, error) {
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if bin, err = exec.LookPath("fusermount"); err != nil {
+			return -1, errors.New("mounting needs root, or fusermount3 or fusermount to be installed")
+		}
+	}
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	local := os.NewFile(uintptr(pair[0]), "fusermount socket")
+	remote := os.NewFile(uintptr(pair[1]), "fusermount socket")
+	defer local.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(bin, "-o", options, "--", mountpoint)
+	// which is descriptor 3 in the child
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return -1, fmt.Errorf("%s: %v: %s", bin, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	if err != nil {
+		return -1, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return -1, fmt.Errorf("%s didn't pass back the FUSE device", bin)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) == 0 {
+		return -1, fmt.Errorf("%s didn't pass back the FUSE device", bin)
+	}
+	syscall.CloseOnExec(fds[0])
+	return fds[0], nil
+}
+
+// Unmount unmounts the filesystem, which ends Serve. It fails if the filesystem's busy.
+func (c *Conn) Unmount() error {
+	err := syscall.Unmount(c.mountpoint, 0)
+	if err != syscall.EPERM {
+		return err
+	}
+	bin, lookErr := exec.LookPath("fusermount3")
+	if lookErr != nil {
+		bin = "fusermount"
+	}
+	if out, err := exec.Command(bin, "-u", c.mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", bin, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Serve answers the kernel's requests until the filesystem is unmounted. Requests which might
+// wait on the Lister or the files' contents are answered concurrently.
+func (c *Conn) Serve() error {
+	defer syscall.Close(c.fd)
+	buf := make([]byte, inHeaderLen+maxWrite+4096)
+	for {
+		n, err := syscall.Read(c.fd, buf)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+			// ENOENT is a request which was interrupted before it was read
+			continue
+		case syscall.ENODEV:
+			return nil // unmounted
+		default:
+			return err
+		}
+		if n < inHeaderLen {
+			return fmt.Errorf("short FUSE request of %d bytes", n)
+		}
+		req := request{
+			opcode: order.Uint32(buf[4:]),
+			unique: order.Uint64(buf[8:]),
+			nodeID: order.Uint64(buf[16:]),
+			body:   append([]byte(nil), buf[inHeaderLen:n]...),
+		}
+		switch req.opcode {
+		case opForget, opBatchForget, opInterrupt:
+			// which aren't answered; inodes live as long as the mount
+		case opInit:
+			if err := c.init(req); err != nil {
+				return err
+			}
+		case opDestroy:
+			c.reply(req, 0)
+			return nil
+		default:
+			go c.handle(req)
+		}
+	}
+}
+
+type request struct {
+	opcode uint32
+	unique uint64
+	nodeID uint64
+	body   []byte
+}
+
+// reply answers req with the outputs, or fails it with errno if that's not 0.
+func (c *Conn) reply(req request, errno syscall.Errno, out ...[]byte) {
+	size := 16
+	for _, o := range out {
+		size += len(o)
+	}
+	msg := make([]byte, 16, size)
+	order.PutUint32(msg[0:], uint32(size))
+	order.PutUint32(msg[4:], uint32(-int32(errno)))
+	order.PutUint64(msg[8:], req.unique)
+	for _, o := range out {
+		msg = append(msg, o...)
+	}
+	// ENOENT is a request which was interrupted while it was being answered
+	if _, err := syscall.Write(c.fd, msg); err != nil && err != syscall.ENOENT {
+		logging.Errorln("FUSE reply failed:", err)
+	}
+}
+
+func (c *Conn) init(req request) error {
+	if len(req.body) < 16 {
+		return errors.New("short FUSE init request")
+	}
+	major, minor := order.Uint32(req.body[0:]), order.Uint32(req.body[4:])
+	if major != 7 || minor < 12 {
+		c.reply(req, syscall.EPROTO)
+		return fmt.Errorf("unsupported FUSE protocol version %d.%d", major, minor)
+	}
+	out := make([]byte, 64)
+	order.PutUint32(out[0:], 7)
+	order.PutUint32(out[4:], min(minor, 31))
+	order.PutUint32(out[8:], order.Uint32(req.body[8:])) // max_readahead
+	order.PutUint32(out[12:], order.Uint32(req.body[12:])&initAsyncRead)
+	order.PutUint16(out[16:], 16) // max_background
+	order.PutUint16(out[18:], 12) // congestion_threshold
+	order.PutUint32(out[20:], maxWrite)
+	order.PutUint32(out[24:], 1) // time_gran
+	if minor < 23 {
+		out = out[:24]
+	}
+	c.reply(req, 0, out)
+	return nil
+}
+
+func (c *Conn) handle(req request) {
+	switch req.opcode {
+	case opLookup:
+		c.lookup(req)
+	case opGetattr:
+		c.getattr(req)
+	case opOpen:
+		c.open(req)
+	case opRead:
+		c.read(req)
+	case opRelease:
+		c.mu.Lock()
+		delete(c.handles, order.Uint64(req.body))
+		c.mu.Unlock()
+		c.reply(req, 0)
+	case opOpendir:
+		c.opendir(req)
+	case opReaddir:
+		c.readdir(req)
+	case opReleasedir:
+		c.mu.Lock()
+		delete(c.dirs, order.Uint64(req.body))
+		c.mu.Unlock()
+		c.reply(req, 0)
+	case opStatfs:
+		out := make([]byte, 80)
+		order.PutUint32(out[40:], 4096) // bsize
+		order.PutUint32(out[44:], 255)  // namelen
+		order.PutUint32(out[48:], 4096) // frsize
+		c.reply(req, 0, out)
+	case opFlush:
+		c.reply(req, 0)
+	default:
+		c.reply(req, syscall.ENOSYS)
+	}
+}
+
+// refresh lists the directory again if the last listing is out of date.
+func (c *Conn) refresh() error {
+	c.refreshing.Lock()
+	defer c.refreshing.Unlock()
+	c.mu.Lock()
+	fresh := time.Since(c.listed) < c.opts.Refresh
+	c.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	list, err := c.list()
+	if err != nil {
+		logging.Errorln("listing files failed:", err)
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byName = make(map[string]*node, len(list))
+	for _, f := range list {
+		id, ok := c.ids[f.Key]
+		if !ok {
+			id = uint64(len(c.ids)) + rootID + 1
+			c.ids[f.Key] = id
+		}
+		n := &node{id, f}
+		c.nodes[id] = n
+		c.byName[f.Name] = n
+	}
+	c.listed = time.Now()
+	return nil
+}
+
+func (c *Conn) lookup(req request) {
+	name, _, _ := bytes.Cut(req.body, []byte{0})
+	if req.nodeID != rootID {
+		c.reply(req, syscall.ENOENT)
+		return
+	}
+	if err := c.refresh(); err != nil {
+		c.reply(req, syscall.EIO)
+		return
+	}
+	c.mu.Lock()
+	n, ok := c.byName[string(name)]
+	c.mu.Unlock()
+	if !ok {
+		c.reply(req, syscall.ENOENT)
+		return
+	}
+	out := make([]byte, 40, 128)
+	order.PutUint64(out[0:], n.id)
+	order.PutUint64(out[16:], uint64(c.opts.Refresh/time.Second)) // entry_valid
+	order.PutUint64(out[24:], uint64(c.opts.Refresh/time.Second)) // attr_valid
+	c.reply(req, 0, append(out, c.attr(n)...))
+}
+
+func (c *Conn) getattr(req request) {
+	var n *node
+	if req.nodeID != rootID {
+		c.mu.Lock()
+		n = c.nodes[req.nodeID]
+		c.mu.Unlock()
+		if n == nil {
+			c.reply(req, syscall.ENOENT)
+			return
+		}
+	}
+	out := make([]byte, 16, 104)
+	order.PutUint64(out[0:], uint64(c.opts.Refresh/time.Second)) // attr_valid
+	c.reply(req, 0, append(out, c.attr(n)...))
+}
+
+// attr is the fuse_attr of a file, or of the directory if n is nil.
+func (c *Conn) attr(n *node) []byte {
+	a := make([]byte, 88)
+	id, size, mtime, mode, nlink := uint64(rootID), int64(0), c.mounted, uint32(syscall.S_IFDIR|0555), uint32(2)
+	if n != nil {
+		id, size, mtime, mode, nlink = n.id, n.Size, n.ModTime, syscall.S_IFREG|0444, 1
+	}
+	order.PutUint64(a[0:], id)
+	order.PutUint64(a[8:], uint64(size))
+	order.PutUint64(a[16:], uint64(size+511)/512) // blocks
+	for _, off := range []int{24, 32, 40} {
+		// atime, mtime and ctime
+		order.PutUint64(a[off:], uint64(mtime.Unix()))
+	}
+	for _, off := range []int{48, 52, 56} {
+		order.PutUint32(a[off:], uint32(mtime.Nanosecond()))
+	}
+	order.PutUint32(a[60:], mode)
+	order.PutUint32(a[64:], nlink)
+	order.PutUint32(a[68:], c.uid)
+	order.PutUint32(a[72:], c.gid)
+	order.PutUint32(a[80:], 4096) // blksize
+	return a
+}
+
+func (c *Conn) open(req request) {
+	if order.Uint32(req.body)&syscall.O_ACCMODE != syscall.O_RDONLY {
+		c.reply(req, syscall.EROFS)
+		return
+	}
+	c.mu.Lock()
+	n := c.nodes[req.nodeID]
+	c.mu.Unlock()
+	if n == nil {
+		c.reply(req, syscall.ENOENT)
+		return
+	}
+
+	r, err := n.Open()
+	if err != nil {
+		logging.Errorln("opening", n.Name, "failed:", err)
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			c.reply(req, syscall.EACCES)
+		case errors.Is(err, fs.ErrNotExist):
+			c.reply(req, syscall.ENOENT)
+		default:
+			c.reply(req, syscall.EIO)
+		}
+		return
+	}
+	c.mu.Lock()
+	c.nextFH++
+	fh := c.nextFH
+	c.handles[fh] = r
+	c.mu.Unlock()
+
+	out := make([]byte, 16)
+	order.PutUint64(out[0:], fh)
+	// the contents of an inode never change, so what the kernel's cached stays good
+	order.PutUint32(out[8:], openKeepCache)
+	c.reply(req, 0, out)
+}
+
+func (c *Conn) read(req request) {
+	fh, off, size := order.Uint64(req.body[0:]), int64(order.Uint64(req.body[8:])), order.Uint32(req.body[16:])
+	c.mu.Lock()
+	r := c.handles[fh]
+	c.mu.Unlock()
+	if r == nil {
+		c.reply(req, syscall.EBADF)
+		return
+	}
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		logging.Errorln("reading failed:", err)
+		c.reply(req, syscall.EIO)
+		return
+	}
+	c.reply(req, 0, buf[:n])
+}
+
+func (c *Conn) opendir(req request) {
+	if req.nodeID != rootID {
+		c.reply(req, syscall.ENOTDIR)
+		return
+	}
+	if err := c.refresh(); err != nil {
+		c.reply(req, syscall.EIO)
+		return
+	}
+	// the listing's kept for the handle, so it reads back consistently however it's split up
+	c.mu.Lock()
+	entries := make([]*node, 0, len(c.byName))
+	for _, n := range c.byName {
+		entries = append(entries, n)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	c.nextFH++
+	fh := c.nextFH
+	c.dirs[fh] = entries
+	c.mu.Unlock()
+
+	out := make([]byte, 16)
+	order.PutUint64(out[0:], fh)
+	c.reply(req, 0, out)
+}
+
+func (c *Conn) readdir(req request) {
+	fh, off, size := order.Uint64(req.body[0:]), order.Uint64(req.body[8:]), int(order.Uint32(req.body[16:]))
+	c.mu.Lock()
+	entries, ok := c.dirs[fh]
+	c.mu.Unlock()
+	if !ok {
+		c.reply(req, syscall.EBADF)
+		return
+	}
+
+	// the offset of each entry is the index of the one after it, counting . and ..
+	out := make([]byte, 0, size)
+	for i := off; i < uint64(len(entries))+2; i++ {
+		id, name, typ := uint64(rootID), ".", uint32(direntDir)
+		switch {
+		case i == 1:
+			name = ".."
+		case i > 1:
+			n := entries[i-2]
+			id, name, typ = n.id, n.Name, direntReg
+		}
+		entry := (24 + len(name) + 7) &^ 7
+		if len(out)+entry > size {
+			break
+		}
+		d := make([]byte, entry)
+		order.PutUint64(d[0:], id)
+		order.PutUint64(d[8:], i+1)
+		order.PutUint32(d[16:], uint32(len(name)))
+		order.PutUint32(d[20:], typ)
+		copy(d[24:], name)
+		out = append(out, d...)
+	}
+	c.reply(req, 0, out)
+}
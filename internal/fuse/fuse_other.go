@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fuse
+
+import "errors"
+
+// Conn is a mounted filesystem.
+type Conn struct{}
+
+// Mount isn't supported on this platform.
+func Mount(mountpoint string, list Lister, opts Options) (*Conn, error) {
+	return nil, errors.New("mounting is only supported on Linux")
+}
+
+func (c *Conn) Serve() error   { return nil }
+func (c *Conn) Unmount() error { return nil }
@@ -0,0 +1,48 @@
+// Package logging adds levels to the standard log package, keeping the "INFO:" and "ERR:"
+// prefixes relay has always used.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+var level = int32(LevelInfo)
+
+// SetLevel sets the lowest level which is logged. It is safe to call concurrently with logging.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func Enabled(l Level) bool {
+	return l >= Level(atomic.LoadInt32(&level))
+}
+
+func output(l Level, prefix string, v []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	log.Output(3, fmt.Sprintln(append([]interface{}{prefix}, v...)...))
+}
+
+// Debugln logs details which are only useful when tracking down a problem.
+func Debugln(v ...interface{}) {
+	output(LevelDebug, "DEBUG:", v)
+}
+
+func Infoln(v ...interface{}) {
+	output(LevelInfo, "INFO:", v)
+}
+
+func Errorln(v ...interface{}) {
+	output(LevelError, "ERR:", v)
+}
@@ -0,0 +1,458 @@
+// Package qr encodes short byte strings as QR codes (versions 1 to 10, byte mode) and renders
+// them for display in a terminal.
+package qr
+
+import (
+	"errors"
+	"strings"
+)
+
+type Level int
+
+const (
+	Low Level = iota
+	Medium
+)
+
+var ErrTooLong = errors.New("qr: data too long to encode")
+
+type blockSpec struct {
+	ecPerBlock int
+	// blocks in group one, then group two; group two blocks hold one more data codeword
+	blocks1, data1 int
+	blocks2, data2 int
+}
+
+// blockSpecs is indexed by version, then Level.
+var blockSpecs = [11][2]blockSpec{
+	1:  {{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}},
+	2:  {{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}},
+	3:  {{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}},
+	4:  {{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}},
+	5:  {{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}},
+	6:  {{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}},
+	7:  {{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}},
+	8:  {{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}},
+	9:  {{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}},
+	10: {{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}},
+}
+
+var alignmentPositions = [11][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+func (s blockSpec) dataCodewords() int {
+	return s.blocks1*s.data1 + s.blocks2*s.data2
+}
+
+// Code is an encoded QR symbol. Modules are indexed [row][column]; true is dark.
+type Code struct {
+	Size    int
+	Modules [][]bool
+
+	version  int
+	level    Level
+	function [][]bool
+}
+
+// Encode encodes data in byte mode, using the smallest version which fits.
+func Encode(data []byte, level Level) (*Code, error) {
+	version := 0
+	for v := 1; v <= 10; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*blockSpecs[v][level].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	size := 4*version + 17
+	c := &Code{Size: size, version: version, level: level}
+	c.Modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for i := range c.Modules {
+		c.Modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	c.drawFunctionPatterns()
+	c.drawCodewords(c.addErrorCorrection(c.dataCodewords(data)))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masking is an XOR, so this undoes it
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+
+	return c, nil
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.Modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentPositions[c.version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			// skip the three corners occupied by finder patterns
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas; the real bits are drawn once a mask is chosen
+	c.drawFormatBits(0)
+	c.drawVersionBits()
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < c.Size && yy >= 0 && yy < c.Size {
+				dist := max(abs(dx), abs(dy))
+				c.set(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	levelBits := [...]int{Low: 1, Medium: 0}[c.level]
+	data := levelBits<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(bits, i))
+	}
+	c.set(8, 7, bit(bits, 6))
+	c.set(8, 8, bit(bits, 7))
+	c.set(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(bits, i))
+	}
+	c.set(8, c.Size-8, true)
+}
+
+func (c *Code) drawVersionBits() {
+	if c.version < 7 {
+		return
+	}
+
+	rem := c.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := c.version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, bit(bits, i))
+		c.set(b, a, bit(bits, i))
+	}
+}
+
+func (c *Code) dataCodewords(data []byte) []byte {
+	capacity := blockSpecs[c.version][c.level].dataCodewords()
+
+	var w bitWriter
+	w.write(0x4, 4)
+	if c.version >= 10 {
+		w.write(len(data), 16)
+	} else {
+		w.write(len(data), 8)
+	}
+	for _, b := range data {
+		w.write(int(b), 8)
+	}
+
+	// terminator, then pad to a whole byte
+	w.write(0, min(4, capacity*8-w.n))
+	w.write(0, (8-w.n%8)%8)
+
+	out := w.bytes()
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+func (c *Code) addErrorCorrection(data []byte) []byte {
+	spec := blockSpecs[c.version][c.level]
+	divisor := rsDivisor(spec.ecPerBlock)
+
+	var blocks, ecBlocks [][]byte
+	for i := 0; i < spec.blocks1+spec.blocks2; i++ {
+		n := spec.data1
+		if i >= spec.blocks1 {
+			n = spec.data2
+		}
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i < max(spec.data1, spec.data2); i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, b := range ecBlocks {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.Modules[y][x] = bit(int(data[i>>3]), 7-(i&7))
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y][x] {
+				c.Modules[y][x] = !c.Modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol using the specification's rules for masks; lower is better.
+func (c *Code) penalty() int {
+	n := c.Size
+	get := func(x, y int, transpose bool) bool {
+		if transpose {
+			return c.Modules[x][y]
+		}
+		return c.Modules[y][x]
+	}
+
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 0
+			for x := 0; x < n; x++ {
+				// runs of five or more modules of the same colour
+				if x > 0 && get(x, y, transpose) == get(x-1, y, transpose) {
+					run++
+					if run == 5 {
+						score += 3
+					} else if run > 5 {
+						score++
+					}
+				} else {
+					run = 1
+				}
+
+				// patterns resembling a finder, with a light border on either side
+				if x+7 <= n {
+					finder := true
+					for k, dark := range []bool{true, false, true, true, true, false, true} {
+						if get(x+k, y, transpose) != dark {
+							finder = false
+							break
+						}
+					}
+					if finder && (lightRun(get, x-4, x, y, n, transpose) || lightRun(get, x+7, x+11, y, n, transpose)) {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.Modules[y][x] {
+				dark++
+			}
+			// 2x2 blocks of the same colour
+			if x+1 < n && y+1 < n {
+				m := c.Modules[y][x]
+				if m == c.Modules[y][x+1] && m == c.Modules[y+1][x] && m == c.Modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// deviation of the proportion of dark modules from 50%
+	score += abs(dark*20-n*n*10) / (n * n) * 10
+	return score
+}
+
+func lightRun(get func(int, int, bool) bool, from, to, y, n int, transpose bool) bool {
+	if from < 0 || to > n {
+		return false
+	}
+	for x := from; x < to; x++ {
+		if get(x, y, transpose) {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the code using Unicode half blocks, two rows of modules per line, with a
+// quiet zone. Light modules are drawn filled, which suits light-on-dark terminals.
+func (c *Code) String() string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+			return true
+		}
+		return !c.Modules[y][x]
+	}
+
+	var sb strings.Builder
+	total := c.Size + 2*quiet
+	for y := 0; y < total; y += 2 {
+		for x := 0; x < total; x++ {
+			top, bottom := light(x, y), y+1 < total && light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteRune('█')
+			case top:
+				sb.WriteRune('▀')
+			case bottom:
+				sb.WriteRune('▄')
+			default:
+				sb.WriteRune(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *bitWriter) write(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if bit(v, i) {
+			w.buf[w.n/8] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+func bit(v, i int) bool {
+	return (v>>i)&1 != 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,172 @@
+// Package store provides a keyed collection safe for concurrent use, for the server's files,
+// upload sessions, mailboxes and the like.
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// Store is a map safe for concurrent use. Lookups only take a read lock, so they don't hold
+// each other up.
+//
+// Each value can have a deadline, after which the store acts as if it's gone. It's only actually
+// removed by RemoveExpired, so whatever else needs cleaning up along with it can be.
+type Store[K comparable, V any] struct {
+	mu    sync.RWMutex
+	items map[K]item[V]
+	// size weighs each value, for Size; it may be nil.
+	size  func(V) uint64
+	total uint64
+}
+
+type item[V any] struct {
+	value V
+	// deadline is when the value expires, or zero if it doesn't.
+	deadline time.Time
+}
+
+func (it item[V]) expired(now time.Time) bool {
+	return !it.deadline.IsZero() && !now.Before(it.deadline)
+}
+
+// New makes an empty store. If size isn't nil, Size is the total of size over every value in the
+// store.
+func New[K comparable, V any](size func(V) uint64) *Store[K, V] {
+	return &Store[K, V]{items: make(map[K]item[V]), size: size}
+}
+
+func (s *Store[K, V]) weigh(v V) uint64 {
+	if s.size == nil {
+		return 0
+	}
+	return s.size(v)
+}
+
+// put stores a value. The store must be write locked.
+func (s *Store[K, V]) put(key K, v V, deadline time.Time) {
+	if old, ok := s.items[key]; ok {
+		s.total -= s.weigh(old.value)
+	}
+	s.items[key] = item[V]{v, deadline}
+	s.total += s.weigh(v)
+}
+
+// Set stores a value which doesn't expire, replacing any with the same key.
+func (s *Store[K, V]) Set(key K, v V) {
+	s.SetExpiring(key, v, time.Time{})
+}
+
+// SetExpiring stores a value which expires at deadline, or never if it's zero.
+func (s *Store[K, V]) SetExpiring(key K, v V, deadline time.Time) {
+	s.mu.Lock()
+	s.put(key, v, deadline)
+	s.mu.Unlock()
+}
+
+// Add stores a value like SetExpiring, but only if there isn't one with the same key already,
+// reporting whether it did.
+func (s *Store[K, V]) Add(key K, v V, deadline time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if it, ok := s.items[key]; ok && !it.expired(time.Now()) {
+		return false
+	}
+	s.put(key, v, deadline)
+	return true
+}
+
+func (s *Store[K, V]) Get(key K) (V, bool) {
+	s.mu.RLock()
+	it, ok := s.items[key]
+	s.mu.RUnlock()
+	if !ok || it.expired(time.Now()) {
+		var zero V
+		return zero, false
+	}
+	return it.value, true
+}
+
+// Update changes the value with the given key in place, returning the updated value, or false if
+// there isn't one. Nothing else can change the value while update runs.
+func (s *Store[K, V]) Update(key K, update func(v *V)) (V, bool) {
+	return s.UpdateExpiring(key, func(v *V, _ *time.Time) { update(v) })
+}
+
+// UpdateExpiring is like Update, but update can also change when the value expires.
+func (s *Store[K, V]) UpdateExpiring(key K, update func(v *V, deadline *time.Time)) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[key]
+	if !ok || it.expired(time.Now()) {
+		var zero V
+		return zero, false
+	}
+	s.total -= s.weigh(it.value)
+	update(&it.value, &it.deadline)
+	s.items[key] = it
+	s.total += s.weigh(it.value)
+	return it.value, true
+}
+
+// Remove removes a value from the store, even if it's expired.
+func (s *Store[K, V]) Remove(key K) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[key]
+	if ok {
+		delete(s.items, key)
+		s.total -= s.weigh(it.value)
+	}
+	return it.value, ok
+}
+
+// RemoveExpired removes every value whose deadline has passed, returning them.
+func (s *Store[K, V]) RemoveExpired(now time.Time) map[K]V {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := make(map[K]V)
+	for key, it := range s.items {
+		if it.expired(now) {
+			expired[key] = it.value
+			delete(s.items, key)
+			s.total -= s.weigh(it.value)
+		}
+	}
+	return expired
+}
+
+// Range calls fn for each unexpired value in the store, in no particular order, until it returns
+// false. The store is read locked throughout, so fn mustn't change it; collect what needs
+// changing and do it afterwards.
+func (s *Store[K, V]) Range(fn func(key K, v V) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for key, it := range s.items {
+		if !it.expired(now) && !fn(key, it.value) {
+			return
+		}
+	}
+}
+
+// Len is the number of values in the store, including expired ones which haven't been removed
+// yet.
+func (s *Store[K, V]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.items)
+}
+
+// Size is the total size of the values in the store, as weighed by the function it was made
+// with, including expired ones which haven't been removed yet.
+func (s *Store[K, V]) Size() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.total
+}
@@ -0,0 +1,140 @@
+"use strict";
+
+// The relay client, compiled to WebAssembly, sets window.relay once it's running.
+const status = document.getElementById("status");
+
+function showStatus(text, isError) {
+  status.textContent = text;
+  status.className = isError ? "error" : "";
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+}
+
+// Times the server hasn't set come through as the zero time.
+function formatTime(t) {
+  if (!t || t.startsWith("0001-")) {
+    return "";
+  }
+  return new Date(t).toLocaleString();
+}
+
+function onProgress(description, bytes, total) {
+  const percent = total > 0 ? Math.floor((bytes / total) * 100) : 100;
+  showStatus(`${description}: ${formatSize(bytes)} of ${formatSize(total)} (${percent}%)`);
+}
+
+// busy disables the form's buttons while f runs, and shows what it throws.
+async function busy(form, f) {
+  const buttons = form.querySelectorAll("button");
+  buttons.forEach((b) => (b.disabled = true));
+  try {
+    await f();
+  } catch (err) {
+    showStatus(err.message, true);
+  } finally {
+    buttons.forEach((b) => (b.disabled = false));
+  }
+}
+
+function save(name, type, data) {
+  const url = URL.createObjectURL(new Blob([data], { type: type || "application/octet-stream" }));
+  const a = document.createElement("a");
+  a.href = url;
+  a.download = name;
+  document.body.appendChild(a);
+  a.click();
+  a.remove();
+  setTimeout(() => URL.revokeObjectURL(url), 60000);
+}
+
+async function uploadFile(event) {
+  event.preventDefault();
+  const form = event.target;
+  await busy(form, async () => {
+    const file = form.elements.file.files[0];
+    const res = await relay.upload(file, form.elements.password.value, {
+      token: form.elements.token.value,
+      expires: Number(form.elements.expires.value),
+      onProgress,
+    });
+    const link = document.getElementById("link");
+    link.href = res.link;
+    link.textContent = res.link;
+    document.getElementById("owner").textContent = res.ownerToken;
+    document.getElementById("uploaded").hidden = false;
+    form.elements.password.value = "";
+    showStatus(`Uploaded ${file.name}`);
+    await listFiles();
+  });
+}
+
+async function downloadFile(event) {
+  event.preventDefault();
+  const form = event.target;
+  await busy(form, async () => {
+    const res = await relay.download(form.elements.target.value, form.elements.password.value, {
+      onProgress,
+    });
+    save(res.name, res.type, res.data);
+    showStatus(`Downloaded ${res.name}`);
+  });
+}
+
+async function listFiles() {
+  const list = await relay.list();
+  const body = document.getElementById("files");
+  body.replaceChildren();
+  list.sort((a, b) => (a.uploaded < b.uploaded ? 1 : -1));
+  for (const meta of list) {
+    const row = document.createElement("tr");
+    for (const text of [meta.name, formatSize(meta.size), formatTime(meta.uploaded),
+      formatTime(meta.expires) || "never"]) {
+      const cell = document.createElement("td");
+      cell.textContent = text;
+      row.appendChild(cell);
+    }
+    const action = document.createElement("td");
+    const button = document.createElement("button");
+    button.type = "button";
+    button.textContent = "Download";
+    button.addEventListener("click", () => {
+      const form = document.getElementById("download");
+      form.elements.target.value = meta.id;
+      form.elements.password.focus();
+    });
+    action.appendChild(button);
+    row.appendChild(action);
+    body.appendChild(row);
+  }
+}
+
+async function start() {
+  if (typeof Go === "undefined") {
+    throw new Error("This server was built without the WebAssembly client; see internal/web.");
+  }
+  const go = new Go();
+  const { instance } = await WebAssembly.instantiateStreaming(fetch("/web/relay.wasm"), go.importObject);
+  go.run(instance);
+
+  document.getElementById("upload").addEventListener("submit", uploadFile);
+  document.getElementById("download").addEventListener("submit", downloadFile);
+  const refresh = document.getElementById("refresh");
+  refresh.addEventListener("click", () => busy(refresh.parentElement, listFiles));
+
+  // a share link opened here, as /#<id> or with the link after the #, fills in the download form
+  if (location.hash.length > 1) {
+    document.getElementById("download").elements.target.value = decodeURIComponent(location.hash.slice(1));
+    history.replaceState(null, "", location.pathname);
+  }
+  await listFiles();
+}
+
+start().catch((err) => showStatus(err.message, true));
@@ -0,0 +1,44 @@
+// Package web holds the server's web UI, which uploads, lists and downloads files from the
+// browser. The encryption and decryption are done in the browser by the relay client compiled to
+// WebAssembly, which isn't checked in; it's built into static with go generate.
+package web
+
+//go:generate sh -c "GOOS=js GOARCH=wasm go build -o static/relay.wasm ../../cmd/relaywasm"
+//go:generate sh -c "cp \"$(go env GOROOT)/lib/wasm/wasm_exec.js\" static/"
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// contentSecurityPolicy lets the UI run its own scripts and WebAssembly, and talk to its server,
+// but nothing else.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self' 'wasm-unsafe-eval'; " +
+	"img-src 'self' data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// Built reports whether the WebAssembly client has been generated into the UI, without which it
+// can't encrypt or decrypt anything.
+func Built() bool {
+	_, err1 := fs.Stat(static, "static/relay.wasm")
+	_, err2 := fs.Stat(static, "static/wasm_exec.js")
+	return err1 == nil && err2 == nil
+}
+
+// Handler serves the UI's files, with index.html at the root and the rest under prefix.
+func Handler(prefix string) http.Handler {
+	sub, _ := fs.Sub(static, "static") // static is always there
+	files := http.StripPrefix(prefix, http.FileServer(http.FS(sub)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.URL.Path == "/" {
+			http.ServeFileFS(w, r, sub, "index.html")
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
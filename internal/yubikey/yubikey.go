@@ -0,0 +1,64 @@
+// Package yubikey computes HMAC-SHA1 challenge-responses with a YubiKey through its command line
+// tools. The slot must already be set up for it, e.g. with `ykman otp chalresp --generate 2`.
+package yubikey
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var ErrUnavailable = errors.New("no YubiKey tool found (install ykman or yubikey-personalization)")
+
+// ResponseSize is the size of an HMAC-SHA1 response.
+const ResponseSize = 20
+
+// MaxChallengeSize is the longest challenge a YubiKey will answer.
+const MaxChallengeSize = 64
+
+func command(slot int, challenge string) (*exec.Cmd, error) {
+	candidates := [][]string{
+		{"ykman", "otp", "calculate", strconv.Itoa(slot), challenge},
+		{"ykchalresp", "-" + strconv.Itoa(slot), "-x", challenge},
+	}
+	for _, c := range candidates {
+		if path, err := exec.LookPath(c[0]); err == nil {
+			return exec.Command(path, c[1:]...), nil
+		}
+	}
+	return nil, ErrUnavailable
+}
+
+// ChallengeResponse asks the YubiKey in the slot, 1 or 2, for its response to the challenge.
+// If the slot requires touch, this waits until the key is touched.
+func ChallengeResponse(slot int, challenge []byte) ([]byte, error) {
+	if slot != 1 && slot != 2 {
+		return nil, fmt.Errorf("invalid YubiKey slot %d", slot)
+	}
+	if len(challenge) == 0 || len(challenge) > MaxChallengeSize {
+		return nil, fmt.Errorf("challenge must be 1 to %d bytes", MaxChallengeSize)
+	}
+
+	cmd, err := command(slot, hex.EncodeToString(challenge))
+	if err != nil {
+		return nil, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(cmd.Path + ": " + msg)
+		}
+		return nil, err
+	}
+
+	resp, err := hex.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil || len(resp) != ResponseSize {
+		return nil, errors.New(cmd.Path + ": unexpected response")
+	}
+	return resp, nil
+}
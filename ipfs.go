@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// ipfsPieceSize is about how large the pieces which files are stored in IPFS in are, rounded to
+// whole chunks.
+const ipfsPieceSize = 1 << 20
+
+// ipfsPieceChunks is how many chunks each piece of a file stored in IPFS holds.
+func ipfsPieceChunks(l layout) uint64 {
+	return max(1, ipfsPieceSize/l.chunkSize)
+}
+
+// IPFSPieces lists the pieces a file's encrypted contents are stored in IPFS in, which hold
+// ChunksPerPiece chunks each, so chunk i is in the piece with CIDs[i/ChunksPerPiece]. The first
+// piece starts with the stream header.
+type IPFSPieces struct {
+	ChunksPerPiece uint64   `json:"chunks_per_piece"`
+	CIDs           []string `json:"cids"`
+}
+
+// GetIPFSPieces responds with the IPFSPieces of a file which has finished uploading, if the
+// server stores files in IPFS, so they can be fetched from the network as well as the server.
+func (rs *RelayServer) GetIPFSPieces(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := files.ParseFileID(p.ByName("id"))
+	f, ok := rs.readyFile(id)
+	if err != nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkAccess(w, r, f) {
+		return
+	}
+	ipfs, ok := f.Content.(*files.IPFSContent)
+	if !ok {
+		http.Error(w, "The file isn't stored in IPFS", http.StatusNotFound)
+		return
+	}
+	l, err := fileLayout(f.FileMetadata)
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(IPFSPieces{ChunksPerPiece: uint64(ipfs.PieceSize) / l.chunkSize, CIDs: ipfs.CIDs()})
+}
+
+// IPFSPieces gets the CIDs of the pieces a file's encrypted contents are stored in IPFS in, if
+// the server stores them there.
+func (rc *RelayClient) IPFSPieces(id files.FileID) (IPFSPieces, error) {
+	var pieces IPFSPieces
+	req, err := rc.newFileRequest("/files/" + id.String() + "/ipfs")
+	if err != nil {
+		return pieces, err
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return pieces, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return pieces, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return pieces, ErrAccessDenied
+	} else if res.StatusCode != http.StatusOK {
+		return pieces, newStatusError("IPFS pieces request", res.StatusCode, body)
+	}
+	err = json.Unmarshal(body, &pieces)
+	return pieces, err
+}
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// largeFileSize is bigger than the memory of most machines the tests run on, so a file this
+	// size can only get through if it's streamed end to end.
+	largeFileSize = 10 << 30
+	// largeFileHeapBudget is how much the heap may grow while the file is relayed: room for the
+	// buffers and pipelines of a client and a server, which doesn't grow with the file.
+	largeFileHeapBudget = 64 << 20
+)
+
+// patternAt is the byte at off of the generated large file.
+func patternAt(off int64) byte {
+	return byte(off ^ off>>8 ^ off>>16 ^ off>>24)
+}
+
+// patternFile is a file of the given size which is generated as it's read, rather than stored.
+type patternFile struct {
+	size int64
+}
+
+func (f patternFile) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = patternAt(off + int64(i))
+	}
+	return len(p), nil
+}
+
+// patternChecker checks what's written to it is the generated file, without keeping any of it.
+type patternChecker struct {
+	off int64
+	err error
+}
+
+func (c *patternChecker) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if want := patternAt(c.off + int64(i)); b != want && c.err == nil {
+			c.err = fmt.Errorf("byte %d is %#x, not %#x", c.off+int64(i), b, want)
+		}
+	}
+	c.off += int64(len(p))
+	return len(p), nil
+}
+
+// heapMonitor samples the heap until it's stopped, recording how far it grew over where it
+// started.
+type heapMonitor struct {
+	start, peak uint64
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func monitorHeap() *heapMonitor {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m := &heapMonitor{start: ms.HeapInuse, peak: ms.HeapInuse, stop: make(chan struct{})}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runtime.ReadMemStats(&ms)
+				if ms.HeapInuse > m.peak {
+					m.peak = ms.HeapInuse
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// growth stops the monitor, returning how far the heap grew.
+func (m *heapMonitor) growth() uint64 {
+	close(m.stop)
+	m.wg.Wait()
+	return m.peak - m.start
+}
+
+func TestLargeFileWithinMemoryBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("relaying a large file takes a while")
+	}
+
+	rs, err := NewServer(ServerConfig{StorageDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rs.Handler())
+	defer srv.Close()
+	rc := NewClient(srv.URL)
+	secret := Keyfile(bytes.Repeat([]byte{1}, 32))
+
+	heap := monitorHeap()
+	u, err := rc.StartUploadFrom(patternFile{largeFileSize}, largeFileSize, "large", secret, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := rc.SendUpload(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check patternChecker
+	if _, err = rc.DownloadTo(uploaded.ID, secret, &check); err != nil {
+		t.Fatal(err)
+	}
+	growth := heap.growth()
+
+	if check.err != nil {
+		t.Error(check.err)
+	}
+	if check.off != largeFileSize {
+		t.Errorf("downloaded %d bytes, not %d", check.off, int64(largeFileSize))
+	}
+	t.Logf("the heap grew by %d bytes", growth)
+	if growth > largeFileHeapBudget {
+		t.Errorf("the heap grew by %d bytes, more than the %d byte budget", growth, largeFileHeapBudget)
+	}
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"hash"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// layout is where the chunks of a file fall in its encrypted contents.
+type layout struct {
+	cipher crypto.Cipher
+	// header is the size of the stream header before the first chunk.
+	header uint64
+	// chunkSize is the size of each encrypted chunk, except the last.
+	chunkSize uint64
+	// emptyFinal is whether an empty file still has a final chunk, as it does since format 3.
+	emptyFinal bool
+}
+
+func fileLayout(meta files.FileMetadata) (layout, error) {
+	c, err := crypto.CipherByName(meta.Cipher)
+	if err != nil {
+		return layout{}, err
+	}
+
+	l := layout{cipher: c, chunkSize: uint64(meta.ChunkSize)}
+	if l.chunkSize == 0 {
+		l.chunkSize = files.DefaultChunkSize
+	}
+	if meta.Format >= 1 {
+		l.header = uint64(crypto.HeaderSize)
+	}
+	l.emptyFinal = meta.Format >= 3
+	return l, nil
+}
+
+// rawChunkSize is how much plaintext each chunk holds.
+func (l layout) rawChunkSize() uint64 {
+	return l.chunkSize - uint64(l.cipher.Overhead())
+}
+
+func (l layout) encryptedSize(size uint64) (bytes uint64, chunks uint64) {
+	raw := l.rawChunkSize()
+	chunks, extra := size/raw, size%raw > 0
+	if extra || chunks == 0 && l.emptyFinal {
+		chunks += 1
+	}
+	bytes = l.header + size + chunks*uint64(l.cipher.Overhead())
+	return bytes, chunks
+}
+
+// chunkOffset is where the chunk at index starts in the encrypted contents.
+func (l layout) chunkOffset(index uint64) uint64 {
+	return l.header + index*l.chunkSize
+}
+
+// chunkIndex is the index of the chunk starting at offset, which must be a chunk boundary.
+func (l layout) chunkIndex(offset uint64) uint64 {
+	if offset <= l.header {
+		return 0
+	}
+	return (offset - l.header) / l.chunkSize
+}
+
+// wholeChunks rounds n bytes of encrypted contents down to the end of the last whole chunk. A
+// header on its own isn't kept, so any non-zero result can be continued without one.
+func (l layout) wholeChunks(n uint64) uint64 {
+	if n <= l.header {
+		return 0
+	}
+	return n - (n-l.header)%l.chunkSize
+}
+
+// contentHash returns the hash recorded in the metadata for the file's contents. Files before
+// format 2 have a plain SHA-256, which anyone can check against a guess at the contents.
+func contentHash(meta files.FileMetadata, key *[crypto.KeySize]byte) hash.Hash {
+	if meta.Format < 2 {
+		return crypto.NewHash()
+	}
+	return crypto.NewKeyedHash(key)
+}
+
+// uploadedID is the ID the chunks of the file asked for as id are bound to: the one it was
+// uploaded with, which is id unless it was forwarded from another server.
+func uploadedID(id files.FileID, meta files.FileMetadata) files.FileID {
+	if !meta.Origin.IsZero() {
+		return meta.Origin
+	}
+	return id
+}
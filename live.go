@@ -0,0 +1,351 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// Live files are streamed from their upload to a single download as they arrive, holding no more
+// than liveBufferChunks of them at once. Whichever of the two starts first waits up to
+// liveWaitTimeout for the other, and the file is removed once the upload ends, whether or not it
+// was delivered, so it can't be resumed or downloaded again.
+const (
+	liveWaitTimeout  = 10 * time.Minute
+	liveBufferChunks = 4
+)
+
+// livePipe connects a live file's upload to its download.
+type livePipe struct {
+	// chunks carries the uploaded chunks to the download, and is closed after the last one.
+	chunks chan []byte
+	// aborted is closed if the upload fails, and sentDirect once the uploader's sent the file
+	// to the downloader directly.
+	aborted        chan struct{}
+	sentDirect     chan struct{}
+	sentDirectOnce sync.Once
+
+	claimed atomic.Bool
+	// downloading is closed when the download claims the pipe, and downloaded once it's finished,
+	// with delivered set if it sent everything.
+	downloading chan struct{}
+	downloaded  chan struct{}
+	delivered   bool
+
+	// direct holds the addresses the uploader offered to send the file from directly.
+	direct atomic.Pointer[[]string]
+}
+
+// maxDirectAddrs is how many addresses an uploader can offer to send a live file from.
+const maxDirectAddrs = 16
+
+// directOffer is the addresses a live file's uploader listens on to send it straight to its
+// downloader. The uploader sends the port it listens on too, which the server adds to the address
+// it sees the uploader at.
+type directOffer struct {
+	Addrs []string `json:"addrs"`
+	Port  uint16   `json:"port,omitempty"`
+}
+
+// livePipe returns the pipe for the live file id, making it if neither side has yet.
+func (rs *RelayServer) livePipe(id files.FileID) *livePipe {
+	p, _ := rs.livePipes.LoadOrStore(id, &livePipe{
+		chunks:      make(chan []byte, liveBufferChunks),
+		aborted:     make(chan struct{}),
+		sentDirect:  make(chan struct{}),
+		downloading: make(chan struct{}),
+		downloaded:  make(chan struct{}),
+	})
+	return p.(*livePipe)
+}
+
+// liveFile returns the live file id, if it's waiting for or in the middle of its upload.
+func (rs *RelayServer) liveFile(id files.FileID) (files.File, bool) {
+	f, ok := rs.files.Get(id)
+	return f, ok && f.Live && (f.State == files.StateCreated || f.State == files.StateUploading)
+}
+
+// uploadLive streams the upload of a live file, which the request has claimed, to its download.
+func (rs *RelayServer) uploadLive(w http.ResponseWriter, r *http.Request, id files.FileID, f files.File) {
+	idStr := id.String()
+	p := rs.livePipe(id)
+	sent := false
+	defer func() {
+		if !sent {
+			close(p.aborted)
+		}
+		rs.livePipes.CompareAndDelete(id, p)
+		rs.files.Remove(id)
+	}()
+
+	if h := r.Header.Get(UploadOffsetHeader); h != "" && h != "0" {
+		http.Error(w, "Live uploads can't be resumed", http.StatusConflict)
+		return
+	}
+
+	logging.Infoln("waiting for live file", idStr, "to be downloaded")
+	timer := time.NewTimer(liveWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.downloading:
+	case <-r.Context().Done():
+		logging.Infoln("live upload for file", idStr, "cancelled")
+		return
+	case <-timer.C:
+		http.Error(w, "Nobody downloaded the file", http.StatusRequestTimeout)
+		return
+	case <-p.sentDirect:
+		http.Error(w, "The file was sent directly", http.StatusGone)
+		return
+	}
+
+	logging.Infoln("streaming live file", idStr)
+	l, _ := fileLayout(f.FileMetadata) // checked when the file was created
+	expected, _ := l.encryptedSize(f.Size)
+	var received uint64
+	read, framed := chunkSource(r)
+	for received < expected {
+		size := l.chunkSize
+		if received < l.header {
+			size = l.header - received
+		}
+		chunk := getChunkBuffer(int(size))
+		n, err := readChunk(r.Context(), read, chunk)
+		if errors.Is(err, context.Canceled) {
+			logging.Infoln("live upload for file", idStr, "cancelled")
+			return
+		} else if err == errUploadIdle {
+			logging.Infoln("live upload for file", idStr, "stalled, abandoning it")
+			http.Error(w, "Upload stalled", http.StatusRequestTimeout)
+			return
+		} else if err == io.EOF || (err == io.ErrUnexpectedEOF && received+uint64(n) < expected) {
+			http.Error(w, "Data smaller than expected file size", http.StatusBadRequest)
+			return
+		} else if errors.Is(err, errBadFrame) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if received >= l.header {
+			if err := ValidateCiphertextChunk(f.FileMetadata, l.chunkIndex(received), chunk[:n]); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		received += uint64(n)
+
+		select {
+		case p.chunks <- chunk[:n]:
+		case <-p.downloaded:
+			http.Error(w, "The download ended before the file was sent", http.StatusBadGateway)
+			return
+		case <-p.sentDirect:
+			http.Error(w, "The file was sent directly", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			logging.Infoln("live upload for file", idStr, "cancelled")
+			return
+		}
+	}
+	if framed {
+		// the empty frame after a whole last chunk is still to come
+		if _, err := readChunk(r.Context(), read, nil); err != io.EOF {
+			http.Error(w, "Data larger than expected file size", http.StatusBadRequest)
+			return
+		}
+	}
+	close(p.chunks)
+	sent = true
+
+	<-p.downloaded
+	if !p.delivered {
+		http.Error(w, "The download ended before the file was sent", http.StatusBadGateway)
+		return
+	}
+	logging.Infoln("streamed", received, "bytes of live file", idStr)
+	w.Write([]byte(""))
+}
+
+// downloadLive streams a live file from its upload.
+func (rs *RelayServer) downloadLive(w http.ResponseWriter, r *http.Request, id files.FileID, f files.File) {
+	if r.Header.Get("Range") != "" {
+		http.Error(w, "Live files can't be downloaded in ranges", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	p := rs.livePipe(id)
+	if !p.claimed.CompareAndSwap(false, true) {
+		http.Error(w, "File is already being downloaded", http.StatusConflict)
+		return
+	}
+	defer func() {
+		rs.livePipes.CompareAndDelete(id, p)
+		close(p.downloaded)
+	}()
+	close(p.downloading)
+
+	// the response isn't started until there's something to send, so it can still be an error
+	timer := time.NewTimer(liveWaitTimeout)
+	defer timer.Stop()
+	var first []byte
+	select {
+	case first = <-p.chunks:
+	case <-p.aborted:
+		http.Error(w, "The upload failed", http.StatusBadGateway)
+		return
+	case <-r.Context().Done():
+		return
+	case <-timer.C:
+		http.Error(w, "The file wasn't uploaded", http.StatusGatewayTimeout)
+		return
+	case <-p.sentDirect:
+		http.Error(w, "The file was sent directly", http.StatusGone)
+		return
+	}
+
+	l, _ := fileLayout(f.FileMetadata)
+	size, _ := l.encryptedSize(f.Size)
+	// the chunks come from the upload whole, so each is a frame
+	framed := wantsFrames(r)
+	if framed {
+		w.Header().Set("Content-Type", FramedContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	}
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	dw := rs.newDeadlineWriter(w, r)
+
+	var prefix []byte
+	chunk, ok := first, true
+	for ok {
+		var err error
+		if framed {
+			prefix = binary.BigEndian.AppendUint32(prefix[:0], uint32(len(chunk)))
+			_, err = dw.Write(prefix)
+		}
+		if err == nil {
+			_, err = dw.Write(chunk)
+		}
+		putChunkBuffer(chunk)
+		if dw.stalled {
+			logging.Infoln("download of live file", id, "stalled, abandoning it")
+			return
+		} else if err != nil {
+			return
+		}
+		select {
+		case chunk, ok = <-p.chunks:
+		case <-p.aborted:
+			// cut the response short, so the client can't mistake it for the whole file
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if framed {
+		if _, err := dw.Write(make([]byte, framePrefixSize)); err != nil {
+			return
+		}
+	}
+	p.delivered = true
+}
+
+// OfferDirect records the addresses a live file's uploader can send it from directly, for its
+// downloader to try before downloading it through the server.
+func (rs *RelayServer) OfferDirect(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, f, ok := rs.ownedFile(w, r, p)
+	if !ok {
+		return
+	}
+	if !f.Live || (f.State != files.StateCreated && f.State != files.StateUploading) {
+		http.Error(w, "Only live files waiting to be downloaded can be sent directly", http.StatusConflict)
+		return
+	}
+
+	var offer directOffer
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addrs := make([]string, 0, len(offer.Addrs)+1)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && offer.Port != 0 {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(offer.Port))))
+		}
+	}
+	for _, addr := range offer.Addrs {
+		// only IP addresses, so the server can't be used to point downloaders at any host
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) == nil || port == "" {
+			http.Error(w, "Invalid address "+strconv.Quote(addr), http.StatusBadRequest)
+			return
+		}
+		if len(addrs) == 0 || addrs[0] != addr {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > maxDirectAddrs {
+		http.Error(w, "Too many addresses", http.StatusBadRequest)
+		return
+	}
+
+	rs.livePipe(id).direct.Store(&addrs)
+	logging.Infoln("uploader of live file", id, "offered to send it directly from", addrs)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDirectOffer returns the addresses a live file's uploader offered to send it from directly,
+// if it did.
+func (rs *RelayServer) GetDirectOffer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := files.ParseFileID(p.ByName("id"))
+	f, live := rs.liveFile(id)
+	if err != nil || !live {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkAccess(w, r, f) {
+		return
+	}
+	pipe, ok := rs.livePipes.Load(id)
+	var addrs *[]string
+	if ok {
+		addrs = pipe.(*livePipe).direct.Load()
+	}
+	if addrs == nil {
+		http.Error(w, "The uploader didn't offer to send the file directly", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(directOffer{Addrs: *addrs})
+}
+
+// SentDirect ends the relayed upload of a live file which its uploader has sent directly instead,
+// which removes it.
+func (rs *RelayServer) SentDirect(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, f, ok := rs.ownedFile(w, r, p)
+	if !ok {
+		return
+	}
+	pipe, ok := rs.livePipes.Load(id)
+	if !f.Live || !ok || pipe.(*livePipe).direct.Load() == nil {
+		http.Error(w, "The file wasn't offered to be sent directly", http.StatusConflict)
+		return
+	}
+	pipe.(*livePipe).sentDirectOnce.Do(func() { close(pipe.(*livePipe).sentDirect) })
+	logging.Infoln("live file", id, "was sent directly")
+	w.WriteHeader(http.StatusNoContent)
+}
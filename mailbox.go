@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bfrengley/relay/internal/logging"
+	"github.com/bfrengley/relay/internal/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Mailboxes let a sender and receiver exchange a few small messages through the server, to run
+// a PAKE from a short code. Each mailbox is numbered by its nameplate, the first part of the
+// code, and each message is written once to a named slot. Only whoever created a mailbox can
+// delete it, with the owner token it was created with, so nobody can break up an exchange by
+// guessing its nameplate.
+const (
+	mailboxTTL      = 10 * time.Minute
+	maxMailboxes    = 1000
+	maxMailboxSlots = 8
+	maxMessageSize  = 4 << 10
+)
+
+var slotPattern = regexp.MustCompile(`^[a-z]{1,16}$`)
+
+// MailboxCreated is the server's response to creating a mailbox.
+type MailboxCreated struct {
+	Nameplate uint32 `json:"nameplate"`
+	// OwnerToken authorises deleting the mailbox; the server only provides it once.
+	OwnerToken string `json:"owner_token"`
+}
+
+// mailbox holds the messages written to it. Its slots are never changed once it's stored, only
+// replaced, so they can be read without holding the store's lock.
+type mailbox struct {
+	slots          map[string][]byte
+	ownerTokenHash [sha256.Size]byte
+}
+
+func (box mailbox) checkOwnerToken(token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(hash[:], box.ownerTokenHash[:]) == 1
+}
+
+type mailboxSet = store.Store[uint32, mailbox]
+
+func parseNameplate(s string) (uint32, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil
+}
+
+// CreateMailbox allocates the lowest free nameplate, keeping codes short.
+func (rs *RelayServer) CreateMailbox(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if rs.mailboxes.Len() >= maxMailboxes {
+		http.Error(w, "Too many mailboxes in use", http.StatusServiceUnavailable)
+		return
+	}
+	token, err := newOwnerToken()
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	box := mailbox{make(map[string][]byte), sha256.Sum256([]byte(token))}
+	n := uint32(1)
+	for !rs.mailboxes.Add(n, box, time.Now().Add(mailboxTTL)) {
+		n++
+	}
+	logging.Infoln("created mailbox", n)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(MailboxCreated{n, token}); err != nil {
+		logging.Errorln(err)
+	}
+}
+
+// PutMessage writes a message to an empty slot. Slots can't be overwritten, so nobody can
+// replace a message once the other side might have read it.
+func (rs *RelayServer) PutMessage(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	slot := p.ByName("slot")
+	if !slotPattern.MatchString(slot) {
+		http.Error(w, "Invalid slot name", http.StatusBadRequest)
+		return
+	}
+	msg, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(msg) > maxMessageSize {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	n, ok := parseNameplate(p.ByName("nameplate"))
+	var conflict string
+	if ok {
+		_, ok = rs.mailboxes.Update(n, func(box *mailbox) {
+			if _, ok := box.slots[slot]; ok {
+				conflict = "Slot already written"
+				return
+			}
+			if len(box.slots) >= maxMailboxSlots {
+				conflict = "Mailbox is full"
+				return
+			}
+			slots := make(map[string][]byte, len(box.slots)+1)
+			for k, v := range box.slots {
+				slots[k] = v
+			}
+			slots[slot] = msg
+			box.slots = slots
+		})
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if conflict != "" {
+		http.Error(w, conflict, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMessage reads a slot, responding with no content if nothing has been written to it yet.
+func (rs *RelayServer) GetMessage(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	n, ok := parseNameplate(p.ByName("nameplate"))
+	var msg []byte
+	if ok {
+		var box mailbox
+		if box, ok = rs.mailboxes.Get(n); ok {
+			msg = box.slots[p.ByName("slot")]
+		}
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if msg == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Add("Content-Type", "application/octet-stream")
+	if _, err := w.Write(msg); err != nil {
+		logging.Errorln(err)
+	}
+}
+
+// DeleteMailbox closes a mailbox once its exchange is finished, which needs the mailbox's owner
+// token.
+func (rs *RelayServer) DeleteMailbox(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	n, ok := parseNameplate(p.ByName("nameplate"))
+	var box mailbox
+	if ok {
+		box, ok = rs.mailboxes.Get(n)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !box.checkOwnerToken(r.Header.Get(OwnerTokenHeader)) {
+		http.Error(w, "Invalid or missing owner token", http.StatusForbidden)
+		return
+	}
+	rs.mailboxes.Remove(n)
+	logging.Infoln("deleted mailbox", n)
+	w.WriteHeader(http.StatusNoContent)
+}
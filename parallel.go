@@ -0,0 +1,214 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// minParallelRange is the least encrypted data worth a range request of its own, so small files
+// are fetched in fewer ranges than asked for.
+const minParallelRange = 4 << 20
+
+// chunkRange is a run of chunks fetched with one range request, from start up to end.
+type chunkRange struct {
+	start, end uint64
+}
+
+// DownloadToFile downloads the file into out, which should be empty, fetching rc.Parallel ranges
+// of it at once if that's set. The ranges are written where they belong as they arrive, so unlike
+// with ResumeDownload, what's in out after a failed download has gaps and should be discarded.
+func (rc *RelayClient) DownloadToFile(id files.FileID, secret Secret, out WritableFile) (DownloadResult, error) {
+	var res DownloadResult
+	meta, err := rc.downloadMetadata(id)
+	res.FileMetadata = meta
+	if err != nil {
+		return res, err
+	}
+	key, err := timeKey(meta, secret, &res.Stats)
+	if err != nil {
+		return res, err
+	}
+	defer crypto.Wipe(key)
+
+	hasher := contentHash(meta, key)
+	l, err := fileLayout(meta)
+	if err != nil {
+		return res, err
+	}
+	// the ranges stop short of the chunk with the end of the file in it, which is fetched last, as
+	// if resuming the download, so the server doesn't count it as downloaded until the rest is
+	var tail uint64
+	if meta.Size > 0 {
+		tail = (meta.Size - 1) / l.rawChunkSize() * l.rawChunkSize()
+	}
+	// live files are streamed as they're uploaded, so they can't be fetched in ranges
+	if rc.Parallel < 2 || meta.Live || tail == 0 {
+		return res, rc.download(id, meta, key, out, 0, hasher, &res.Stats)
+	}
+	start := time.Now()
+	if err = rc.downloadRanges(id, meta, key, out, rc.Parallel, tail/l.rawChunkSize(), &res.Stats); err != nil {
+		return res, err
+	}
+	// which leaves the hash of what's arrived to take before the last chunk follows it
+	hashStart := time.Now()
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		return res, err
+	}
+	if _, err = io.CopyN(hasher, out, int64(tail)); err != nil {
+		return res, err
+	}
+	res.Stats.Crypto += time.Since(hashStart)
+	err = rc.download(id, meta, key, out, tail, hasher, &res.Stats)
+	res.Stats.Elapsed = time.Since(start)
+	logging.Infoln("downloaded", res.Stats)
+	return res, err
+}
+
+// downloadRanges downloads the first upto chunks of the file's contents into out in up to n ranges
+// fetched at once, each chunk decrypted and written in its own place as it arrives. It doesn't
+// check the file's hash, but adds the time it took to stats.
+func (rc *RelayClient) downloadRanges(id files.FileID, meta files.FileMetadata, key *[crypto.KeySize]byte, out WritableFile, n int, upto uint64, stats *TransferStats) error {
+	l, err := fileLayout(meta)
+	if err != nil {
+		return err
+	}
+	size, chunks := l.encryptedSize(meta.Size)
+
+	per := (upto + uint64(n) - 1) / uint64(n)
+	if least := minParallelRange / l.chunkSize; per < least {
+		per = least
+	}
+	var ranges []chunkRange
+	for start := uint64(0); start < upto; start += per {
+		end := start + per
+		if end > upto {
+			end = upto
+		}
+		ranges = append(ranges, chunkRange{start, end})
+	}
+	logging.Infoln("downloading and decrypting file in", len(ranges), "ranges")
+
+	chunkKey := crypto.Subkey(key, crypto.PurposeChunks)
+	defer crypto.Wipe(chunkKey)
+	stream := crypto.Stream{
+		Version:     meta.Format,
+		Cipher:      l.cipher,
+		FileID:      []byte(uploadedID(id, meta).String()),
+		NoncePrefix: meta.NoncePrefix,
+	}
+	pb := rc.progress("Downloading", int64(upto*l.rawChunkSize()))
+	defer pb.stop()
+
+	// the first range to fail stops the rest
+	ctx, cancel := context.WithCancel(rc.context())
+	defer cancel()
+	start := time.Now()
+	var network, busy stopwatch
+	meters := make([]*meter, len(ranges))
+	errs := make(chan error, len(ranges))
+	for i, r := range ranges {
+		go func(i int, r chunkRange) {
+			defer busy.add(time.Now())
+			err := rc.downloadRange(ctx, id, l, size, chunks, key, chunkKey, stream, out, pb, r, start, &network, &meters[i])
+			errs <- err
+			if err != nil {
+				cancel()
+			}
+		}(i, r)
+	}
+	var firstErr error
+	for range ranges {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	for _, m := range meters {
+		stats.addMeter(m)
+	}
+	stats.Network += network.total()
+	stats.Crypto += busy.total() - network.total()
+
+	pb.Finish()
+	logging.Infoln("file downloaded and decrypted")
+	return nil
+}
+
+// downloadRange fetches the chunks in r, of the file's size bytes of encrypted contents in chunks
+// chunks, decrypting them with chunkKey and writing them to out. The time it waits on the server
+// is added to network, and what it received is metered from start in *received.
+func (rc *RelayClient) downloadRange(
+	ctx context.Context, id files.FileID, l layout, size, chunks uint64,
+	key, chunkKey *[crypto.KeySize]byte, stream crypto.Stream, out io.WriterAt, progress io.Writer, r chunkRange,
+	start time.Time, network *stopwatch, received **meter,
+) error {
+	from, to := l.chunkOffset(r.start), size
+	if r.start == 0 {
+		from = 0 // the stream header too
+	}
+	if r.end < chunks {
+		to = l.chunkOffset(r.end)
+	}
+
+	req, err := rc.newFileRequest("/files/" + id.String())
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+	requested := time.Now()
+	res, err := rc.c.Do(req)
+	network.add(requested)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		body, _ := io.ReadAll(res.Body)
+		return newStatusError("download", res.StatusCode, body)
+	}
+
+	body := newMeter(res.Body, start)
+	*received = body
+	defer func() { network.ns.Add(int64(body.wait.total())) }()
+
+	if from < l.chunkOffset(r.start) {
+		header := make([]byte, l.header)
+		if _, err = io.ReadFull(body, header); err != nil {
+			return fmt.Errorf("reading stream header: %w", err)
+		}
+		if err = stream.CheckHeader(header, key, int(l.chunkSize)); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, l.chunkSize)
+	var plain []byte
+	for i := r.start; i < r.end; i++ {
+		final := i == chunks-1
+		n := l.chunkSize
+		if final {
+			n = size - l.chunkOffset(i)
+		}
+		if _, err = io.ReadFull(body, buf[:n]); err != nil {
+			return err
+		}
+		if plain, err = crypto.OpenChunk(*chunkKey, stream, i, final, buf[:n], plain[:0]); err != nil {
+			return &crypto.ChunkError{Index: i, Offset: int64(l.chunkOffset(i)), Err: err}
+		}
+		if _, err = out.WriteAt(plain, int64(i*l.rawChunkSize())); err != nil {
+			return err
+		}
+		progress.Write(plain)
+	}
+	return nil
+}
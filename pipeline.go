@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"io"
+	"sync"
+)
+
+// pipelineDepth is how many chunks encrypting an upload can get ahead of sending it.
+const pipelineDepth = 2
+
+// pipeline reads from r in a goroutine of its own, up to depth buffers of size bytes ahead of
+// what's been read from the pipeline, so the work r does to produce them, like encrypting,
+// overlaps with what's done with them, like sending. It needs closing to stop the goroutine.
+type pipeline struct {
+	// full carries buffers which have been filled, and free those which can be filled again.
+	full chan []byte
+	free chan []byte
+	// err is what ended r, set before full is closed.
+	err error
+
+	// buf is the buffer being read from, and cur what's left of it to read.
+	buf, cur []byte
+
+	done      chan struct{}
+	exited    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeline(r io.Reader, size, depth int) *pipeline {
+	p := &pipeline{
+		full:   make(chan []byte, depth),
+		free:   make(chan []byte, depth+1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	// one more than depth, for the buffer being read from
+	for i := 0; i <= depth; i++ {
+		p.free <- make([]byte, size)
+	}
+	go p.fill(r)
+	return p
+}
+
+func (p *pipeline) fill(r io.Reader) {
+	defer close(p.exited)
+	defer close(p.full)
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			select {
+			case p.full <- buf[:n]:
+			case <-p.done:
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			p.err = io.EOF
+			return
+		} else if err != nil {
+			p.err = err
+			return
+		}
+	}
+}
+
+func (p *pipeline) Read(b []byte) (int, error) {
+	for len(p.cur) == 0 {
+		if p.buf != nil {
+			p.free <- p.buf[:cap(p.buf)]
+			p.buf = nil
+		}
+		buf, ok := <-p.full
+		if !ok {
+			return 0, p.err
+		}
+		p.buf, p.cur = buf, buf
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// Close stops reading from r, and waits until it's no longer being read.
+func (p *pipeline) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	<-p.exited
+	return nil
+}
@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimit spreads what's sent through it out to rate bytes a second, letting up to a second's
+// worth through at once after a pause. Bytes are reserved in the order they're asked for, so
+// downloads sharing one take turns rather than the fastest taking it all.
+type rateLimit struct {
+	rate float64
+
+	mu sync.Mutex
+	// next is when everything reserved so far has been sent at the rate.
+	next time.Time
+}
+
+// newRateLimit returns a limit of rate bytes a second, or nil, which doesn't limit anything, if
+// rate is zero.
+func newRateLimit(rate uint64) *rateLimit {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimit{rate: float64(rate)}
+}
+
+// reserve reserves n bytes, returning how long to wait before sending them.
+func (l *rateLimit) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if burst := now.Add(-time.Second); l.next.Before(burst) {
+		l.next = burst
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return l.next.Sub(now)
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+const (
+	recipientPrefix = "relay-pk-"
+	identityPrefix  = "RELAY-SK-"
+)
+
+// Recipient is a public key to encrypt files to, so they can be sent without agreeing on a
+// password first. Only the matching Identity can decrypt them, so not even the uploader can
+// download them again or resume their uploads.
+type Recipient [crypto.X25519KeySize]byte
+
+func ParseRecipient(s string) (Recipient, error) {
+	var r Recipient
+	if err := decodeKey(s, recipientPrefix, r[:]); err != nil {
+		return r, fmt.Errorf("invalid recipient: %w", err)
+	}
+	return r, nil
+}
+
+func (r Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(r[:])
+}
+
+func (r Recipient) KDF() string {
+	return crypto.KDFX25519
+}
+
+// DeriveKey makes a new key for a file, recording the ephemeral key it was made with in the
+// metadata.
+func (r Recipient) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	if meta.Ephemeral != nil {
+		return nil, errors.New("only the recipient can decrypt a file encrypted to them")
+	}
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+	key, ephemeral, err := crypto.X25519SenderKey((*[crypto.X25519KeySize]byte)(&r), salt)
+	if err != nil {
+		return nil, err
+	}
+	meta.Ephemeral = ephemeral[:]
+	return key, nil
+}
+
+// Identity is the private key which decrypts files sent to its Recipient.
+type Identity [crypto.X25519KeySize]byte
+
+func NewIdentity() (*Identity, error) {
+	private, _, err := crypto.NewX25519Key()
+	return (*Identity)(private), err
+}
+
+func ParseIdentity(s string) (*Identity, error) {
+	id := new(Identity)
+	if err := decodeKey(s, identityPrefix, id[:]); err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	return id, nil
+}
+
+// ReadIdentity reads an identity file, as written by String. Blank lines and lines starting
+// with # are ignored.
+func ReadIdentity(path string) (*Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return ParseIdentity(line)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no identity found in %s", path)
+}
+
+func (id *Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func (id *Identity) Recipient() (Recipient, error) {
+	pub, err := crypto.X25519Public((*[crypto.X25519KeySize]byte)(id))
+	if err != nil {
+		return Recipient{}, err
+	}
+	return Recipient(*pub), nil
+}
+
+func (id *Identity) KDF() string {
+	return crypto.KDFX25519
+}
+
+func (id *Identity) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	if len(meta.Ephemeral) != crypto.X25519KeySize {
+		return nil, fmt.Errorf("ephemeral key must be %d bytes, not %d", crypto.X25519KeySize, len(meta.Ephemeral))
+	}
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.X25519RecipientKey((*[crypto.X25519KeySize]byte)(id), (*[crypto.X25519KeySize]byte)(meta.Ephemeral), salt)
+}
+
+func decodeKey(s, prefix string, key []byte) error {
+	if !strings.HasPrefix(s, prefix) {
+		return fmt.Errorf("must start with %s", prefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return err
+	}
+	if len(b) != len(key) {
+		return fmt.Errorf("must be %d bytes, not %d", len(key), len(b))
+	}
+	copy(key, b)
+	return nil
+}
@@ -0,0 +1,337 @@
+// Package relaymobile is a binding of the relay client for Android and iOS apps, built with
+// gomobile:
+//
+//	gomobile bind -target android ./relaymobile
+//	gomobile bind -target ios ./relaymobile
+//
+// Its API only uses what gomobile can bind: strings, byte slices, numbers, pointers to structs of
+// those, and interfaces the app implements. Files are encrypted with passwords, or the one
+// embedded in a share link.
+//
+// Transfers block, so the app should call them off its main thread. Cancel stops every transfer
+// the client has in progress.
+package relaymobile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bfrengley/relay"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// ProgressListener is told how transfers are going, from a thread of their own.
+type ProgressListener interface {
+	// OnProgress is called with how many of the total bytes have been transferred, with
+	// description saying what, e.g. "Uploading".
+	OnProgress(description string, bytes, total int64)
+}
+
+// Client talks to a relay server.
+type Client struct {
+	mu       sync.Mutex
+	rc       relay.RelayClient
+	listener ProgressListener
+	// ctx is cancelled by Cancel, which starts a new one for the transfers after.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewClient returns a client for the server at the URL server, like "https://relay.example".
+func NewClient(server string) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{rc: relay.NewClient(server), ctx: ctx, cancel: cancel}
+}
+
+// SetToken sets the token the server needs to upload files, if it needs one.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rc.Token = token
+}
+
+// SetAccessPassword sets the access password sent with downloads, and set on uploads.
+func (c *Client) SetAccessPassword(password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rc.AccessPassword = password
+}
+
+// SetProgressListener sets the listener told how transfers are going, or removes it if nil.
+func (c *Client) SetProgressListener(l ProgressListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = l
+}
+
+// errCancelled is what transfers stopped by Cancel fail with.
+var errCancelled = errors.New("transfer cancelled")
+
+// Cancel stops every transfer in progress, which fail with the error "transfer cancelled".
+// Transfers started afterwards aren't affected.
+func (c *Client) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+}
+
+// failed returns the error a transfer made by rc failed with, or errCancelled if it was cancelled.
+func failed(rc *relay.RelayClient, err error) error {
+	if rc.Context.Err() != nil {
+		return errCancelled
+	}
+	return err
+}
+
+// client returns the relay client for a transfer, on server if it's set, which Cancel stops.
+func (c *Client) client(server string) relay.RelayClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rc := c.rc
+	if server != "" {
+		rc.Server = server
+	}
+	rc.Context = c.ctx
+	if l := c.listener; l != nil {
+		rc.Progress = func(description string, total int64) relay.Progress {
+			return progress{l, description, total}
+		}
+	}
+	return rc
+}
+
+type progress struct {
+	l           ProgressListener
+	description string
+	total       int64
+}
+
+func (p progress) Update(bytes int64) {
+	p.l.OnProgress(p.description, bytes, p.total)
+}
+
+func (p progress) Finish() error {
+	return nil
+}
+
+// UploadOptions control how the server keeps an uploaded file. The zero value keeps it until
+// it's deleted.
+type UploadOptions struct {
+	// Name is the file name stored on the server, instead of the name of the local file.
+	Name string
+	// ContentType is the file's MIME type, or if empty, the one for its name's extension, if any.
+	ContentType string
+	Description string
+	// Tags are separated by commas.
+	Tags string
+	// ExpiresSeconds is how long the server keeps the file for, if non-zero.
+	ExpiresSeconds int64
+	// MaxDownloads is how many times the file can be downloaded before it's deleted, if non-zero.
+	MaxDownloads int64
+}
+
+func (o *UploadOptions) options() relay.UploadOptions {
+	var opts relay.UploadOptions
+	if o == nil {
+		return opts
+	}
+	opts.Name, opts.ContentType, opts.Description = o.Name, o.ContentType, o.Description
+	for _, tag := range strings.Split(o.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			opts.Tags = append(opts.Tags, tag)
+		}
+	}
+	opts.Expires = time.Duration(o.ExpiresSeconds) * time.Second
+	if o.MaxDownloads > 0 {
+		opts.MaxDownloads = uint(o.MaxDownloads)
+	}
+	return opts
+}
+
+// UploadResult is what an upload made.
+type UploadResult struct {
+	ID string
+	// Link is the file's share link, without the password.
+	Link string
+	// OwnerToken is needed to delete the file; the server only gives it out once.
+	OwnerToken string
+	Size       int64
+}
+
+// UploadFile encrypts the file at path with password and uploads it.
+func (c *Client) UploadFile(path, password string, opts *UploadOptions) (*UploadResult, error) {
+	if password == "" {
+		return nil, errors.New("a password is needed to encrypt the file")
+	}
+	rc := c.client("")
+	res, err := rc.UploadFile(path, relay.Password(password), opts.options())
+	if err != nil {
+		return nil, failed(&rc, err)
+	}
+	return newUploadResult(&rc, res), nil
+}
+
+// UploadBytes encrypts data with password and uploads it as a file called name.
+func (c *Client) UploadBytes(name string, data []byte, password string, opts *UploadOptions) (*UploadResult, error) {
+	if password == "" {
+		return nil, errors.New("a password is needed to encrypt the file")
+	}
+	rc := c.client("")
+	u, err := rc.StartUploadFrom(bytes.NewReader(data), int64(len(data)), name, relay.Password(password), opts.options())
+	if err != nil {
+		return nil, failed(&rc, err)
+	}
+	res, err := rc.SendUpload(u)
+	if err != nil {
+		return nil, failed(&rc, err)
+	}
+	return newUploadResult(&rc, res), nil
+}
+
+func newUploadResult(rc *relay.RelayClient, res relay.UploadResult) *UploadResult {
+	return &UploadResult{
+		ID:         res.ID.String(),
+		Link:       rc.ShareLink(res.ID),
+		OwnerToken: res.OwnerToken,
+		Size:       int64(res.Size),
+	}
+}
+
+// FileInfo describes a file on the server.
+type FileInfo struct {
+	ID          string
+	Name        string
+	Size        int64
+	ContentType string
+	Description string
+	// Tags are separated by commas.
+	Tags string
+	// Uploaded and Expires are in milliseconds since the Unix epoch, and Expires is 0 if the
+	// file doesn't expire.
+	Uploaded int64
+	Expires  int64
+}
+
+func newFileInfo(meta files.FileMetadata) *FileInfo {
+	info := &FileInfo{
+		ID:          meta.ID.String(),
+		Name:        meta.Name,
+		Size:        int64(meta.Size),
+		ContentType: meta.ContentType,
+		Description: meta.Description,
+		Tags:        strings.Join(meta.Tags, ","),
+	}
+	if !meta.Uploaded.IsZero() {
+		info.Uploaded = meta.Uploaded.UnixMilli()
+	}
+	if !meta.Expires.IsZero() {
+		info.Expires = meta.Expires.UnixMilli()
+	}
+	return info
+}
+
+// target parses a file ID, or a share link which may carry the password, returning the client for
+// the link's server.
+func (c *Client) target(idOrLink, password string) (relay.RelayClient, files.FileID, relay.Password, error) {
+	idOrLink = strings.TrimSpace(idOrLink)
+	if !strings.Contains(idOrLink, "/") {
+		id, err := files.ParseFileID(idOrLink)
+		return c.client(""), id, relay.Password(password), err
+	}
+	server, id, secret, err := relay.ParseShareLink(idOrLink)
+	if password == "" {
+		password = secret
+	}
+	return c.client(server), id, relay.Password(password), err
+}
+
+// Metadata returns the description of a file, given its ID or share link.
+func (c *Client) Metadata(idOrLink string) (*FileInfo, error) {
+	rc, id, _, err := c.target(idOrLink, "")
+	if err != nil {
+		return nil, err
+	}
+	meta, err := rc.GetMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(meta), nil
+}
+
+// Download is a downloaded file's contents and description.
+type Download struct {
+	Info *FileInfo
+	Data []byte
+}
+
+// DownloadBytes downloads and decrypts a file, given its ID or share link, into memory. The
+// password can be empty if the link carries it.
+func (c *Client) DownloadBytes(idOrLink, password string) (*Download, error) {
+	rc, id, secret, err := c.target(idOrLink, password)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, errors.New("a password is needed to decrypt the file")
+	}
+	var buf bytes.Buffer
+	res, err := rc.DownloadTo(id, secret, &buf)
+	if err != nil {
+		return nil, failed(&rc, err)
+	}
+	return &Download{Info: newFileInfo(res.FileMetadata), Data: buf.Bytes()}, nil
+}
+
+// DownloadFile downloads and decrypts a file, given its ID or share link, to path. The password
+// can be empty if the link carries it. Nothing is left at path if it fails.
+func (c *Client) DownloadFile(idOrLink, password, path string) (*FileInfo, error) {
+	rc, id, secret, err := c.target(idOrLink, password)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, errors.New("a password is needed to decrypt the file")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rc.DownloadToFile(id, secret, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, failed(&rc, err)
+	}
+	return newFileInfo(res.FileMetadata), nil
+}
+
+// ListJSON lists the files on the server, as a JSON array of their metadata as the server's API
+// gives it.
+func (c *Client) ListJSON() (string, error) {
+	rc := c.client("")
+	list, err := rc.ListFiles(relay.ListFilter{})
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(list)
+	return string(b), err
+}
+
+// Delete deletes a file, given its ID or share link, with the owner token it was uploaded with.
+func (c *Client) Delete(idOrLink, ownerToken string) error {
+	rc, id, _, err := c.target(idOrLink, "")
+	if err != nil {
+		return err
+	}
+	_, err = rc.DeleteFile(id, ownerToken)
+	return err
+}
@@ -0,0 +1,7 @@
+//go:build tools
+
+package relaymobile
+
+// gomobile binds packages with the golang.org/x/mobile the module requires, which it would drop
+// without something importing it. The tools tag keeps the import out of every build.
+import _ "golang.org/x/mobile/bind"
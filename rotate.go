@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// RotateKey re-encrypts a file with a new secret, for when the old one has leaked. It downloads
+// and decrypts the file, then uploads it again encrypted with newSecret. Anything opts leaves
+// unset is kept from the old file: its name, cipher, chunk size, content type, description, tags, and
+// whatever remains of its expiry and download limit.
+//
+// With opts.Replace set to id, the new file takes the old one's place, keeping its ID and owner
+// token, so existing links carry on working with the new secret. Otherwise it's uploaded as a new
+// file, and the old one is left for the caller to delete.
+//
+// The decrypted contents are held in a temporary file while they're uploaded again, which is
+// removed afterwards.
+func (rc *RelayClient) RotateKey(id files.FileID, oldSecret, newSecret Secret, opts UploadOptions) (UploadResult, error) {
+	tmp, err := os.CreateTemp("", "relay-rotate-*")
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	meta, err := rc.ResumeDownload(id, oldSecret, tmp, nil)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if err = tmp.Close(); err != nil {
+		return UploadResult{}, err
+	}
+
+	if opts.Name == "" {
+		opts.Name = meta.Name
+	}
+	if opts.Cipher == "" {
+		opts.Cipher = meta.Cipher
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = meta.ChunkSize
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = meta.ContentType
+	}
+	if opts.Description == "" {
+		opts.Description = meta.Description
+	}
+	if opts.Tags == nil {
+		opts.Tags = meta.Tags
+	}
+	if opts.Expires == 0 && !meta.Expires.IsZero() {
+		if opts.Expires = time.Until(meta.Expires); opts.Expires <= 0 {
+			return UploadResult{}, errors.New("the file has expired")
+		}
+	}
+	if opts.MaxDownloads == 0 && meta.MaxDownloads > 0 {
+		if meta.Downloads >= meta.MaxDownloads {
+			return UploadResult{}, errors.New("the file has no downloads left")
+		}
+		opts.MaxDownloads = meta.MaxDownloads - meta.Downloads
+	}
+
+	logging.Infoln("re-encrypting file", id, "with a new key")
+	return rc.UploadFile(tmp.Name(), newSecret, opts)
+}
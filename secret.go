@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+	"github.com/bfrengley/relay/internal/yubikey"
+)
+
+// Secret is what the key for a file is derived from.
+type Secret interface {
+	// KDF names the key derivation function recorded in the file's metadata.
+	KDF() string
+	// DeriveKey derives the key for a file from the salt and parameters in its metadata.
+	DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error)
+}
+
+// ScryptParams are the cost parameters for deriving a key from a Password.
+type ScryptParams = crypto.ScryptParams
+
+// Password is a secret stretched into a key with scrypt.
+type Password string
+
+func (p Password) KDF() string {
+	return crypto.KDFScrypt
+}
+
+func (p Password) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+	params := crypto.DefaultScryptParams
+	if meta.Scrypt != nil {
+		params = *meta.Scrypt
+	}
+	password := []byte(p)
+	defer crypto.Zero(password)
+	return crypto.ScryptKey(password, salt, params)
+}
+
+// Keyfile is a secret made of random bytes, such as those from ReadKeyfile. It must be at least
+// MinKeyfileSize bytes long.
+type Keyfile []byte
+
+const MinKeyfileSize = crypto.KeySize
+
+func (k Keyfile) KDF() string {
+	return crypto.KDFKeyfile
+}
+
+func (k Keyfile) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	if len(k) < MinKeyfileSize {
+		return nil, fmt.Errorf("keyfile must be at least %d bytes", MinKeyfileSize)
+	}
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.KeyfileKey(k, salt), nil
+}
+
+// YubiKey is a secret held in a YubiKey's challenge-response slot, 1 or 2, which must be set up
+// for HMAC-SHA1. Only the same YubiKey can decrypt the file again.
+type YubiKey int
+
+func (y YubiKey) KDF() string {
+	return crypto.KDFYubiKey
+}
+
+func (y YubiKey) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Infoln("waiting for the YubiKey; touch it if it's flashing")
+	resp, err := yubikey.ChallengeResponse(int(y), crypto.YubiKeyChallenge(salt))
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Zero(resp)
+	return crypto.KeyfileKey(resp, salt), nil
+}
+
+func ReadKeyfile(path string) (Keyfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < MinKeyfileSize {
+		return nil, fmt.Errorf("keyfile %s must be at least %d bytes", path, MinKeyfileSize)
+	}
+	return Keyfile(data), nil
+}
+
+func metadataSalt(meta *files.FileMetadata) (*[crypto.SaltSize]byte, error) {
+	if len(meta.Salt) != crypto.SaltSize {
+		return nil, fmt.Errorf("salt must be %d bytes, not %d", crypto.SaltSize, len(meta.Salt))
+	}
+	return (*[crypto.SaltSize]byte)(meta.Salt), nil
+}
+
+// kdfName describes a KDF from file metadata for error messages.
+func kdfName(kdf string) string {
+	switch kdf {
+	case crypto.KDFKeyfile:
+		return "a keyfile"
+	case crypto.KDFX25519:
+		return "a recipient's public key"
+	case crypto.KDFSSHEd25519:
+		return "an Ed25519 SSH key"
+	case crypto.KDFSSHRSA:
+		return "an RSA SSH key"
+	case crypto.KDFYubiKey:
+		return "a YubiKey"
+	}
+	return "a password"
+}
+
+// fileKey derives the key for an existing file, checking it against the file's challenge.
+func fileKey(meta files.FileMetadata, secret Secret) (*[crypto.KeySize]byte, error) {
+	kdf := meta.KDF
+	if kdf == "" {
+		kdf = crypto.KDFScrypt
+	}
+	if kdf != secret.KDF() {
+		return nil, fmt.Errorf("%w: the file was encrypted with %s", ErrWrongPassword, kdfName(kdf))
+	}
+
+	logging.Infoln("deriving key")
+	key, err := deriveKey(&meta, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Infoln("validating challenge...")
+	challengeKey := crypto.Subkey(key, crypto.PurposeChallenge)
+	defer crypto.Zero(challengeKey[:])
+	if !meta.CheckChallenge(*challengeKey) {
+		crypto.Wipe(key)
+		return nil, fmt.Errorf("failed to validate challenge: %w", ErrWrongPassword)
+	}
+	logging.Infoln("successfully validated challenge")
+	return key, nil
+}
+
+// deriveKey derives a file's key, locking it in memory where possible. It should be wiped with
+// crypto.Wipe once it's no longer needed.
+func deriveKey(meta *files.FileMetadata, secret Secret) (*[crypto.KeySize]byte, error) {
+	key, err := secret.DeriveKey(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = crypto.Lock(key[:]); err != nil {
+		logging.Debugln("couldn't lock the key in memory:", err)
+	}
+	return key, nil
+}
@@ -1,30 +1,264 @@
 package relay
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"math/bits"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/bfrengley/relay/internal/crypto"
 	"github.com/bfrengley/relay/internal/files"
-	"github.com/google/uuid"
+	"github.com/bfrengley/relay/internal/logging"
+	"github.com/bfrengley/relay/internal/store"
 	"github.com/julienschmidt/httprouter"
 )
 
+// uploadIdleTimeout is how long an upload can wait for a chunk before it's abandoned, so a client
+// which has stalled doesn't hold on to the file and stop the upload being resumed.
+const uploadIdleTimeout = time.Minute
+
+var errUploadIdle = errors.New("upload stalled")
+
+// A download has downloadIdleTimeout to send each downloadSlice bytes of the file before it's
+// abandoned, so a client which stops reading, or reads slower than about 8 KiB/s, can't hold on
+// to its connection and the contents it has open indefinitely.
+const (
+	downloadIdleTimeout = 30 * time.Second
+	downloadSlice       = 256 << 10
+)
+
+const (
+	OwnerTokenHeader = "X-Owner-Token"
+	// AccessPasswordHeader carries the password needed to get a file, if it has one. Creating a
+	// file with it set makes the file need it.
+	AccessPasswordHeader = "X-Access-Password"
+	// UploadOffsetHeader gives the offset into the encrypted contents at which an upload resumes.
+	UploadOffsetHeader = "X-Upload-Offset"
+)
+
+func newOwnerToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func prettyPrint(i interface{}) string {
 	s, _ := json.MarshalIndent(i, "", "\t")
 	return string(s)
 }
 
+type ServerConfig struct {
+	Addr string
+	// StorageDir holds uploaded file contents on disk; if empty, files are kept in memory, so
+	// they can only be as large as the memory available. Files on disk are streamed in and out
+	// with buffers of a chunk or so, whatever their size.
+	StorageDir string
+	// MapFiles serves files on disk by mapping them into memory. Plain HTTP/1 downloads already
+	// go straight from the page cache with sendfile, but those over TLS or HTTP/2 can't, and
+	// mapping saves them copying the contents through a buffer first.
+	MapFiles bool
+	// IPFSAPI, if set, is the URL of an IPFS node's RPC API, such as http://127.0.0.1:5001,
+	// which stores file contents instead of StorageDir or memory. Each file's encrypted chunks are
+	// added and pinned in pieces of about a MiB, and unpinned when it's removed. Live files still
+	// only pass through memory.
+	IPFSAPI string
+
+	MaxFileSize uint64
+	MaxFiles    int
+	// MaxChunkSize is the largest chunk size files can be uploaded in, and so the largest buffer
+	// an upload reads into. If zero, it's files.MaxChunkSize.
+	MaxChunkSize uint32
+
+	// AuthToken, if set, must be presented as a bearer token to create or upload files. It also
+	// lets files be restored from the trash without their owner tokens.
+	AuthToken string
+
+	// MemoryBudget, if set, caps the memory committed to file data: the whole encrypted size of
+	// every file kept in memory, including what's yet to arrive, and a chunk buffer for each
+	// upload which is pending. New files which would take it over the budget are refused.
+	MemoryBudget uint64
+
+	// DownloadRate, if set, limits each download request to that many bytes a second, and
+	// EgressRate all of them together, so one downloader can't take the whole of the server's
+	// bandwidth. Requests share EgressRate evenly, so a client downloading in parallel ranges gets
+	// a share for each.
+	DownloadRate uint64
+	EgressRate   uint64
+
+	// TrashPeriod is how long deleted and expired files stay in the trash, where they can be
+	// restored, before they're purged. If it's zero, they're purged straight away.
+	TrashPeriod time.Duration
+
+	TLSCertFile string
+	TLSKeyFile  string
+	// H2C serves HTTP/2 without TLS as well as HTTP/1, for a proxy in front of the server which
+	// terminates TLS and multiplexes requests over one connection to it. HTTP/2 clients have to
+	// use it with prior knowledge; there's no upgrade from HTTP/1. It should only be reachable by
+	// the trusted proxy.
+	H2C bool
+	// HTTP3 serves HTTP/3 as well, on the same port over UDP, which copes better with lossy
+	// networks than TCP does; clients connecting over TCP are told about it. It needs TLS, and a
+	// build with the http3 tag (see HTTP3Built).
+	HTTP3 bool
+	// ForwardTo lists the URLs of the servers the owners of files can have them forwarded to,
+	// or "*" for any. Forwarding is disabled if it's empty, since it has the server make requests
+	// wherever it's told.
+	ForwardTo []string
+	// WebDAV serves the files which are listed read-only over WebDAV under /dav/, for file
+	// managers and other tools. They're still encrypted, beside the metadata to decrypt them with.
+	WebDAV bool
+	// WebUI, if set, is served at / and under /web/, such as internal/web's UI, which uploads,
+	// lists and downloads files from the browser, encrypting and decrypting them there.
+	WebUI http.Handler
+}
+
 type RelayServer struct {
-	readyFiles   files.FileSet
-	pendingFiles files.FileSet
+	// receiving is the number of bytes written by uploads in progress, which aren't counted in
+	// files until they finish. It's first so it's aligned for atomic access on 32-bit platforms.
+	receiving int64
+
+	config ServerConfig
+	// admitting is held while a new file is checked against MaxFiles and the memory budget and
+	// stored, so files created at the same time can't go over either between them.
+	admitting sync.Mutex
+	// files holds every file from when it's created until it's removed, whatever state it's in.
+	files files.FileSet
+	// index holds the ready files which can be searched for.
+	index     *files.Index
+	bundles   *bundleSet
+	mailboxes *mailboxSet
+	// livePipes holds a *livePipe for each live file whose upload or download has started.
+	livePipes sync.Map
+	// egress limits all downloads together to EgressRate.
+	egress *rateLimit
 }
 
-func (rs *RelayServer) CreateFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func NewServer(config ServerConfig) (*RelayServer, error) {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, errors.New("both a TLS certificate and key must be provided")
+	}
+	if config.HTTP3 {
+		if !HTTP3Built {
+			return nil, errHTTP3NotBuilt
+		}
+		if config.TLSCertFile == "" {
+			return nil, errors.New("HTTP/3 needs a TLS certificate and key")
+		}
+	}
+	if config.StorageDir != "" && config.IPFSAPI != "" {
+		return nil, errors.New("file contents can be stored on disk or in IPFS, but not both")
+	}
+	if config.StorageDir != "" {
+		if err := os.MkdirAll(config.StorageDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxChunkSize == 0 {
+		config.MaxChunkSize = files.MaxChunkSize
+	} else if config.MaxChunkSize < files.DefaultChunkSize || config.MaxChunkSize > files.MaxChunkSize {
+		return nil, fmt.Errorf("the maximum chunk size must be %d to %d bytes", files.DefaultChunkSize, files.MaxChunkSize)
+	}
+
+	return &RelayServer{
+		config:    config,
+		files:     files.NewSet(),
+		index:     files.NewIndex(),
+		bundles:   store.New[files.FileID, []files.FileID](nil),
+		mailboxes: store.New[uint32, mailbox](nil),
+		egress:    newRateLimit(config.EgressRate),
+	}, nil
+}
+
+func (rs *RelayServer) fileCount() int {
+	return rs.files.Len()
+}
+
+func (rs *RelayServer) dataPath(id files.FileID) string {
+	return filepath.Join(rs.config.StorageDir, id.String())
+}
+
+var errFileNotFound = errors.New("file not found")
+
+// readyFile returns a file which can be downloaded.
+func (rs *RelayServer) readyFile(id files.FileID) (files.File, bool) {
+	f, ok := rs.files.Get(id)
+	return f, ok && f.State == files.StateReady
+}
+
+// checkAccess reports whether the request carries the file's access password, if it has one,
+// responding with an error if not.
+func checkAccess(w http.ResponseWriter, r *http.Request, f files.File) bool {
+	if !f.CheckAccess(r.Header.Get(AccessPasswordHeader)) {
+		http.Error(w, "Missing or incorrect access password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ownedFile returns the file named in the request's path, as long as the request carries the
+// file's owner token, which anything changing the file needs. Otherwise it responds with an error
+// and returns false.
+func (rs *RelayServer) ownedFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) (files.FileID, files.File, bool) {
+	id, err := files.ParseFileID(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return id, files.File{}, false
+	}
+	f, ok := rs.files.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return id, f, false
+	}
+	// the token is set when the file is created and never changes, so it can be checked up front
+	if !f.CheckOwnerToken(r.Header.Get(OwnerTokenHeader)) {
+		http.Error(w, "Invalid or missing owner token", http.StatusForbidden)
+		return id, f, false
+	}
+	return id, f, true
+}
+
+// updateUpload changes the file whose contents are uploaded to id: its replacement if it has
+// one, or else the file itself. The change is only kept if update succeeds.
+func (rs *RelayServer) updateUpload(id files.FileID, update func(f *files.File) error) error {
+	err := errFileNotFound
+	rs.files.Update(id, func(f *files.File) {
+		if f.State.Done() || f.State == files.StateTrashed {
+			return
+		}
+		target := f
+		if f.Replacement != nil {
+			target = f.Replacement
+		}
+		next := *target
+		if err = update(&next); err == nil {
+			if target == f {
+				*f = next
+			} else {
+				f.Replacement = &next
+			}
+		}
+	})
+	return err
+}
+
+// decodeNewFile reads and checks the metadata of a file being created, writing an error response
+// and returning false if it isn't acceptable.
+func (rs *RelayServer) decodeNewFile(w http.ResponseWriter, r *http.Request) (files.FileMetadata, bool) {
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 
@@ -32,126 +266,569 @@ func (rs *RelayServer) CreateFile(w http.ResponseWriter, r *http.Request, _ http
 	err := decoder.Decode(&meta)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return meta, false
+	}
+	if err := meta.ValidateNew(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return meta, false
+	}
+	if !meta.Expires.IsZero() && !meta.Expires.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return meta, false
+	}
+	if meta.ChunkSize > rs.config.MaxChunkSize {
+		http.Error(
+			w,
+			fmt.Sprintf("Chunk size exceeds maximum of %d bytes", rs.config.MaxChunkSize),
+			http.StatusBadRequest,
+		)
+		return meta, false
+	}
+	if rs.config.MaxFileSize > 0 && meta.Size > rs.config.MaxFileSize {
+		http.Error(
+			w,
+			fmt.Sprintf("File exceeds maximum size of %d bytes", rs.config.MaxFileSize),
+			http.StatusRequestEntityTooLarge,
+		)
+		return meta, false
+	}
+	return meta, true
+}
+
+// newPendingFile makes the record of a new file, or a replacement for one, ready for its
+// contents to be uploaded, protected by the access password in the request if there is one.
+func (rs *RelayServer) newPendingFile(r *http.Request, id files.FileID, token string, meta files.FileMetadata) (files.File, error) {
+	meta.Schema = files.SchemaVersion
+	meta.ID = id
+	meta.Uploaded = time.Now().UTC()
+	tokenHash := sha256.Sum256([]byte(token))
+	f := files.File{FileMetadata: meta, State: files.StateCreated, OwnerTokenHash: tokenHash[:]}
+	if err := f.SetAccessPassword(r.Header.Get(AccessPasswordHeader)); err != nil {
+		return f, err
+	}
+	if meta.Live {
+		return f, nil
+	}
+	if rs.config.IPFSAPI != "" {
+		l, err := fileLayout(meta)
+		if err != nil {
+			return f, err
+		}
+		f.Content = files.NewIPFSContent(rs.config.IPFSAPI, int64(l.header), int64(l.chunkSize*ipfsPieceChunks(l)))
+	} else if rs.config.StorageDir == "" {
+		f.Content = files.NewMemoryContent()
+	}
+	return f, nil
+}
+
+// writeCreated responds with the ID and owner token of a new file.
+func writeCreated(w http.ResponseWriter, id files.FileID, token string) {
+	idBytes, err := json.Marshal(files.CreatedFile{ID: id, OwnerToken: token})
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if meta.Name == "" {
-		http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(idBytes)
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if meta.Size == 0 {
-		http.Error(w, "File must be >0 bytes", http.StatusBadRequest)
+}
+
+func (rs *RelayServer) CreateFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	meta, ok := rs.decodeNewFile(w, r)
+	if !ok {
 		return
 	}
-	if len(meta.Hash) != sha256.Size {
-		http.Error(w, "Hash must be valid SHA-256 hash", http.StatusBadRequest)
+
+	id := files.NewFileID()
+	token, err := newOwnerToken()
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if len(meta.Salt) != crypto.SaltSize {
-		http.Error(w, "Salt must be 16 bytes", http.StatusBadRequest)
+	f, err := rs.newPendingFile(r, id, token, meta)
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if len(meta.Challenge) != sha256.Size+crypto.Overhead { // is this right?
-		http.Error(w, "Invalid challenge size", http.StatusBadRequest)
+	rs.admitting.Lock()
+	if rs.config.MaxFiles > 0 && rs.fileCount() >= rs.config.MaxFiles {
+		rs.admitting.Unlock()
+		http.Error(w, "Server is storing the maximum number of files", http.StatusInsufficientStorage)
 		return
 	}
-	if !meta.Uploaded.IsZero() {
-		http.Error(w, `Unexpected field "uploaded" found`, http.StatusBadRequest)
+	if !rs.admit(w, f) {
+		rs.admitting.Unlock()
 		return
 	}
-	if meta.ID != "" {
-		http.Error(w, `Unexpected field "id" found`, http.StatusBadRequest)
+	rs.files.Set(id, f)
+	rs.admitting.Unlock()
+	logging.Infoln("created new file", prettyPrint(f.FileMetadata))
+	writeCreated(w, id, token)
+}
+
+// ReplaceFile starts uploading new contents and metadata for a file, such as the same contents
+// encrypted with a new key, keeping its ID and owner token. The old file stays available until
+// the new contents have all been uploaded, and then the new file takes its place.
+func (rs *RelayServer) ReplaceFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, old, ok := rs.ownedFile(w, r, p)
+	if !ok {
 		return
 	}
-	if meta.Downloads != 0 {
-		http.Error(w, `Unexpected field "downloads" found`, http.StatusBadRequest)
+	if old.State != files.StateReady {
+		http.Error(w, "Only files which have finished uploading can be replaced", http.StatusConflict)
+		return
 	}
+	token := r.Header.Get(OwnerTokenHeader)
 
-	id := uuid.New()
-	idBytes, err := json.Marshal(files.FileID{ID: id.String()})
-	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	meta, ok := rs.decodeNewFile(w, r)
+	if !ok {
 		return
 	}
-
-	meta.ID = id.String()
-	meta.Uploaded = time.Now().UTC()
-	f := files.File{FileMetadata: meta, Data: make([][]byte, 0)}
-	rs.pendingFiles.Set(id, f)
-	log.Println("INFO: created new file", prettyPrint(meta))
-
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	_, err = w.Write(idBytes)
+	if meta.Live {
+		http.Error(w, "Replacements can't be live", http.StatusBadRequest)
+		return
+	}
+	replacement, err := rs.newPendingFile(r, id, token, meta)
 	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
+		logging.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rs.admitting.Lock()
+	if !rs.admit(w, replacement) {
+		rs.admitting.Unlock()
+		return
+	}
+	var ready, uploading bool
+	rs.files.Update(id, func(f *files.File) {
+		if ready = f.State == files.StateReady; !ready {
+			return
+		}
+		// a replacement which hasn't started uploading is just superseded
+		if uploading = f.Replacement != nil && f.Replacement.State == files.StateUploading; !uploading {
+			f.Replacement = &replacement
+		}
+	})
+	rs.admitting.Unlock()
+	if !ready {
+		http.NotFound(w, r) // deleted concurrently
+		return
+	}
+	if uploading {
+		http.Error(w, "A replacement is already being uploaded", http.StatusConflict)
+		return
+	}
+	logging.Infoln("replacing file", prettyPrint(replacement.FileMetadata))
+	writeCreated(w, id, token)
 }
 
 func (rs *RelayServer) UploadFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	idStr := p.ByName("id")
-	if idStr == "" {
-		http.Error(w, "Missing file ID", http.StatusBadRequest)
+	id, _, ok := rs.ownedFile(w, r, p)
+	if !ok {
 		return
 	}
-
-	id, err := uuid.Parse(idStr)
-	f, ok := rs.pendingFiles.Remove(id)
-
-	if !ok || err != nil {
+	idStr := id.String()
+	// claim the file, so nothing else uploads to it at the same time
+	var f files.File
+	err := rs.updateUpload(id, func(file *files.File) error {
+		f = *file
+		return file.Transition(files.StateUploading)
+	})
+	if errors.Is(err, errFileNotFound) {
 		http.NotFound(w, r)
 		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if f.Live {
+		rs.uploadLive(w, r, id, f)
+		return
 	}
 
-	log.Println("INFO: beginning upload for file", idStr)
-	var fileBytes, totalBytes uint64
-	for {
-		select {
-		case <-r.Context().Done():
-			log.Println("INFO: upload for file", idStr, "cancelled")
+	l, _ := fileLayout(f.FileMetadata) // checked when the file was created
+	expected, _ := l.encryptedSize(f.Size)
+	received := f.Received
+	var cw files.ContentWriter
+	done := false
+	// an interrupted upload keeps the whole chunks it received, so it can be resumed from there
+	defer func() {
+		if done {
 			return
-		default: // request not cancelled - read next chunk
 		}
-
-		chunk := make([]byte, ChunkSize)
-		n, err := r.Body.Read(chunk)
-		if n > 0 {
-			if n < crypto.Overhead {
-				http.Error(w, "Invalid chunk", http.StatusBadRequest)
-				return
+		if received > expected {
+			received = expected
+		}
+		f.Received = l.wholeChunks(received)
+		if cw != nil {
+			if err := cw.Truncate(int64(f.Received)); err != nil {
+				logging.Errorln(err)
 			}
-
-			fileBytes += uint64(n - crypto.Overhead)
-			totalBytes += uint64(n)
-			if fileBytes > f.Size {
-				http.Error(w, "Data exceeded expected file size", http.StatusBadRequest)
-				return
+			cw.Close()
+		}
+		err := rs.updateUpload(id, func(file *files.File) error {
+			file.Received = f.Received
+			return file.Transition(files.StateCreated)
+		})
+		if err != nil {
+			// the file was removed while it was being uploaded
+			if ipfs, ok := f.Content.(*files.IPFSContent); ok {
+				ipfs.Remove()
+			} else if f.Content == nil {
+				files.RemovePart(rs.dataPath(id))
 			}
+		}
+	}()
 
-			f.Data = append(f.Data, chunk[:n])
+	var offset uint64
+	if h := r.Header.Get(UploadOffsetHeader); h != "" {
+		offset, err = strconv.ParseUint(h, 10, 64)
+		if err != nil || offset != l.wholeChunks(offset) {
+			http.Error(w, "Invalid upload offset", http.StatusBadRequest)
+			return
 		}
+	}
+	if offset > received {
+		http.Error(
+			w,
+			fmt.Sprintf("Upload offset %d is past the %d bytes received", offset, received),
+			http.StatusConflict,
+		)
+		return
+	}
+	received = offset
+	if cw, err = rs.contentWriter(id, f, offset); err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err == io.EOF {
+	if offset > 0 {
+		logging.Infoln("resuming upload for file", idStr, "at offset", offset)
+	} else {
+		logging.Infoln("beginning upload for file", idStr)
+	}
+	var totalBytes uint64
+	read, _ := chunkSource(r)
+	for {
+		// read a whole chunk, or the header, however the body happens to arrive
+		size := l.chunkSize
+		if received < l.header {
+			size = l.header - received
+		}
+		chunk := getChunkBuffer(int(size))
+		n, err := readChunk(r.Context(), read, chunk)
+		if errors.Is(err, context.Canceled) {
+			logging.Infoln("upload for file", idStr, "cancelled")
+			return
+		} else if err == errUploadIdle {
+			logging.Infoln("upload for file", idStr, "stalled, abandoning it")
+			http.Error(w, "Upload stalled", http.StatusRequestTimeout)
+			return
+		} else if err == io.EOF {
 			break // we've read the whole body
-		} else if err != nil {
+		} else if errors.Is(err, errBadFrame) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil && err != io.ErrUnexpectedEOF {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return // ?
+			return
+		}
+		// only the last chunk can be short, and it has to hold exactly the rest of the file
+		last := err == io.ErrUnexpectedEOF
+		if received < l.header {
+			if last {
+				http.Error(w, "Invalid stream header", http.StatusBadRequest)
+				return
+			}
+		} else if err := ValidateCiphertextChunk(f.FileMetadata, l.chunkIndex(received), chunk[:n]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		received += uint64(n)
+		totalBytes += uint64(n)
+
+		_, err = cw.Write(chunk[:n])
+		putChunkBuffer(chunk)
+		if err != nil {
+			logging.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if last {
+			break
 		}
 	}
 
-	if fileBytes < f.Size {
-		log.Println("INFO: received", fileBytes, "bytes but expected", f.Size)
+	if received < expected {
+		logging.Infoln("received", received, "bytes but expected", expected)
 		http.Error(w, "Data smaller than expected file size", http.StatusBadRequest)
 		return
 	}
 
-	log.Println("INFO: received", totalBytes, "bytes of data for file", idStr)
-	rs.readyFiles.Set(id, f)
+	content, err := cw.Finish()
+	cw = nil
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logging.Infoln("received", totalBytes, "bytes of data for file", idStr)
+	done = true
+	var ready files.File
+	var replaced files.Content
+	rs.files.UpdateExpiring(id, func(file *files.File, deadline *time.Time) {
+		if file.State.Done() || file.State == files.StateTrashed {
+			return
+		}
+		next := *file
+		if next.Replacement != nil {
+			next = *next.Replacement // which takes the old file's place
+		}
+		next.Content, next.Received = content, received
+		if next.Transition(files.StateReady) == nil {
+			if file.Replacement != nil {
+				replaced = file.Content
+			}
+			*file, *deadline, ready = next, next.Expires, next
+		}
+	})
+	if ready.State != files.StateReady {
+		// the file was removed while it was being uploaded
+		if err := content.Remove(); err != nil {
+			logging.Errorln(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	// contents on disk are overwritten in place, but anything else the replaced file stored is
+	// left behind
+	if replaced != nil && replaced != content {
+		if err := replaced.Remove(); err != nil {
+			logging.Errorln(err)
+		}
+	}
+	// files with an access password can't be searched for, since the results would give their
+	// details away
+	if ready.AccessHash == nil {
+		rs.index.Add(ready.FileMetadata)
+	} else {
+		rs.index.Remove(id)
+	}
+	logging.Debugln("storing", rs.files.Len(), "files totalling", rs.files.Bytes(), "bytes, and receiving", atomic.LoadInt64(&rs.receiving), "more")
 	w.Write([]byte(""))
 }
 
+// budgetRetryAfter is how long clients are asked to wait before trying again when a new file
+// doesn't fit in the memory budget.
+const budgetRetryAfter = 30 * time.Second
+
+// admit reports whether the new file f fits in the memory budget alongside everything already
+// committed, responding with an error if not. It must be called with rs.admitting held.
+func (rs *RelayServer) admit(w http.ResponseWriter, f files.File) bool {
+	budget := rs.config.MemoryBudget
+	if budget == 0 {
+		return true
+	}
+	need := rs.memoryNeeded(f)
+	if need > budget {
+		http.Error(w, "File is larger than the server's memory budget", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	used := rs.memoryCommitted()
+	if used+need <= budget {
+		return true
+	}
+	logging.Infoln("refusing new file needing", need, "bytes of memory, with", used, "of the", budget, "byte budget committed")
+	w.Header().Set("Retry-After", strconv.Itoa(int(budgetRetryAfter.Seconds())))
+	http.Error(w, "Server is too busy to take the file; try again later", http.StatusServiceUnavailable)
+	return false
+}
+
+// memoryCommitted is how much memory the server has committed to file data, which can grow to
+// that much without any more files being created.
+func (rs *RelayServer) memoryCommitted() uint64 {
+	var committed uint64
+	rs.files.Range(func(_ files.FileID, f files.File) bool {
+		committed += rs.memoryNeeded(f)
+		if f.Replacement != nil {
+			committed += rs.memoryNeeded(*f.Replacement)
+		}
+		return true
+	})
+	return committed
+}
+
+// memoryNeeded is how much memory f can take up: all of its encrypted contents if they're kept in
+// memory, and the buffer its upload reads chunks into until it's finished.
+func (rs *RelayServer) memoryNeeded(f files.File) uint64 {
+	var need uint64
+	if f.State == files.StateCreated || f.State == files.StateUploading {
+		chunk := uint64(files.DefaultChunkSize)
+		if l, err := fileLayout(f.FileMetadata); err == nil {
+			chunk = l.chunkSize
+		}
+		need += chunk
+		if f.Live {
+			// and those on their way to the download
+			need += chunk * liveBufferChunks
+		}
+	}
+	if mem, ok := f.Content.(*files.MemoryContent); ok && !f.State.Done() {
+		size := uint64(mem.Size())
+		if l, err := fileLayout(f.FileMetadata); err == nil {
+			if encrypted, _ := l.encryptedSize(f.Size); encrypted > size {
+				size = encrypted
+			}
+		}
+		need += size
+	}
+	if ipfs, ok := f.Content.(*files.IPFSContent); ok && !f.State.Done() {
+		// the piece being uploaded
+		need += uint64(ipfs.Header + ipfs.PieceSize)
+	}
+	return need
+}
+
+// contentWriter opens a file's contents for an upload to write to, from offset onwards.
+func (rs *RelayServer) contentWriter(id files.FileID, f files.File, offset uint64) (files.ContentWriter, error) {
+	var cw files.ContentWriter
+	var err error
+	switch c := f.Content.(type) {
+	case *files.MemoryContent:
+		cw = c.Writer(int64(offset))
+	case *files.IPFSContent:
+		cw, err = c.Writer(int64(offset))
+	default:
+		cw, err = files.NewDiskWriter(rs.dataPath(id), int64(offset))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &receivingWriter{ContentWriter: cw, total: &rs.receiving}, nil
+}
+
+// receivingWriter counts the bytes written through it in total until it's finished or closed, so
+// the server knows how much it's in the middle of receiving.
+type receivingWriter struct {
+	files.ContentWriter
+	total   *int64
+	written int64
+}
+
+func (w *receivingWriter) Write(p []byte) (int, error) {
+	n, err := w.ContentWriter.Write(p)
+	w.written += int64(n)
+	atomic.AddInt64(w.total, int64(n))
+	return n, err
+}
+
+func (w *receivingWriter) release() {
+	atomic.AddInt64(w.total, -w.written)
+	w.written = 0
+}
+
+func (w *receivingWriter) Finish() (files.Content, error) {
+	w.release()
+	return w.ContentWriter.Finish()
+}
+
+func (w *receivingWriter) Close() error {
+	w.release()
+	return w.ContentWriter.Close()
+}
+
+// readChunk fills chunk with read, which reads like io.ReadFull, but gives up if ctx is cancelled
+// or the chunk takes longer than uploadIdleTimeout to arrive. The read carries on in the
+// background after it gives up, so chunk mustn't be used again.
+func readChunk(ctx context.Context, read func([]byte) (int, error), chunk []byte) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := read(chunk)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(uploadIdleTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-timer.C:
+		return 0, errUploadIdle
+	}
+}
+
+// chunkBuffers holds buffers for reading uploaded chunks into, so busy uploads don't allocate one
+// for each chunk. Files have chunks of different sizes, so buffers are pooled by their capacity,
+// which is the power of two at or above the size they were made for.
+var chunkBuffers [bits.UintSize]sync.Pool
+
+func getChunkBuffer(size int) []byte {
+	class := bits.Len(uint(size - 1))
+	if b, ok := chunkBuffers[class].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1<<class)
+}
+
+// putChunkBuffer returns a buffer from getChunkBuffer to the pool. It mustn't be passed to
+// readChunk when that gave up, since the read carries on into it.
+func putChunkBuffer(b []byte) {
+	b = b[:cap(b)]
+	chunkBuffers[bits.Len(uint(cap(b)-1))].Put(&b)
+}
+
+func (rs *RelayServer) GetUploadStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, f, ok := rs.ownedFile(w, r, p)
+	if !ok {
+		return
+	}
+	if f.Replacement != nil {
+		f = *f.Replacement
+	}
+	var status files.UploadStatus
+	switch f.State {
+	case files.StateCreated:
+		status.Offset = f.Received
+	case files.StateUploading:
+		http.Error(w, "Upload is still in progress", http.StatusConflict)
+		return
+	case files.StateReady:
+		status = files.UploadStatus{Offset: f.Received, Complete: true}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if _, err = w.Write(statusBytes); err != nil {
+		logging.Errorln(err)
+	}
+}
+
 func (rs *RelayServer) GetFileContents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	idStr := p.ByName("id")
 	if idStr == "" {
@@ -159,29 +836,404 @@ func (rs *RelayServer) GetFileContents(w http.ResponseWriter, r *http.Request, p
 		return
 	}
 
-	id, err := uuid.Parse(idStr)
-	f, ok := rs.readyFiles.Get(id)
+	id, err := files.ParseFileID(idStr)
+	f, ok := rs.readyFile(id)
+	if lf, live := rs.liveFile(id); !ok && err == nil && live {
+		if checkAccess(w, r, lf) {
+			rs.downloadLive(w, r, id, lf)
+		}
+		return
+	}
 
 	if !ok || err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	if !checkAccess(w, r, f) {
+		return
+	}
+
+	open := f.Content.Open
+	if d, ok := f.Content.(files.DiskContent); ok && rs.config.MapFiles {
+		open = d.Map
+	}
+	data, err := open()
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer data.Close()
 
-	flusher := w.(http.Flusher)
+	if rs.serveFramed(w, r, id, f, data) {
+		return
+	}
+
+	// ServeContent handles ranges and conditional requests. The ETag changes when the file is
+	// replaced, even if it's by the same plaintext.
+	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Add("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", contentETag(f))
+	// the last deadline also covers flushing the response; the server clears it afterwards
+	dw := rs.newDeadlineWriter(w, r)
+	rec := &statusRecorder{ResponseWriter: dw}
+	http.ServeContent(rec, r, "", f.Uploaded, data)
+	if dw.stalled {
+		logging.Infoln("download of file", idStr, "stalled, abandoning it")
+		return
+	} else if dw.failed {
+		return
+	}
 
-	for i := range f.Data {
-		_, err := w.Write(f.Data[i])
+	// reading part of a file isn't a download of it, but reading it to the end is, whether that
+	// was all at once, by resuming, or in ranges, so it's counted by where the contents were left
+	if rec.status != http.StatusOK && rec.status != http.StatusPartialContent {
+		return
+	}
+	l, _ := fileLayout(f.FileMetadata) // checked when the file was created
+	size, _ := l.encryptedSize(f.Size)
+	if sent, err := data.Seek(0, io.SeekCurrent); err == nil && uint64(sent) == size {
+		rs.recordDownload(id)
+	}
+}
+
+// serveFramed serves the contents data of the file id framed, if the download r asks for them so,
+// reporting whether it did. The frames are the chunks in the contents' index, or, for contents
+// stored without one, where the file's layout puts them.
+func (rs *RelayServer) serveFramed(w http.ResponseWriter, r *http.Request, id files.FileID, f files.File, data io.ReadSeeker) bool {
+	if !wantsFrames(r) {
+		return false
+	}
+	l, _ := fileLayout(f.FileMetadata) // checked when the file was created
+	size, _ := l.encryptedSize(f.Size)
+	ci, err := f.Content.Chunks()
+	if err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	var sizes frameSizer = l
+	boundary := func(offset uint64) bool { return offset == l.wholeChunks(offset) }
+	if ci != nil {
+		defer ci.Close()
+		boundary = func(offset uint64) bool {
+			_, ok, err := ci.Find(int64(offset))
+			return ok && err == nil
+		}
+	}
+	offset, ok := framedOffset(r, size, boundary)
+	if !ok {
+		return false
+	}
+	if ci != nil {
+		// seek straight to the chunk the download starts from
+		next, _, _ := ci.Find(int64(offset))
+		sizes = &indexFrames{ci: ci, next: next}
+	}
+	if _, err := data.Seek(int64(offset), io.SeekStart); err != nil {
+		logging.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", FramedContentType)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", contentETag(f))
+	status := http.StatusOK
+	if r.Header.Get("Range") != "" {
+		// the range of the contents which the frames carry
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		status = http.StatusPartialContent
+	}
+	dw := rs.newDeadlineWriter(w, r)
+	dw.WriteHeader(status)
+	_, err = io.Copy(dw, newFramingReader(data, sizes, l.chunkSize, offset))
+	if dw.stalled {
+		logging.Infoln("download of file", id, "stalled, abandoning it")
+		return true
+	} else if err != nil {
+		logging.Errorln(err)
+		return true
+	}
+	// a framed download always runs to the end of the file
+	rs.recordDownload(id)
+	return true
+}
+
+// contentETag is the ETag of a file's contents, which changes when the file is replaced.
+func contentETag(f files.File) string {
+	return `"` + strconv.FormatInt(f.Uploaded.UnixNano(), 36) + `"`
+}
+
+// statusRecorder remembers the status of a response, for handlers which need to know what
+// http.ServeContent decided. It passes ReadFrom through, so contents on disk can still be sent
+// with sendfile.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return io.Copy(s.ResponseWriter, r)
+}
+
+// deadlineWriter gives each downloadSlice bytes written through it downloadIdleTimeout to be
+// sent, splitting up larger writes, so a response which stalls fails instead of waiting forever.
+// It also holds each slice back until the server's rate limits let it through.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc     *http.ResponseController
+	ctx    context.Context
+	limits [2]*rateLimit
+	// failed is set once a write has failed, and stalled too if it was because it timed out.
+	failed, stalled bool
+}
+
+// newDeadlineWriter returns a deadlineWriter for the response to the download r.
+func (rs *RelayServer) newDeadlineWriter(w http.ResponseWriter, r *http.Request) *deadlineWriter {
+	return &deadlineWriter{
+		ResponseWriter: w,
+		rc:             http.NewResponseController(w),
+		ctx:            r.Context(),
+		limits:         [2]*rateLimit{newRateLimit(rs.config.DownloadRate), rs.egress},
+	}
+}
+
+// throttle waits until the rate limits let n more bytes be sent.
+func (d *deadlineWriter) throttle(n int) error {
+	var wait time.Duration
+	for _, l := range d.limits {
+		wait = max(wait, l.reserve(n))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+func (d *deadlineWriter) extend() {
+	// a writer which can't have deadlines is left without them
+	d.rc.SetWriteDeadline(time.Now().Add(downloadIdleTimeout))
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > downloadSlice {
+			n = downloadSlice
+		}
+		if err := d.throttle(n); err != nil {
+			d.noteFailure(err)
+			return written, err
+		}
+		d.extend()
+		m, err := d.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			d.noteFailure(err)
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom sends r a slice at a time. It keeps the limit ServeContent puts on the contents as the
+// only one around them, so those on disk can still be sent with sendfile, or straight from memory
+// if they're mapped.
+func (d *deadlineWriter) ReadFrom(r io.Reader) (int64, error) {
+	src, remaining := r, int64(-1)
+	if lr, ok := r.(*io.LimitedReader); ok {
+		src, remaining = lr.R, lr.N
+		defer func() { lr.N = remaining }()
+	}
+	var written int64
+	for remaining != 0 {
+		n := int64(downloadSlice)
+		if remaining > 0 && remaining < n {
+			n = remaining
+		}
+		if err := d.throttle(int(n)); err != nil {
+			d.noteFailure(err)
+			return written, err
+		}
+		d.extend()
+		var m int64
+		var err error
+		if mr, ok := src.(*files.MappedReader); ok {
+			// mapped contents are written from where they're mapped, without a buffer between
+			var b []byte
+			if b, err = mr.Next(int(n)); err == nil {
+				var k int
+				k, err = d.ResponseWriter.Write(b)
+				m = int64(k)
+			} else if err == io.EOF {
+				err = nil
+			}
+		} else {
+			m, err = io.Copy(d.ResponseWriter, &io.LimitedReader{R: src, N: n})
+		}
+		written += m
+		if remaining > 0 {
+			remaining -= m
+		}
 		if err != nil {
-			log.Println("ERR:", err)
+			d.noteFailure(err)
+			return written, err
+		}
+		if m < n {
+			break // the end of r
+		}
+	}
+	return written, nil
+}
+
+func (d *deadlineWriter) noteFailure(err error) {
+	d.failed = true
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		d.stalled = true
+	}
+}
+
+// removeContents removes a file's contents, along with those of any replacement for it which has
+// started uploading.
+func (rs *RelayServer) removeContents(id files.FileID, f files.File) {
+	rs.removeContent(id, &f)
+	if f.Replacement != nil {
+		rs.removeContent(id, f.Replacement)
+	}
+}
+
+func (rs *RelayServer) removeContent(id files.FileID, f *files.File) {
+	var err error
+	if f.Content != nil {
+		err = f.Content.Remove()
+	} else if f.Received > 0 {
+		// the partial contents of an interrupted upload
+		err = files.RemovePart(rs.dataPath(id))
+	}
+	if err != nil {
+		logging.Errorln(err)
+	}
+}
+
+// trash moves a ready file to the trash until rs.config.TrashPeriod from now, returning any
+// replacement for it, which is dropped rather than kept in the trash with it.
+func (rs *RelayServer) trash(f *files.File) (*files.File, error) {
+	if err := f.Transition(files.StateTrashed); err != nil {
+		return nil, err
+	}
+	f.Purge = time.Now().Add(rs.config.TrashPeriod)
+	dropped := f.Replacement
+	f.Replacement = nil
+	return dropped, nil
+}
+
+// recordDownload counts a completed download of a file, deleting it once it reaches its
+// download limit.
+func (rs *RelayServer) recordDownload(id files.FileID) {
+	var deleted bool
+	f, ok := rs.files.Update(id, func(f *files.File) {
+		if f.State != files.StateReady {
 			return
 		}
-		flusher.Flush()
+		// each count is applied to the file in the set, so only the download which reaches the
+		// limit deletes it, however many finish at once
+		f.Downloads++
+		deleted = f.MaxDownloads > 0 && f.Downloads == f.MaxDownloads && f.Transition(files.StateDeleted) == nil
+	})
+	if ok && deleted {
+		rs.files.Remove(id)
+		rs.index.Remove(id)
+		rs.removeContents(id, f)
+		logging.Infoln("deleted file", id, "after", f.Downloads, "downloads")
 	}
+}
 
-	rs.readyFiles.Lock()
-	f.Downloads += 1
-	rs.readyFiles.Unlock()
+// expireFiles deletes expired files, empty bundles and expired mailboxes every interval, so they
+// don't linger until someone asks for them.
+func (rs *RelayServer) expireFiles(interval time.Duration) {
+	for range time.Tick(interval) {
+		for id, f := range rs.files.RemoveExpired(time.Now()) {
+			rs.index.Remove(id)
+			if f.State == files.StateTrashed {
+				if err := f.Transition(files.StateDeleted); err != nil {
+					logging.Errorln("purged file", id, "unexpectedly:", err)
+				}
+				rs.removeContents(id, f)
+				logging.Infoln("purged file", id)
+				continue
+			}
+
+			if rs.config.TrashPeriod > 0 {
+				dropped, err := rs.trash(&f)
+				if err == nil {
+					rs.files.SetExpiring(id, f, f.Purge)
+					if dropped != nil {
+						rs.removeContent(id, dropped)
+					}
+					logging.Infoln("expired file", id, "into the trash")
+					continue
+				}
+				logging.Errorln("expired file", id, "unexpectedly:", err)
+			} else if err := f.Transition(files.StateExpired); err != nil {
+				logging.Errorln("expired file", id, "unexpectedly:", err)
+			}
+			rs.removeContents(id, f)
+			logging.Infoln("expired file", id)
+		}
+		rs.removeEmptyBundles()
+		rs.mailboxes.RemoveExpired(time.Now())
+	}
+}
+
+// ServerInfo describes what the server accepts, so clients can work within it.
+type ServerInfo struct {
+	// MinChunkSize and MaxChunkSize bound the chunk sizes files can be uploaded in.
+	MinChunkSize uint32 `json:"min_chunk_size"`
+	MaxChunkSize uint32 `json:"max_chunk_size"`
+	// MaxFileSize is the largest file accepted, if non-zero.
+	MaxFileSize uint64 `json:"max_file_size,omitempty"`
+	// Framing is whether the server reads uploads framed as FramedContentType.
+	Framing bool `json:"framing,omitempty"`
+}
+
+func (rs *RelayServer) GetInfo(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	info := ServerInfo{
+		MinChunkSize: files.MinChunkSize,
+		MaxChunkSize: rs.config.MaxChunkSize,
+		MaxFileSize:  rs.config.MaxFileSize,
+		Framing:      true,
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		logging.Errorln(err)
+	}
 }
 
 func (rs *RelayServer) GetFileMetadata(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -191,17 +1243,24 @@ func (rs *RelayServer) GetFileMetadata(w http.ResponseWriter, r *http.Request, p
 		return
 	}
 
-	id, err := uuid.Parse(idStr)
-	f, ok := rs.readyFiles.Get(id)
+	id, err := files.ParseFileID(idStr)
+	f, ok := rs.readyFile(id)
+	if !ok {
+		// which can be downloaded once their upload starts
+		f, ok = rs.liveFile(id)
+	}
 
 	if !ok || err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	if !checkAccess(w, r, f) {
+		return
+	}
 
 	metaBytes, err := json.Marshal(f.FileMetadata)
 	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
+		logging.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -210,23 +1269,141 @@ func (rs *RelayServer) GetFileMetadata(w http.ResponseWriter, r *http.Request, p
 
 	_, err = w.Write(metaBytes)
 	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
+		logging.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (rs *RelayServer) GetFileList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	files := make([]files.FileMetadata, 0)
-	rs.readyFiles.Lock()
-	for _, f := range rs.readyFiles.Files {
-		files = append(files, f.FileMetadata)
+// DeleteFile moves a ready file to the trash, if the server keeps one, and otherwise deletes it
+// for good. Files in the trash, or which haven't finished uploading, are deleted for good, as are
+// any with the "purge" query parameter set.
+func (rs *RelayServer) DeleteFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _, ok := rs.ownedFile(w, r, p)
+	if !ok {
+		return
+	}
+	purge, _ := strconv.ParseBool(r.URL.Query().Get("purge"))
+
+	var err error
+	var dropped *files.File
+	f, ok := rs.files.UpdateExpiring(id, func(f *files.File, deadline *time.Time) {
+		if f.Replacement != nil && f.Replacement.State == files.StateUploading {
+			err = &files.TransitionError{From: files.StateUploading, To: files.StateDeleted}
+		} else if f.State == files.StateReady && rs.config.TrashPeriod > 0 && !purge {
+			if dropped, err = rs.trash(f); err == nil {
+				*deadline = f.Purge
+			}
+		} else {
+			err = f.Transition(files.StateDeleted)
+		}
+	})
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	rs.index.Remove(id)
+
+	if f.State == files.StateTrashed {
+		if dropped != nil {
+			rs.removeContent(id, dropped)
+		}
+		logging.Infoln("moved file", id, "to the trash until", f.Purge.Format(time.RFC3339))
+		trashedBytes, err := json.Marshal(files.TrashedFile{Purge: f.Purge})
+		if err != nil {
+			logging.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err = w.Write(trashedBytes); err != nil {
+			logging.Errorln(err)
+		}
+		return
+	}
+
+	rs.files.Remove(id)
+	rs.removeContents(id, f)
+	logging.Infoln("deleted file", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RestoreFile takes a file back out of the trash. It needs the file's owner token, or the
+// server's auth token. A file which expired into the trash gets as long again as it had at first
+// before it expires again.
+func (rs *RelayServer) RestoreFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := files.ParseFileID(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, ok := rs.files.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !rs.isAdmin(r) && !f.CheckOwnerToken(r.Header.Get(OwnerTokenHeader)) {
+		http.Error(w, "Invalid or missing owner token", http.StatusForbidden)
+		return
+	}
+
+	var trashed bool
+	now := time.Now()
+	f, ok = rs.files.UpdateExpiring(id, func(f *files.File, deadline *time.Time) {
+		if trashed = f.State == files.StateTrashed; !trashed {
+			return
+		}
+		f.Transition(files.StateReady)
+		f.Purge = time.Time{}
+		if !f.Expires.IsZero() && !f.Expires.After(now) {
+			f.Expires = now.Add(f.Expires.Sub(f.Uploaded))
+		}
+		*deadline = f.Expires
+	})
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !trashed {
+		http.Error(w, "File isn't in the trash", http.StatusConflict)
+		return
+	}
+	if f.AccessHash == nil {
+		rs.index.Add(f.FileMetadata)
+	}
+
+	logging.Infoln("restored file", id, "from the trash")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listFilter returns a filter for the files a list or search can include: those which are ready and
+// don't need an access password, with every tag given as a "tag" query parameter, and with the
+// content type given as "type", if any, which can be like "image/*".
+func listFilter(w http.ResponseWriter, r *http.Request) (func(f files.File) bool, bool) {
+	query := r.URL.Query()
+	tags := query["tag"]
+	for _, tag := range tags {
+		if err := files.ValidateTag(tag); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
 	}
-	rs.readyFiles.Unlock()
+	contentType := query.Get("type")
 
-	filesBytes, err := json.Marshal(files)
+	return func(f files.File) bool {
+		// files with an access password aren't listed, since the list would give their details away
+		return f.State == files.StateReady && f.AccessHash == nil && f.HasTags(tags) && (contentType == "" || f.MatchesType(contentType))
+	}, true
+}
+
+func writeFileList(w http.ResponseWriter, list []files.FileMetadata) {
+	filesBytes, err := json.Marshal(list)
 	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
+		logging.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -235,22 +1412,160 @@ func (rs *RelayServer) GetFileList(w http.ResponseWriter, r *http.Request, _ htt
 
 	_, err = w.Write(filesBytes)
 	if err != nil {
-		log.Printf("ERR: %s\n", err.Error())
+		logging.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func ListenAndServe(port string) error {
-	rs := RelayServer{files.NewSet(), files.NewSet()}
+func (rs *RelayServer) GetFileList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	include, ok := listFilter(w, r)
+	if !ok {
+		return
+	}
+
+	list := make([]files.FileMetadata, 0)
+	rs.files.Range(func(_ files.FileID, f files.File) bool {
+		if include(f) {
+			list = append(list, f.FileMetadata)
+		}
+		return true
+	})
+	writeFileList(w, list)
+}
+
+// SearchFiles lists the files with a word in their name or tags starting with each word of the
+// "q" query parameter, filtered like GetFileList.
+func (rs *RelayServer) SearchFiles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return
+	}
+	include, ok := listFilter(w, r)
+	if !ok {
+		return
+	}
+
+	list := make([]files.FileMetadata, 0)
+	for _, id := range rs.index.Search(q) {
+		// the index can lag behind a file being removed
+		if f, ok := rs.files.Get(id); ok && include(f) {
+			list = append(list, f.FileMetadata)
+		}
+	}
+	writeFileList(w, list)
+}
+
+// isAdmin reports whether the request carries the server's auth token. Without one, nobody is.
+func (rs *RelayServer) isAdmin(r *http.Request) bool {
+	if rs.config.AuthToken == "" {
+		return false
+	}
+	// compare hashes, since ConstantTimeCompare gives away whether the lengths match
+	want := sha256.Sum256([]byte(rs.config.AuthToken))
+	got := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+func (rs *RelayServer) requireAuth(h httprouter.Handle) httprouter.Handle {
+	if rs.config.AuthToken == "" {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !rs.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid or missing authorization token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+func (rs *RelayServer) Handler() http.Handler {
 	router := httprouter.New()
 
+	router.GET("/info", rs.GetInfo)
 	router.GET("/files", rs.GetFileList)
-	router.POST("/files", rs.CreateFile)
-	router.PUT("/files/:id", rs.UploadFile)
+	router.POST("/files", rs.requireAuth(rs.CreateFile))
+	router.POST("/files/:id/replace", rs.requireAuth(rs.ReplaceFile))
+	router.POST("/files/:id/restore", rs.RestoreFile)
+	router.PUT("/files/:id", rs.requireAuth(rs.UploadFile))
 	router.GET("/files/:id/metadata", rs.GetFileMetadata)
-	router.GET("/files/:id", rs.GetFileContents)
+	router.GET("/files/:id/upload", rs.requireAuth(rs.GetUploadStatus))
+	router.PUT("/files/:id/direct", rs.OfferDirect)
+	router.GET("/files/:id/direct", rs.GetDirectOffer)
+	router.POST("/files/:id/direct/sent", rs.SentDirect)
+	router.GET("/files/:id/ipfs", rs.GetIPFSPieces)
+	// httprouter won't have /files/search next to /files/:id, so searches are picked out here
+	router.GET("/files/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if p.ByName("id") == "search" {
+			rs.SearchFiles(w, r, p)
+		} else {
+			rs.GetFileContents(w, r, p)
+		}
+	})
+	router.DELETE("/files/:id", rs.DeleteFile)
+	router.POST("/files/:id/forward", rs.ForwardFile)
+
+	router.POST("/bundles", rs.requireAuth(rs.CreateBundle))
+	router.GET("/bundles/:id", rs.GetBundle)
 
-	log.Println("INFO: listening on port", port)
-	return http.ListenAndServe(":"+port, router)
+	// only starting an exchange needs a token; the receiver only has the code
+	router.POST("/mailboxes", rs.requireAuth(rs.CreateMailbox))
+	router.PUT("/mailboxes/:nameplate/:slot", rs.PutMessage)
+	router.GET("/mailboxes/:nameplate/:slot", rs.GetMessage)
+	router.DELETE("/mailboxes/:nameplate", rs.DeleteMailbox)
+
+	if rs.config.WebDAV {
+		// including the methods which would change files, to refuse them
+		for _, method := range []string{
+			http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND",
+			http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK",
+		} {
+			router.Handle(method, "/dav/*path", rs.WebDAV)
+		}
+	}
+	if ui := rs.config.WebUI; ui != nil {
+		serveUI := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) { ui.ServeHTTP(w, r) }
+		router.GET("/", serveUI)
+		router.GET("/web/*path", serveUI)
+	}
+	return router
+}
+
+func (rs *RelayServer) ListenAndServe() error {
+	go rs.expireFiles(time.Minute)
+
+	// HTTP/2 lets parallel transfers share one connection, rather than each needing their own
+	srv := &http.Server{Addr: rs.config.Addr, Handler: rs.Handler(), Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(rs.config.H2C)
+
+	logging.Infoln("listening on", rs.config.Addr)
+	if rs.config.HTTP3 {
+		serveHTTP3 := withHTTP3(srv, rs.config.TLSCertFile, rs.config.TLSKeyFile)
+		logging.Infoln("serving HTTP/3 on UDP as well")
+		errs := make(chan error, 2)
+		go func() { errs <- serveHTTP3() }()
+		go func() { errs <- srv.ListenAndServeTLS(rs.config.TLSCertFile, rs.config.TLSKeyFile) }()
+		return <-errs
+	}
+	if rs.config.TLSCertFile != "" {
+		return srv.ListenAndServeTLS(rs.config.TLSCertFile, rs.config.TLSKeyFile)
+	}
+	if rs.config.H2C {
+		logging.Infoln("serving HTTP/2 without TLS")
+	}
+	return srv.ListenAndServe()
+}
+
+func ListenAndServe(port string) error {
+	rs, err := NewServer(ServerConfig{Addr: ":" + port})
+	if err != nil {
+		return err
+	}
+	return rs.ListenAndServe()
 }
@@ -0,0 +1,295 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// testSecret is the secret the tests' files are encrypted with.
+var testSecret = Keyfile(bytes.Repeat([]byte{1}, 32))
+
+// startServer starts a server with the given config for the test, returning it and a client of
+// it.
+func startServer(t *testing.T, config ServerConfig) (*RelayServer, *RelayClient) {
+	t.Helper()
+	rs, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rs.Handler())
+	t.Cleanup(srv.Close)
+	rc := NewClient(srv.URL)
+	return rs, &rc
+}
+
+// uploadPattern uploads a generated file of size bytes with opts, returning its ID.
+func uploadPattern(t *testing.T, rc *RelayClient, size int64, opts UploadOptions) files.FileID {
+	t.Helper()
+	u, err := rc.StartUploadFrom(patternFile{size}, size, "pattern", testSecret, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := rc.SendUpload(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.ID
+}
+
+// fetch GETs the encrypted contents of the file, or the range of them spec gives if it isn't
+// empty, returning the response's status once its body has been read.
+func fetch(rc *RelayClient, id files.FileID, spec string) (int, error) {
+	req, err := rc.newFileRequest("/files/" + id.String())
+	if err != nil {
+		return 0, err
+	}
+	if spec != "" {
+		req.Header.Set("Range", spec)
+	}
+	res, err := rc.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(io.Discard, res.Body)
+	return res.StatusCode, err
+}
+
+// checkFetch fetches the contents, or the range spec of them, failing the test unless the
+// response has the status want.
+func checkFetch(t *testing.T, rc *RelayClient, id files.FileID, spec string, want int) {
+	t.Helper()
+	status, err := fetch(rc, id, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != want {
+		t.Fatalf("fetching %q got status %d, not %d", spec, status, want)
+	}
+}
+
+func TestMaxDownloadsDeletesAtLimit(t *testing.T) {
+	const limit = 3
+	rs, rc := startServer(t, ServerConfig{})
+	id := uploadPattern(t, rc, 100<<10, UploadOptions{MaxDownloads: limit})
+
+	for i := 1; i <= limit; i++ {
+		if _, ok := rs.readyFile(id); !ok {
+			t.Fatalf("the file was deleted after %d of its %d downloads", i-1, limit)
+		}
+		var check patternChecker
+		if _, err := rc.DownloadTo(id, testSecret, &check); err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+		if check.err != nil {
+			t.Fatalf("download %d: %v", i, check.err)
+		}
+	}
+	if _, ok := rs.readyFile(id); ok {
+		t.Fatalf("the file is still there after its %d downloads", limit)
+	}
+	checkFetch(t, rc, id, "", http.StatusNotFound)
+}
+
+func TestMaxDownloadsConcurrent(t *testing.T) {
+	const limit = 4
+	storage := t.TempDir()
+	rs, rc := startServer(t, ServerConfig{StorageDir: storage})
+	id := uploadPattern(t, rc, 1<<20, UploadOptions{MaxDownloads: limit})
+
+	// none of these finish before they've all started, since the file is only deleted once the
+	// last of them has
+	var wg sync.WaitGroup
+	statuses := make([]int, limit)
+	errs := make([]error, limit)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i], errs[i] = fetch(rc, id, "")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if errs[i] != nil {
+			t.Errorf("download %d: %v", i, errs[i])
+		} else if status != http.StatusOK {
+			t.Errorf("download %d got status %d, not %d", i, status, http.StatusOK)
+		}
+	}
+	if _, ok := rs.files.Get(id); ok {
+		t.Fatalf("the file is still there after its %d downloads", limit)
+	}
+	// and nothing of it is left behind, in the server's totals or in storage
+	if n, size := rs.files.Len(), rs.files.Bytes(); n != 0 || size != 0 {
+		t.Errorf("the server still counts %d files of %d bytes", n, size)
+	}
+	entries, err := os.ReadDir(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s is left in the storage directory", e.Name())
+	}
+}
+
+func TestPartialReadsNotCounted(t *testing.T) {
+	rs, rc := startServer(t, ServerConfig{})
+	id := uploadPattern(t, rc, 100<<10, UploadOptions{MaxDownloads: 1})
+
+	for _, spec := range []string{"bytes=0-0", "bytes=0-1023", "bytes=4096-8191"} {
+		checkFetch(t, rc, id, spec, http.StatusPartialContent)
+		if _, ok := rs.readyFile(id); !ok {
+			t.Fatalf("reading the range %s deleted the file", spec)
+		}
+	}
+
+	checkFetch(t, rc, id, "", http.StatusOK)
+	if _, ok := rs.readyFile(id); ok {
+		t.Error("the file is still there after its one download")
+	}
+}
+
+func TestParallelDownloadCounted(t *testing.T) {
+	rs, rc := startServer(t, ServerConfig{})
+	// large enough to be fetched in more than one range
+	const size = 3*minParallelRange + 1<<20
+	id := uploadPattern(t, rc, size, UploadOptions{MaxDownloads: 1})
+
+	out, err := os.Create(t.TempDir() + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	rc.Parallel = 3
+	if _, err = rc.DownloadToFile(id, testSecret, out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var check patternChecker
+	if _, err = io.Copy(&check, out); err != nil {
+		t.Fatal(err)
+	}
+	if check.err != nil {
+		t.Fatal(check.err)
+	} else if check.off != size {
+		t.Fatalf("downloaded %d bytes, not %d", check.off, size)
+	}
+	if _, ok := rs.readyFile(id); ok {
+		t.Error("the file is still there after its one download")
+	}
+}
+
+func TestRangesToTheEndCounted(t *testing.T) {
+	const size = 100 << 10
+	tests := []struct {
+		name string
+		// read reads the file's encrypted contents, of encrypted bytes, to the end.
+		read func(rc *RelayClient, id files.FileID, encrypted uint64) error
+	}{
+		{"whole file", func(rc *RelayClient, id files.FileID, encrypted uint64) error {
+			return checkStatus(fetch(rc, id, fmt.Sprintf("bytes=0-%d", encrypted-1)))
+		}},
+		{"last byte", func(rc *RelayClient, id files.FileID, encrypted uint64) error {
+			return checkStatus(fetch(rc, id, fmt.Sprintf("bytes=%d-%d", encrypted-1, encrypted-1)))
+		}},
+		{"several ranges", func(rc *RelayClient, id files.FileID, encrypted uint64) error {
+			return checkStatus(fetch(rc, id, fmt.Sprintf("bytes=0-0,%d-%d", encrypted-10, encrypted-1)))
+		}},
+		{"mounted", func(rc *RelayClient, id files.FileID, _ uint64) error {
+			ra, _, err := rc.OpenFile(id, testSecret)
+			if err != nil {
+				return err
+			}
+			var check patternChecker
+			if _, err = io.Copy(&check, io.NewSectionReader(ra, 0, size)); err != nil {
+				return err
+			}
+			return check.err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, rc := startServer(t, ServerConfig{})
+			id := uploadPattern(t, rc, size, UploadOptions{MaxDownloads: 1})
+			f, _ := rs.readyFile(id)
+			l, err := fileLayout(f.FileMetadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted, _ := l.encryptedSize(f.Size)
+
+			if err = tt.read(rc, id, encrypted); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := rs.readyFile(id); ok {
+				t.Error("the file is still there after being read to the end")
+			}
+		})
+	}
+}
+
+// checkStatus returns an error for a fetch which failed or didn't get part of the contents.
+func checkStatus(status int, err error) error {
+	if err == nil && status != http.StatusPartialContent {
+		err = fmt.Errorf("got status %d, not %d", status, http.StatusPartialContent)
+	}
+	return err
+}
+
+func TestMaxFilesConcurrent(t *testing.T) {
+	const limit = 3
+	rs, rc := startServer(t, ServerConfig{MaxFiles: limit})
+	u, err := rc.StartUploadFrom(patternFile{1 << 10}, 1<<10, "pattern", testSecret, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := u.State.FileMetadata
+	meta.ID, meta.Schema = files.FileID{}, 0
+	body, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest are all created at once, so only the server's own locking keeps them to the limit
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	statuses := make([]int, 10*limit)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/files", bytes.NewReader(body))
+			<-start
+			rs.CreateFile(w, r, nil)
+			statuses[i] = w.Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 1
+	for _, status := range statuses {
+		if status == http.StatusCreated {
+			created++
+		} else if status != http.StatusInsufficientStorage {
+			t.Errorf("creating a file got status %d", status)
+		}
+	}
+	if created != limit || rs.fileCount() != limit {
+		t.Errorf("%d files were created, and the server is storing %d, with a limit of %d", created, rs.fileCount(), limit)
+	}
+}
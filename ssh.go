@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+	"github.com/bfrengley/relay/internal/logging"
+)
+
+// maxSSHKeysSize limits how much is read when fetching SSH keys from a URL.
+const maxSSHKeysSize = 1 << 20
+
+// SSHRecipient is an Ed25519 or RSA SSH public key to encrypt files to, so they can be sent to
+// someone with the keys they already have. Like a Recipient, only the matching private key can
+// decrypt them.
+type SSHRecipient struct {
+	key ssh.PublicKey
+}
+
+// IsSSHPublicKey reports whether s looks like an SSH public key in authorized_keys format, rather
+// than somewhere to read one from.
+func IsSSHPublicKey(s string) bool {
+	for _, prefix := range []string{"ssh-", "ecdsa-", "sk-"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSSHRecipient parses an SSH public key in authorized_keys format.
+func ParseSSHRecipient(s string) (*SSHRecipient, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	switch key.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA:
+		return &SSHRecipient{key}, nil
+	}
+	return nil, fmt.Errorf("unsupported SSH key type %s", key.Type())
+}
+
+// ReadSSHRecipient reads an SSH public key from a file, or from an http(s) URL such as
+// https://github.com/<user>.keys. If there's more than one usable key, it picks the first
+// Ed25519 one, or failing that the first RSA one.
+func ReadSSHRecipient(source string) (*SSHRecipient, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		data, err = fetchSSHKeys(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var found *SSHRecipient
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseSSHRecipient(line)
+		if err != nil {
+			logging.Debugln("skipping SSH key:", err)
+			continue
+		}
+		if r.key.Type() == ssh.KeyAlgoED25519 {
+			return r, nil
+		}
+		if found == nil {
+			found = r
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no Ed25519 or RSA SSH public keys found in %s", source)
+	}
+	return found, nil
+}
+
+func fetchSSHKeys(url string) ([]byte, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxSSHKeysSize))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching SSH keys from %s failed with status %s", url, res.Status)
+	}
+	return body, nil
+}
+
+func (r *SSHRecipient) String() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(r.key)))
+}
+
+// Fingerprint is the key's SHA-256 fingerprint, as ssh-keygen -l shows it.
+func (r *SSHRecipient) Fingerprint() string {
+	return ssh.FingerprintSHA256(r.key)
+}
+
+func (r *SSHRecipient) KDF() string {
+	return sshKDF(r.key.Type())
+}
+
+// DeriveKey makes a new key for a file, recording what the recipient needs to derive it again
+// in the metadata.
+func (r *SSHRecipient) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	if meta.Ephemeral != nil {
+		return nil, errors.New("only the recipient can decrypt a file encrypted to them")
+	}
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pub := r.key.(ssh.CryptoPublicKey).CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		key, ephemeral, err := crypto.SSHEd25519SenderKey(pub, salt)
+		if err != nil {
+			return nil, err
+		}
+		meta.Ephemeral = ephemeral[:]
+		return key, nil
+	case *rsa.PublicKey:
+		key, wrapped, err := crypto.SSHRSASenderKey(pub, salt)
+		if err != nil {
+			return nil, err
+		}
+		meta.Ephemeral = wrapped
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported SSH key type %s", r.key.Type())
+}
+
+// SSHIdentity is an Ed25519 or RSA SSH private key, which decrypts files sent to its public key.
+type SSHIdentity struct {
+	key interface{}
+}
+
+// ReadSSHIdentity reads an SSH private key file. If the key is encrypted, passphrase is called
+// to ask for its passphrase.
+func ReadSSHIdentity(path string, passphrase func() ([]byte, error)) (*SSHIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Zero(data)
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var pass []byte
+		if pass, err = passphrase(); err != nil {
+			return nil, err
+		}
+		defer crypto.Zero(pass)
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	}
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("%s: %w", path, ErrWrongPassword)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return &SSHIdentity{*k}, nil
+	case ed25519.PrivateKey, *rsa.PrivateKey:
+		return &SSHIdentity{k}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported SSH key type %T", path, key)
+}
+
+// IsSSHPrivateKey reports whether data looks like a PEM encoded SSH private key, rather than a
+// relay identity.
+func IsSSHPrivateKey(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN ")) && bytes.Contains(data, []byte("PRIVATE KEY-----"))
+}
+
+func (id *SSHIdentity) KDF() string {
+	if _, ok := id.key.(*rsa.PrivateKey); ok {
+		return crypto.KDFSSHRSA
+	}
+	return crypto.KDFSSHEd25519
+}
+
+func (id *SSHIdentity) DeriveKey(meta *files.FileMetadata) (*[crypto.KeySize]byte, error) {
+	salt, err := metadataSalt(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := id.key.(type) {
+	case ed25519.PrivateKey:
+		if len(meta.Ephemeral) != crypto.X25519KeySize {
+			return nil, fmt.Errorf("ephemeral key must be %d bytes, not %d", crypto.X25519KeySize, len(meta.Ephemeral))
+		}
+		return crypto.SSHEd25519RecipientKey(k, (*[crypto.X25519KeySize]byte)(meta.Ephemeral), salt)
+	case *rsa.PrivateKey:
+		key, err := crypto.SSHRSARecipientKey(k, meta.Ephemeral, salt)
+		if errors.Is(err, crypto.ErrDecryptFailed) {
+			// the file was encrypted to some other key
+			return nil, fmt.Errorf("failed to unwrap the file key: %w", ErrWrongPassword)
+		}
+		return key, err
+	}
+	return nil, errors.New("unsupported SSH key")
+}
+
+func sshKDF(keyType string) string {
+	if keyType == ssh.KeyAlgoRSA {
+		return crypto.KDFSSHRSA
+	}
+	return crypto.KDFSSHEd25519
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/bfrengley/relay/crypto"
+	"github.com/bfrengley/relay/internal/files"
+)
+
+// TransferStats break down where the time went in sending or receiving a file's contents, to tell
+// whether deriving its key, encrypting or decrypting it, or the network held it up.
+type TransferStats struct {
+	// Bytes is how much encrypted data was sent or received, taking Elapsed.
+	Bytes   uint64        `json:"bytes"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	// KDF is how long deriving the key took, before the transfer started.
+	KDF time.Duration `json:"kdf_ns"`
+	// Crypto is the time spent encrypting or decrypting and hashing, including reading or writing
+	// the local file, and Network the time spent waiting on the server. Uploads encrypt while they
+	// send, so the two overlap, and whichever is closer to Elapsed is holding the upload up. For
+	// downloads in parallel ranges, they're summed over the ranges.
+	Crypto  time.Duration `json:"crypto_ns"`
+	Network time.Duration `json:"network_ns"`
+	// PerSecond is how many bytes were sent or received in each second of the transfer.
+	PerSecond []uint64 `json:"per_second,omitempty"`
+}
+
+// Throughput is the average rate of the transfer in bytes per second.
+func (s TransferStats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+func (s TransferStats) String() string {
+	return fmt.Sprintf("%d bytes in %v (%.2f MB/s); deriving the key took %v, crypto %v, and the network %v",
+		s.Bytes, s.Elapsed.Round(time.Millisecond), s.Throughput()/1e6,
+		s.KDF.Round(time.Millisecond), s.Crypto.Round(time.Millisecond), s.Network.Round(time.Millisecond))
+}
+
+// addMeter adds what m counted to the stats, for a meter started at the same time as the transfer.
+func (s *TransferStats) addMeter(m *meter) {
+	for i, n := range m.perSecond {
+		if i == len(s.PerSecond) {
+			s.PerSecond = append(s.PerSecond, 0)
+		}
+		s.PerSecond[i] += n
+		s.Bytes += n
+	}
+}
+
+// meter times reads from r, and counts the bytes they return in each second since start. It's
+// only read from one goroutine at a time, but the time can be read from any.
+type meter struct {
+	r         io.Reader
+	start     time.Time
+	wait      stopwatch
+	perSecond []uint64
+}
+
+func newMeter(r io.Reader, start time.Time) *meter {
+	return &meter{r: r, start: start}
+}
+
+func (m *meter) Read(p []byte) (int, error) {
+	before := time.Now()
+	n, err := m.r.Read(p)
+	m.wait.add(before)
+	if n > 0 {
+		sec := int(time.Since(m.start) / time.Second)
+		for len(m.perSecond) <= sec {
+			m.perSecond = append(m.perSecond, 0)
+		}
+		m.perSecond[sec] += uint64(n)
+	}
+	return n, err
+}
+
+// stopwatch adds up times from any number of goroutines.
+type stopwatch struct {
+	ns atomic.Int64
+}
+
+// add adds the time since start.
+func (s *stopwatch) add(start time.Time) {
+	s.ns.Add(int64(time.Since(start)))
+}
+
+func (s *stopwatch) total() time.Duration {
+	return time.Duration(s.ns.Load())
+}
+
+// timedReader adds the time spent reading from r to a stopwatch.
+type timedReader struct {
+	r  io.Reader
+	sw *stopwatch
+}
+
+func (t timedReader) Read(p []byte) (int, error) {
+	defer t.sw.add(time.Now())
+	return t.r.Read(p)
+}
+
+// timeKey is fileKey, recording how long it took in stats.
+func timeKey(meta files.FileMetadata, secret Secret, stats *TransferStats) (*[crypto.KeySize]byte, error) {
+	start := time.Now()
+	key, err := fileKey(meta, secret)
+	stats.KDF = time.Since(start)
+	return key, err
+}
@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// MinPasswordEntropy is the estimated entropy, in bits, below which a password is weak enough to
+// be worth guessing offline, even with scrypt slowing each guess down.
+const MinPasswordEntropy = 40
+
+// commonPasswords are the bases of the passwords people choose most, which attackers try first
+// whatever digits, symbols or capitals are added to them.
+var commonPasswords = []string{
+	"password", "passwort", "motdepasse", "contrasena", "qwerty", "qwertz", "azerty", "asdf",
+	"zxcv", "qazwsx", "letmein", "welcome", "admin", "administrator", "root", "login", "user",
+	"guest", "test", "secret", "changeme", "default", "master", "access", "iloveyou", "love",
+	"lovely", "hello", "hello123", "monkey", "dragon", "shadow", "sunshine", "princess", "football",
+	"baseball", "soccer", "hockey", "superman", "batman", "starwars", "pokemon", "trustno",
+	"whatever", "freedom", "charlie", "michael", "jordan", "jennifer", "thomas", "daniel",
+	"ashley", "jessica", "summer", "winter", "spring", "autumn", "january", "february", "march",
+	"april", "june", "july", "august", "september", "october", "november", "december",
+	"monday", "friday", "sunday", "flower", "cookie", "cheese", "chocolate", "computer",
+	"internet", "server", "relay", "upload", "download", "file", "files", "share", "abc",
+	"abcdef", "killer", "pepper", "ginger", "orange", "banana", "purple", "silver", "golden",
+	"tigger", "buster", "hunter", "ranger", "mustang", "harley", "matrix", "ninja", "samsung",
+	"google", "apple", "facebook", "secure", "private", "company", "office", "family", "money",
+	"blink", "zaq", "qwertyuiop", "asdfgh", "asdfghjkl", "zxcvbn", "zxcvbnm", "1qaz", "2wsx",
+}
+
+// leet undoes common character substitutions, so they don't hide a common password.
+var leet = strings.NewReplacer("@", "a", "4", "a", "8", "b", "3", "e", "6", "g", "1", "i",
+	"!", "i", "0", "o", "5", "s", "$", "s", "7", "t", "+", "t", "2", "z")
+
+// Entropy estimates how many bits of entropy the password has, erring on the low side. It
+// charges each character by the set of characters the password draws from, except that repeats
+// and runs such as "aaa" or "1234" cost almost nothing, and so do common passwords and their
+// variations, which are charged as a single guess from a short list.
+func (p Password) Entropy() float64 {
+	chars := []rune(string(p))
+	if len(chars) == 0 {
+		return 0
+	}
+
+	perChar := math.Log2(float64(charsetSize(chars)))
+	cost := make([]float64, len(chars))
+	for i, c := range chars {
+		cost[i] = perChar
+		if i > 0 {
+			if d := c - chars[i-1]; d >= -1 && d <= 1 {
+				cost[i] = 1
+			}
+		}
+	}
+
+	// years are nearly always recent ones, so they're only a couple of hundred guesses
+	for i := 0; i+4 <= len(chars); i++ {
+		if isYear(chars[i : i+4]) {
+			cost[i], cost[i+1], cost[i+2], cost[i+3] = math.Log2(200), 0, 0, 0
+			i += 3
+		}
+	}
+
+	// charge each common password found as one guess from the list, plus a little for how it's
+	// been capitalised or substituted
+	normal := []rune(leet.Replace(strings.ToLower(string(p))))
+	if len(normal) == len(chars) {
+		wordCost := math.Log2(float64(len(commonPasswords))) + 2
+		for i := 0; i < len(normal); {
+			word := longestCommonPassword(normal[i:])
+			if word == 0 {
+				i++
+				continue
+			}
+			var covered float64
+			for j := i; j < i+word; j++ {
+				covered += cost[j]
+				cost[j] = 0
+			}
+			cost[i] = math.Min(covered, wordCost)
+			i += word
+		}
+	}
+
+	var total float64
+	for _, c := range cost {
+		total += c
+	}
+	return total
+}
+
+// longestCommonPassword returns the length of the longest common password s starts with, or 0.
+func longestCommonPassword(s []rune) int {
+	longest := 0
+	for _, word := range commonPasswords {
+		n := len(word)
+		if n > longest && n >= 3 && n <= len(s) && string(s[:n]) == word {
+			longest = n
+		}
+	}
+	return longest
+}
+
+func isYear(s []rune) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return string(s[:2]) == "19" || string(s[:2]) == "20"
+}
+
+// charsetSize is the size of the set of characters the password appears to be drawn from.
+func charsetSize(chars []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, c := range chars {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, set := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if set.used {
+			size += set.size
+		}
+	}
+	return size
+}
@@ -0,0 +1,40 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bfrengley/relay/internal/files"
+)
+
+var (
+	// ErrInvalidMetadata is matched by errors for metadata that's malformed or inconsistent.
+	ErrInvalidMetadata = files.ErrInvalidMetadata
+	// ErrInvalidChunk is matched by errors for encrypted chunks which are the wrong size for where
+	// they are in a file.
+	ErrInvalidChunk = errors.New("invalid chunk")
+)
+
+// ValidateCiphertextChunk checks that chunk is the right size to be the chunk at index in the
+// encrypted contents of a file with the given metadata, which must already be valid. Every chunk
+// but the last is exactly the file's chunk size, and the last holds the rest of the file. It doesn't check
+// the stream header, which comes before the first chunk.
+func ValidateCiphertextChunk(meta files.FileMetadata, index uint64, chunk []byte) error {
+	l, err := fileLayout(meta)
+	if err != nil {
+		return err
+	}
+	size, chunks := l.encryptedSize(meta.Size)
+	if index >= chunks {
+		return fmt.Errorf("%w: chunk %d is past the last chunk, %d", ErrInvalidChunk, index, chunks-1)
+	}
+
+	want := l.chunkSize
+	if index == chunks-1 {
+		want = size - l.chunkOffset(index)
+	}
+	if uint64(len(chunk)) != want {
+		return fmt.Errorf("%w: chunk %d is %d bytes, not %d", ErrInvalidChunk, index, len(chunk), want)
+	}
+	return nil
+}